@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Banner analysis inspects the CMP's banner on the first visit, before the consent is injected, for the design
+	// patterns regulators look at: whether rejecting is as easy as accepting, i.e. whether a reject button is present on
+	// the first layer, as large and as legible as the accept button, or how many clicks it takes. The heuristics only
+	// see banners in the page's DOM, open shadow roots and same-origin frames, not those of cross-origin CMP frames
+	AnalyzeBanner     = false
+	BannerFile        = "banner.csv"
+	MinRejectSize     = 0.8  // MinRejectSize specifies the fraction of the accept button's area below which the reject button is flagged as smaller.
+	MinButtonContrast = 4.5  // MinButtonContrast specifies the WCAG AA contrast ratio of normal text, below which a reject button less legible than the accept button is flagged.
+	SecondLayerWait   = 1000 // SecondLayerWait specifies the milliseconds to wait for the second layer after clicking the settings button.
+
+	// Heuristic flags of a banner
+	flagNoBannerFound     = "no-banner-found"     // No banner was found on the page, e.g. as it is rendered in a cross-origin frame.
+	flagNoReject          = "no-reject"           // No reject button was found on the first or the second layer.
+	flagRejectSecondLayer = "reject-second-layer" // Rejecting takes an extra click on the settings button, while accepting takes one.
+	flagRejectSmaller     = "reject-smaller"      // The reject button is smaller than MinRejectSize of the accept button.
+	flagRejectLowContrast = "reject-low-contrast" // The reject button's text contrast is below MinButtonContrast, while the accept button's is not.
+
+	// Text of the buttons of each kind, in the languages of the scanned sites. Reject is matched first, as its texts
+	// often contain those of accept, e.g. "do not consent"
+	rejectPattern   = `reject|decline|refuse|deny|disagree|do not (accept|agree|consent)|(only|strictly) (necessary|essential|required)|necessary only|continue without|weiger|ablehnen|nur notwendige|refuser|continuer sans|rechazar|rifiuta|recusar|odrzuć|avvis|afvis|neka`
+	acceptPattern   = `accept|agree|allow|consent|got it|^ok$|akkoord|accepteer|toestaan|akzeptieren|zustimmen|einverstanden|accepter|j.accepte|aceptar|accetta|aceitar|akceptuj|godta|acceptera|hyväksy`
+	settingsPattern = `settings|manage|options|preferences|customi[sz]e|more info|details|instellingen|einstellungen|paramètres|personnaliser|configurar|gestisci|preferencje`
+
+	// Names, IDs and classes of the containers of CMP banners
+	bannerPattern = `consent|cookie|cmp|gdpr|privacy|onetrust|didomi|usercentrics|cookiebot|qc-cmp|sp_message|truste|borlabs|iubenda|cky-|cc-window|cc_banner`
+
+	// JavaScript defining bannerAnalysis(), which returns the visible banner and its accept, reject and settings buttons
+	// with their text, area and contrast ratio, keeping the settings button in window.__bannerSettings to click it
+	bannerFunctionJS = `
+			const bannerAnalysis = () => {
+				const bannerName = new RegExp('` + bannerPattern + `', 'i');
+				const kinds = [
+					['reject', new RegExp('` + rejectPattern + `', 'i')],
+					['accept', new RegExp('` + acceptPattern + `', 'i')],
+					['settings', new RegExp('` + settingsPattern + `', 'i')],
+				];
+				const visible = (el) => {
+					const rect = el.getBoundingClientRect();
+					const style = getComputedStyle(el);
+					return rect.width > 0 && rect.height > 0 && style.visibility !== 'hidden' && style.display !== 'none' && style.opacity !== '0';
+				};
+				const rgba = (color) => (color.match(/[\d.]+/g) || [0, 0, 0, 0]).map(Number).concat([1]).slice(0, 4);
+				const luminance = ([r, g, b]) => {
+					const channel = (c) => {
+						c /= 255;
+						return c <= 0.03928 ? c / 12.92 : Math.pow((c + 0.055) / 1.055, 2.4);
+					};
+					return 0.2126 * channel(r) + 0.7152 * channel(g) + 0.0722 * channel(b);
+				};
+				const background = (el) => {
+					for (; el && el.nodeType === 1; el = el.parentNode || el.host) {
+						const color = rgba(getComputedStyle(el).backgroundColor);
+						if (color[3] > 0) {
+							return color;
+						}
+					}
+					return [255, 255, 255, 1];
+				};
+				const contrast = (el) => {
+					const a = luminance(rgba(getComputedStyle(el).color));
+					const b = luminance(background(el));
+					return (Math.max(a, b) + 0.05) / (Math.min(a, b) + 0.05);
+				};
+
+				const roots = [];
+				const collect = (root) => {
+					roots.push(root);
+					root.querySelectorAll('*').forEach((el) => {
+						if (el.shadowRoot) {
+							collect(el.shadowRoot);
+						}
+						if (el.tagName === 'IFRAME') {
+							try {
+								if (el.contentDocument) {
+									collect(el.contentDocument);
+								}
+							} catch (e) {
+							}
+						}
+					});
+				};
+				collect(document);
+
+				let banner = null;
+				for (const root of roots) {
+					for (const el of root.querySelectorAll('[id], [class], [aria-label], [role="dialog"]')) {
+						const name = [el.id, typeof el.className === 'string' ? el.className : '', el.getAttribute('aria-label') || ''].join(' ');
+						if ((bannerName.test(name) || el.getAttribute('role') === 'dialog') && visible(el) && el.querySelector('button, a, [role="button"], input[type="button"], input[type="submit"]')) {
+							banner = el;
+							break;
+						}
+					}
+					if (banner) {
+						break;
+					}
+				}
+				if (!banner) {
+					return {found: false};
+				}
+
+				const result = {found: true};
+				const buttons = banner.querySelectorAll('button, a, [role="button"], input[type="button"], input[type="submit"]');
+				for (const button of buttons) {
+					const text = (button.innerText || button.value || button.getAttribute('aria-label') || '').trim().replace(/\s+/g, ' ');
+					if (!text || text.length > 60 || !visible(button)) {
+						continue;
+					}
+					for (const [kind, pattern] of kinds) {
+						if (pattern.test(text)) {
+							if (!result[kind]) {
+								const rect = button.getBoundingClientRect();
+								result[kind] = {text: text, area: rect.width * rect.height, contrast: contrast(button)};
+								if (kind === 'settings') {
+									window.__bannerSettings = button;
+								}
+							}
+							break;
+						}
+					}
+				}
+				return result;
+			};
+		`
+
+	// JavaScript resolving to the analysis of the first layer of the banner
+	bannerJS = `(() => {` + bannerFunctionJS + `return bannerAnalysis(); })()`
+
+	// JavaScript clicking the settings button found by bannerJS and resolving to the analysis of the second layer
+	secondLayerJS = `
+			new Promise((resolve) => {
+				` + bannerFunctionJS + `
+				if (!window.__bannerSettings) {
+					resolve(null);
+					return;
+				}
+				window.__bannerSettings.click();
+				setTimeout(() => resolve(bannerAnalysis()), %d);
+			})
+		`
+)
+
+// bannerButton is a button of the CMP's banner.
+type bannerButton struct {
+	Text     string  `json:"text"`
+	Area     float64 `json:"area"`     // Area is the button's area in CSS pixels.
+	Contrast float64 `json:"contrast"` // Contrast is the WCAG contrast ratio of the button's text and background.
+}
+
+// bannerLayer is a layer of the CMP's banner, with the buttons of each kind found on it.
+type bannerLayer struct {
+	Found    bool          `json:"found"`
+	Accept   *bannerButton `json:"accept"`
+	Reject   *bannerButton `json:"reject"`
+	Settings *bannerButton `json:"settings"`
+}
+
+// bannerAnalysis holds the buttons of the CMP's banner and the heuristic flags raised by them.
+type bannerAnalysis struct {
+	DisplayStatus  string
+	First          bannerLayer
+	ClicksToReject int // ClicksToReject is 1 for a reject button on the first layer, 2 on the second and 0 if there is none.
+	Flags          []string
+}
+
+// analyzeBanner inspects the banner shown on the current page and raises the heuristic flags, clicking the settings
+// button if the first layer has no reject button.
+func analyzeBanner(session seleniumSession, displayStatus string) bannerAnalysis {
+	analysis := bannerAnalysis{DisplayStatus: displayStatus}
+	if err := session.Evaluate(bannerJS, &analysis.First); err != nil {
+		session.log.Warn("Error analyzing the banner", "error", err)
+	}
+	if !analysis.First.Found {
+		analysis.Flags = append(analysis.Flags, flagNoBannerFound)
+		return analysis
+	}
+
+	reject := analysis.First.Reject
+	switch {
+	case reject != nil:
+		analysis.ClicksToReject = 1
+	case analysis.First.Settings != nil:
+		var second *bannerLayer
+		if err := session.Evaluate(fmt.Sprintf(secondLayerJS, SecondLayerWait), &second); err != nil {
+			session.log.Warn("Error analyzing the banner's second layer", "error", err)
+		}
+		if second != nil && second.Reject != nil {
+			analysis.ClicksToReject = 2
+			analysis.Flags = append(analysis.Flags, flagRejectSecondLayer)
+		}
+	}
+	if analysis.ClicksToReject == 0 {
+		analysis.Flags = append(analysis.Flags, flagNoReject)
+	}
+
+	if accept := analysis.First.Accept; accept != nil && reject != nil {
+		if reject.Area < MinRejectSize*accept.Area {
+			analysis.Flags = append(analysis.Flags, flagRejectSmaller)
+		}
+		if reject.Contrast < MinButtonContrast && accept.Contrast >= MinButtonContrast {
+			analysis.Flags = append(analysis.Flags, flagRejectLowContrast)
+		}
+	}
+	if len(analysis.Flags) > 0 {
+		session.log.Info("Banner heuristics raised flags", "flags", analysis.Flags)
+	}
+	return analysis
+}
+
+// row returns the analysis as a row of the banner file.
+func (a bannerAnalysis) row(domain string) []string {
+	button := func(b *bannerButton) []string {
+		if b == nil {
+			return []string{"", "", ""}
+		}
+		return []string{b.Text, strconv.FormatFloat(b.Area, 'f', 0, 64), strconv.FormatFloat(b.Contrast, 'f', 2, 64)}
+	}
+	clicks := ""
+	if a.ClicksToReject > 0 {
+		clicks = strconv.Itoa(a.ClicksToReject)
+	}
+
+	row := []string{domain, a.DisplayStatus, fmt.Sprint(a.First.Found)}
+	row = append(row, button(a.First.Accept)...)
+	row = append(row, button(a.First.Reject)...)
+	if a.First.Settings != nil {
+		row = append(row, a.First.Settings.Text)
+	} else {
+		row = append(row, "")
+	}
+	return append(row, clicks, strings.Join(a.Flags, " "))
+}
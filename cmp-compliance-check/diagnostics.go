@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+const (
+	// Key of the cookie and local storage item the consent is injected in, see tcf.StoreConsent
+	injectedConsentKey = "euconsent-v2"
+
+	// Names of the cookies and local storage items CMPs keep the consent in, e.g. OneTrust's OptanonConsent, Didomi's
+	// didomi_token or Cookiebot's CookieConsent, and values that are TC strings, which start with "C" in version 2 as
+	// their first field is the version
+	consentKeyPattern = `consent|tcf|cmp|optanon|didomi|cookiebot|usercentrics|borlabs|_sp_|quantcast`
+	tcStringPattern   = `^C[A-Za-z0-9_-]{20,}`
+
+	// JavaScript returning the injected local storage item and the local storage keys holding a TC string, or named
+	// after the consent storage of a CMP
+	consentStorageJS = `
+			(() => {
+				const named = new RegExp('` + consentKeyPattern + `', 'i');
+				const tcString = new RegExp('` + tcStringPattern + `');
+				const keys = [];
+				let injected = null;
+				try {
+					injected = localStorage.getItem('` + injectedConsentKey + `');
+					for (let i = 0; i < localStorage.length; i++) {
+						const key = localStorage.key(i);
+						if (named.test(key) || tcString.test(localStorage.getItem(key) || '')) {
+							keys.push(key);
+						}
+					}
+				} catch (e) {
+				}
+				return {injected: injected, keys: keys};
+			})()
+		`
+)
+
+var (
+	consentKeyRegexp = regexp.MustCompile("(?i)" + consentKeyPattern)
+	tcStringRegexp   = regexp.MustCompile(tcStringPattern)
+)
+
+// bannerDiagnostics tells why a CMP showed its banner again after the reload although it returned the injected TC
+// string.
+type bannerDiagnostics struct {
+	CookieKept       bool     // CookieKept reports whether the euconsent-v2 cookie still held the injected TC string after the reload.
+	LocalStorageKept bool     // LocalStorageKept reports whether the euconsent-v2 local storage item still held it.
+	CmpID            int      // CmpID is the CMP ID reported by ping after the reload.
+	GvlVersion       int      // GvlVersion is the vendor list version reported by ping after the reload.
+	ConsentKeys      []string // ConsentKeys are the cookies and local storage items holding a TC string or named after a CMP's consent storage, i.e. those the CMP most likely reads.
+}
+
+// pageVerdict classifies the CMP's behavior on a page from its display status and the TC string it returned, see
+// verdict.Classify. Its condition is the one written to the results file:
+//   - 0: the banner is shown and the injected TC string was not kept
+//   - 1: the banner is hidden and the injected TC string was kept
+//   - 2: the banner is shown although the injected TC string was kept
+//   - 3: the banner is hidden but the injected TC string was not kept
+func pageVerdict(tcString string, statusAfter string, tcStringAfterReload string) verdict.Verdict {
+	return verdict.Classify(statusAfter == "visible", verdict.TCStringKept(tcString, tcStringAfterReload))
+}
+
+// diagnoseBanner collects the diagnostics of the current page if the CMP showed its banner again although it returned
+// the injected TC string, or returns nil otherwise. Diagnostics that cannot be collected are left empty.
+func diagnoseBanner(session seleniumSession, tcString string, statusAfter string, tcStringAfterReload string) *bannerDiagnostics {
+	if pageVerdict(tcString, statusAfter, tcStringAfterReload) != verdict.BannerReshown {
+		return nil
+	}
+	d := &bannerDiagnostics{}
+
+	if ping, err := tcf.GetPing(session); err != nil {
+		session.log.Warn("Error querying the CMP for diagnostics", "error", err)
+	} else {
+		d.CmpID, d.GvlVersion = ping.CmpID, ping.GvlVersion
+	}
+
+	// The cookies are taken from the browser rather than document.cookie, which hides HttpOnly cookies set by the server
+	if cookies, err := session.Cookies(); err != nil {
+		session.log.Warn("Error reading cookies for diagnostics", "error", err)
+	} else {
+		for _, c := range cookies {
+			if c.Name == injectedConsentKey && c.Value == tcString {
+				d.CookieKept = true
+			}
+			if consentKeyRegexp.MatchString(c.Name) || tcStringRegexp.MatchString(c.Value) {
+				d.ConsentKeys = append(d.ConsentKeys, "cookie:"+c.Name)
+			}
+		}
+	}
+
+	var storage struct {
+		Injected *string  `json:"injected"`
+		Keys     []string `json:"keys"`
+	}
+	if err := session.Evaluate(consentStorageJS, &storage); err != nil {
+		session.log.Warn("Error reading local storage for diagnostics", "error", err)
+	} else {
+		d.LocalStorageKept = storage.Injected != nil && *storage.Injected == tcString
+		for _, key := range storage.Keys {
+			d.ConsentKeys = append(d.ConsentKeys, "localStorage:"+key)
+		}
+	}
+
+	session.log.Info("Banner shown despite the injected TC string", "cookieKept", d.CookieKept, "localStorageKept", d.LocalStorageKept, "cmpId", d.CmpID, "gvlVersion", d.GvlVersion, "consentKeys", d.ConsentKeys)
+	return d
+}
+
+// columns returns the diagnostics as the results file's columns, which are empty for other conditions than 2. The
+// CMP is mismatched if it reports another CMP ID or vendor list version after the reload than the TC string was
+// generated for. CMPs not reporting them are not.
+func (d *bannerDiagnostics) columns(injected tcf.Ping) []string {
+	if d == nil {
+		return []string{"", "", "", "", "", ""}
+	}
+	mismatch := d.CmpID != 0 && d.CmpID != injected.CmpID || d.GvlVersion != 0 && d.GvlVersion != injected.GvlVersion
+	return []string{fmt.Sprint(d.CookieKept), fmt.Sprint(d.LocalStorageKept), strconv.Itoa(d.CmpID), strconv.Itoa(d.GvlVersion), fmt.Sprint(mismatch), strings.Join(d.ConsentKeys, "; ")}
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"encoding/csv"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/SirDataFR/iabtcfv2"
 	"github.com/tebeka/selenium"
 	"github.com/tebeka/selenium/chrome"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/links"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/notify"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
 )
 
 // Constants related to the configuration of the chrome driver and the JS scripts to be executed.
@@ -20,14 +29,16 @@ const (
 	TCFDomainsFile   = "domains.csv"
 	ResultsFile      = "output.csv"
 	PageLoadTimeout  = 30 * time.Second
+	SubPageLimit     = 0 // SubPageLimit is the number of internal pages linked from the homepage on which the CMP's status is also checked.
+
+	TCFTimeOut = 10 * time.Second // TCFTimeOut specifies the maximum duration of time allowed to wait for the TCF API to become available.
 
-	cmpIDJS         = "let cmpId = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {cmpId = PingReturn.cmpId}); return cmpId"
-	cmpVerJS        = "let cmpv = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {cmpv = PingReturn.cmpId}); return cmpv"
-	gvlVerJS        = "let gvl = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {gvl = PingReturn.gvlVersion}); return gvl"
-	displayStatusJS = "let ds = \"\"; window.__tcfapi('ping', 2, (PingReturn,success) => {ds = PingReturn.displayStatus}); return ds"
-	tcStringJS      = "let tc = \"\"; window.__tcfapi('getTCData',2,(tcData,success) => {tc = tcData.tcString}); return tc"
+	linksJS = "Array.from(document.querySelectorAll('a[href]')).map((a) => a.href)"
 )
 
+// rotation keeps track of the current part of the results file, see outfile.RotateEvery.
+var rotation = outfile.NewRotator()
+
 // setChromeCapabilities sets up the chrome capabilities for selenium.
 func setChromeCapabilities() selenium.Capabilities {
 	chromeCaps := chrome.Capabilities{
@@ -50,25 +61,42 @@ func readCSV(filename string) ([][]string, error) {
 	}
 	defer fd.Close()
 
-	fileReader := csv.NewReader(fd)
+	fileReader := csvfile.NewReader(fd)
 	return fileReader.ReadAll()
 }
 
-// createCSVWriter creates a new CSV file and returns its file descriptor and a CSV writer.
-func createCSVWriter(filename string) (*os.File, *csv.Writer, error) {
-	resultsFile, err := os.Create(filename)
+// Headers of the results and banner files
+var (
+	resultsHeader = []string{"Domain", "Condition", "CmpID", "FinalTCString", "GeneratedTCString", "Page", "CookieKept", "LocalStorageKept", "CmpIDAfter", "GvlVersionAfter", "CmpMismatch", "ConsentKeys", "ConsentStorage", "Verdict"}
+	bannerHeader  = []string{"Domain", "DisplayStatus", "BannerFound", "AcceptText", "AcceptArea", "AcceptContrast", "RejectText", "RejectArea", "RejectContrast", "SettingsText", "ClicksToReject", "Flags"}
+)
+
+// createCSVWriter opens the current part of the CSV file, creating it if needed, and returns it along with a CSV
+// writer. The file is compressed according to its name or outfile.Compression. The rows of a file written under another
+// header, e.g. before diagnostic columns were added, are migrated to the header first, see outfile.OpenCSV.
+func createCSVWriter(name string, header []string) (*outfile.File, *csv.Writer, error) {
+	resultsFile, err := outfile.OpenCSV(rotation.Name(name), header)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	resultswriter := csv.NewWriter(resultsFile)
+	resultswriter := csvfile.NewWriter(resultsFile, resultsFile.New)
 
-	header := []string{"Domain", "Condition", "CmpID", "FinalTCString", "GeneratedTCString"}
-	err = resultswriter.Write(header)
-	if err != nil {
-		return nil, nil, err
+	// Only write the header to a new file, so the results of a resumed run are appended
+	if resultsFile.New {
+		err = resultswriter.Write(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		resultswriter.Flush()
+
+		// List the new part of a rotated results file in the manifest
+		if outfile.Rotating() {
+			if err := outfile.AddToManifest(name, resultsFile.Name); err != nil {
+				slog.Error("Error adding part to manifest", "file", resultsFile.Name, "error", err)
+			}
+		}
 	}
-	resultswriter.Flush()
 
 	return resultsFile, resultswriter, nil
 }
@@ -76,13 +104,17 @@ func createCSVWriter(filename string) (*os.File, *csv.Writer, error) {
 // setPageLoadTimeout sets the page load timeout for the selenium web driver.
 func setPageLoadTimeout(driver selenium.WebDriver, timeout time.Duration) error {
 	if err := driver.SetImplicitWaitTimeout(timeout); err != nil {
-		log.Println(err)
 		driver.Quit()
 		return err
 	}
 
 	if err := driver.SetPageLoadTimeout(timeout); err != nil {
-		log.Println(err)
+		driver.Quit()
+		return err
+	}
+
+	// The TCF probes are run as asynchronous scripts, see seleniumSession.Evaluate
+	if err := driver.SetAsyncScriptTimeout(timeout); err != nil {
 		driver.Quit()
 		return err
 	}
@@ -93,55 +125,13 @@ func setPageLoadTimeout(driver selenium.WebDriver, timeout time.Duration) error
 func navigateWebsite(driver selenium.WebDriver, domain string) error {
 	err := driver.Get("https://" + domain)
 	if err != nil {
-		log.Println(err)
 		driver.Quit()
 	}
 	return err
 }
 
-// executeScriptAndQuitOnError executes a JavaScript script and terminates the current session if there is an error.
-func executeScriptAndQuitOnError(driver selenium.WebDriver, js string) (interface{}, error) {
-	res, err := driver.ExecuteScript(js, nil)
-	if err != nil {
-		driver.Quit()
-	}
-	return res, err
-}
-
-// parseIntegerResult parses the given value to an integer.
-func parseIntegerResult(value interface{}, defaultValue int) int {
-	if value != nil {
-		return int(value.(float64))
-	}
-	return defaultValue
-}
-
-// parseStringResult parses the given value to a string.
-func parseStringResult(value interface{}, defaultValue string) string {
-	if value != nil {
-		return value.(string)
-	}
-	return defaultValue
-}
-
-// setCookiesAndLocalStorage sets the 'euconsent-v2' and 'eupubconsent-v2' cookies and local storage items to the given TC string.
-func setCookiesAndLocalStorage(driver selenium.WebDriver, tcString string) error {
-	cookieJS := "document.cookie = 'euconsent-v2=" + tcString + "';document.cookie = 'eupubconsent-v2=" + tcString + "';"
-	localStorageJS := "localStorage.setItem('euconsent-v2', '" + tcString + "');localStorage.setItem('eupubconsent-v2', '" + tcString + "');"
-
-	_, err := executeScriptAndQuitOnError(driver, cookieJS)
-	if err != nil {
-		return err
-	}
-	_, err = executeScriptAndQuitOnError(driver, localStorageJS)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// generateAndSetTCData generates a TCData object and sets the 'euconsent-v2' and 'eupubconsent-v2' cookies and local storage items to its string representation.
-func generateAndSetTCData(driver selenium.WebDriver, cmpID int, cmpVer int, gvlVer int) (string, error) {
+// generateAndSetTCData generates a TCData object and stores its string representation where the CMP looks for the consent of returning users, see tcf.StorageFor.
+func generateAndSetTCData(session seleniumSession, cmpID int, cmpVer int, gvlVer int) (string, error) {
 
 	// Get the current date and time
 	currentTime := time.Now()
@@ -163,58 +153,232 @@ func generateAndSetTCData(driver selenium.WebDriver, cmpID int, cmpVer int, gvlV
 	}
 
 	tcString := tcData.ToTCString()
-	err := setCookiesAndLocalStorage(driver, tcString)
+	storage, err := tcf.StoreConsent(session, cmpID, tcString)
 	if err != nil {
 		return "", err
 	}
+	session.log.Debug("Injected consent", "storage", storage)
 	return tcString, nil
 }
 
-// writeRow writes a row of data to the CSV file.
-func writeRow(driver selenium.WebDriver, writer *csv.Writer, domain string, tcString string, cmpID int, statusAfter string, tcStringAfterReload string) {
-	// Prepare row data
-
-	var row []string
-	if statusAfter != "visible" && tcString == strings.Split(tcStringAfterReload, ".")[0] {
-		row = []string{domain, "1", strconv.Itoa(cmpID), tcStringAfterReload, tcString}
-	} else if statusAfter == "visible" && tcString == strings.Split(tcStringAfterReload, ".")[0] {
-		row = []string{domain, "2", strconv.Itoa(cmpID), tcStringAfterReload, tcString}
-	} else if statusAfter != "visible" && tcString != strings.Split(tcStringAfterReload, ".")[0] {
-		row = []string{domain, "3", strconv.Itoa(cmpID), tcStringAfterReload, tcString}
-	} else {
-		row = []string{domain, "0", strconv.Itoa(cmpID), tcStringAfterReload, tcString}
-	}
+// writeRow writes a row of data to the CSV file, with the diagnostics of condition 2, if any, and the page's verdict
+// to the verdicts file.
+func writeRow(driver selenium.WebDriver, results resultsWriter, domain string, page string, tcString string, injected tcf.Ping, statusAfter string, tcStringAfterReload string, diagnostics *bannerDiagnostics) {
+	v := pageVerdict(tcString, statusAfter, tcStringAfterReload)
+	row := []string{domain, v.Condition(), strconv.Itoa(injected.CmpID), tcStringAfterReload, tcString, page}
+	row = append(row, diagnostics.columns(injected)...)
+	row = append(row, tcf.StorageFor(injected.CmpID).Name, string(v))
 
-	err := writer.Write(row)
+	err := results.rows.Write(row)
 	if err != nil {
-		log.Fatalf("Error while writing row data: %v", err)
+		fatal("Error while writing row data", "error", err)
 		driver.Quit()
 	}
-	writer.Flush()
+	results.rows.Flush()
+
+	record := verdict.NewRecord(StateTool, domain, page, v)
+	record.CmpID = injected.CmpID
+	results.writeVerdict(record)
+
+	if notify.Enabled() {
+		notifyCondition(domain, page, v, injected, tcString, tcStringAfterReload)
+	}
+}
+
+// notifyCondition posts the findings of the page's verdict to the webhooks configured in notify.Webhooks: the
+// banner reshown by the CMP in conditions 0 and 2, and the TC string changed by the CMP in conditions 0 and 3 if it
+// changed the consent or legitimate interest granted to purposes or vendors.
+// Errors are logged.
+func notifyCondition(domain string, page string, v verdict.Verdict, injected tcf.Ping, tcString string, tcStringAfterReload string) {
+	var findings []notify.Finding
+	now := time.Now()
+	if v == verdict.ConsentIgnored || v == verdict.BannerReshown {
+		evidence := fmt.Sprintf("CMP %d showed its banner again on %s (%s, condition %s)", injected.CmpID, page, v, v.Condition())
+		findings = append(findings, notify.Finding{Kind: notify.FindingBannerReshown, Tool: StateTool, Domain: domain, Evidence: evidence, Time: now})
+	}
+	// Only changed purpose and vendor grants count, as CMPs rewrite their metadata as a matter of course
+	if (v == verdict.ConsentIgnored || v == verdict.TCStringRegenerated) && tcfaudit.DiffTCStrings(tcString, tcStringAfterReload).GrantsChanged() {
+		evidence := fmt.Sprintf("CMP %d on %s returned %s instead of the injected %s", injected.CmpID, page, tcStringAfterReload, tcString)
+		findings = append(findings, notify.Finding{Kind: notify.FindingTCStringMismatch, Tool: StateTool, Domain: domain, Evidence: evidence, Time: now})
+	}
+	if len(findings) == 0 {
+		return
+	}
+	if err := notify.Send(findings); err != nil {
+		slog.Error("Error notifying findings", "domain", domain, "error", err)
+	}
 }
 
 // navigateAndCheckStatus navigates to a website, checks the CMP's status and writes it to the CSV file.
-func navigateAndCheckStatus(driver selenium.WebDriver, domain string, tcString string, cmpID int, tcStringJS string, resultswriter *csv.Writer) error {
+func navigateAndCheckStatus(session seleniumSession, domain string, tcString string, injected tcf.Ping, results resultsWriter) error {
 	// Reload the page
-	err := navigateWebsite(driver, domain)
+	err := navigateWebsite(session.driver, domain)
 	if err != nil {
 		return err
 	}
 
-	displayStatusAfterReload, err := executeScriptAndQuitOnError(driver, displayStatusJS)
+	statusAfter, tcStringAfter, err := getStatus(session)
 	if err != nil {
 		return err
 	}
-	statusAfter := parseStringResult(displayStatusAfterReload, "noStatus")
 
-	tcStringAfterReload, err := executeScriptAndQuitOnError(driver, tcStringJS)
+	captureScreenshot(session, domain, "3-after-reload")
+	diagnostics := diagnoseBanner(session, tcString, statusAfter, tcStringAfter)
+	writeRow(session.driver, results, domain, "https://"+domain, tcString, injected, statusAfter, tcStringAfter, diagnostics)
+
+	return nil
+}
+
+// waitForAPI waits for the TCF API on the current page, logging how long it took. The error is returned for pages on
+// which it does not load, which on sub-pages are left to the probes that follow, which report them.
+func waitForAPI(session seleniumSession) error {
+	latency, err := tcf.WaitForAPI(session, TCFTimeOut)
 	if err != nil {
+		session.log.Debug("TCF API not ready", "timeout", TCFTimeOut, "error", err)
 		return err
 	}
-	tcStringAfter := parseStringResult(tcStringAfterReload, "dummy.string")
+	session.log.Debug("TCF API ready", "latency", latency)
+	return nil
+}
 
-	writeRow(driver, resultswriter, domain, tcString, cmpID, statusAfter, tcStringAfter)
+// getStatus waits for the TCF API and returns the CMP's display status and TC string on the current page, or
+// "noStatus" and "dummy.string" if the CMP does not report them.
+func getStatus(session seleniumSession) (string, string, error) {
+	waitForAPI(session)
 
+	ping, err := tcf.GetPing(session)
+	if err != nil {
+		return "", "", err
+	}
+	status := ping.DisplayStatus
+	if status == "" {
+		status = "noStatus"
+	}
+
+	tcData, err := tcf.GetTCData(session)
+	if err != nil {
+		return "", "", err
+	}
+	tcString := tcData.TCString
+	if tcString == "" {
+		tcString = "dummy.string"
+	}
+
+	return status, tcString, nil
+}
+
+// getInternalLinks returns up to limit distinct internal links found on the current page.
+func getInternalLinks(session seleniumSession, domain string, limit int) []string {
+	var hrefs []string
+	if err := session.Evaluate(linksJS, &hrefs); err != nil {
+		session.log.Warn("Error collecting links", "error", err)
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var found []string
+	for _, href := range hrefs {
+		link, ok := links.Internal(href, domain)
+		if !ok || links.IsHomepage(link) || seen[link] {
+			continue
+		}
+		seen[link] = true
+		found = append(found, link)
+		if len(found) == limit {
+			break
+		}
+	}
+	return found
+}
+
+// checkSubPages visits the internal pages linked from the current page and writes the CMP's status on each of them to the CSV file.
+// A failure on a single sub-page does not end the session.
+func checkSubPages(session seleniumSession, domain string, tcString string, injected tcf.Ping, results resultsWriter) {
+	for _, link := range getInternalLinks(session, domain, SubPageLimit) {
+		if err := session.Navigate(link); err != nil {
+			session.log.Error("Error navigating to sub-page", "url", link, "error", err)
+			continue
+		}
+
+		status, tcStringOnPage, err := getStatus(session)
+		if err != nil {
+			session.log.Error("Error querying the CMP's status", "url", link, "error", err)
+			continue
+		}
+
+		diagnostics := diagnoseBanner(session, tcString, status, tcStringOnPage)
+		writeRow(session.driver, results, domain, link, tcString, injected, status, tcStringOnPage, diagnostics)
+	}
+}
+
+// checkDomain opens a new browser session, retrieves the CMP ID, version, and GVL version on the given domain, generates and
+// sets TC data, navigates back to the domain and writes the CMP's status to the CSV file. Domains on which the TCF API
+// does not load are written with their verdict, see apiVerdict.
+func checkDomain(caps selenium.Capabilities, domain string, results resultsWriter, bannerwriter *csv.Writer, logger *slog.Logger) error {
+	driver, err := selenium.NewRemote(caps, "")
+	if err != nil {
+		return err
+	}
+	defer driver.Quit()
+
+	if err = setPageLoadTimeout(driver, PageLoadTimeout); err != nil {
+		return err
+	}
+
+	// Navigate to the website
+	if err = navigateWebsite(driver, domain); err != nil {
+		return err
+	}
+
+	session := seleniumSession{driver, logger}
+	if err := waitForAPI(session); err != nil {
+		v := apiVerdict(session)
+		session.log.Info("CMP not checked", "verdict", v, "error", err)
+		results.writeUnchecked(domain, v, err)
+		return nil
+	}
+
+	ping, err := tcf.GetPing(session)
+	if err != nil {
+		return err
+	}
+	captureScreenshot(session, domain, "1-initial-load")
+
+	// Inspect the banner of the first visit before the consent is injected
+	if AnalyzeBanner {
+		if err := bannerwriter.Write(analyzeBanner(session, ping.DisplayStatus).row(domain)); err != nil {
+			session.log.Error("Error writing banner analysis", "error", err)
+		}
+		bannerwriter.Flush()
+	}
+
+	// Set default values for CMPs which do not report their version or the vendor list version
+	if ping.CmpVersion == 0 {
+		ping.CmpVersion = 1
+	}
+	if ping.GvlVersion == 0 {
+		ping.GvlVersion = 133
+	}
+
+	// Generate a valid TC string for that CMP and save it in a cookie and local storage on that domain
+	tcString, err := generateAndSetTCData(session, ping.CmpID, ping.CmpVersion, ping.GvlVersion)
+	if err != nil {
+		return err
+	}
+	captureScreenshot(session, domain, "2-after-injection")
+
+	err = navigateAndCheckStatus(session, domain, tcString, ping, results)
+	if err != nil {
+		return err
+	}
+
+	if SubPageLimit > 0 {
+		checkSubPages(session, domain, tcString, ping, results)
+	}
+
+	if err = driver.Close(); err != nil {
+		session.log.Warn("Error closing the browser window", "error", err)
+	}
 	return nil
 }
 
@@ -222,10 +386,12 @@ func navigateAndCheckStatus(driver selenium.WebDriver, domain string, tcString s
 // navigates to each domain, retrieves the CMP ID, version, and GVL version, generates and sets TC data, navigates back to the domain and checks
 // the CMP's status, and finally writes the results to the CSV file.
 func main() {
+	setupLogging()
+
 	// Set up Chrome driver service
 	service, err := selenium.NewChromeDriverService(ChromeDriverPath, Port)
 	if err != nil {
-		log.Fatal("Error starting Chrome driver service:", err)
+		fatal("Error starting Chrome driver service", "error", err)
 	}
 	defer service.Stop()
 
@@ -235,73 +401,91 @@ func main() {
 	// Read CSV file
 	domains, err := readCSV(TCFDomainsFile)
 	if err != nil {
-		log.Fatalf("Error reading %s file: %v", TCFDomainsFile, err)
+		fatal("Error reading domains file", "file", TCFDomainsFile, "error", err)
 	}
 
-	// Open file to write results to and Create CSV writer
-	resultsFile, resultswriter, err := createCSVWriter(ResultsFile)
+	// Open file to append results to and Create CSV writer
+	resultsFile, resultswriter, err := createCSVWriter(ResultsFile, resultsHeader)
 	if err != nil {
-		log.Fatalf("Error creating %s file: %v", ResultsFile, err)
+		fatal("Error creating results file", "file", ResultsFile, "error", err)
 	}
-	defer resultsFile.Close()
+	defer func() { resultsFile.Close() }()
 
-	for _, domain := range domains {
+	// Open the file the verdicts are written to as JSON lines
+	verdictsFile, err := openVerdictsFile()
+	if err != nil {
+		fatal("Error creating verdicts file", "file", VerdictsFile, "error", err)
+	}
+	defer func() { verdictsFile.Close() }()
 
-		driver, err := selenium.NewRemote(caps, "")
+	var bannerFile *outfile.File
+	var bannerwriter *csv.Writer
+	if AnalyzeBanner {
+		bannerFile, bannerwriter, err = createCSVWriter(BannerFile, bannerHeader)
 		if err != nil {
-			log.Println(err)
-			continue
+			fatal("Error creating banner file", "file", BannerFile, "error", err)
 		}
-		defer driver.Quit()
+		defer func() { bannerFile.Close() }()
+	}
 
-		if err = setPageLoadTimeout(driver, PageLoadTimeout); err != nil {
-			log.Println(err)
-			continue
-		}
+	// Open the state database in which the progress is kept
+	store, err := state.Open(StateFile)
+	if err != nil {
+		fatal("Error opening state database", "error", err)
+	}
 
-		// Navigate to the website
-		if err = navigateWebsite(driver, domain[0]); err != nil {
-			log.Println(err)
-			continue
-		}
+	for _, domain := range domains {
+		// Tag all records logged while checking the domain with it, passing the logger down with the session
+		logger, stopDomainLogging := startDomainLogging(domain[0])
 
-		cmpIDRes, err := executeScriptAndQuitOnError(driver, cmpIDJS)
-		if err != nil {
-			log.Println(err)
+		// Skip domains that have already been checked, or are being checked by another run
+		if !claimDomain(store, domain[0]) {
+			stopDomainLogging()
 			continue
 		}
-		cmpID := parseIntegerResult(cmpIDRes, 0)
 
-		cmpVerRes, err := executeScriptAndQuitOnError(driver, cmpVerJS)
-		if err != nil {
-			log.Println(err)
-			continue
+		// Start a new part of the results file once the current one holds RotateEvery domains, or the date changes
+		if rotation.Next() {
+			resultsFile.Close()
+			resultsFile, resultswriter, err = createCSVWriter(ResultsFile, resultsHeader)
+			if err != nil {
+				fatal("Error creating results file", "file", rotation.Name(ResultsFile), "error", err)
+			}
+			verdictsFile.Close()
+			verdictsFile, err = openVerdictsFile()
+			if err != nil {
+				fatal("Error creating verdicts file", "file", rotation.Name(VerdictsFile), "error", err)
+			}
+			if AnalyzeBanner {
+				bannerFile.Close()
+				bannerFile, bannerwriter, err = createCSVWriter(BannerFile, bannerHeader)
+				if err != nil {
+					fatal("Error creating banner file", "file", rotation.Name(BannerFile), "error", err)
+				}
+			}
 		}
-		cmpVer := parseIntegerResult(cmpVerRes, 1)
 
-		gvlVerRes, err := executeScriptAndQuitOnError(driver, gvlVerJS)
+		results := resultsWriter{rows: resultswriter, verdicts: verdictsFile}
+		err := checkDomain(caps, domain[0], results, bannerwriter, logger)
 		if err != nil {
-			log.Println(err)
-			continue
+			logger.Error("Error checking domain", "error", err)
+			results.writeUnchecked(domain[0], verdict.Error, err)
+		} else {
+			logger.Info("Done with domain")
 		}
-		gvlVer := parseIntegerResult(gvlVerRes, 133)
-
-		// Generate a valid TC string for that CMP and save it in a cookie and local storage on that domain
-		tcString, err := generateAndSetTCData(driver, cmpID, cmpVer, gvlVer)
-		if err != nil {
-			log.Println(err)
-			continue
+		// Write out the results compressed so far, so they are kept if the run is stopped
+		if err := resultsFile.Flush(); err != nil {
+			logger.Error("Error flushing results file", "error", err)
 		}
-
-		err = navigateAndCheckStatus(driver, domain[0], tcString, cmpID, tcStringJS, resultswriter)
-		if err != nil {
-			log.Println(err)
-			continue
+		if err := verdictsFile.Flush(); err != nil {
+			logger.Error("Error flushing verdicts file", "error", err)
 		}
-
-		err = driver.Close()
-		if err != nil {
-			log.Println(err)
+		if AnalyzeBanner {
+			if err := bannerFile.Flush(); err != nil {
+				logger.Error("Error flushing banner file", "error", err)
+			}
 		}
+		finishDomain(store, domain[0], err)
+		stopDomainLogging()
 	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Logging configuration
+	LogLevel      = slog.LevelInfo // LogLevel specifies the minimum level of the records logged.
+	LogJSON       = false          // LogJSON switches the log output from text to JSON lines.
+	PerDomainLogs = false          // PerDomainLogs additionally writes the records logged while processing a domain to <LogDir>/<domain>.log, compressed according to outfile.Compression.
+	LogDir        = "logs"
+)
+
+// logConfig holds the logging constants.
+var logConfig = logging.Config{Level: LogLevel, JSON: LogJSON, PerDomain: PerDomainLogs, Dir: LogDir}
+
+// setupLogging installs the default logger, which writes to stderr.
+func setupLogging() {
+	logConfig.Setup()
+}
+
+// startDomainLogging returns a logger tagging every record with the given domain and, if PerDomainLogs is set, also
+// writing it to the domain's log file, for the check of the domain to log through. The returned function closes the
+// log file.
+func startDomainLogging(domain string) (*slog.Logger, func()) {
+	return logConfig.ForDomain(domain, domain)
+}
+
+// fatal logs an error and exits the program.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
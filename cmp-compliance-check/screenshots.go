@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Screenshots of the whole page are taken on initial load, after the consent is injected and after reload, and
+	// saved per domain, as visual evidence of whether the banner reappeared despite a valid TC string (condition 2)
+	CaptureScreenshots = false
+	ScreenshotDir      = "screenshots" // ScreenshotDir specifies the directory in which a sub-directory per domain is created.
+	ScreenshotQuality  = 90            // ScreenshotQuality specifies the JPEG quality of the screenshots.
+
+	pageSizeJS = "return [document.documentElement.scrollWidth, document.documentElement.scrollHeight, window.outerWidth, window.outerHeight]"
+)
+
+// captureScreenshot saves a screenshot of the whole current page to <ScreenshotDir>/<domain>/<stage>.jpg, like the
+// adtech-vendor check does. The window is resized to the page's size for the screenshot and back afterwards. Failing
+// to capture or save a screenshot does not end the session.
+func captureScreenshot(session seleniumSession, domain string, stage string) {
+	if !CaptureScreenshots {
+		return
+	}
+
+	if size, err := session.driver.ExecuteScript(pageSizeJS, nil); err == nil {
+		if dims, ok := size.([]interface{}); ok && len(dims) == 4 {
+			var px [4]int
+			for i, d := range dims {
+				v, _ := d.(float64)
+				px[i] = int(v)
+			}
+			if px[0] > 0 && px[1] > 0 {
+				if err := session.driver.ResizeWindow("", px[0], px[1]); err != nil {
+					session.log.Debug("Error resizing the window to the page", "error", err)
+				}
+				defer session.driver.ResizeWindow("", px[2], px[3])
+			}
+		}
+	}
+
+	shot, err := session.driver.Screenshot()
+	if err != nil {
+		session.log.Warn("Error capturing screenshot", "stage", stage, "error", err)
+		return
+	}
+	img, err := png.Decode(bytes.NewReader(shot))
+	if err != nil {
+		session.log.Warn("Error decoding screenshot", "stage", stage, "error", err)
+		return
+	}
+
+	dir := filepath.Join(ScreenshotDir, domain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		session.log.Error("Error creating screenshot directory", "error", err)
+		return
+	}
+	f, err := os.Create(filepath.Join(dir, stage+".jpg"))
+	if err != nil {
+		session.log.Error("Error writing screenshot", "stage", stage, "error", err)
+		return
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: ScreenshotQuality}); err != nil {
+		session.log.Error("Error writing screenshot", "stage", stage, "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tebeka/selenium"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+// seleniumSession implements browser.Session on a selenium web driver, so the TCF probes in package tcf can be used
+// from this tool.
+type seleniumSession struct {
+	driver selenium.WebDriver
+	log    *slog.Logger // log is the logger of the domain checked in the session, see startDomainLogging.
+}
+
+var _ browser.Session = seleniumSession{}
+
+// Navigate loads the URL and waits for the page to load.
+func (s seleniumSession) Navigate(url string) error {
+	return s.driver.Get(url)
+}
+
+// Reload reloads the current page and waits for it to load.
+func (s seleniumSession) Reload() error {
+	return s.driver.Refresh()
+}
+
+// Evaluate evaluates the JavaScript expression on the current page. The expression is run as an asynchronous script,
+// which resolves promises and passes the result back as JSON, so it is decoded the same way as with chromedp.
+func (s seleniumSession) Evaluate(js string, res interface{}) error {
+	script := "const done = arguments[arguments.length - 1];" +
+		"Promise.resolve(" + js + ").then((v) => done(JSON.stringify(v === undefined ? null : v)), () => done(null));"
+	value, err := s.driver.ExecuteScriptAsync(script, nil)
+	if err != nil || res == nil {
+		return err
+	}
+
+	encoded, _ := value.(string)
+	if encoded == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(encoded), res)
+}
+
+// Cookies returns the cookies the browser sends to the current page.
+func (s seleniumSession) Cookies() ([]*http.Cookie, error) {
+	cookies, err := s.driver.GetCookies()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		cookie := &http.Cookie{
+			Name:   c.Name,
+			Value:  c.Value,
+			Path:   c.Path,
+			Domain: c.Domain,
+			Secure: c.Secure,
+		}
+		if c.Expiry != 0 {
+			cookie.Expires = time.Unix(int64(c.Expiry), 0)
+		}
+		result = append(result, cookie)
+	}
+	return result, nil
+}
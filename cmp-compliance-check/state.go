@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+)
+
+const (
+	// Progress is kept in the state database shared with the other tools, see the scan-state tool to inspect or reset it
+	StateFile  = "../scan-state.db"
+	StateTool  = "cmp-compliance-check" // StateTool is the name under which the progress of this tool is stored.
+	StaleAfter = 10 * time.Minute       // StaleAfter specifies after how long a domain left running, e.g. by a stopped run, is checked again.
+)
+
+// claimDomain reports whether the domain should be checked by this run, marking it as running if so.
+func claimDomain(store state.Storage, domain string) bool {
+	err := store.Claim(StateTool, domain, StaleAfter)
+	if errors.Is(err, state.ErrSkip) {
+		slog.Debug("Skipping domain that is done or being checked elsewhere", "domain", domain)
+		return false
+	}
+	if err != nil {
+		slog.Error("Error claiming domain", "domain", domain, "error", err)
+		return false
+	}
+	return true
+}
+
+// finishDomain marks the domain as done, or as failed if checkErr is not nil, and records the files its results were written to.
+func finishDomain(store state.Storage, domain string, checkErr error) {
+	artifacts := map[string]string{"results": outfile.Path(rotation.Name(ResultsFile)), "verdicts": outfile.Path(rotation.Name(VerdictsFile))}
+	if AnalyzeBanner {
+		artifacts["banner"] = outfile.Path(rotation.Name(BannerFile))
+	}
+	if CaptureScreenshots {
+		artifacts["screenshots"] = filepath.Join(ScreenshotDir, domain)
+	}
+	if PerDomainLogs {
+		artifacts["log"] = logConfig.FilePath(domain)
+	}
+	if err := store.Finish(StateTool, domain, checkErr, artifacts); err != nil {
+		slog.Error("Error saving domain state", "domain", domain, "error", err)
+	}
+}
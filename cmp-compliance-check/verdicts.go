@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+// VerdictsFile holds the verdict of every page checked as JSON lines, see verdict.Record. The results file holds them
+// in its Verdict column, along with the rows of the domains that could not be checked.
+const VerdictsFile = "verdicts.jsonl"
+
+// resultsWriter writes the rows of the results file and the records of the verdicts file.
+type resultsWriter struct {
+	rows     *csv.Writer
+	verdicts *outfile.File
+}
+
+// openVerdictsFile opens the current part of the verdicts file, listing it in the manifest if it is new.
+func openVerdictsFile() (*outfile.File, error) {
+	file, err := outfile.Open(rotation.Name(VerdictsFile))
+	if err != nil {
+		return nil, err
+	}
+	if file.New && outfile.Rotating() {
+		if err := outfile.AddToManifest(VerdictsFile, file.Name); err != nil {
+			slog.Error("Error adding part to manifest", "file", file.Name, "error", err)
+		}
+	}
+	return file, nil
+}
+
+// writeVerdict writes the record to the verdicts file. Errors are logged.
+func (w resultsWriter) writeVerdict(record verdict.Record) {
+	if err := json.NewEncoder(w.verdicts).Encode(record); err != nil {
+		slog.Error("Error writing verdict", "error", err)
+	}
+}
+
+// writeUnchecked writes the row and record of a domain whose CMP could not be checked, with the verdict and error.
+func (w resultsWriter) writeUnchecked(domain string, v verdict.Verdict, checkErr error) {
+	record := verdict.NewRecord(StateTool, domain, "https://"+domain, v)
+	if checkErr != nil {
+		record.Detail = checkErr.Error()
+	}
+	row := make([]string, len(resultsHeader))
+	row[0], row[5], row[len(row)-1] = domain, record.Page, string(v)
+	if err := w.rows.Write(row); err != nil {
+		slog.Error("Error writing results row", "error", err)
+	}
+	w.rows.Flush()
+	w.writeVerdict(record)
+}
+
+// apiVerdict returns the verdict of a page on which the TCF API did not load: NoCMP if the page has neither a __tcfapi
+// function nor a __tcfapiLocator frame, APITimeout if it has either but the CMP did not answer.
+func apiVerdict(session seleniumSession) verdict.Verdict {
+	mode, err := tcf.DetectMode(session)
+	if err == nil && mode == tcf.ModeNone {
+		return verdict.NoCMP
+	}
+	return verdict.APITimeout
+}
@@ -0,0 +1,22 @@
+// Package browser defines the Session interface through which the compliance checks drive a browser tab, so the
+// consent injection and TCF queries in package tcf are shared between the chromedp and selenium based tools. Each
+// tool implements Session for the automation library it uses, and Fake implements it without a browser.
+package browser
+
+import "net/http"
+
+// Session is a browser tab.
+type Session interface {
+	// Navigate loads the URL and waits for the page to load.
+	Navigate(url string) error
+
+	// Reload reloads the current page and waits for it to load.
+	Reload() error
+
+	// Evaluate evaluates the JavaScript expression on the current page. If it evaluates to a promise, the promise is
+	// awaited. Unless res is nil, the result is decoded into res as JSON.
+	Evaluate(js string, res interface{}) error
+
+	// Cookies returns the cookies the browser sends to the current page.
+	Cookies() ([]*http.Cookie, error)
+}
@@ -0,0 +1,105 @@
+package browser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var _ Session = (*Fake)(nil)
+
+// Fake is a Session without a browser, for the tests of the code driving one: it records the pages loaded and the
+// expressions evaluated, and answers them as it is told to. It is safe for concurrent use.
+type Fake struct {
+	// PageCookies holds the cookies the browser sends to each URL.
+	PageCookies map[string][]*http.Cookie
+
+	// Eval answers the expressions evaluated, returning a value encoded to JSON and decoded into the caller's result.
+	// Expressions are answered with null if it is nil.
+	Eval func(url string, js string) (interface{}, error)
+
+	// NavigateErr is returned by Navigate and Reload, if set.
+	NavigateErr error
+
+	mu          sync.Mutex
+	url         string
+	navigations []string
+	reloads     int
+	evaluated   []string
+}
+
+// Navigate records the URL as the current page.
+func (f *Fake) Navigate(url string) error {
+	if f.NavigateErr != nil {
+		return f.NavigateErr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.url = url
+	f.navigations = append(f.navigations, url)
+	return nil
+}
+
+// Reload records a reload of the current page.
+func (f *Fake) Reload() error {
+	if f.NavigateErr != nil {
+		return f.NavigateErr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reloads++
+	return nil
+}
+
+// Evaluate records the expression and decodes the answer of Eval into res.
+func (f *Fake) Evaluate(js string, res interface{}) error {
+	f.mu.Lock()
+	url := f.url
+	f.evaluated = append(f.evaluated, js)
+	f.mu.Unlock()
+
+	var value interface{}
+	if f.Eval != nil {
+		var err error
+		if value, err = f.Eval(url, js); err != nil {
+			return err
+		}
+	}
+	if res == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding the result of the expression: %w", err)
+	}
+	return json.Unmarshal(data, res)
+}
+
+// Cookies returns the cookies held for the current page.
+func (f *Fake) Cookies() ([]*http.Cookie, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.PageCookies[f.url], nil
+}
+
+// Navigations returns the URLs navigated to, in order.
+func (f *Fake) Navigations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.navigations...)
+}
+
+// Reloads returns the number of reloads.
+func (f *Fake) Reloads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reloads
+}
+
+// Evaluated returns the expressions evaluated, in order.
+func (f *Fake) Evaluated() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.evaluated...)
+}
@@ -0,0 +1,67 @@
+// Package csvfile creates the CSV readers and writers used by the Go tools, so that the files they pass to each other
+// share a single delimiter and encoding, configured here.
+//
+// Fields are only ever written through encoding/csv, which quotes every field containing the delimiter, a quote or a
+// line break, so consent strings and semicolon separated lists stay intact whichever delimiter is configured.
+package csvfile
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+)
+
+const (
+	// Delimiter separates the fields of every CSV file read or written, e.g. ';' for spreadsheet applications in
+	// locales that use the comma as decimal separator. tcf-crawler.py has a matching CSV_DELIMITER setting.
+	Delimiter = ','
+
+	// WriteBOM starts every new CSV file with a UTF-8 byte order mark, which some spreadsheet applications need to
+	// detect the encoding. Readers skip the mark whether or not it is set.
+	WriteBOM = false
+)
+
+// bom is the UTF-8 encoded byte order mark.
+var bom = []byte{0xEF, 0xBB, 0xBF}
+
+// NewWriter returns a CSV writer for w using the configured delimiter. If WriteBOM is set and isNew reports that the
+// file w writes to is empty, the byte order mark is written along with the first row, so files that are appended to
+// only contain it once.
+func NewWriter(w io.Writer, isNew bool) *csv.Writer {
+	if WriteBOM && isNew {
+		w = &bomWriter{w: w, pending: true}
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Comma = Delimiter
+	return writer
+}
+
+// bomWriter writes the byte order mark before the first data written to it, if pending.
+type bomWriter struct {
+	w       io.Writer
+	pending bool
+}
+
+// Write writes p, preceded by the byte order mark on the first call.
+func (b *bomWriter) Write(p []byte) (int, error) {
+	if b.pending {
+		if _, err := b.w.Write(bom); err != nil {
+			return 0, err
+		}
+		b.pending = false
+	}
+	return b.w.Write(p)
+}
+
+// NewReader returns a CSV reader for r using the configured delimiter, skipping a leading byte order mark.
+func NewReader(r io.Reader) *csv.Reader {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(bom)); err == nil && string(prefix) == string(bom) {
+		br.Discard(len(bom))
+	}
+
+	reader := csv.NewReader(br)
+	reader.Comma = Delimiter
+	return reader
+}
@@ -0,0 +1,86 @@
+package gvl
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	_ Client = HTTPClient{}
+	_ Client = FakeClient{}
+)
+
+// DisclosureUserAgent is the user agent device disclosures are requested with, as some vendors refuse other clients.
+const DisclosureUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.110 Safari/537.3"
+
+// Client fetches the GVL and the vendors' device disclosures, returning their bodies. HTTPClient fetches them over the
+// network, and FakeClient serves them from memory for the tests of the tools.
+type Client interface {
+	VendorList(url string) ([]byte, error)
+	Disclosure(url string) ([]byte, error)
+}
+
+// HTTPClient fetches the GVL and the device disclosures over HTTP, failing on any status but 200 OK.
+type HTTPClient struct {
+	DisclosureTimeout time.Duration // DisclosureTimeout specifies the maximum duration of fetching a device disclosure.
+}
+
+// VendorList returns the body of the vendor list at the URL.
+func (c HTTPClient) VendorList(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch vendor list from %s, status code: %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Disclosure returns the body of the device disclosure at the URL, requested with DisclosureUserAgent.
+func (c HTTPClient) Disclosure(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", DisclosureUserAgent)
+
+	resp, err := (&http.Client{Timeout: c.DisclosureTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch device disclosure from %s, status code: %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// FakeClient serves the vendor lists and device disclosures it holds by URL, failing as a 404 would for the others.
+type FakeClient struct {
+	VendorLists map[string][]byte
+	Disclosures map[string][]byte
+}
+
+// VendorList returns the vendor list held for the URL.
+func (c FakeClient) VendorList(url string) ([]byte, error) {
+	body, found := c.VendorLists[url]
+	if !found {
+		return nil, fmt.Errorf("failed to fetch vendor list from %s, status code: %d", url, http.StatusNotFound)
+	}
+	return body, nil
+}
+
+// Disclosure returns the device disclosure held for the URL.
+func (c FakeClient) Disclosure(url string) ([]byte, error) {
+	body, found := c.Disclosures[url]
+	if !found {
+		return nil, fmt.Errorf("failed to fetch device disclosure from %s, status code: %d", url, http.StatusNotFound)
+	}
+	return body, nil
+}
@@ -0,0 +1,128 @@
+package gvl
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DeviceDisclosure is a vendor's device storage disclosure.
+type DeviceDisclosure struct {
+	Disclosures []Disclosure `json:"disclosures"`
+	Domains     []Domain     `json:"domains"`
+}
+
+// FetchDisclosure fetches the device disclosure at the URL and parses it. Vendors without a device disclosure URL
+// disclose nothing.
+func FetchDisclosure(c Client, url string) (*DeviceDisclosure, error) {
+	if url == "" {
+		return &DeviceDisclosure{}, nil
+	}
+
+	body, err := c.Disclosure(url)
+	if err != nil {
+		return nil, err
+	}
+	deviceDisclosure, err := ParseDisclosure(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device disclosure JSON from %s: %v", url, err)
+	}
+	return deviceDisclosure, nil
+}
+
+// ParseDisclosure parses the body of a device disclosure. Its entries are not attributed to a vendor, and their Index
+// is left 0.
+func ParseDisclosure(body []byte) (*DeviceDisclosure, error) {
+	var deviceDisclosure DeviceDisclosure
+	if err := json.Unmarshal(body, &deviceDisclosure); err != nil {
+		return nil, err
+	}
+	return &deviceDisclosure, nil
+}
+
+// ValidateDisclosure returns the ways the body departs from the device storage disclosure format: an object with an
+// array of disclosures and an optional array of domains. Cookie disclosures must state their maximum age and whether
+// it is refreshed.
+func ValidateDisclosure(body []byte) []string {
+	var document map[string]interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return []string{"not a JSON object: " + err.Error()}
+	}
+
+	var errs []string
+	disclosures, ok := document["disclosures"].([]interface{})
+	if !ok {
+		errs = append(errs, "disclosures is not an array")
+	}
+	for i, d := range disclosures {
+		disclosure, ok := d.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Sprintf("disclosures[%d] is not an object", i))
+			continue
+		}
+		if identifier, ok := disclosure["identifier"].(string); !ok || identifier == "" {
+			errs = append(errs, fmt.Sprintf("disclosures[%d].identifier is missing", i))
+		}
+		switch disclosure["type"] {
+		case "cookie":
+			if maxAge, found := disclosure["maxAgeSeconds"]; !found {
+				errs = append(errs, fmt.Sprintf("disclosures[%d].maxAgeSeconds is missing", i))
+			} else if _, ok := maxAge.(float64); !ok && maxAge != nil {
+				errs = append(errs, fmt.Sprintf("disclosures[%d].maxAgeSeconds is not a number", i))
+			}
+			if _, ok := disclosure["cookieRefresh"].(bool); !ok {
+				errs = append(errs, fmt.Sprintf("disclosures[%d].cookieRefresh is not a boolean", i))
+			}
+		case "web", "app":
+		default:
+			errs = append(errs, fmt.Sprintf("disclosures[%d].type %v is not cookie, web or app", i, disclosure["type"]))
+		}
+		if !isArrayOf(disclosure["purposes"], isNumber) {
+			errs = append(errs, fmt.Sprintf("disclosures[%d].purposes is not an array of purpose IDs", i))
+		}
+		if domains, found := disclosure["domains"]; found && !isArrayOf(domains, isString) {
+			errs = append(errs, fmt.Sprintf("disclosures[%d].domains is not an array of strings", i))
+		}
+	}
+
+	if domains, found := document["domains"]; found {
+		list, ok := domains.([]interface{})
+		if !ok {
+			errs = append(errs, "domains is not an array")
+		}
+		for i, d := range list {
+			domain, ok := d.(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Sprintf("domains[%d] is not an object", i))
+			} else if _, ok := domain["domain"].(string); !ok {
+				errs = append(errs, fmt.Sprintf("domains[%d].domain is missing", i))
+			}
+		}
+	}
+	return errs
+}
+
+// isArrayOf reports whether value is a JSON array of elements all satisfying isElement.
+func isArrayOf(value interface{}, isElement func(interface{}) bool) bool {
+	array, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, element := range array {
+		if !isElement(element) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNumber reports whether the JSON value is a number.
+func isNumber(value interface{}) bool {
+	_, ok := value.(float64)
+	return ok
+}
+
+// isString reports whether the JSON value is a string.
+func isString(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
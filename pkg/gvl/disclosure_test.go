@@ -0,0 +1,98 @@
+package gvl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const disclosureURL = "https://vendor.example/disclosures.json"
+
+func TestFetchDisclosure(t *testing.T) {
+	client := FakeClient{Disclosures: map[string][]byte{
+		disclosureURL: []byte(`{
+			"disclosures": [
+				{"identifier": "uid", "type": "cookie", "maxAgeSeconds": 86400, "cookieRefresh": true, "domains": ["vendor.example"], "purposes": [1, 3]},
+				{"identifier": "cache", "type": "web", "maxAgeSeconds": null, "purposes": [1]}
+			],
+			"domains": [{"domain": "vendor.example", "use": "ads"}]
+		}`),
+		"https://broken.example/disclosures.json": []byte(`{"disclosures": {}}`),
+	}}
+	maxAge := 86400
+
+	tests := []struct {
+		name string
+		url  string
+		want *DeviceDisclosure
+		err  string
+	}{
+		{name: "no URL", url: "", want: &DeviceDisclosure{}},
+		{name: "disclosure", url: disclosureURL, want: &DeviceDisclosure{
+			Disclosures: []Disclosure{
+				{Identifier: "uid", Type: "cookie", MaxAgeSeconds: &maxAge, CookieRefresh: true, Domains: []string{"vendor.example"}, Purposes: []int{1, 3}},
+				{Identifier: "cache", Type: "web", Purposes: []int{1}},
+			},
+			Domains: []Domain{{Domain: "vendor.example", Use: "ads"}},
+		}},
+		{name: "not found", url: "https://missing.example/disclosures.json", err: "status code: 404"},
+		{name: "malformed", url: "https://broken.example/disclosures.json", err: "failed to unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FetchDisclosure(client, tt.url)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("FetchDisclosure(%q) error = %v, want one containing %q", tt.url, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchDisclosure(%q) error = %v", tt.url, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FetchDisclosure(%q) = %+v, want %+v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDisclosure(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "valid", body: `{"disclosures": [{"identifier": "uid", "type": "cookie", "maxAgeSeconds": null, "cookieRefresh": false, "purposes": [1]}], "domains": [{"domain": "a.com"}]}`},
+		{name: "not JSON", body: `[`, want: []string{"not a JSON object: unexpected end of JSON input"}},
+		{name: "no disclosures", body: `{}`, want: []string{"disclosures is not an array"}},
+		{name: "cookie without age", body: `{"disclosures": [{"identifier": "uid", "type": "cookie", "purposes": [1]}]}`,
+			want: []string{"disclosures[0].maxAgeSeconds is missing", "disclosures[0].cookieRefresh is not a boolean"}},
+		{name: "bad entry", body: `{"disclosures": [{"type": "file", "purposes": ["1"], "domains": "a.com"}]}`,
+			want: []string{"disclosures[0].identifier is missing", "disclosures[0].type file is not cookie, web or app", "disclosures[0].purposes is not an array of purpose IDs", "disclosures[0].domains is not an array of strings"}},
+		{name: "bad domains", body: `{"disclosures": [], "domains": [{"use": "ads"}, "a.com"]}`,
+			want: []string{"domains[0].domain is missing", "domains[1] is not an object"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateDisclosure([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateDisclosure(%s) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDatasetRows(t *testing.T) {
+	dataset := &Dataset{
+		Vendors: []Vendor{{ID: 7, Name: "V", Purposes: []int{1, 2}, LegIntPurposes: []int{7}, DisclosureURL: disclosureURL, Domains: []Domain{{Domain: "v.com", Use: "ads"}}}},
+		Disclosures: []Disclosure{
+			{VendorID: 7, Identifier: "uid", Type: "cookie", Domains: []string{"v.com", "w.com"}, Purposes: []int{1}},
+			{VendorID: 7, Index: 1, Identifier: "cache", Type: "web", Purposes: []int{1, 2}},
+			{VendorID: 7, Index: 2, Identifier: "app", Type: "app"},
+		},
+	}
+	want := [][]string{{"V", "7", "[1 2]", disclosureURL, "v.com, w.com", "uid", "[1]", "v.com", "ads", "", "cache", "[1 2]", "", "[7]"}}
+	if got := dataset.Rows(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Rows() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+// Package gvl matches cookies and web storage identifiers to the vendors disclosing them in the CSV or the store
+// written by gvl-to-csv.go. The vendors are indexed by the domains and identifiers they disclose, so matching an identifier takes
+// a few map lookups rather than a comparison with every vendor.
+//
+// Domains match the way the cross-reference always matched them: segment by segment from the top-level domain, until
+// the shorter of the two domains ends, so a vendor domain matches its subdomains and its parent domains. Disclosed
+// identifiers containing "*", e.g. "_gcl_*", and regular expressions between slashes, e.g. "/^_pk_id\.\d+/", or using
+// regular expression syntax other than ".", are patterns, which only match if no vendor on the domain discloses the
+// identifier itself.
+//
+// An identifier only matches a disclosure covering its domain. Indexes built from the GVL store index each disclosure
+// with its own domains, or its vendor's domains if it lists none, and their matches cite the disclosure entry that
+// matched. The GVL CSV does not tell which domains belong to which identifier, so its disclosures cover all the domains
+// of their row. A disclosure domain of "*" covers every domain.
+package gvl
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+// Columns of the GVL CSV
+const (
+	NameColumn          = 0
+	IDColumn            = 1
+	PurposesColumn      = 2
+	VendorDomainsColumn = 7 // VendorDomainsColumn holds the domains the vendor uses, which are matched for every type of identifier.
+)
+
+// IdentifierColumns are the columns of the GVL CSV holding the domains, identifiers and purposes disclosed for a type
+// of identifier, and the type of the device disclosure entries they are taken from.
+type IdentifierColumns struct {
+	Domains, Names, Purposes int
+	Type                     string
+}
+
+var (
+	CookieColumns  = IdentifierColumns{Domains: 4, Names: 5, Purposes: 6, Type: "cookie"}
+	StorageColumns = IdentifierColumns{Domains: 9, Names: 10, Purposes: 11, Type: "web"}
+)
+
+// Kinds of identifier matches
+const (
+	MatchExact    = "exact"    // The vendor discloses the identifier itself.
+	MatchWildcard = "wildcard" // The vendor discloses an identifier with "*" wildcards matching it.
+	MatchRegex    = "regex"    // The vendor discloses a regular expression matching the identifier.
+)
+
+// Confidence levels of identifier matches. Exact matches are certain. Patterns with at least MinPatternLiteral literal
+// characters, e.g. "_gcl_*", are likely to mean the identifier, shorter ones, e.g. "_*" or "*", match almost anything.
+const (
+	ConfidenceHigh   = "high"
+	ConfidenceMedium = "medium"
+	ConfidenceLow    = "low"
+
+	MinPatternLiteral = 4
+)
+
+// Index finds the vendors disclosing an identifier of a type, in the order of the GVL CSV.
+type Index struct {
+	vendors  [][]string
+	domains  map[string][]int        // domains maps each disclosed domain to the vendors disclosing it.
+	parents  map[string][]int        // parents maps each parent domain of a disclosed domain to the vendors disclosing the latter.
+	names    map[string][]disclosure // names maps each disclosed identifier to its disclosures.
+	scopes   map[disclosure][]string // scopes maps each disclosure to the domains it covers.
+	anywhere []int                   // anywhere holds the vendors with disclosures covering every domain.
+	patterns map[int][]pattern       // patterns maps each vendor to the patterns among its disclosed identifiers.
+	entries  [][]*Disclosure         // entries holds the disclosures of each vendor, if the index was built from the GVL store.
+}
+
+// disclosure is the n-th identifier disclosed by a vendor.
+type disclosure struct {
+	vendor int
+	n      int
+}
+
+// pattern is a disclosed identifier matching other identifiers.
+type pattern struct {
+	disclosure
+	kind    string // kind is MatchWildcard or MatchRegex.
+	re      *regexp.Regexp
+	literal int // literal is the number of literal characters of a wildcard, or of the literal prefix of a regular expression.
+}
+
+// Match is the result of matching an identifier.
+type Match struct {
+	Vendor     []string // Vendor is the row of the vendor disclosing the identifier on a matching domain, nil if none does.
+	Identifier int      // Identifier is the position of the disclosed identifier or pattern among those of Vendor.
+	Kind       string   // Kind tells exact matches from pattern matches.
+	Confidence string   // Confidence is ConfidenceHigh for exact matches, and depends on the pattern otherwise.
+	Partial    []string // Partial is the last vendor with a matching domain, if no vendor discloses the identifier.
+
+	// Disclosure is the disclosure entry of Vendor that matched, if the index was built from the GVL store.
+	Disclosure *Disclosure
+}
+
+// Citation returns the location of the disclosure entry that matched, as its vendor's device disclosure URL with a
+// JSON pointer to the entry, e.g. "https://example.com/disclosures.json#/disclosures/3", or an empty string if the
+// index was built from the GVL CSV or the vendor has no device disclosure URL.
+func (m Match) Citation() string {
+	if m.Disclosure == nil || len(m.Vendor) <= DisclosureURLColumn || m.Vendor[DisclosureURLColumn] == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s#/disclosures/%d", m.Vendor[DisclosureURLColumn], m.Disclosure.Index)
+}
+
+// GVL is the vendors of the GVL CSV or store.
+type GVL struct {
+	Vendors [][]string // Vendors are the rows of the GVL CSV, written from the dataset if the GVL was read from the store.
+	dataset *Dataset
+}
+
+// Load reads the GVL store at path if it ends in StoreExtension, or else the GVL CSV.
+func Load(path string) (*GVL, error) {
+	if strings.HasSuffix(path, StoreExtension) {
+		dataset, err := ReadStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return &GVL{Vendors: dataset.Rows(), dataset: dataset}, nil
+	}
+	vendors, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GVL{Vendors: vendors}, nil
+}
+
+// Version returns the vendor list version of the GVL store, or 0 if the GVL was read from the CSV, which has none.
+func (g *GVL) Version() int {
+	if g.dataset == nil {
+		return 0
+	}
+	return g.dataset.Version
+}
+
+// Index indexes the vendors by the domains and identifiers of the given type they disclose: by the disclosure entries
+// of the store if the GVL was read from one, or else by the given columns of the CSV.
+func (g *GVL) Index(columns IdentifierColumns) *Index {
+	if g.dataset == nil {
+		return NewIndex(g.Vendors, columns)
+	}
+
+	x := newIndex(g.Vendors)
+	x.entries = make([][]*Disclosure, len(g.Vendors))
+	byVendor := g.dataset.disclosuresOf()
+	for i, vendor := range g.dataset.Vendors {
+		for _, d := range byVendor[vendor.ID] {
+			if d.Type != columns.Type {
+				continue
+			}
+			scope := make([]string, 0, len(d.Domains))
+			for _, domain := range d.Domains {
+				scope = append(scope, strings.ReplaceAll(domain, " ", ""))
+			}
+			if len(scope) == 0 {
+				for _, domain := range vendor.Domains {
+					scope = append(scope, strings.ReplaceAll(domain.Domain, " ", ""))
+				}
+			}
+			x.addName(i, len(x.entries[i]), strings.ReplaceAll(d.Identifier, " ", ""), scope)
+			x.entries[i] = append(x.entries[i], d)
+			for _, domain := range d.Domains {
+				x.addDomain(i, strings.ReplaceAll(domain, " ", ""))
+			}
+		}
+		for _, domain := range vendor.Domains {
+			x.addDomain(i, strings.ReplaceAll(domain.Domain, " ", ""))
+		}
+	}
+	return x
+}
+
+// Read reads the rows of the GVL CSV at path, which may be compressed.
+func Read(path string) ([][]string, error) {
+	file, err := outfile.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return csvfile.NewReader(file).ReadAll()
+}
+
+// NewIndex indexes the vendors of the GVL CSV rows by the domains disclosed in the given columns and the vendor
+// domains. Rows written before the columns were added disclose nothing.
+func NewIndex(vendors [][]string, columns IdentifierColumns) *Index {
+	x := newIndex(vendors)
+	for i, vendor := range vendors {
+		if len(vendor) <= columns.Purposes {
+			continue
+		}
+		scope := append(splitList(vendor[columns.Domains]), splitList(vendor[VendorDomainsColumn])...)
+		for n, name := range splitList(vendor[columns.Names]) {
+			x.addName(i, n, name, scope)
+		}
+		for _, domain := range scope {
+			x.addDomain(i, domain)
+		}
+	}
+	return x
+}
+
+// newIndex returns an empty index of the vendors.
+func newIndex(vendors [][]string) *Index {
+	return &Index{vendors: vendors, domains: map[string][]int{}, parents: map[string][]int{}, names: map[string][]disclosure{}, scopes: map[disclosure][]string{}, patterns: map[int][]pattern{}}
+}
+
+// addName indexes the n-th identifier disclosed by the i-th vendor, on the domains it covers.
+func (x *Index) addName(i int, n int, name string, scope []string) {
+	d := disclosure{vendor: i, n: n}
+	x.names[name] = append(x.names[name], d)
+	x.scopes[d] = scope
+	if slices.Contains(scope, "*") && !slices.Contains(x.anywhere, i) {
+		x.anywhere = append(x.anywhere, i)
+	}
+	if p, ok := compilePattern(name); ok {
+		p.disclosure = d
+		x.patterns[i] = append(x.patterns[i], p)
+	}
+}
+
+// covers tells whether the disclosure covers the domain: whether one of its domains is "*", or matches the domain
+// segment by segment. A leading "*." of a disclosed domain is dropped, so "*.example.com" covers example.com too.
+func (x *Index) covers(d disclosure, domain string) bool {
+	for _, scope := range x.scopes[d] {
+		if scope == "*" || domainsMatch(strings.TrimPrefix(scope, "*."), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainsMatch tells whether the domains match segment by segment from the top-level domain, until the shorter of
+// them ends.
+func domainsMatch(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// addDomain indexes a domain disclosed by the i-th vendor, and its parent domains.
+func (x *Index) addDomain(i int, domain string) {
+	x.domains[domain] = append(x.domains[domain], i)
+	segments := strings.Split(domain, ".")
+	for s := 1; s < len(segments); s++ {
+		parent := strings.Join(segments[s:], ".")
+		x.parents[parent] = append(x.parents[parent], i)
+	}
+}
+
+// entry returns the disclosure entry of the n-th identifier disclosed by the i-th vendor, or nil if the index was built
+// from the GVL CSV.
+func (x *Index) entry(i int, n int) *Disclosure {
+	if x.entries == nil || n >= len(x.entries[i]) {
+		return nil
+	}
+	return x.entries[i][n]
+}
+
+// Match returns the first vendor with a disclosure of the identifier covering the identifier's domain, then the vendor
+// with the disclosure of a pattern matching it with the most literal characters, the first vendor's on a tie, or else
+// the last vendor disclosing a matching domain.
+func (x *Index) Match(name, domain string) Match {
+	name = strings.ReplaceAll(name, " ", "")
+	domain = strings.ReplaceAll(domain, " ", "")
+
+	// The disclosures are in the order of the GVL CSV, so the first covering the domain is the first vendor's
+	for _, d := range x.names[name] {
+		if x.covers(d, domain) {
+			return Match{Vendor: x.vendors[d.vendor], Identifier: d.n, Kind: MatchExact, Confidence: ConfidenceHigh, Disclosure: x.entry(d.vendor, d.n)}
+		}
+	}
+
+	// Only the vendors disclosing a matching domain, or a disclosure covering every domain, can disclose a pattern
+	// covering the domain
+	candidates := x.candidates(domain)
+	vendors := slices.Clone(candidates)
+	for _, i := range x.anywhere {
+		if !slices.Contains(vendors, i) {
+			vendors = append(vendors, i)
+		}
+	}
+	slices.Sort(vendors)
+
+	var best *pattern
+	for _, i := range vendors {
+		for j, p := range x.patterns[i] {
+			if (best == nil || p.literal > best.literal) && x.covers(p.disclosure, domain) && p.re.MatchString(name) {
+				best = &x.patterns[i][j]
+			}
+		}
+	}
+	if best != nil {
+		confidence := ConfidenceMedium
+		if best.literal < MinPatternLiteral {
+			confidence = ConfidenceLow
+		}
+		return Match{Vendor: x.vendors[best.vendor], Identifier: best.n, Kind: best.kind, Confidence: confidence, Disclosure: x.entry(best.vendor, best.n)}
+	}
+	if len(candidates) == 0 {
+		return Match{}
+	}
+	return Match{Partial: x.vendors[candidates[len(candidates)-1]]}
+}
+
+// compilePattern compiles the disclosed identifier if it is a pattern: a regular expression if it is written between
+// slashes or uses regular expression syntax, or else a wildcard if it contains "*". Identifiers only using "." are
+// taken literally, as in "id5id.1st", and regular expressions that do not compile are only matched exactly.
+func compilePattern(name string) (pattern, bool) {
+	if expr, ok := strings.CutPrefix(name, "/"); ok && len(expr) > 1 && strings.HasSuffix(expr, "/") {
+		return compileRegex(strings.TrimSuffix(expr, "/"))
+	}
+	if strings.ContainsAny(name, `^$[](){}+?|\`) {
+		return compileRegex(name)
+	}
+	if !strings.Contains(name, "*") {
+		return pattern{}, false
+	}
+
+	parts := strings.Split(name, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	return pattern{kind: MatchWildcard, re: re, literal: len(name) - strings.Count(name, "*")}, true
+}
+
+// compileRegex compiles a disclosed regular expression, which must match the whole identifier unless it is anchored.
+func compileRegex(expr string) (pattern, bool) {
+	anchored := expr
+	if !strings.HasPrefix(expr, "^") && !strings.HasSuffix(expr, "$") {
+		anchored = "^(?:" + expr + ")$"
+	}
+	re, err := regexp.Compile(anchored)
+	if err != nil {
+		return pattern{}, false
+	}
+
+	// Expressions starting with "^" have no literal prefix, so it is taken from the expression without it, if that
+	// compiles on its own
+	prefix, _ := re.LiteralPrefix()
+	if unanchored, ok := strings.CutPrefix(expr, "^"); ok {
+		prefix = ""
+		if re, err := regexp.Compile(unanchored); err == nil {
+			prefix, _ = re.LiteralPrefix()
+		}
+	}
+	return pattern{kind: MatchRegex, re: re, literal: len(prefix)}, true
+}
+
+// VendorOnDomain returns the first vendor disclosing a domain matching the given one, or nil if there is none.
+func (x *Index) VendorOnDomain(domain string) []string {
+	if candidates := x.candidates(domain); len(candidates) > 0 {
+		return x.vendors[candidates[0]]
+	}
+	return nil
+}
+
+// VendorsOnDomain returns every vendor disclosing a domain matching the given one, in the order of the GVL CSV.
+func (x *Index) VendorsOnDomain(domain string) [][]string {
+	var vendors [][]string
+	for _, i := range x.candidates(domain) {
+		vendors = append(vendors, x.vendors[i])
+	}
+	return vendors
+}
+
+// candidates returns the vendors disclosing a domain matching the given one, in the order of the GVL CSV: the
+// vendors disclosing the domain or one of its parents, and those disclosing one of its subdomains.
+func (x *Index) candidates(domain string) []int {
+	domain = strings.ReplaceAll(domain, " ", "")
+	found := map[int]bool{}
+	segments := strings.Split(domain, ".")
+	for s := range segments {
+		for _, i := range x.domains[strings.Join(segments[s:], ".")] {
+			found[i] = true
+		}
+	}
+	for _, i := range x.parents[domain] {
+		found[i] = true
+	}
+
+	candidates := make([]int, 0, len(found))
+	for i := range found {
+		candidates = append(candidates, i)
+	}
+	sort.Ints(candidates)
+	return candidates
+}
+
+// splitList splits a list of the GVL CSV separated by ";", removing all spaces.
+func splitList(list string) []string {
+	return strings.Split(strings.ReplaceAll(list, " ", ""), ";")
+}
@@ -0,0 +1,138 @@
+package gvl
+
+import (
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  bool
+		kind     string
+		literal  int
+		matches  []string
+		mismatch []string
+	}{
+		{name: "_ga"},
+		{name: "id5id.1st"},
+		{name: "_gcl_*", pattern: true, kind: MatchWildcard, literal: 5, matches: []string{"_gcl_au", "_gcl_"}, mismatch: []string{"_gclid", "x_gcl_au"}},
+		{name: "*", pattern: true, kind: MatchWildcard, literal: 0, matches: []string{"anything"}},
+		{name: `/^_pk_id\.\d+/`, pattern: true, kind: MatchRegex, literal: 7, matches: []string{"_pk_id.12"}, mismatch: []string{"x_pk_id.1", "_pk_id."}},
+		{name: "_hj[a-z]+", pattern: true, kind: MatchRegex, literal: 3, matches: []string{"_hjid"}, mismatch: []string{"_hj1", "x_hjid"}},
+		{name: "_hj[", pattern: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := compilePattern(tt.name)
+			if ok != tt.pattern {
+				t.Fatalf("compilePattern(%q) pattern = %v, want %v", tt.name, ok, tt.pattern)
+			}
+			if !ok {
+				return
+			}
+			if p.kind != tt.kind || p.literal != tt.literal {
+				t.Errorf("compilePattern(%q) = %s with %d literal characters, want %s with %d", tt.name, p.kind, p.literal, tt.kind, tt.literal)
+			}
+			for _, name := range tt.matches {
+				if !p.re.MatchString(name) {
+					t.Errorf("%q does not match %q", tt.name, name)
+				}
+			}
+			for _, name := range tt.mismatch {
+				if p.re.MatchString(name) {
+					t.Errorf("%q matches %q", tt.name, name)
+				}
+			}
+		})
+	}
+}
+
+// csvRow returns a row of the GVL CSV disclosing the cookies on the domain, which is also the vendor's domain.
+func csvRow(name string, id string, domain string, cookies string) []string {
+	return []string{name, id, "[1]", "", domain, cookies, "[1]", domain, "", "", "", "", "", "[]"}
+}
+
+func TestIndexMatch(t *testing.T) {
+	index := NewIndex([][]string{
+		csvRow("A", "1", "a.com", "_ga; _gcl_*"),
+		csvRow("B", "2", "b.com", "_ga; _g*"),
+	}, CookieColumns)
+
+	tests := []struct {
+		name, cookie, domain string
+		vendor               string // vendor is the ID of the vendor matched, "" if none is.
+		kind, confidence     string
+		partial              string // partial is the ID of the vendor partially matched, "" if none is.
+	}{
+		{name: "exact", cookie: "_ga", domain: "a.com", vendor: "1", kind: MatchExact, confidence: ConfidenceHigh},
+		{name: "exact on subdomain", cookie: "_ga", domain: ".www.b.com", vendor: "2", kind: MatchExact, confidence: ConfidenceHigh},
+		{name: "wildcard", cookie: "_gcl_au", domain: "a.com", vendor: "1", kind: MatchWildcard, confidence: ConfidenceMedium},
+		{name: "short wildcard", cookie: "_gcl_au", domain: "b.com", vendor: "2", kind: MatchWildcard, confidence: ConfidenceLow},
+		{name: "undisclosed identifier", cookie: "_fbp", domain: "a.com", partial: "1"},
+		{name: "unknown domain", cookie: "_ga", domain: "c.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := index.Match(tt.cookie, tt.domain)
+			if got := idOf(m.Vendor); got != tt.vendor {
+				t.Fatalf("Match(%q, %q) vendor = %q, want %q", tt.cookie, tt.domain, got, tt.vendor)
+			}
+			if m.Kind != tt.kind || m.Confidence != tt.confidence {
+				t.Errorf("Match(%q, %q) = %s match with %s confidence, want %s with %s", tt.cookie, tt.domain, m.Kind, m.Confidence, tt.kind, tt.confidence)
+			}
+			if got := idOf(m.Partial); got != tt.partial {
+				t.Errorf("Match(%q, %q) partial = %q, want %q", tt.cookie, tt.domain, got, tt.partial)
+			}
+		})
+	}
+}
+
+func TestStoreIndexMatchesDisclosureDomains(t *testing.T) {
+	dataset := &Dataset{
+		Vendors: []Vendor{
+			{ID: 1, Name: "A", DisclosureURL: "https://a.com/disclosures.json", Domains: []Domain{{Domain: "a.com"}}},
+			{ID: 2, Name: "B", Domains: []Domain{{Domain: "b.com"}}},
+		},
+		Disclosures: []Disclosure{
+			{VendorID: 1, Index: 0, Identifier: "uid", Type: "cookie", Domains: []string{"t.a.com"}},
+			{VendorID: 1, Index: 1, Identifier: "sid", Type: "cookie"},
+			{VendorID: 1, Index: 2, Identifier: "sid", Type: "web", Domains: []string{"*"}},
+			{VendorID: 2, Index: 0, Identifier: "uid", Type: "cookie", Domains: []string{"*"}},
+		},
+	}
+	index := (&GVL{Vendors: dataset.Rows(), dataset: dataset}).Index(CookieColumns)
+
+	tests := []struct {
+		name, cookie, domain string
+		vendor               string
+		citation             string
+		partial              string
+	}{
+		{name: "disclosure domain", cookie: "uid", domain: "t.a.com", vendor: "1", citation: "https://a.com/disclosures.json#/disclosures/0"},
+		{name: "other domain of the vendor", cookie: "uid", domain: "www.a.com", vendor: "2"},
+		{name: "vendor domain without disclosure domains", cookie: "sid", domain: "www.a.com", vendor: "1", citation: "https://a.com/disclosures.json#/disclosures/1"},
+		{name: "not covered", cookie: "sid", domain: "b.com", partial: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := index.Match(tt.cookie, tt.domain)
+			if got := idOf(m.Vendor); got != tt.vendor {
+				t.Fatalf("Match(%q, %q) vendor = %q, want %q", tt.cookie, tt.domain, got, tt.vendor)
+			}
+			if got := m.Citation(); got != tt.citation {
+				t.Errorf("Match(%q, %q) citation = %q, want %q", tt.cookie, tt.domain, got, tt.citation)
+			}
+			if got := idOf(m.Partial); got != tt.partial {
+				t.Errorf("Match(%q, %q) partial = %q, want %q", tt.cookie, tt.domain, got, tt.partial)
+			}
+		})
+	}
+}
+
+// idOf returns the ID of the vendor of the GVL CSV row, or "" if there is none.
+func idOf(vendor []string) string {
+	if vendor == nil {
+		return ""
+	}
+	return vendor[IDColumn]
+}
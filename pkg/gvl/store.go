@@ -0,0 +1,233 @@
+package gvl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The GVL store keeps the vendor list and the device disclosures of its vendors, as fetched by gvl-to-csv.go, in a
+// bbolt database with a record per vendor and per disclosure. Unlike the GVL CSV, which joins the identifiers, domains
+// and purposes of a vendor's disclosures into cells, it keeps each disclosure whole, so an identifier matched against
+// it is attributed the domains and purposes of the exact disclosure that matched.
+const (
+	StoreExtension = ".db" // StoreExtension tells a GVL store from a GVL CSV.
+
+	// DisclosureURLColumn is the column of the GVL CSV holding the vendor's device storage disclosure URL.
+	DisclosureURLColumn = 3
+
+	storeTimeout = 30 * time.Second // storeTimeout is the maximum duration of time to wait for another process to release the store.
+)
+
+// Buckets of the GVL store
+var (
+	metaBucket        = []byte("meta")        // The vendor list version and when it was fetched.
+	vendorsBucket     = []byte("vendors")     // The vendors, keyed by ID.
+	disclosuresBucket = []byte("disclosures") // The disclosures, keyed by vendor ID and position.
+)
+
+// Dataset is a GVL version with the device disclosures of its vendors.
+type Dataset struct {
+	Version     int          `json:"version"`
+	LastUpdated string       `json:"lastUpdated"`
+	Fetched     time.Time    `json:"fetched"`
+	Vendors     []Vendor     `json:"-"` // Vendors are in ascending order of ID.
+	Disclosures []Disclosure `json:"-"` // Disclosures are in the order of their vendors, then of their position.
+}
+
+// Vendor is a vendor of the GVL.
+type Vendor struct {
+	ID             int      `json:"id"`
+	Name           string   `json:"name"`
+	Purposes       []int    `json:"purposes"`
+	LegIntPurposes []int    `json:"legIntPurposes"`
+	DisclosureURL  string   `json:"deviceStorageDisclosureUrl"`
+	DeletedDate    string   `json:"deletedDate,omitempty"`
+	Domains        []Domain `json:"domains"` // Domains are the domains the vendor uses, from its device disclosure.
+}
+
+// Domain is a domain a vendor uses.
+type Domain struct {
+	Domain string `json:"domain"`
+	Use    string `json:"use"`
+}
+
+// Disclosure is an entry of a vendor's device disclosure.
+type Disclosure struct {
+	VendorID      int      `json:"vendorId,omitempty"`
+	Index         int      `json:"index,omitempty"` // Index is the position of the entry in the disclosures array of the vendor's device disclosure.
+	Identifier    string   `json:"identifier"`
+	Type          string   `json:"type"`
+	MaxAgeSeconds *int     `json:"maxAgeSeconds"`
+	CookieRefresh bool     `json:"cookieRefresh"`
+	Domains       []string `json:"domains"`
+	Purposes      []int    `json:"purposes"`
+}
+
+// WriteStore writes the dataset to a new GVL store at path, replacing any existing one.
+func WriteStore(path string, d *Dataset) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: storeTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := putJSON(meta, []byte("dataset"), d); err != nil {
+			return err
+		}
+
+		vendors, err := tx.CreateBucket(vendorsBucket)
+		if err != nil {
+			return err
+		}
+		for _, v := range d.Vendors {
+			if err := putJSON(vendors, vendorKey(v.ID), v); err != nil {
+				return err
+			}
+		}
+
+		disclosures, err := tx.CreateBucket(disclosuresBucket)
+		if err != nil {
+			return err
+		}
+		for _, disclosure := range d.Disclosures {
+			if err := putJSON(disclosures, disclosureKey(disclosure.VendorID, disclosure.Index), disclosure); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReadStore reads the dataset from the GVL store at path.
+func ReadStore(path string) (*Dataset, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: storeTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	d := &Dataset{}
+	err = db.View(func(tx *bolt.Tx) error {
+		meta, vendors, disclosures := tx.Bucket(metaBucket), tx.Bucket(vendorsBucket), tx.Bucket(disclosuresBucket)
+		if meta == nil || vendors == nil || disclosures == nil {
+			return fmt.Errorf("%s is not a GVL store", path)
+		}
+		if err := json.Unmarshal(meta.Get([]byte("dataset")), d); err != nil {
+			return err
+		}
+		// Keys are zero-padded, so the cursors return the vendors and disclosures in order
+		err := vendors.ForEach(func(_, value []byte) error {
+			var v Vendor
+			if err := json.Unmarshal(value, &v); err != nil {
+				return err
+			}
+			d.Vendors = append(d.Vendors, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return disclosures.ForEach(func(_, value []byte) error {
+			var disclosure Disclosure
+			if err := json.Unmarshal(value, &disclosure); err != nil {
+				return err
+			}
+			d.Disclosures = append(d.Disclosures, disclosure)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// putJSON stores the value encoded as JSON under the key.
+func putJSON(b *bolt.Bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// vendorKey returns the key of the vendor with the given ID.
+func vendorKey(id int) []byte {
+	return []byte(fmt.Sprintf("%08d", id))
+}
+
+// disclosureKey returns the key of the vendor's disclosure at the given position.
+func disclosureKey(vendorID int, index int) []byte {
+	return []byte(fmt.Sprintf("%08d/%06d", vendorID, index))
+}
+
+// disclosuresOf returns the disclosures of every vendor, by vendor ID.
+func (d *Dataset) disclosuresOf() map[int][]*Disclosure {
+	byVendor := map[int][]*Disclosure{}
+	for i := range d.Disclosures {
+		byVendor[d.Disclosures[i].VendorID] = append(byVendor[d.Disclosures[i].VendorID], &d.Disclosures[i])
+	}
+	return byVendor
+}
+
+// Rows returns the vendors as the rows of the GVL CSV written by gvl-to-csv.go, without its header.
+func (d *Dataset) Rows() [][]string {
+	byVendor := d.disclosuresOf()
+	rows := make([][]string, 0, len(d.Vendors))
+	for _, v := range d.Vendors {
+		var cookies, storage [3][]string
+		for _, disclosure := range byVendor[v.ID] {
+			columns := &cookies
+			switch disclosure.Type {
+			case CookieColumns.Type:
+			case StorageColumns.Type:
+				columns = &storage
+			default:
+				continue
+			}
+			columns[0] = append(columns[0], strings.Join(disclosure.Domains, ", "))
+			columns[1] = append(columns[1], disclosure.Identifier)
+			columns[2] = append(columns[2], fmt.Sprint(disclosure.Purposes))
+		}
+		var domains, uses []string
+		for _, domain := range v.Domains {
+			domains = append(domains, domain.Domain)
+			uses = append(uses, domain.Use)
+		}
+
+		rows = append(rows, []string{
+			v.Name,
+			strconv.Itoa(v.ID),
+			fmt.Sprint(v.Purposes),
+			v.DisclosureURL,
+			strings.Join(cookies[0], "; "),
+			strings.Join(cookies[1], "; "),
+			strings.Join(cookies[2], "; "),
+			strings.Join(domains, "; "),
+			strings.Join(uses, "; "),
+			strings.Join(storage[0], "; "),
+			strings.Join(storage[1], "; "),
+			strings.Join(storage[2], "; "),
+			v.DeletedDate,
+			fmt.Sprint(v.LegIntPurposes),
+		})
+	}
+	return rows
+}
@@ -0,0 +1,41 @@
+// Package links picks the links of a page that lead to other pages of the same site, for the tools that check the
+// sub-pages of a domain besides its homepage.
+package links
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SkippedExtensions lists the file extensions of links that do not lead to web pages.
+var SkippedExtensions = map[string]bool{
+	".pdf": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".svg": true, ".webp": true,
+	".zip": true, ".mp3": true, ".mp4": true, ".xml": true, ".rss": true, ".doc": true, ".docx": true,
+}
+
+// Internal normalizes the given link and reports whether it points to a web page on the given host. The www and apex
+// variants of a host are considered the same site.
+func Internal(link string, host string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+
+	if strings.TrimPrefix(u.Hostname(), "www.") != strings.TrimPrefix(host, "www.") {
+		return "", false
+	}
+
+	if SkippedExtensions[strings.ToLower(path.Ext(u.Path))] {
+		return "", false
+	}
+
+	u.Fragment = ""
+	return u.String(), true
+}
+
+// IsHomepage reports whether the normalized link points to the root of its site, without a query.
+func IsHomepage(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
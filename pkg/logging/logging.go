@@ -0,0 +1,125 @@
+// Package logging sets up the log/slog loggers of the crawlers: the default logger writing to stderr, and the logger
+// of each domain, which tags its records with the domain and can also write them to a file of its own.
+//
+// The logger of a domain is passed down with the context of its scan, see NewContext and FromContext, rather than
+// installed as the default logger, so records logged by other goroutines, e.g. of another scan or a server, are
+// neither tagged with the domain nor written to its file.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+// Config holds the logging settings of a tool.
+type Config struct {
+	Level     slog.Level // Level specifies the minimum level of the records logged.
+	JSON      bool       // JSON switches the log output from text to JSON lines.
+	PerDomain bool       // PerDomain additionally writes the records of each domain to <Dir>/<file name>.log.
+	Dir       string     // Dir is the directory of the per-domain log files.
+}
+
+// NewHandler returns a log handler writing records to w in the configured format.
+func (c Config) NewHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: c.Level}
+	if c.JSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// Setup installs the default logger, which writes to stderr.
+func (c Config) Setup() {
+	slog.SetDefault(slog.New(c.NewHandler(os.Stderr)))
+}
+
+// FilePath returns the path of the log file of the domain whose file name is given, compressed according to
+// outfile.Compression.
+func (c Config) FilePath(fileName string) string {
+	return outfile.Path(filepath.Join(c.Dir, fileName+".log"))
+}
+
+// ForDomain returns a logger tagging every record with the given domain on top of the default logger and, if
+// PerDomain is set, also writing it to the log file named fileName. The returned function closes that file.
+func (c Config) ForDomain(domain string, fileName string) (*slog.Logger, func()) {
+	handler := slog.Default().Handler()
+
+	var file *outfile.File
+	if c.PerDomain {
+		var err error
+		if err = os.MkdirAll(c.Dir, 0755); err == nil {
+			file, err = outfile.Create(filepath.Join(c.Dir, fileName+".log"))
+		}
+		if err != nil {
+			slog.Error("Error creating domain log file", "domain", domain, "error", err)
+		} else {
+			handler = teeHandler{handler, c.NewHandler(file)}
+		}
+	}
+
+	return slog.New(handler).With("domain", domain), func() {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// loggerKey is the key of the context value holding the logger, see NewContext.
+type loggerKey struct{}
+
+// NewContext returns a context holding the logger, which FromContext returns for it and the contexts derived from it.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger held by the context, or the default logger if it holds none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Tee returns a log handler passing every record on to both handlers.
+func Tee(first, second slog.Handler) slog.Handler {
+	return teeHandler{first, second}
+}
+
+// teeHandler is a log handler passing every record on to two handlers.
+type teeHandler struct {
+	first, second slog.Handler
+}
+
+// Enabled reports whether either handler handles records at the given level.
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.first.Enabled(ctx, level) || h.second.Enabled(ctx, level)
+}
+
+// Handle passes the record on to the handlers that are enabled for its level.
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if h.first.Enabled(ctx, r.Level) {
+		err = h.first.Handle(ctx, r.Clone())
+	}
+	if h.second.Enabled(ctx, r.Level) {
+		if err2 := h.second.Handle(ctx, r.Clone()); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// WithAttrs returns a teeHandler whose handlers both include the given attributes.
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h.first.WithAttrs(attrs), h.second.WithAttrs(attrs)}
+}
+
+// WithGroup returns a teeHandler whose handlers both nest attributes in the given group.
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h.first.WithGroup(name), h.second.WithGroup(name)}
+}
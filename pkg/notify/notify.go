@@ -0,0 +1,145 @@
+// Package notify posts the high-severity findings of the checks to webhooks, generic JSON or Slack incoming webhooks,
+// so regressions are noticed without reading the CSV files.
+//
+// The webhooks are configured in Webhooks, each with the kinds of findings it receives. The findings of a domain are
+// posted together, in a single request per webhook, once the domain is scanned.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	Timeout     = 10 * time.Second // Timeout specifies the maximum duration of posting to a webhook.
+	MaxEvidence = 300              // MaxEvidence specifies the length above which the evidence of a finding is truncated.
+
+	// Formats of the webhooks
+	FormatJSON  = "json"  // The findings are posted as {"findings": [...]}.
+	FormatSlack = "slack" // The findings are posted as the text of a Slack incoming webhook message.
+)
+
+// Kinds of findings
+const (
+	FindingRejectAllCookies = "cookies-under-reject-all" // A third party set cookies although the user rejected all.
+	FindingTCStringMismatch = "tc-string-mismatch"       // The CMP returned a TC string other than the injected one.
+	FindingBannerReshown    = "banner-reshown"           // The CMP showed its banner again although it kept the injected consent.
+)
+
+// Webhook is a URL the findings are posted to.
+type Webhook struct {
+	URL      string
+	Format   string   // Format is FormatJSON or FormatSlack.
+	Findings []string // Findings holds the kinds of findings posted to the webhook, all of them if empty.
+}
+
+// Webhooks are the webhooks the findings of the checks are posted to, e.g.
+//
+//	{URL: "https://hooks.slack.com/services/...", Format: FormatSlack, Findings: []string{FindingRejectAllCookies}}
+var Webhooks = []Webhook{}
+
+// Finding is a high-severity finding on a domain.
+type Finding struct {
+	Kind     string    `json:"kind"`
+	Tool     string    `json:"tool"` // Tool is the check that made the finding.
+	Domain   string    `json:"domain"`
+	Vendor   string    `json:"vendor,omitempty"` // Vendor is the vendor the finding is attributed to, if known.
+	Evidence string    `json:"evidence"`         // Evidence is a snippet of the data showing the finding, e.g. a cookie or a consent diff.
+	Time     time.Time `json:"time"`
+}
+
+// Enabled reports whether any webhook is configured.
+func Enabled() bool {
+	return len(Webhooks) > 0
+}
+
+// Send posts the findings to every webhook receiving any of their kinds, truncating their evidence to MaxEvidence.
+// The errors of all webhooks are returned joined.
+func Send(findings []Finding) error {
+	for i := range findings {
+		if len(findings[i].Evidence) > MaxEvidence {
+			findings[i].Evidence = findings[i].Evidence[:MaxEvidence] + "..."
+		}
+	}
+
+	client := &http.Client{Timeout: Timeout}
+	var errs []error
+	for _, webhook := range Webhooks {
+		var selected []Finding
+		for _, f := range findings {
+			if webhook.receives(f.Kind) {
+				selected = append(selected, f)
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+		if err := webhook.post(client, selected); err != nil {
+			errs = append(errs, fmt.Errorf("posting to %s: %w", webhook.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// receives reports whether the findings of the kind are posted to the webhook.
+func (w Webhook) receives(kind string) bool {
+	if len(w.Findings) == 0 {
+		return true
+	}
+	for _, k := range w.Findings {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// post posts the findings to the webhook in its format.
+func (w Webhook) post(client *http.Client, findings []Finding) error {
+	var payload interface{}
+	switch w.Format {
+	case FormatSlack:
+		payload = map[string]string{"text": slackText(findings)}
+	case FormatJSON, "":
+		payload = map[string][]Finding{"findings": findings}
+	default:
+		return fmt.Errorf("unknown format %q", w.Format)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// slackText formats the findings as the lines of a Slack message, in Slack's mrkdwn.
+func slackText(findings []Finding) string {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	var lines []string
+	for _, f := range findings {
+		line := fmt.Sprintf("*%s* on `%s`", f.Kind, escape.Replace(f.Domain))
+		if f.Vendor != "" {
+			line += " by " + escape.Replace(f.Vendor)
+		}
+		line += " (" + f.Tool + ")"
+		if f.Evidence != "" {
+			line += "\n> " + escape.Replace(strings.ReplaceAll(f.Evidence, "\n", " "))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,136 @@
+package outfile
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+)
+
+// OpenCSV opens the output CSV file for appending like Open, making sure the rows appended share the header of the
+// rows already in it. If the file was written under a different header, e.g. by a run before columns were added, and
+// that header is a prefix of the given one, its rows are rewritten under the given header, padded with empty fields.
+// Otherwise the file is moved aside to a name with the time it was last written, see VersionedPath, and a new one is
+// started. New is only set if the header still has to be written.
+func OpenCSV(path string, header []string) (*File, error) {
+	if len(header) > 0 {
+		if err := migrateHeader(Path(path), header); err != nil {
+			return nil, err
+		}
+	}
+	return Open(path)
+}
+
+// migrateHeader rewrites or moves aside the CSV file at path if its header differs from the given one.
+func migrateHeader(path string, header []string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && info.Size() == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	old, err := readHeader(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case slices.Equal(old, header):
+		return nil
+	case len(old) < len(header) && slices.Equal(old, header[:len(old)]):
+		return rewriteRows(path, header)
+	}
+	return os.Rename(path, VersionedPath(path, info.ModTime()))
+}
+
+// readHeader returns the first row of the CSV file at path.
+func readHeader(path string) ([]string, error) {
+	reader, err := OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	r := csvfile.NewReader(reader)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+// rewriteRows rewrites the CSV file at path under the header, padding its rows to the header's length. The rows are
+// written to a temporary file first, which then replaces the file, so it is kept as is if the rewrite fails.
+func rewriteRows(path string, header []string) error {
+	reader, err := OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmp := strings.Replace(path, ".csv", ".rewrite.csv", 1)
+	if tmp == path {
+		tmp = path + ".rewrite"
+	}
+	out, err := open(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	writer := csvfile.NewWriter(out, true)
+	r := csvfile.NewReader(reader)
+	r.FieldsPerRecord = -1
+
+	err = copyRows(r, writer, header)
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// copyRows writes the header and then the rows read after the old header, padded to the header's length.
+func copyRows(r *csv.Reader, w *csv.Writer, header []string) error {
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := r.Read(); err != nil {
+		return err
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+}
+
+// VersionedPath returns the name an output file at path written under an outdated header is moved to, with the time
+// it was last written inserted before its extension, e.g. output.20240102-150405.csv.
+func VersionedPath(path string, modified time.Time) string {
+	stamp := "." + modified.Format(partTimeFormat)
+	if i := strings.LastIndex(path, ".csv"); i >= 0 {
+		return path[:i] + stamp + path[i:]
+	}
+	return path + stamp
+}
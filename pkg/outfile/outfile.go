@@ -0,0 +1,157 @@
+// Package outfile opens the output files of the tools, transparently compressing them with gzip or zstd.
+//
+// The compression is selected by the extension of the file name, ".gz" or ".zst", or for every output file by the
+// Compression setting, which appends the matching extension. Data is compressed as it is written, so memory use does
+// not grow with the size of the output. Files opened for appending get a new gzip member or zstd frame per run, which
+// decompressors read as one continuous stream.
+package outfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression specifies the compression of every output file: "" to only compress files named *.gz or *.zst, "gzip"
+// or "zstd".
+const Compression = ""
+
+// File is an output file, compressed according to its name.
+type File struct {
+	Name string // Name is the path of the file, including the extension added for Compression.
+	New  bool   // New reports whether the file was empty when opened, e.g. to decide whether to write a header.
+
+	file       *os.File
+	compressor io.WriteCloser
+}
+
+// Open opens the output file for appending, creating it if it does not exist.
+func Open(path string) (*File, error) {
+	return open(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+}
+
+// Create creates the output file, truncating it if it exists.
+func Create(path string) (*File, error) {
+	return open(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY)
+}
+
+// Path returns the path under which an output file with the given name is written, i.e. with the extension matching
+// Compression added.
+func Path(path string) string {
+	switch {
+	case Compression == "gzip" && !strings.HasSuffix(path, ".gz"):
+		return path + ".gz"
+	case Compression == "zstd" && !strings.HasSuffix(path, ".zst"):
+		return path + ".zst"
+	}
+	return path
+}
+
+// OpenReader opens a file written by this package for reading, decompressing it according to its name. Like Open,
+// it adds the extension matching Compression to the path.
+func OpenReader(path string) (io.ReadCloser, error) {
+	path = Path(path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{gz, file, gz.Close}, nil
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{zr, file, func() error { zr.Close(); return nil }}, nil
+	}
+	return file, nil
+}
+
+// readCloser reads from a decompressor and closes both the decompressor and the underlying file.
+type readCloser struct {
+	io.Reader
+	file  *os.File
+	close func() error
+}
+
+// Close closes the decompressor and the file.
+func (r readCloser) Close() error {
+	err := r.close()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func open(path string, flag int) (*File, error) {
+	path = Path(path)
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &File{Name: path, New: info.Size() == 0, file: file}
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		f.compressor = gzip.NewWriter(file)
+	case strings.HasSuffix(path, ".zst"):
+		f.compressor, err = zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Write compresses p, if needed, and writes it to the file.
+func (f *File) Write(p []byte) (int, error) {
+	if f.compressor != nil {
+		return f.compressor.Write(p)
+	}
+	return f.file.Write(p)
+}
+
+// flusher is implemented by the gzip and zstd writers.
+type flusher interface {
+	Flush() error
+}
+
+// Flush writes out the data compressed so far, so it is readable even if the program is stopped before Close. As it
+// lowers the compression ratio, it is meant to be called at checkpoints such as the end of a domain, not per row.
+func (f *File) Flush() error {
+	if c, ok := f.compressor.(flusher); ok {
+		return c.Flush()
+	}
+	return nil
+}
+
+// Close completes the compressed stream, if any, and closes the file. Data written is only guaranteed to be readable
+// from compressed files once they are closed.
+func (f *File) Close() error {
+	var err error
+	if f.compressor != nil {
+		err = f.compressor.Close()
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package outfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+)
+
+const (
+	// Rotation splits the output files of long crawls into parts, each named after the shard and the time the part
+	// was started, e.g. output.shard-1.20240102-150405.csv. Every part is listed in the manifest.
+	RotateEvery  = 0              // RotateEvery starts new parts of the output files after this many domains, 0 to disable.
+	RotateDaily  = false          // RotateDaily starts new parts of the output files when the date changes.
+	Shard        = ""             // Shard is added to the names of the parts, so runs over different domain lists or machines write separate files.
+	ManifestFile = "manifest.csv" // ManifestFile lists the parts of the output files written in the directory of the tool.
+
+	partTimeFormat = "20060102-150405"
+)
+
+// Rotating reports whether the output files are split into parts.
+func Rotating() bool {
+	return RotateEvery > 0 || RotateDaily || Shard != ""
+}
+
+// Rotator keeps track of the current part of the output files of a run.
+type Rotator struct {
+	started time.Time // started is the time at which the current part was started.
+	domains int       // domains is the number of domains written to the current part.
+}
+
+// NewRotator returns a Rotator whose first part starts now.
+func NewRotator() *Rotator {
+	return &Rotator{started: time.Now()}
+}
+
+// Next is called before each domain and reports whether a new part is started for it, in which case the output
+// files are to be reopened under the names returned by Name.
+func (r *Rotator) Next() bool {
+	if !Rotating() {
+		return false
+	}
+
+	now := time.Now()
+	rotate := RotateEvery > 0 && r.domains >= RotateEvery ||
+		RotateDaily && now.Format("2006-01-02") != r.started.Format("2006-01-02")
+	if rotate {
+		r.started = now
+		r.domains = 0
+	}
+	r.domains++
+	return rotate
+}
+
+// Name returns the name of the current part of the output file, which is the name itself if rotation is disabled.
+// The part is inserted before the extension, and Open adds the extension for Compression after it.
+func (r *Rotator) Name(path string) string {
+	if !Rotating() {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	if Shard != "" {
+		base += "." + Shard
+	}
+	return base + "." + r.started.Format(partTimeFormat) + ext
+}
+
+// AddToManifest records in the manifest that part is a part of the output file with the given name. The manifest
+// itself is neither rotated nor compressed.
+func AddToManifest(name string, part string) error {
+	file, err := os.OpenFile(ManifestFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	writer := csvfile.NewWriter(file, info.Size() == 0)
+	if info.Size() == 0 {
+		writer.Write([]string{"Output", "Part", "Shard", "Opened"})
+	}
+	writer.Write([]string{name, part, Shard, time.Now().Format(time.RFC3339)})
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,157 @@
+package sqlexport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// bigQuery exports the rows to a BigQuery dataset.
+type bigQuery struct {
+	client  *bigquery.Client
+	dataset *bigquery.Dataset
+	run     int64
+	schemas map[string]bigquery.Schema // schemas holds the schema known for each table.
+}
+
+// openBigQuery connects to the project, creates the runs table of the dataset if it does not exist and records the run,
+// whose ID is the time it started in nanoseconds, as BigQuery has no sequences.
+func openBigQuery(project string, dataset string, tool string, host string) (*bigQuery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to BigQuery: %w", err)
+	}
+	started := time.Now()
+	b := &bigQuery{
+		client:  client,
+		dataset: client.Dataset(dataset),
+		run:     started.UnixNano(),
+		schemas: map[string]bigquery.Schema{},
+	}
+	runs := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType, Required: true},
+		{Name: "tool", Type: bigquery.StringFieldType, Required: true},
+		{Name: "host", Type: bigquery.StringFieldType, Required: true},
+		{Name: "started_at", Type: bigquery.TimestampFieldType, Required: true},
+	}
+	if err := b.ensureTable(ctx, RunsTable, runs); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("creating table %s: %w", RunsTable, err)
+	}
+	row := &bigquery.ValuesSaver{
+		Schema:   runs,
+		InsertID: strconv.FormatInt(b.run, 10),
+		Row:      []bigquery.Value{b.run, tool, host, started},
+	}
+	if err := b.dataset.Table(RunsTable).Inserter().Put(ctx, row); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("recording export run: %w", err)
+	}
+	return b, nil
+}
+
+// Write streams the rows into the output's table, adding the table and its missing columns first. Rows are sent with
+// insert IDs made up of the run, the table and their offset, which stay the same when the rows are written again, so
+// BigQuery drops the duplicates of rows a failed insert did insert.
+func (b *bigQuery) Write(output string, header []string, offset int, rows [][]string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	table := TableName(output)
+	columns := ColumnNames(header, width(header, rows))
+	schema := bigquery.Schema{
+		{Name: RunColumn, Type: bigquery.IntegerFieldType, Required: true},
+		{Name: ExportedAtColumn, Type: bigquery.TimestampFieldType, Required: true},
+	}
+	for _, column := range columns {
+		schema = append(schema, &bigquery.FieldSchema{Name: column, Type: bigquery.StringFieldType})
+	}
+	if err := b.ensureTable(ctx, table, schema); err != nil {
+		return fmt.Errorf("creating table %s: %w", table, err)
+	}
+
+	exported := time.Now()
+	savers := make([]*bigquery.ValuesSaver, len(rows))
+	for i, row := range rows {
+		values := make([]bigquery.Value, len(schema))
+		values[0], values[1] = b.run, exported
+		for j, value := range row {
+			values[j+2] = value
+		}
+		savers[i] = &bigquery.ValuesSaver{
+			Schema:   schema,
+			InsertID: fmt.Sprintf("%d-%s-%d", b.run, table, offset+i),
+			Row:      values,
+		}
+	}
+	if err := b.dataset.Table(table).Inserter().Put(ctx, savers); err != nil {
+		return fmt.Errorf("inserting into %s: %w", table, err)
+	}
+	return nil
+}
+
+// ensureTable creates the table with the schema if it does not exist, or adds the fields of the schema it lacks.
+// BigQuery only adds nullable fields to existing tables, so required fields are only required in new tables.
+func (b *bigQuery) ensureTable(ctx context.Context, table string, schema bigquery.Schema) error {
+	known := map[string]bool{}
+	for _, field := range b.schemas[table] {
+		known[field.Name] = true
+	}
+	missing := false
+	for _, field := range schema {
+		missing = missing || !known[field.Name]
+	}
+	if !missing {
+		return nil
+	}
+
+	t := b.dataset.Table(table)
+	metadata, err := t.Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		if err := t.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
+			return err
+		}
+		b.schemas[table] = schema
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	current := append(bigquery.Schema{}, metadata.Schema...)
+	known = map[string]bool{}
+	for _, field := range current {
+		known[field.Name] = true
+	}
+	added := false
+	for _, field := range schema {
+		if !known[field.Name] {
+			current = append(current, &bigquery.FieldSchema{Name: field.Name, Type: field.Type})
+			added = true
+		}
+	}
+	if added {
+		if _, err := t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: current}, metadata.ETag); err != nil {
+			return err
+		}
+	}
+	b.schemas[table] = current
+	return nil
+}
+
+// Close closes the client.
+func (b *bigQuery) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,243 @@
+package sqlexport
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq" // The PostgreSQL driver of database/sql.
+)
+
+// migrationLock is the key of the advisory lock held while migrating, so concurrent runs migrate one at a time.
+const migrationLock = 0x5c4e
+
+// migration is a change of the exporter's own tables, applied once per database in the order of its version.
+type migration struct {
+	version     int
+	description string
+	sql         string
+}
+
+// postgresMigrations are the changes of the exporter's own tables. Append new migrations rather than changing applied
+// ones, which databases already ran.
+var postgresMigrations = []migration{
+	{1, "runs and exported tables", `
+		CREATE TABLE export_runs (
+			id         bigserial   PRIMARY KEY,
+			tool       text        NOT NULL,
+			host       text        NOT NULL,
+			started_at timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE TABLE export_tables (
+			table_name text        PRIMARY KEY,
+			output     text        NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now()
+		);
+	`},
+	{2, "columns of the exported tables, with the header they hold and when they were added", `
+		CREATE TABLE export_columns (
+			table_name  text        NOT NULL REFERENCES export_tables,
+			column_name text        NOT NULL,
+			header      text        NOT NULL,
+			added_at    timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (table_name, column_name)
+		);
+	`},
+	{3, "index of the runs by tool and start time", `
+		CREATE INDEX export_runs_tool ON export_runs (tool, started_at);
+	`},
+}
+
+// postgres exports the rows to PostgreSQL.
+type postgres struct {
+	db      *sql.DB
+	run     int64
+	columns map[string]map[string]bool // columns holds the columns known to exist in each table.
+}
+
+// openPostgres connects to the database, applies the pending migrations and records the run.
+func openPostgres(dsn string, tool string, host string) (*postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	p := &postgres{db: db, columns: map[string]map[string]bool{}}
+	if err := p.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating export database: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, `INSERT INTO export_runs (tool, host) VALUES ($1, $2) RETURNING id`, tool, host).Scan(&p.run); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("recording export run: %w", err)
+	}
+	return p, nil
+}
+
+// migrate applies the migrations the database has not run yet, each in a transaction of its own, holding
+// migrationLock.
+func (p *postgres) migrate(ctx context.Context) error {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version     integer     PRIMARY KEY,
+			description text        NOT NULL,
+			applied_at  timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := conn.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+
+	for _, m := range postgresMigrations {
+		if m.version <= applied {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`, m.version, m.description); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write inserts the rows into the output's table in a single transaction, adding the table and its missing columns
+// first.
+func (p *postgres) Write(output string, header []string, _ int, rows [][]string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	table := TableName(output)
+	columns := ColumnNames(header, width(header, rows))
+	if err := p.ensureTable(ctx, table, output, header, columns); err != nil {
+		return fmt.Errorf("creating table %s: %w", table, err)
+	}
+
+	names := []string{quoteIdentifier(RunColumn)}
+	params := []string{"$1"}
+	for i, column := range columns {
+		names = append(names, quoteIdentifier(column))
+		params = append(params, "$"+strconv.Itoa(i+2))
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, quoteIdentifier(table), strings.Join(names, ", "), strings.Join(params, ", ")))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		values := make([]interface{}, len(columns)+1)
+		values[0] = p.run
+		for i, value := range row {
+			values[i+1] = value
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inserting into %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureTable creates the table if it does not exist, adds the columns it lacks and records them in export_tables and
+// export_columns.
+func (p *postgres) ensureTable(ctx context.Context, table string, output string, header []string, columns []string) error {
+	known := p.columns[table]
+	missing := false
+	for _, column := range columns {
+		missing = missing || !known[column]
+	}
+	if !missing {
+		return nil
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statements := []struct {
+		sql  string
+		args []interface{}
+	}{
+		{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s bigint NOT NULL REFERENCES export_runs, %s timestamptz NOT NULL DEFAULT now())`,
+			quoteIdentifier(table), quoteIdentifier(RunColumn), quoteIdentifier(ExportedAtColumn)), nil},
+		{`INSERT INTO export_tables (table_name, output) VALUES ($1, $2) ON CONFLICT DO NOTHING`, []interface{}{table, output}},
+	}
+	for i, column := range columns {
+		headerName := ""
+		if i < len(header) {
+			headerName = header[i]
+		}
+		statements = append(statements,
+			struct {
+				sql  string
+				args []interface{}
+			}{fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s text`, quoteIdentifier(table), quoteIdentifier(column)), nil},
+			struct {
+				sql  string
+				args []interface{}
+			}{`INSERT INTO export_columns (table_name, column_name, header) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, []interface{}{table, column, headerName}},
+		)
+	}
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s.sql, s.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if known == nil {
+		known = map[string]bool{}
+		p.columns[table] = known
+	}
+	for _, column := range columns {
+		known[column] = true
+	}
+	return nil
+}
+
+// Close closes the connections to the database.
+func (p *postgres) Close() error {
+	return p.db.Close()
+}
+
+// quoteIdentifier quotes the identifier for PostgreSQL.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
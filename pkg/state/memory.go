@@ -0,0 +1,131 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+)
+
+var _ Storage = (*Memory)(nil)
+
+// Memory keeps the state of the domains in memory, the way Store keeps it in the database file, for the tests of the
+// tools. It is safe for concurrent use.
+type Memory struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	records map[string]map[string]Record // records holds the records of each tool, by domain.
+}
+
+// NewMemory returns an empty Memory reading the time from c.
+func NewMemory(c clock.Clock) *Memory {
+	return &Memory{clock: c, records: map[string]map[string]Record{}}
+}
+
+// modify applies fn to a copy of the record of the given domain, which starts out empty if the domain has no state
+// yet, and stores the result.
+func (m *Memory) modify(tool string, domain string, fn func(r *Record) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records, found := m.records[tool]
+	if !found {
+		records = map[string]Record{}
+		m.records[tool] = records
+	}
+	r, found := records[domain]
+	if !found {
+		r = Record{Domain: domain}
+	}
+	r.Artifacts = copyArtifacts(r.Artifacts)
+	if err := fn(&r); err != nil {
+		return err
+	}
+	r.Updated = m.clock.Now()
+	records[domain] = r
+	return nil
+}
+
+// copyArtifacts returns a copy of the artifacts of a record, so the records handed out do not share them.
+func copyArtifacts(artifacts map[string]string) map[string]string {
+	if artifacts == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(artifacts))
+	for kind, path := range artifacts {
+		copied[kind] = path
+	}
+	return copied
+}
+
+// Claim marks the domain as running, as Store.Claim does.
+func (m *Memory) Claim(tool string, domain string, staleAfter time.Duration) error {
+	return m.modify(tool, domain, claim(m.clock, staleAfter))
+}
+
+// Finish marks the domain as done, partial or failed, as Store.Finish does.
+func (m *Memory) Finish(tool string, domain string, err error, artifacts map[string]string) error {
+	return m.modify(tool, domain, finish(err, artifacts))
+}
+
+// Skip marks the domain as skipped, as Store.Skip does.
+func (m *Memory) Skip(tool string, domain string, reason string) error {
+	err := m.modify(tool, domain, skip(reason))
+	if errors.Is(err, ErrSkip) {
+		return nil
+	}
+	return err
+}
+
+// Get returns the record of the given domain, or nil if it has no state.
+func (m *Memory) Get(tool string, domain string) (*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, found := m.records[tool][domain]
+	if !found {
+		return nil, nil
+	}
+	r.Artifacts = copyArtifacts(r.Artifacts)
+	return &r, nil
+}
+
+// Tools returns the names of the tools that have stored state, ordered by name.
+func (m *Memory) Tools() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tools []string
+	for tool := range m.records {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	return tools, nil
+}
+
+// List returns the records of all domains of the given tool, ordered by domain.
+func (m *Memory) List(tool string) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []Record
+	for _, r := range m.records[tool] {
+		r.Artifacts = copyArtifacts(r.Artifacts)
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Domain < records[j].Domain })
+	return records, nil
+}
+
+// Reset removes the state of the given domains of a tool, or of all its domains if none are given.
+func (m *Memory) Reset(tool string, domains ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(domains) == 0 {
+		delete(m.records, tool)
+		return nil
+	}
+	for _, domain := range domains {
+		delete(m.records[tool], domain)
+	}
+	return nil
+}
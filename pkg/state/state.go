@@ -0,0 +1,283 @@
+// Package state persists the progress of the compliance checks in a single bbolt database shared by all tools.
+//
+// Every tool stores its domains in a bucket of its own, keyed by domain. The database file is only opened for the
+// duration of a single transaction, so several processes can share it, e.g. when scanning parts of a domain list in
+// parallel.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// Domain states
+const (
+	StatusRunning = "running" // The domain is being processed, or the process handling it was stopped.
+	StatusDone    = "done"    // The domain was processed.
+	StatusFailed  = "failed"  // Processing the domain ended with an error, it is retried on the next run.
+	StatusSkipped = "skipped" // The domain was not processed, e.g. because the run's time budget ran out, it is processed on the next run.
+	StatusPartial = "partial" // The domain was processed in part, e.g. because its share of the run's time budget ran out, it is processed again on the next run.
+)
+
+// LockTimeout is the maximum duration of time to wait for another process to release the database file.
+const LockTimeout = 30 * time.Second
+
+// Record holds the state of a single domain for a single tool.
+type Record struct {
+	Domain    string            `json:"domain"`
+	Status    string            `json:"status"`
+	Attempts  int               `json:"attempts"`            // Attempts counts the number of times processing the domain was started.
+	LastError string            `json:"lastError,omitempty"` // LastError is the error with which the last attempt failed.
+	Started   time.Time         `json:"started"`
+	Updated   time.Time         `json:"updated"`
+	Artifacts map[string]string `json:"artifacts,omitempty"` // Artifacts maps each kind of output written for the domain to its path.
+}
+
+// Storage keeps the state of the domains of every tool. Store keeps it in the database file, and Memory in memory
+// for the tests of the tools.
+type Storage interface {
+	Claim(tool string, domain string, staleAfter time.Duration) error
+	Finish(tool string, domain string, err error, artifacts map[string]string) error
+	Skip(tool string, domain string, reason string) error
+	Get(tool string, domain string) (*Record, error)
+	Tools() ([]string, error)
+	List(tool string) ([]Record, error)
+	Reset(tool string, domains ...string) error
+}
+
+// Store is a handle on the state database file.
+type Store struct {
+	path  string
+	clock clock.Clock
+}
+
+// Open returns a Store for the database at the given path, which is created if it does not exist.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, clock: clock.System}
+	if err := s.update(func(*bolt.Tx) error { return nil }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the path of the database file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// SetClock makes the store read the time from c, which stamps the records and ages the running domains.
+func (s *Store) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// view runs fn in a read-only transaction.
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: LockTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening state database %s: %w", s.path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: LockTimeout})
+	if err != nil {
+		return fmt.Errorf("opening state database %s: %w", s.path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// getRecord decodes the record of the given domain from bucket b, it returns nil if there is none.
+func getRecord(b *bolt.Bucket, domain string) (*Record, error) {
+	if b == nil {
+		return nil, nil
+	}
+	data := b.Get([]byte(domain))
+	if data == nil {
+		return nil, nil
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("decoding state of %s: %w", domain, err)
+	}
+	return &r, nil
+}
+
+// putRecord encodes r into bucket b.
+func putRecord(b *bolt.Bucket, r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(r.Domain), data)
+}
+
+// modify applies fn to the record of the given domain, which starts out empty if the domain has no state yet, and
+// stores the result.
+func (s *Store) modify(tool string, domain string, fn func(r *Record) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(tool))
+		if err != nil {
+			return err
+		}
+		r, err := getRecord(b, domain)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			r = &Record{Domain: domain}
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+		r.Updated = s.clock.Now()
+		return putRecord(b, r)
+	})
+}
+
+// ErrSkip is returned by Claim for domains that should not be processed by the caller.
+var ErrSkip = errors.New("domain is done or being processed elsewhere")
+
+// ErrPartial is wrapped by the errors passed to Finish for domains that were only processed in part.
+var ErrPartial = errors.New("domain processed in part")
+
+// Claim marks the domain as running for the given tool. It returns ErrSkip if the domain is already done, or if
+// another process started it less than staleAfter ago; older running domains are assumed to be left over from a
+// stopped run and are claimed again.
+func (s *Store) Claim(tool string, domain string, staleAfter time.Duration) error {
+	return s.modify(tool, domain, claim(s.clock, staleAfter))
+}
+
+// Finish marks the domain as done, as partial if err wraps ErrPartial, or as failed if err is another error, and
+// records the paths of the artifacts written.
+func (s *Store) Finish(tool string, domain string, err error, artifacts map[string]string) error {
+	return s.modify(tool, domain, finish(err, artifacts))
+}
+
+// Skip marks the domain as skipped for the given reason, unless it is already done.
+func (s *Store) Skip(tool string, domain string, reason string) error {
+	err := s.modify(tool, domain, skip(reason))
+	if errors.Is(err, ErrSkip) {
+		return nil
+	}
+	return err
+}
+
+// claim returns the change of a record claimed by Claim.
+func claim(c clock.Clock, staleAfter time.Duration) func(r *Record) error {
+	return func(r *Record) error {
+		if r.Status == StatusDone || (r.Status == StatusRunning && clock.Since(c, r.Updated) < staleAfter) {
+			return ErrSkip
+		}
+		r.Status = StatusRunning
+		r.Attempts++
+		r.Started = c.Now()
+		return nil
+	}
+}
+
+// finish returns the change of a record finished by Finish.
+func finish(err error, artifacts map[string]string) func(r *Record) error {
+	return func(r *Record) error {
+		r.Status, r.LastError = StatusDone, ""
+		if errors.Is(err, ErrPartial) {
+			r.Status, r.LastError = StatusPartial, err.Error()
+		} else if err != nil {
+			r.Status, r.LastError = StatusFailed, err.Error()
+		}
+		if len(artifacts) > 0 && r.Artifacts == nil {
+			r.Artifacts = map[string]string{}
+		}
+		for kind, path := range artifacts {
+			r.Artifacts[kind] = path
+		}
+		return nil
+	}
+}
+
+// skip returns the change of a record skipped by Skip.
+func skip(reason string) func(r *Record) error {
+	return func(r *Record) error {
+		if r.Status == StatusDone {
+			return ErrSkip
+		}
+		r.Status, r.LastError = StatusSkipped, reason
+		return nil
+	}
+}
+
+// Get returns the record of the given domain, or nil if it has no state.
+func (s *Store) Get(tool string, domain string) (*Record, error) {
+	var r *Record
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		r, err = getRecord(tx.Bucket([]byte(tool)), domain)
+		return err
+	})
+	return r, err
+}
+
+// Tools returns the names of the tools that have stored state.
+func (s *Store) Tools() ([]string, error) {
+	var tools []string
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			tools = append(tools, string(name))
+			return nil
+		})
+	})
+	return tools, err
+}
+
+// List returns the records of all domains of the given tool, ordered by domain.
+func (s *Store) List(tool string) ([]Record, error) {
+	var records []Record
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tool))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			r, err := getRecord(b, string(k))
+			if err != nil {
+				return err
+			}
+			records = append(records, *r)
+			return nil
+		})
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].Domain < records[j].Domain })
+	return records, err
+}
+
+// Reset removes the state of the given domains of a tool, or of all its domains if none are given.
+func (s *Store) Reset(tool string, domains ...string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if len(domains) == 0 {
+			if err := tx.DeleteBucket([]byte(tool)); err != nil && !errors.Is(err, berrors.ErrBucketNotFound) {
+				return err
+			}
+			return nil
+		}
+		b := tx.Bucket([]byte(tool))
+		if b == nil {
+			return nil
+		}
+		for _, domain := range domains {
+			if err := b.Delete([]byte(domain)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+)
+
+const (
+	testTool   = "tool"
+	testDomain = "example.com"
+	staleAfter = time.Hour
+)
+
+// storageKinds are the kinds of storage every test runs against, see newStorage.
+var storageKinds = []string{"store", "memory"}
+
+// newStorage returns an empty Store or Memory reading the time from a fake clock.
+func newStorage(t *testing.T, kind string) (Storage, *clock.Fake) {
+	c := clock.NewFake(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	if kind == "memory" {
+		return NewMemory(c), c
+	}
+	store, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	store.SetClock(c)
+	return store, c
+}
+
+func TestTransitions(t *testing.T) {
+	// step is a change of the domain's state, after the clock advanced by wait.
+	type step struct {
+		wait    time.Duration
+		claim   bool
+		finish  error // finish is the error the domain is finished with, if the step neither claims nor skips it.
+		skip    string
+		wantErr error
+		kept    bool // kept is set if the state refuses the step, e.g. claiming a domain that is done, and keeps the record.
+	}
+	tests := []struct {
+		name         string
+		steps        []step
+		wantStatus   string
+		wantAttempts int
+		wantError    string
+	}{
+		{name: "done", steps: []step{{claim: true}, {}}, wantStatus: StatusDone, wantAttempts: 1},
+		{name: "failed", steps: []step{{claim: true}, {finish: errors.New("timeout")}}, wantStatus: StatusFailed, wantAttempts: 1, wantError: "timeout"},
+		{name: "partial", steps: []step{{claim: true}, {finish: fmt.Errorf("budget spent: %w", ErrPartial)}}, wantStatus: StatusPartial, wantAttempts: 1, wantError: "budget spent: domain processed in part"},
+		{name: "partial claimed again", steps: []step{{claim: true}, {finish: ErrPartial}, {claim: true}, {}}, wantStatus: StatusDone, wantAttempts: 2},
+		{name: "failed claimed again", steps: []step{{claim: true}, {finish: errors.New("dns")}, {claim: true}}, wantStatus: StatusRunning, wantAttempts: 2, wantError: "dns"},
+		{name: "done not claimed again", steps: []step{{claim: true}, {}, {claim: true, wantErr: ErrSkip, kept: true}}, wantStatus: StatusDone, wantAttempts: 1},
+		{name: "running not claimed again", steps: []step{{claim: true}, {wait: time.Minute, claim: true, wantErr: ErrSkip, kept: true}}, wantStatus: StatusRunning, wantAttempts: 1},
+		{name: "stale running claimed again", steps: []step{{claim: true}, {wait: 2 * staleAfter, claim: true}}, wantStatus: StatusRunning, wantAttempts: 2},
+		{name: "skipped", steps: []step{{skip: "budget"}}, wantStatus: StatusSkipped, wantError: "budget"},
+		{name: "done not skipped", steps: []step{{claim: true}, {}, {skip: "budget", kept: true}}, wantStatus: StatusDone, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		for _, kind := range storageKinds {
+			t.Run(tt.name+"/"+kind, func(t *testing.T) {
+				storage, c := newStorage(t, kind)
+				var updated time.Time
+				for i, s := range tt.steps {
+					c.Advance(s.wait)
+					var err error
+					switch {
+					case s.claim:
+						err = storage.Claim(testTool, testDomain, staleAfter)
+					case s.skip != "":
+						err = storage.Skip(testTool, testDomain, s.skip)
+					default:
+						err = storage.Finish(testTool, testDomain, s.finish, nil)
+					}
+					if !errors.Is(err, s.wantErr) {
+						t.Fatalf("step %d error = %v, want %v", i, err, s.wantErr)
+					}
+					if !s.kept {
+						updated = c.Now()
+					}
+				}
+
+				r, err := storage.Get(testTool, testDomain)
+				if err != nil || r == nil {
+					t.Fatalf("Get() = %v, %v", r, err)
+				}
+				if r.Status != tt.wantStatus || r.Attempts != tt.wantAttempts || r.LastError != tt.wantError {
+					t.Errorf("record = %s after %d attempts with error %q, want %s after %d with %q", r.Status, r.Attempts, r.LastError, tt.wantStatus, tt.wantAttempts, tt.wantError)
+				}
+				if !r.Updated.Equal(updated) {
+					t.Errorf("Updated = %v, want %v", r.Updated, updated)
+				}
+			})
+		}
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	for _, kind := range storageKinds {
+		t.Run(kind, func(t *testing.T) {
+			storage, _ := newStorage(t, kind)
+			storage.Finish(testTool, testDomain, ErrPartial, map[string]string{"cookies": "a.csv"})
+			storage.Finish(testTool, testDomain, nil, map[string]string{"screenshots": "b"})
+
+			r, err := storage.Get(testTool, testDomain)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			want := map[string]string{"cookies": "a.csv", "screenshots": "b"}
+			if !reflect.DeepEqual(r.Artifacts, want) {
+				t.Errorf("Artifacts = %v, want %v", r.Artifacts, want)
+			}
+
+			if err := storage.Reset(testTool, testDomain); err != nil {
+				t.Fatalf("Reset() error = %v", err)
+			}
+			if r, err := storage.Get(testTool, testDomain); r != nil || err != nil {
+				t.Errorf("Get() after Reset = %v, %v, want nil", r, err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, kind := range storageKinds {
+		t.Run(kind, func(t *testing.T) {
+			storage, _ := newStorage(t, kind)
+			for _, domain := range []string{"b.com", "a.com"} {
+				storage.Claim(testTool, domain, staleAfter)
+			}
+			storage.Skip("other", "c.com", "budget")
+
+			records, err := storage.List(testTool)
+			if err != nil || len(records) != 2 || records[0].Domain != "a.com" || records[1].Domain != "b.com" {
+				t.Errorf("List() = %v, %v, want a.com and b.com", records, err)
+			}
+			if tools, err := storage.Tools(); err != nil || !reflect.DeepEqual(tools, []string{"other", testTool}) {
+				t.Errorf("Tools() = %v, %v, want %v", tools, err, []string{"other", testTool})
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Package tcaudit audits a TC string on its own, without a page or a browser: Decode reports the purposes and vendors
+// it grants, how old it is, the policy version it was created under, and the patterns suggesting it was not created by
+// a user's choice in a conforming CMP, such as a string created the moment it is read or consenting to every vendor ID
+// up to the highest. Use package tcfaudit to audit how a page's CMP handles a TC string.
+package tcaudit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	MaxPurposeID         = 11 // MaxPurposeID is the highest purpose ID defined by the TCF v2.2 policies.
+	CurrentPolicyVersion = 4  // CurrentPolicyVersion is the TCF policy version of TCF v2.2, which CMPs have had to use since November 2023.
+
+	purposeBits        = 24 // purposeBits is the size of the purpose bit fields in the core string.
+	specialFeatureBits = 12 // specialFeatureBits is the size of the special feature bit field in the core string.
+
+	// StaleAge is the age of the last update after which the consent should have been asked again: the TCF policies
+	// let a CMP keep a user's choice for at most 13 months.
+	StaleAge = 390 * 24 * time.Hour
+
+	// FreshWindow is how close to the time of the audit a string created and last updated at the same moment has to be
+	// to have been made on the spot, e.g. by a script writing consent before the user saw a banner.
+	FreshWindow = time.Minute
+
+	// FullRangeMinVendors is the highest vendor ID from which consenting to every vendor ID up to the highest is
+	// suspicious: the GVL has gaps left by deleted vendors, which a CMP listing the GVL's vendors does not consent to.
+	FullRangeMinVendors = 100
+)
+
+// Suspicious patterns
+const (
+	PatternCreatedNow          = "created-now"           // Created and last updated at the same moment, within FreshWindow of the audit.
+	PatternFutureTimestamp     = "future-timestamp"      // Created or last updated more than FreshWindow after the time of the audit.
+	PatternUpdatedBeforeCreate = "updated-before-create" // Last updated before it was created.
+	PatternStale               = "stale"                 // Last updated more than StaleAge ago.
+	PatternOutdatedPolicy      = "outdated-policy"       // Created under a policy version older than CurrentPolicyVersion.
+	PatternFullRange           = "full-range"            // Consents to every vendor ID from 1 to at least FullRangeMinVendors.
+	PatternPurposeOneMisuse    = "purpose-one-misuse"    // Purpose one treatment where it is not allowed, or with purpose 1 consented.
+	PatternUnknownPurpose      = "unknown-purpose"       // Grants a purpose above MaxPurposeID.
+)
+
+// eeaCountries are the countries of the EEA and the UK, whose publishers may not use purpose one treatment, as their
+// laws require consent for storing information on a device.
+var eeaCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true, "EE": true, "ES": true,
+	"FI": true, "FR": true, "GB": true, "GR": true, "HR": true, "HU": true, "IE": true, "IS": true, "IT": true,
+	"LI": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true, "NO": true, "PL": true, "PT": true,
+	"RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// Pattern is a suspicious pattern found in a TC string.
+type Pattern struct {
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+// Audit is the analysis of a TC string.
+type Audit struct {
+	TCString            string        `json:"tcString"`
+	Version             int           `json:"version"`
+	CmpID               int           `json:"cmpId"`
+	CmpVersion          int           `json:"cmpVersion"`
+	ConsentScreen       int           `json:"consentScreen"`
+	ConsentLanguage     string        `json:"consentLanguage"`
+	VendorListVersion   int           `json:"vendorListVersion"`
+	PolicyVersion       int           `json:"policyVersion"`
+	IsServiceSpecific   bool          `json:"isServiceSpecific"`
+	PurposeOneTreatment bool          `json:"purposeOneTreatment"`
+	PublisherCC         string        `json:"publisherCC"`
+	Created             time.Time     `json:"created"`
+	LastUpdated         time.Time     `json:"lastUpdated"`
+	Audited             time.Time     `json:"audited"`
+	Age                 time.Duration `json:"age"` // Age is the time between the last update and the audit.
+
+	Purposes        []int  `json:"purposes"`        // Purposes are the purposes consented to, including those above MaxPurposeID.
+	PurposesLI      []int  `json:"purposesLI"`      // PurposesLI are the purposes whose legitimate interest is established.
+	SpecialFeatures []int  `json:"specialFeatures"` // SpecialFeatures are the special features opted in to.
+	Vendors         string `json:"vendors"`         // Vendors are the vendors consented to, as compact ranges, e.g. "1-50,52".
+	VendorsLI       string `json:"vendorsLI"`       // VendorsLI are the vendors whose legitimate interest is established, as compact ranges.
+	VendorCount     int    `json:"vendorCount"`
+	VendorLICount   int    `json:"vendorLICount"`
+	MaxVendorID     int    `json:"maxVendorId"`
+
+	Suspicious []Pattern `json:"suspicious"`
+}
+
+// Decode decodes the TC string and audits it at the current time.
+func Decode(tcString string) (*Audit, error) {
+	return DecodeAt(tcString, clock.System.Now())
+}
+
+// DecodeAt decodes the TC string and audits it as of now, against which its age and timestamps are judged.
+func DecodeAt(tcString string, now time.Time) (*Audit, error) {
+	decoded, err := iabtcfv2.Decode(tcString)
+	if err != nil {
+		return nil, err
+	}
+	if decoded == nil || decoded.CoreString == nil {
+		return nil, errors.New("TC string has no core string")
+	}
+
+	core := decoded.CoreString
+	a := &Audit{
+		TCString:            tcString,
+		Version:             core.Version,
+		CmpID:               core.CmpId,
+		CmpVersion:          core.CmpVersion,
+		ConsentScreen:       core.ConsentScreen,
+		ConsentLanguage:     core.ConsentLanguage,
+		VendorListVersion:   core.VendorListVersion,
+		PolicyVersion:       core.TcfPolicyVersion,
+		IsServiceSpecific:   core.IsServiceSpecific,
+		PurposeOneTreatment: core.PurposeOneTreatment,
+		PublisherCC:         core.PublisherCC,
+		Created:             core.Created,
+		LastUpdated:         core.LastUpdated,
+		Audited:             now,
+		Age:                 now.Sub(core.LastUpdated),
+		MaxVendorID:         core.MaxVendorId,
+		Purposes:            allowedIDs(purposeBits, decoded.IsPurposeAllowed),
+		PurposesLI:          allowedIDs(purposeBits, decoded.IsPurposeLIAllowed),
+		SpecialFeatures:     allowedIDs(specialFeatureBits, decoded.IsSpecialFeatureAllowed),
+		Suspicious:          []Pattern{},
+	}
+	vendors := allowedIDs(core.MaxVendorId, decoded.IsVendorAllowed)
+	vendorsLI := allowedIDs(core.MaxVendorIdLI, decoded.IsVendorLIAllowed)
+	a.Vendors, a.VendorCount = tcfaudit.CompactRanges(vendors), len(vendors)
+	a.VendorsLI, a.VendorLICount = tcfaudit.CompactRanges(vendorsLI), len(vendorsLI)
+
+	a.checkTimestamps()
+	a.checkPolicy()
+	if core.MaxVendorId >= FullRangeMinVendors && len(vendors) == core.MaxVendorId {
+		a.flag(PatternFullRange, fmt.Sprintf("consents to every vendor ID from 1 to %d", core.MaxVendorId))
+	}
+	return a, nil
+}
+
+// checkTimestamps flags strings made on the spot, timestamps that cannot be right and strings too old to be relied on.
+func (a *Audit) checkTimestamps() {
+	switch {
+	case a.Created.After(a.Audited.Add(FreshWindow)) || a.LastUpdated.After(a.Audited.Add(FreshWindow)):
+		a.flag(PatternFutureTimestamp, fmt.Sprintf("created %s, last updated %s", a.Created.UTC().Format(time.RFC3339), a.LastUpdated.UTC().Format(time.RFC3339)))
+	case a.Created.Equal(a.LastUpdated) && a.Age < FreshWindow:
+		a.flag(PatternCreatedNow, fmt.Sprintf("created and last updated %s before the audit", a.Age.Round(time.Second)))
+	}
+	if a.LastUpdated.Before(a.Created) {
+		a.flag(PatternUpdatedBeforeCreate, fmt.Sprintf("last updated %s before it was created", a.Created.Sub(a.LastUpdated).Round(time.Second)))
+	}
+	if a.Age > StaleAge {
+		a.flag(PatternStale, fmt.Sprintf("last updated %d days ago", int(a.Age.Hours()/24)))
+	}
+}
+
+// checkPolicy flags strings created under an outdated policy, purposes the policies do not define and purpose one
+// treatment where it is not allowed.
+func (a *Audit) checkPolicy() {
+	if a.PolicyVersion < CurrentPolicyVersion {
+		a.flag(PatternOutdatedPolicy, fmt.Sprintf("policy version %d", a.PolicyVersion))
+	}
+	for _, id := range append(append([]int{}, a.Purposes...), a.PurposesLI...) {
+		if id > MaxPurposeID {
+			a.flag(PatternUnknownPurpose, fmt.Sprintf("purpose %d", id))
+			break
+		}
+	}
+	if !a.PurposeOneTreatment {
+		return
+	}
+	switch {
+	case len(a.Purposes) > 0 && a.Purposes[0] == 1:
+		a.flag(PatternPurposeOneMisuse, "purpose 1 consented although it was not disclosed")
+	case eeaCountries[a.PublisherCC]:
+		a.flag(PatternPurposeOneMisuse, "publisher country "+a.PublisherCC+" requires consent for purpose 1")
+	}
+}
+
+// flag records a suspicious pattern.
+func (a *Audit) flag(name string, detail string) {
+	a.Suspicious = append(a.Suspicious, Pattern{Name: name, Detail: detail})
+}
+
+// Flagged reports whether the audit found the pattern.
+func (a *Audit) Flagged(name string) bool {
+	for _, p := range a.Suspicious {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIDs returns the IDs 1 to max allowed by the predicate.
+func allowedIDs(max int, allowed func(int) bool) []int {
+	ids := []int{}
+	for id := 1; id <= max; id++ {
+		if allowed(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
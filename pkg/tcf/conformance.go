@@ -0,0 +1,289 @@
+package tcf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+// Names of the conformance checks of a page's __tcfapi, see CheckConformance
+const (
+	CheckStubQueue           = "stub-queue"            // The stub queues the calls made before the CMP loads, which the CMP answers once loaded.
+	CheckPingFields          = "ping-fields"           // ping returns the mandatory fields with valid values.
+	CheckAddEventListener    = "add-event-listener"    // addEventListener calls back successfully with a listenerId.
+	CheckRemoveEventListener = "remove-event-listener" // removeEventListener removes that listener successfully.
+	CheckInvalidVersion      = "invalid-version"       // getTCData calls back unsuccessfully for a version other than 2.
+)
+
+// Results of the conformance checks
+const (
+	CheckPass    = "pass"
+	CheckFail    = "fail"
+	CheckSkipped = "skipped" // The check could not be run on the page, e.g. the stub queue if the CMP was loaded before any stub.
+)
+
+const (
+	// StubMonitorJS is run in the top frame of every new document before the page's own scripts. It catches the first
+	// function the page assigns to window.__tcfapi, which is the stub if the CMP uses one, and calls ping and getTCData
+	// on it right away, to tell whether the stub answered ping itself and whether getTCData was queued and answered once
+	// the CMP loaded. CMPs that declare __tcfapi as a global function rather than assign it are not caught.
+	StubMonitorJS = `
+			(function () {
+				if (window !== window.top || window.__vendorComplianceStub) {
+					return;
+				}
+				const stub = {seen: false, pingAnswered: false, pingSync: false, loadedWhenSeen: false, queued: false, error: ''};
+				window.__vendorComplianceStub = stub;
+
+				const probe = () => {
+					let sync = true;
+					try {
+						window.__tcfapi('ping', 2, (pingReturn) => {
+							if (!stub.pingAnswered) {
+								stub.pingAnswered = true;
+								stub.pingSync = sync;
+								stub.loadedWhenSeen = !!(pingReturn && pingReturn.cmpLoaded);
+							}
+						});
+						window.__tcfapi('getTCData', 2, () => {
+							stub.queued = true;
+						});
+					} catch (e) {
+						stub.error = String(e);
+					}
+					sync = false;
+				};
+
+				let current = window.__tcfapi;
+				try {
+					Object.defineProperty(window, '__tcfapi', {
+						configurable: true,
+						enumerable: true,
+						get: () => current,
+						set: (value) => {
+							current = value;
+							if (!stub.seen && typeof value === 'function' && !value.viaLocator) {
+								stub.seen = true;
+								setTimeout(probe, 0);
+							}
+						},
+					});
+				} catch (e) {
+				}
+			})()
+		`
+
+	// JavaScript resolving to the answers of the page's __tcfapi to the conformance probes, or null if there is no
+	// __tcfapi. Each call resolves unanswered after a second.
+	conformanceJS = `
+			(async () => {
+				if (typeof window.__tcfapi !== 'function') {
+					return null;
+				}
+				const call = (command, version, parameter) => new Promise((resolve) => {
+					const timer = setTimeout(() => resolve({answered: false}), 1000);
+					try {
+						window.__tcfapi(command, version, (returnValue, success) => {
+							clearTimeout(timer);
+							resolve({answered: true, returnValue: returnValue, success: success === true});
+						}, parameter);
+					} catch (e) {
+						clearTimeout(timer);
+						resolve({answered: false, error: String(e)});
+					}
+				});
+
+				const result = {stub: window.__vendorComplianceStub || null};
+				const ping = await call('ping', 2);
+				result.ping = ping.answered && ping.returnValue && typeof ping.returnValue === 'object' ? ping.returnValue : null;
+				result.pingError = ping.error || '';
+
+				const listener = await call('addEventListener', 2);
+				const tcData = listener.returnValue && typeof listener.returnValue === 'object' ? listener.returnValue : {};
+				result.listener = {answered: listener.answered, success: listener.success, error: listener.error || ''};
+				if (typeof tcData.listenerId === 'number') {
+					result.listener.listenerId = tcData.listenerId;
+					const removed = await call('removeEventListener', 2, tcData.listenerId);
+					result.removed = {answered: removed.answered, success: removed.returnValue === true || removed.success, error: removed.error || ''};
+				}
+
+				const invalid = await call('getTCData', 1);
+				result.invalidVersion = {answered: invalid.answered, success: invalid.success, error: invalid.error || ''};
+				return result;
+			})()
+		`
+)
+
+// Values of the ping fields with a fixed set of values
+var (
+	cmpStatuses     = []string{"stub", "loading", "loaded", "error"}
+	displayStatuses = []string{"visible", "hidden", "disabled"}
+)
+
+// ConformanceCheck is the result of a conformance check of a page's __tcfapi.
+type ConformanceCheck struct {
+	Name   string
+	Result string
+	Detail string // Detail tells why the check failed or was skipped.
+}
+
+// callAnswer is a __tcfapi call's answer to a conformance probe.
+type callAnswer struct {
+	Answered bool   `json:"answered"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error"`
+}
+
+// listenerAnswer is the answer to addEventListener, with the ID of the listener registered.
+type listenerAnswer struct {
+	callAnswer
+	ListenerID *float64 `json:"listenerId"`
+}
+
+// conformanceProbe holds the answers of the page's __tcfapi to the conformance probes.
+type conformanceProbe struct {
+	Stub *struct {
+		Seen           bool   `json:"seen"`
+		PingAnswered   bool   `json:"pingAnswered"`
+		PingSync       bool   `json:"pingSync"`
+		LoadedWhenSeen bool   `json:"loadedWhenSeen"`
+		Queued         bool   `json:"queued"`
+		Error          string `json:"error"`
+	} `json:"stub"`
+	Ping           map[string]interface{} `json:"ping"` // Ping is kept raw, to check the types of its fields.
+	PingError      string                 `json:"pingError"`
+	Listener       *listenerAnswer        `json:"listener"`
+	Removed        *callAnswer            `json:"removed"`
+	InvalidVersion *callAnswer            `json:"invalidVersion"`
+}
+
+// CheckConformance checks the page's __tcfapi implementation against the TCF specification and returns the checklist,
+// which is empty if the page has no __tcfapi. The stub queue can only be checked on pages loaded after StubMonitorJS
+// was registered.
+func CheckConformance(s browser.Session) ([]ConformanceCheck, error) {
+	var probe *conformanceProbe
+	if err := s.Evaluate(conformanceJS, &probe); err != nil || probe == nil {
+		return nil, err
+	}
+	loaded := false
+	if cmpLoaded, ok := probe.Ping["cmpLoaded"].(bool); ok {
+		loaded = cmpLoaded
+	}
+
+	var checks []ConformanceCheck
+	check := func(name string, result string, detail string) {
+		checks = append(checks, ConformanceCheck{Name: name, Result: result, Detail: detail})
+	}
+
+	// The stub queue is only observable if the first __tcfapi was a stub, i.e. did not report the CMP loaded when called
+	stub := probe.Stub
+	switch {
+	case stub == nil || !stub.Seen:
+		check(CheckStubQueue, CheckSkipped, "no __tcfapi assignment observed")
+	case stub.Error != "":
+		check(CheckStubQueue, CheckFail, "stub threw: "+stub.Error)
+	case stub.PingAnswered && stub.PingSync && stub.LoadedWhenSeen:
+		check(CheckStubQueue, CheckSkipped, "CMP loaded without a stub")
+	case stub.Queued:
+		check(CheckStubQueue, CheckPass, "")
+	case !loaded:
+		check(CheckStubQueue, CheckSkipped, "CMP did not load")
+	default:
+		check(CheckStubQueue, CheckFail, "getTCData called on the stub was not answered once the CMP loaded")
+	}
+
+	if probe.Ping == nil {
+		detail := "ping not answered"
+		if probe.PingError != "" {
+			detail = "ping threw: " + probe.PingError
+		}
+		check(CheckPingFields, CheckFail, detail)
+	} else if invalid := invalidPingFields(probe.Ping, loaded); len(invalid) > 0 {
+		check(CheckPingFields, CheckFail, strings.Join(invalid, "; "))
+	} else {
+		check(CheckPingFields, CheckPass, "")
+	}
+
+	listener := probe.Listener
+	switch {
+	case listener == nil:
+		check(CheckAddEventListener, CheckFail, unanswered(nil))
+	case !listener.Answered:
+		check(CheckAddEventListener, CheckFail, unanswered(&listener.callAnswer))
+	case !listener.Success:
+		check(CheckAddEventListener, CheckFail, "called back unsuccessfully")
+	case listener.ListenerID == nil:
+		check(CheckAddEventListener, CheckFail, "no listenerId")
+	default:
+		check(CheckAddEventListener, CheckPass, "")
+	}
+
+	switch removed := probe.Removed; {
+	case removed == nil:
+		check(CheckRemoveEventListener, CheckSkipped, "no listener to remove")
+	case !removed.Answered:
+		check(CheckRemoveEventListener, CheckFail, unanswered(removed))
+	case !removed.Success:
+		check(CheckRemoveEventListener, CheckFail, "called back unsuccessfully")
+	default:
+		check(CheckRemoveEventListener, CheckPass, "")
+	}
+
+	switch invalid := probe.InvalidVersion; {
+	case invalid == nil || !invalid.Answered:
+		check(CheckInvalidVersion, CheckFail, unanswered(invalid))
+	case invalid.Success:
+		check(CheckInvalidVersion, CheckFail, "version 1 accepted")
+	default:
+		check(CheckInvalidVersion, CheckPass, "")
+	}
+	return checks, nil
+}
+
+// unanswered describes a call that was not answered.
+func unanswered(a *callAnswer) string {
+	if a != nil && a.Error != "" {
+		return "threw: " + a.Error
+	}
+	return "not answered"
+}
+
+// invalidPingFields returns the mandatory fields of the ping response that are missing or invalid. cmpVersion, cmpId,
+// gvlVersion and tcfPolicyVersion are only mandatory once the CMP is loaded, and gdprApplies may be undefined until the
+// CMP has determined it.
+func invalidPingFields(ping map[string]interface{}, loaded bool) []string {
+	var invalid []string
+	if value, found := ping["gdprApplies"]; found && value != nil {
+		if _, ok := value.(bool); !ok {
+			invalid = append(invalid, fmt.Sprintf("gdprApplies %v is not a boolean", value))
+		}
+	}
+	if _, ok := ping["cmpLoaded"].(bool); !ok {
+		invalid = append(invalid, "cmpLoaded missing")
+	}
+	invalid = append(invalid, invalidEnum(ping, "cmpStatus", cmpStatuses)...)
+	invalid = append(invalid, invalidEnum(ping, "displayStatus", displayStatuses)...)
+	if version, ok := ping["apiVersion"].(string); !ok || !strings.HasPrefix(version, "2") {
+		invalid = append(invalid, fmt.Sprintf("apiVersion %v is not 2.x", ping["apiVersion"]))
+	}
+	if loaded {
+		for _, field := range []string{"cmpVersion", "cmpId", "gvlVersion", "tcfPolicyVersion"} {
+			if _, ok := ping[field].(float64); !ok {
+				invalid = append(invalid, field+" missing")
+			}
+		}
+	}
+	return invalid
+}
+
+// invalidEnum returns the string field if it is missing or not one of the values.
+func invalidEnum(ping map[string]interface{}, field string, values []string) []string {
+	value, _ := ping[field].(string)
+	for _, v := range values {
+		if value == v {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s %v is not one of %s", field, ping[field], strings.Join(values, ", "))}
+}
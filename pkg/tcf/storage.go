@@ -0,0 +1,203 @@
+package tcf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+// StorageItem is a cookie or local storage item a CMP keeps the consent of returning users in.
+type StorageItem struct {
+	Name   string
+	Cookie bool // Cookie is set for cookies, the item is stored in local storage otherwise.
+
+	// Value formats the TC string the way the CMP stores it in the item. The TC string is stored as is if it is nil.
+	Value func(tcString string, now time.Time) string
+}
+
+// Storage is where a CMP looks for the consent of returning users.
+type Storage struct {
+	Name  string
+	Items []StorageItem
+}
+
+// DefaultStorage holds the euconsent-v2 cookie and local storage item, which most CMPs read the TC string from. The
+// eupubconsent-v2 items hold the publisher TC segment alone, not a core TC string, so they are left alone.
+var DefaultStorage = Storage{
+	Name: "default",
+	Items: []StorageItem{
+		{Name: "euconsent-v2", Cookie: true},
+		{Name: "euconsent-v2"},
+	},
+}
+
+// Storages holds the storage of the CMPs, by CMP ID, that also need consent in their own format before they take the
+// TC string as the consent of a returning user, rather than showing their banner again or overwriting it. The items
+// are stored in addition to those of DefaultStorage. Add a CMP here when its injected TC string does not take effect.
+var Storages = map[int]Storage{
+	// Didomi keeps the consent in its own token, a base64 encoded JSON object listing the purposes and vendors enabled.
+	// Browsers drop the cookie if the token exceeds 4 KB, as with all vendors consented, leaving the local storage item
+	7: {Name: "didomi", Items: []StorageItem{
+		{Name: "didomi_token", Cookie: true, Value: didomiToken},
+		{Name: "didomi_token", Value: didomiToken},
+	}},
+
+	// OneTrust reads the TC string from euconsent-v2 and only hides its banner once OptanonAlertBoxClosed holds the time
+	// it was closed
+	28: {Name: "onetrust", Items: []StorageItem{
+		{Name: "OptanonAlertBoxClosed", Cookie: true, Value: func(_ string, now time.Time) string {
+			return now.UTC().Format("2006-01-02T15:04:05.000Z")
+		}},
+	}},
+
+	// Cookiebot keeps the consent in the CookieConsent cookie, a URL encoded JavaScript object with the categories
+	// consented to and the TC string
+	134: {Name: "cookiebot", Items: []StorageItem{
+		{Name: "CookieConsent", Cookie: true, Value: cookiebotConsent},
+	}},
+}
+
+// Didomi's IDs of the TCF purposes
+var didomiPurposes = map[int]string{
+	1:  "cookies",
+	2:  "select_basic_ads",
+	3:  "create_ads_profile",
+	4:  "select_personalized_ads",
+	5:  "create_content_profile",
+	6:  "select_personalized_content",
+	7:  "measure_ad_performance",
+	8:  "measure_content_performance",
+	9:  "market_research",
+	10: "improve_products",
+	11: "use_limited_data_to_select_content",
+}
+
+// StorageFor returns the storage of the CMP with the given ID, DefaultStorage for CMPs without an entry in Storages.
+func StorageFor(cmpID int) Storage {
+	storage, found := Storages[cmpID]
+	if !found {
+		return DefaultStorage
+	}
+	storage.Items = append(append([]StorageItem(nil), DefaultStorage.Items...), storage.Items...)
+	return storage
+}
+
+// StoreConsent stores the TC string in the items of the storage of the CMP with the given ID on the current page,
+// where the CMP looks for the consent of returning users, and returns the name of the storage.
+func StoreConsent(s browser.Session, cmpID int, tcString string) (string, error) {
+	return Store(s, StorageFor(cmpID), tcString)
+}
+
+// Store stores the consent string in the items of the storage on the current page, and returns the name of the storage.
+func Store(s browser.Session, storage Storage, tcString string) (string, error) {
+	now := time.Now()
+
+	var js strings.Builder
+	js.WriteString("(() => {")
+	for _, item := range storage.Items {
+		value := tcString
+		if item.Value != nil {
+			value = item.Value(tcString, now)
+		}
+		// The name and value are written as JSON, which are valid JavaScript string literals
+		name, _ := json.Marshal(item.Name)
+		quoted, _ := json.Marshal(value)
+		if item.Cookie {
+			fmt.Fprintf(&js, "document.cookie = %s + '=' + %s + '; path=/; max-age=31536000';", name, quoted)
+		} else {
+			fmt.Fprintf(&js, "localStorage.setItem(%s, %s);", name, quoted)
+		}
+	}
+	js.WriteString("})()")
+	return storage.Name, s.Evaluate(js.String(), nil)
+}
+
+// consentedIDs returns the purposes and vendors consented to in the TC string, which are empty if it cannot be decoded.
+// The vendors are read through IsVendorAllowed, as the consent of range encoded strings is not in VendorsConsent.
+func consentedIDs(tcString string) (purposes map[int]bool, vendors map[int]bool) {
+	tcData, err := iabtcfv2.Decode(tcString)
+	if err != nil || tcData == nil || tcData.CoreString == nil {
+		return nil, nil
+	}
+	purposes, vendors = map[int]bool{}, map[int]bool{}
+	for id := 1; id <= maxPurposeID; id++ {
+		if tcData.IsPurposeAllowed(id) {
+			purposes[id] = true
+		}
+	}
+	for id := 1; id <= tcData.CoreString.MaxVendorId; id++ {
+		if tcData.IsVendorAllowed(id) {
+			vendors[id] = true
+		}
+	}
+	return purposes, vendors
+}
+
+// maxPurposeID is the size of the purpose consent bit field in the core string.
+const maxPurposeID = 24
+
+// didomiToken formats the TC string's consent as Didomi's token, listing the purposes by their Didomi ID and the IAB
+// vendors by their ID.
+func didomiToken(tcString string, now time.Time) string {
+	purposes, vendors := consentedIDs(tcString)
+	type enabled struct {
+		Enabled  []string `json:"enabled"`
+		Disabled []string `json:"disabled"`
+	}
+	token := struct {
+		UserID   string  `json:"user_id"`
+		Created  string  `json:"created"`
+		Updated  string  `json:"updated"`
+		Vendors  enabled `json:"vendors"`
+		Purposes enabled `json:"purposes"`
+		Version  int     `json:"version"`
+	}{
+		UserID:   fmt.Sprintf("%x", now.UnixNano()),
+		Created:  now.UTC().Format(time.RFC3339),
+		Updated:  now.UTC().Format(time.RFC3339),
+		Vendors:  enabled{Enabled: []string{}, Disabled: []string{}},
+		Purposes: enabled{Enabled: []string{}, Disabled: []string{}},
+		Version:  2,
+	}
+	for id := 1; id <= len(didomiPurposes); id++ {
+		if purposes[id] {
+			token.Purposes.Enabled = append(token.Purposes.Enabled, didomiPurposes[id])
+		} else {
+			token.Purposes.Disabled = append(token.Purposes.Disabled, didomiPurposes[id])
+		}
+	}
+	var ids []int
+	for id, consented := range vendors {
+		if consented {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		token.Vendors.Enabled = append(token.Vendors.Enabled, fmt.Sprint(id))
+	}
+
+	encoded, _ := json.Marshal(token)
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
+// cookiebotConsent formats the TC string's consent as Cookiebot's CookieConsent cookie. The preferences, statistics
+// and marketing categories are consented to if any purpose is.
+func cookiebotConsent(tcString string, now time.Time) string {
+	purposes, _ := consentedIDs(tcString)
+	consented := false
+	for _, granted := range purposes {
+		consented = consented || granted
+	}
+
+	value := fmt.Sprintf("{stamp:'%x',necessary:true,preferences:%t,statistics:%t,marketing:%t,method:'explicit',ver:1,utc:%d,iab2:'%s',region:'eu'}",
+		now.UnixNano(), consented, consented, consented, now.UnixMilli(), tcString)
+	return strings.NewReplacer("'", "%27", ",", "%2C").Replace(value)
+}
@@ -0,0 +1,119 @@
+package tcf
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+func TestStore(t *testing.T) {
+	storage := Storage{Name: "test", Items: []StorageItem{
+		{Name: "consent", Cookie: true},
+		{Name: "consent"},
+		{Name: "closed", Cookie: true, Value: func(string, time.Time) string { return "yes" }},
+	}}
+	fake := &browser.Fake{}
+	name, err := Store(fake, storage, "TC'STRING")
+	if err != nil || name != "test" {
+		t.Fatalf("Store() = %q, %v, want %q", name, err, "test")
+	}
+
+	evaluated := fake.Evaluated()
+	if len(evaluated) != 1 {
+		t.Fatalf("Store() evaluated %d expressions, want 1", len(evaluated))
+	}
+	for _, want := range []string{
+		`document.cookie = "consent" + '=' + "TC'STRING" + '; path=/; max-age=31536000';`,
+		`localStorage.setItem("consent", "TC'STRING");`,
+		`document.cookie = "closed" + '=' + "yes"`,
+	} {
+		if !strings.Contains(evaluated[0], want) {
+			t.Errorf("Store() evaluated %s, want it to contain %s", evaluated[0], want)
+		}
+	}
+}
+
+func TestStorageFor(t *testing.T) {
+	tests := []struct {
+		cmpID int
+		name  string
+		extra []string // extra are the names of the items stored in addition to those of DefaultStorage.
+	}{
+		{cmpID: 0, name: "default"},
+		{cmpID: 7, name: "didomi", extra: []string{"didomi_token", "didomi_token"}},
+		{cmpID: 28, name: "onetrust", extra: []string{"OptanonAlertBoxClosed"}},
+		{cmpID: 134, name: "cookiebot", extra: []string{"CookieConsent"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := StorageFor(tt.cmpID)
+			if storage.Name != tt.name {
+				t.Errorf("StorageFor(%d) = %q, want %q", tt.cmpID, storage.Name, tt.name)
+			}
+			var names []string
+			for _, item := range storage.Items {
+				names = append(names, item.Name)
+			}
+			var want []string
+			for _, item := range DefaultStorage.Items {
+				want = append(want, item.Name)
+			}
+			want = append(want, tt.extra...)
+			if strings.Join(names, ",") != strings.Join(want, ",") {
+				t.Errorf("StorageFor(%d) items = %v, want %v", tt.cmpID, names, want)
+			}
+		})
+	}
+}
+
+func TestGetPing(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer interface{}
+		err    error
+		want   Ping
+	}{
+		{name: "answered", answer: map[string]interface{}{"cmpId": 28, "cmpVersion": 5, "gvlVersion": 200, "cmpLoaded": true}, want: Ping{CmpID: 28, CmpVersion: 5, GvlVersion: 200, CmpLoaded: true}},
+		{name: "no CMP", answer: nil},
+		{name: "failed", err: errors.New("page navigated")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &browser.Fake{Eval: func(string, string) (interface{}, error) { return tt.answer, tt.err }}
+			ping, err := GetPing(fake)
+			if !errors.Is(err, tt.err) || ping != tt.want {
+				t.Errorf("GetPing() = %+v, %v, want %+v, %v", ping, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestWaitForAPI(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  interface{}
+		err     error
+		want    time.Duration
+		wantErr error
+	}{
+		{name: "ready", answer: map[string]interface{}{"ready": true, "ms": 250}, want: 250 * time.Millisecond},
+		{name: "not ready", answer: map[string]interface{}{"ready": false}, wantErr: ErrAPITimeout},
+		{name: "probe failing", err: errors.New("page navigated"), wantErr: ErrAPITimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &browser.Fake{Eval: func(string, string) (interface{}, error) { return tt.answer, tt.err }}
+			latency, err := WaitForAPI(fake, 50*time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WaitForAPI() error = %v, want %v", err, tt.wantErr)
+			}
+			// The latency includes the time until the probe ran, which is not 0 but small
+			if err == nil && (latency < tt.want || latency > tt.want+time.Second) {
+				t.Errorf("WaitForAPI() = %v, want about %v", latency, tt.want)
+			}
+		})
+	}
+}
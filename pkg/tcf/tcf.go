@@ -0,0 +1,301 @@
+// Package tcf queries the IAB TCF v2 API of a page and injects consent strings into it through a browser.Session,
+// so the chromedp and selenium based tools share a single implementation of the probes.
+package tcf
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+// Modes in which the TCF API can be present on a page, see DetectMode
+const (
+	ModeNone    = "none"    // No __tcfapi function and no __tcfapiLocator frame.
+	ModeStub    = "stub"    // Only the stub is loaded: ping is not answered or reports cmpLoaded false.
+	ModeLocator = "locator" // No __tcfapi function of the page's own, but a __tcfapiLocator frame through which a cross-frame CMP is reached.
+	ModeFull    = "full"    // The CMP is loaded and answers ping with cmpLoaded true.
+)
+
+const (
+	// JavaScript resolving to the CMP's ping response, or null if it does not answer within a second. The callback
+	// is awaited, as it is only called asynchronously by CMPs reached through a __tcfapiLocator frame.
+	pingJS = `
+			new Promise((resolve) => {
+				setTimeout(() => resolve(null), 1000);
+				window.__tcfapi('ping', 2, (pingReturn) => resolve(pingReturn));
+			})
+		`
+
+	// JavaScript resolving to the TC string and event status returned by getTCData, waiting for the CMP to load if needed
+	tcDataJS = `
+			new Promise((resolve) => {
+				if (typeof window.__tcfapi === 'function') {
+					callGetTCData();
+				} else {
+					window.addEventListener('cmpLoaded', callGetTCData);
+				}
+
+				function callGetTCData() {
+					window.__tcfapi('getTCData', 2, (tcData, success) => {
+						if (success) {
+							resolve({tcString: tcData.tcString, eventStatus: tcData.eventStatus});
+						} else {
+							resolve(null);
+						}
+					});
+				}
+			})
+		`
+
+	// JavaScript, formatted with the timeout in milliseconds and locatorProxyJS, resolving once the TCF API reports a
+	// CMP ID in its ping response or once the timeout has passed, with whether it did and the milliseconds it took.
+	// Rather than polling, the API is checked whenever the document changes, a resource such as a script finishes
+	// loading, or a message is received, e.g. from a __tcfapiLocator frame, in which case the postMessage based client is
+	// installed first. A ping the stub queues is answered as soon as the CMP loads. A check every second catches APIs
+	// defined from timers.
+	waitForAPIJS = `
+			new Promise((resolve) => {
+				const started = performance.now();
+				let done = false;
+				let pinging = false;
+				const observer = new MutationObserver(() => check());
+				const fallback = setInterval(() => check(), 1000);
+				const timer = setTimeout(() => finish(false), %d);
+
+				function finish(ready) {
+					if (done) {
+						return;
+					}
+					done = true;
+					observer.disconnect();
+					clearInterval(fallback);
+					clearTimeout(timer);
+					document.removeEventListener('load', check, true);
+					window.removeEventListener('message', check);
+					resolve({ready: ready, ms: performance.now() - started});
+				}
+
+				function check() {
+					if (done || pinging) {
+						return;
+					}
+					if (typeof window.__tcfapi !== 'function') {
+						%s;
+						if (typeof window.__tcfapi !== 'function') {
+							return;
+						}
+					}
+
+					// Stubs and locator frames may never answer, so the API is pinged again on the next change after a second
+					pinging = true;
+					const retry = setTimeout(() => pinging = false, 1000);
+					try {
+						window.__tcfapi('ping', 2, (pingReturn) => {
+							clearTimeout(retry);
+							pinging = false;
+							if (pingReturn && pingReturn.cmpId) {
+								finish(true);
+							}
+						});
+					} catch (e) {
+						clearTimeout(retry);
+						pinging = false;
+					}
+				}
+
+				observer.observe(document, {childList: true, subtree: true});
+				document.addEventListener('load', check, true);
+				window.addEventListener('message', check);
+				check();
+			})
+		`
+
+	// JavaScript resolving to the mode in which the TCF API is present on the page
+	modeJS = `
+			new Promise((resolve) => {
+				const hasLocator = () => {
+					let win = window;
+					while (win) {
+						try {
+							if (win.frames['__tcfapiLocator']) {
+								return true;
+							}
+						} catch (e) {}
+						if (win === window.top) {
+							break;
+						}
+						win = win.parent;
+					}
+					return false;
+				};
+
+				if (typeof window.__tcfapi !== 'function' || window.__tcfapi.viaLocator) {
+					resolve(hasLocator() ? 'locator' : 'none');
+					return;
+				}
+
+				const timer = setTimeout(() => resolve('stub'), 2000);
+				try {
+					window.__tcfapi('ping', 2, (pingReturn) => {
+						clearTimeout(timer);
+						resolve(pingReturn && pingReturn.cmpLoaded ? 'full' : 'stub');
+					});
+				} catch (e) {
+					clearTimeout(timer);
+					resolve('stub');
+				}
+			})
+		`
+
+	// JavaScript which, on pages where the CMP lives in another frame and is only reachable through a __tcfapiLocator
+	// frame, defines window.__tcfapi as a client that forwards each call to the CMP's frame via postMessage, as
+	// described in the TCF specification. The other probes then work unchanged on such pages. The client is marked
+	// with viaLocator, so the page is still reported in the locator mode.
+	locatorProxyJS = `
+			(function () {
+				if (typeof window.__tcfapi === 'function') {
+					return;
+				}
+
+				let cmpFrame;
+				let win = window;
+				while (win) {
+					try {
+						if (win.frames['__tcfapiLocator']) {
+							cmpFrame = win;
+							break;
+						}
+					} catch (e) {}
+					if (win === window.top) {
+						break;
+					}
+					win = win.parent;
+				}
+				if (!cmpFrame) {
+					return;
+				}
+
+				const callbacks = {};
+				let nextCallId = 0;
+				const tcfapi = (command, version, callback, parameter) => {
+					const callId = 'vendor-compliance-' + nextCallId++;
+					callbacks[callId] = callback;
+					cmpFrame.postMessage({__tcfapiCall: {command: command, parameter: parameter, version: version, callId: callId}}, '*');
+				};
+				tcfapi.viaLocator = true;
+				window.__tcfapi = tcfapi;
+
+				window.addEventListener('message', (event) => {
+					let data = event.data;
+					if (typeof data === 'string') {
+						try {
+							data = JSON.parse(data);
+						} catch (e) {
+							return;
+						}
+					}
+					const payload = data && data.__tcfapiReturn;
+					if (payload && typeof callbacks[payload.callId] === 'function') {
+						callbacks[payload.callId](payload.returnValue, payload.success);
+					}
+				}, false);
+			})()
+		`
+)
+
+// Ping is the CMP's response to the ping command.
+type Ping struct {
+	GdprApplies      bool   `json:"gdprApplies"`
+	CmpLoaded        bool   `json:"cmpLoaded"`
+	CmpStatus        string `json:"cmpStatus"`
+	DisplayStatus    string `json:"displayStatus"`
+	APIVersion       string `json:"apiVersion"`
+	CmpVersion       int    `json:"cmpVersion"`
+	CmpID            int    `json:"cmpId"`
+	GvlVersion       int    `json:"gvlVersion"`
+	TcfPolicyVersion int    `json:"tcfPolicyVersion"`
+}
+
+// TCData holds the fields of the getTCData response the checks use.
+type TCData struct {
+	TCString    string `json:"tcString"`
+	EventStatus string `json:"eventStatus"`
+}
+
+// GetPing returns the CMP's ping response, which is empty if the CMP did not answer.
+func GetPing(s browser.Session) (Ping, error) {
+	var ping *Ping
+	if err := s.Evaluate(pingJS, &ping); err != nil || ping == nil {
+		return Ping{}, err
+	}
+	return *ping, nil
+}
+
+// GetTCData returns the TC string and event status the CMP returns from getTCData.
+func GetTCData(s browser.Session) (TCData, error) {
+	var tcData *TCData
+	if err := s.Evaluate(tcDataJS, &tcData); err != nil || tcData == nil {
+		return TCData{}, err
+	}
+	return *tcData, nil
+}
+
+// DetectMode returns the mode in which the TCF API is present on the current page.
+func DetectMode(s browser.Session) (string, error) {
+	mode := ModeNone
+	err := s.Evaluate(modeJS, &mode)
+	return mode, err
+}
+
+// InstallLocatorProxy defines the postMessage based __tcfapi client on the current page if the page has no __tcfapi
+// function of its own but a __tcfapiLocator frame.
+func InstallLocatorProxy(s browser.Session) error {
+	return s.Evaluate(locatorProxyJS, nil)
+}
+
+// ErrAPITimeout is returned by WaitForAPI if the TCF API did not report a CMP ID before the timeout.
+var ErrAPITimeout = errors.New("TCF API not ready before the timeout")
+
+// retryDelay is the time to wait before waiting for the API again on a page whose probe failed, e.g. because the page
+// navigated while it ran.
+const retryDelay = 100 * time.Millisecond
+
+// readiness is the result of waitForAPIJS.
+type readiness struct {
+	Ready  bool    `json:"ready"`
+	Millis float64 `json:"ms"`
+}
+
+// WaitForAPI waits for the TCF API to load and report a CMP ID, and returns how long it took. The wait runs on the
+// page, see waitForAPIJS, so the latency is exact rather than rounded to a polling interval. On pages with only a
+// __tcfapiLocator frame it installs the postMessage based client. Probes failing while the page is still loading are
+// run again. If the timeout passes first, ErrAPITimeout is returned, wrapping the last error of the probe, if any.
+func WaitForAPI(s browser.Session, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	var lastErr error
+	for {
+		remaining := timeout - time.Since(start)
+		if remaining <= 0 {
+			if lastErr != nil {
+				return 0, fmt.Errorf("%w: %v", ErrAPITimeout, lastErr)
+			}
+			return 0, ErrAPITimeout
+		}
+
+		probeStart := time.Since(start)
+		var result *readiness
+		err := s.Evaluate(fmt.Sprintf(waitForAPIJS, remaining.Milliseconds(), locatorProxyJS), &result)
+		switch {
+		case err == nil && result != nil && result.Ready:
+			return probeStart + time.Duration(result.Millis*float64(time.Millisecond)), nil
+		case err == nil && result != nil:
+			return 0, ErrAPITimeout
+		case err == nil:
+			err = errors.New("the probe returned no result")
+		}
+		lastErr = err
+		time.Sleep(retryDelay)
+	}
+}
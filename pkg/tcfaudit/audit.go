@@ -0,0 +1,108 @@
+package tcfaudit
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// Kinds of findings of an audit
+const (
+	FindingTCFMissing      = "tcf-missing"       // The page has no TCF API, or its CMP did not report a CMP ID.
+	FindingTCStringMissing = "tc-string-missing" // The CMP returned no TC string after reload.
+	FindingTCStringChanged = "tc-string-changed" // The CMP changed the injected TC string after reload.
+	FindingBannerReshown   = "banner-reshown"    // The CMP showed its UI after reload, despite the injected consent.
+)
+
+// Finding is an issue found by an audit.
+type Finding struct {
+	Kind   string
+	Detail string
+}
+
+// Options configure an audit.
+type Options struct {
+	APITimeout time.Duration // APITimeout specifies how long to wait for the TCF API after each page load.
+}
+
+// DefaultOptions are the options used by the checks.
+var DefaultOptions = Options{APITimeout: 10 * time.Second}
+
+// PageAudit is the result of auditing how a page's CMP handles the consent of a profile.
+type PageAudit struct {
+	URL               string
+	Profile           string
+	Mode              string   // Mode is the mode in which the TCF API was present on load, see tcf.DetectMode.
+	Ping              tcf.Ping // Ping is the CMP's ping response on load.
+	EventStatusBefore string   // EventStatusBefore is the event status reported on load, before the consent was injected.
+	Injected          string   // Injected is the TC string generated from the profile and injected.
+	Storage           string   // Storage is the name of the CMP's storage the TC string was injected in, see tcf.StorageFor.
+	Returned          string   // Returned is the TC string the CMP returned after reload.
+	EventStatusAfter  string
+	Diff              Diff
+	Cookies           []*http.Cookie // Cookies are the cookies the browser sends to the page after reload.
+	Findings          []Finding
+}
+
+// Audit loads the URL in the session, injects the TC string generated from the profile for the page's CMP, reloads
+// the page and compares the TC string the CMP returns with the injected one. Pages without a CMP are reported with the
+// tcf-missing finding rather than an error, which is only returned if the session fails.
+func Audit(s browser.Session, url string, profile ConsentProfile, opts Options) (*PageAudit, error) {
+	audit := &PageAudit{URL: url, Profile: profile.Name}
+	if err := s.Navigate(url); err != nil {
+		return nil, err
+	}
+
+	// Pages on which the API does not load are reported with the tcf-missing finding below
+	tcf.WaitForAPI(s, opts.APITimeout)
+	mode, err := tcf.DetectMode(s)
+	if err != nil {
+		return nil, err
+	}
+	audit.Mode = mode
+	if audit.Ping, err = tcf.GetPing(s); err != nil {
+		return nil, err
+	}
+	if audit.Ping.CmpID == 0 {
+		audit.Findings = append(audit.Findings, Finding{Kind: FindingTCFMissing, Detail: "mode " + mode})
+		return audit, nil
+	}
+
+	before, err := tcf.GetTCData(s)
+	if err != nil {
+		return nil, err
+	}
+	audit.EventStatusBefore = before.EventStatus
+
+	audit.Injected = profile.TCString(CMPFromPing(audit.Ping))
+	if audit.Storage, err = tcf.StoreConsent(s, audit.Ping.CmpID, audit.Injected); err != nil {
+		return nil, err
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	tcf.WaitForAPI(s, opts.APITimeout)
+	after, err := tcf.GetTCData(s)
+	if err != nil {
+		return nil, err
+	}
+	audit.Returned, audit.EventStatusAfter = after.TCString, after.EventStatus
+	if audit.Cookies, err = s.Cookies(); err != nil {
+		return nil, err
+	}
+
+	audit.Diff = DiffTCStrings(audit.Injected, audit.Returned)
+	switch {
+	case audit.Returned == "":
+		audit.Findings = append(audit.Findings, Finding{Kind: FindingTCStringMissing})
+	case !audit.Diff.Empty():
+		audit.Findings = append(audit.Findings, Finding{Kind: FindingTCStringChanged, Detail: audit.Diff.Summary()})
+	}
+	if audit.EventStatusAfter == "cmpuishown" {
+		audit.Findings = append(audit.Findings, Finding{Kind: FindingBannerReshown, Detail: "event status cmpuishown after reload"})
+	}
+	return audit, nil
+}
@@ -0,0 +1,256 @@
+package tcfaudit
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Fields of the TCF Canada v1 TC string with fixed values
+const (
+	canadaVersion          = 1
+	canadaPolicyVersion    = 1
+	canadaPublisherSegment = 3
+	canadaPurposes         = 24 // canadaPurposes is the number of bits of the purpose fields.
+	canadaSpecialFeatures  = 12 // canadaSpecialFeatures is the number of bits of the special feature field.
+)
+
+// CanadaTCString returns the TCF Canada v1 TC string of the profile for the CMP, with a core string and a publisher
+// purposes segment. Canada has express and implied consent rather than consent and legitimate interest, so the
+// profile's purposes and vendors are expressly consented to, and those of its legitimate interest impliedly.
+func (p ConsentProfile) CanadaTCString(cmp CMP) string {
+	now := time.Now()
+	var core bitWriter
+	core.write(canadaVersion, 6)
+	core.write(uint64(now.UnixMilli()/100), 36)
+	core.write(uint64(now.UnixMilli()/100), 36)
+	core.write(uint64(cmp.ID), 12)
+	core.write(uint64(cmp.Version), 12)
+	core.write(2, 6) // ConsentScreen
+	core.writeLetters("EN")
+	core.write(uint64(cmp.GvlVersion), 12)
+	core.write(canadaPolicyVersion, 6)
+	core.write(0, 1) // UseNonStandardStacks
+	core.writeBits(p.SpecialFeatures, canadaSpecialFeatures)
+	core.writeBits(p.Purposes, canadaPurposes)
+	core.writeBits(p.PurposesLI, canadaPurposes)
+	core.writeVendors(p.Vendors)
+	core.writeVendors(p.VendorsLI)
+
+	var publisher bitWriter
+	publisher.write(canadaPublisherSegment, 3)
+	publisher.write(0, canadaPurposes) // PubPurposesExpressConsent
+	publisher.write(0, canadaPurposes) // PubPurposesImpliedConsent
+	publisher.write(0, 6)              // NumCustomPurposes
+
+	return strings.Join([]string{core.encode(), publisher.encode()}, ".")
+}
+
+// DecodeCanadaGrants decodes the core string of the TCF Canada v1 TC string and returns what it grants, the purposes
+// and vendors expressly consented to as consented, and those impliedly consented to as their legitimate interest.
+func DecodeCanadaGrants(tcString string) (Grants, error) {
+	core, _, _ := strings.Cut(tcString, ".")
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(core, "="))
+	if err != nil {
+		return Grants{}, fmt.Errorf("decoding the core string: %w", err)
+	}
+
+	r := bitReader{bytes: data}
+	if version := r.read(6); version != canadaVersion {
+		return Grants{}, fmt.Errorf("unsupported TCF Canada version %d", version)
+	}
+	r.skip(36 + 36) // Created, LastUpdated
+	g := Grants{CmpID: int(r.read(12)), CmpVersion: int(r.read(12))}
+	r.skip(6 + 12 + 12 + 6 + 1) // ConsentScreen, ConsentLanguage, VendorListVersion, TcfPolicyVersion, UseNonStandardStacks
+	g.SpecialFeatures = r.readBits(canadaSpecialFeatures)
+	g.Purposes = r.readBits(canadaPurposes)
+	g.PurposesLI = r.readBits(canadaPurposes)
+	g.Vendors = r.readVendors()
+	g.VendorsLI = r.readVendors()
+	if r.overrun {
+		return Grants{}, errors.New("the core string is truncated")
+	}
+	return g, nil
+}
+
+// DiffCanadaTCStrings decodes both TCF Canada TC strings and returns the differences between what they grant, the
+// express consent as the consent and the implied consent as the legitimate interest of the Diff.
+func DiffCanadaTCStrings(generated string, returned string) Diff {
+	if returned == "" {
+		return Diff{Error: "CMP returned no TC string"}
+	}
+
+	gen, err := DecodeCanadaGrants(generated)
+	if err != nil {
+		return Diff{Error: fmt.Sprintf("failed to decode generated TC string: %v", err)}
+	}
+	ret, err := DecodeCanadaGrants(returned)
+	if err != nil {
+		return Diff{Error: fmt.Sprintf("failed to decode returned TC string: %v", err)}
+	}
+
+	diff := Diff{Fields: map[string][2]string{}}
+	if gen.CmpID != ret.CmpID {
+		diff.Fields["cmpId"] = [2]string{fmt.Sprint(gen.CmpID), fmt.Sprint(ret.CmpID)}
+	}
+	if gen.CmpVersion != ret.CmpVersion {
+		diff.Fields["cmpVersion"] = [2]string{fmt.Sprint(gen.CmpVersion), fmt.Sprint(ret.CmpVersion)}
+	}
+	if len(diff.Fields) == 0 {
+		diff.Fields = nil
+	}
+	diff.PurposesAdded, diff.PurposesDropped = diffIDSets(gen.Purposes, ret.Purposes)
+	diff.PurposesLIAdded, diff.PurposesLIDropped = diffIDSets(gen.PurposesLI, ret.PurposesLI)
+	diff.SpecialFeaturesAdded, diff.SpecialFeaturesDropped = diffIDSets(gen.SpecialFeatures, ret.SpecialFeatures)
+
+	added, dropped := diffIDSets(gen.Vendors, ret.Vendors)
+	diff.VendorsAdded, diff.VendorsDropped = CompactRanges(added), CompactRanges(dropped)
+	added, dropped = diffIDSets(gen.VendorsLI, ret.VendorsLI)
+	diff.VendorsLIAdded, diff.VendorsLIDropped = CompactRanges(added), CompactRanges(dropped)
+	return diff
+}
+
+// diffIDSets returns the ascending IDs only in returned (added) and those only in generated (dropped).
+func diffIDSets(generated []int, returned []int) (added []int, dropped []int) {
+	gen, ret := map[int]bool{}, map[int]bool{}
+	maxID := 0
+	for _, id := range generated {
+		gen[id], maxID = true, max(maxID, id)
+	}
+	for _, id := range returned {
+		ret[id], maxID = true, max(maxID, id)
+	}
+	return diffIDs(maxID, func(id int) bool { return gen[id] }, func(id int) bool { return ret[id] })
+}
+
+// bitReader reads the bit fields of a TC string segment. Reading past its end reads zeros and sets overrun.
+type bitReader struct {
+	bytes   []byte
+	bits    int
+	overrun bool
+}
+
+// read reads an n bit value, most significant bit first.
+func (r *bitReader) read(n int) uint64 {
+	var value uint64
+	for i := 0; i < n; i++ {
+		value <<= 1
+		if r.bits/8 >= len(r.bytes) {
+			r.overrun = true
+		} else if r.bytes[r.bits/8]>>uint(7-r.bits%8)&1 == 1 {
+			value |= 1
+		}
+		r.bits++
+	}
+	return value
+}
+
+// skip skips n bits.
+func (r *bitReader) skip(n int) {
+	r.read(n)
+}
+
+// readBits reads a bit field of n bits and returns the IDs of the bits set, ID 1 being the first bit.
+func (r *bitReader) readBits(n int) []int {
+	var ids []int
+	for id := 1; id <= n; id++ {
+		if r.read(1) == 1 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// readVendors reads a vendor section as written by writeVendors, either range or bit field encoded.
+func (r *bitReader) readVendors() []int {
+	maxVendorID := int(r.read(16))
+	if r.read(1) == 0 {
+		return r.readBits(maxVendorID)
+	}
+
+	var ids []int
+	entries := int(r.read(12))
+	for i := 0; i < entries && !r.overrun; i++ {
+		isRange := r.read(1) == 1
+		from := int(r.read(16))
+		to := from
+		if isRange {
+			to = int(r.read(16))
+		}
+		for id := from; id <= to && id <= maxVendorID; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// bitWriter writes the bit fields of a TC string segment.
+type bitWriter struct {
+	bytes []byte
+	bits  int
+}
+
+// write writes the lowest n bits of the value, most significant first.
+func (w *bitWriter) write(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		if value>>uint(i)&1 == 1 {
+			w.bytes[w.bits/8] |= 1 << uint(7-w.bits%8)
+		}
+		w.bits++
+	}
+}
+
+// writeLetters writes the letters as 6 bits each, A being 0.
+func (w *bitWriter) writeLetters(letters string) {
+	for _, letter := range letters {
+		w.write(uint64(letter-'A'), 6)
+	}
+}
+
+// writeBits writes a bit field of n bits with the bits of the IDs set, ID 1 being the first bit.
+func (w *bitWriter) writeBits(ids []int, n int) {
+	set := idSet(ids)
+	for id := 1; id <= n; id++ {
+		if set[id] {
+			w.write(1, 1)
+		} else {
+			w.write(0, 1)
+		}
+	}
+}
+
+// writeVendors writes a vendor section, range encoded as the ranges are, or as an empty bit field without vendors.
+func (w *bitWriter) writeVendors(ranges []IDRange) {
+	maxVendorID := 0
+	for _, r := range ranges {
+		maxVendorID = max(maxVendorID, r.To)
+	}
+	w.write(uint64(maxVendorID), 16)
+	if len(ranges) == 0 {
+		w.write(0, 1) // IsRangeEncoding, with a bit field of MaxVendorId bits
+		return
+	}
+
+	w.write(1, 1)
+	w.write(uint64(len(ranges)), 12)
+	for _, r := range ranges {
+		if r.From == r.To {
+			w.write(0, 1)
+			w.write(uint64(r.From), 16)
+			continue
+		}
+		w.write(1, 1)
+		w.write(uint64(r.From), 16)
+		w.write(uint64(r.To), 16)
+	}
+}
+
+// encode returns the segment base64url encoded without padding.
+func (w *bitWriter) encode() string {
+	return base64.RawURLEncoding.EncodeToString(w.bytes)
+}
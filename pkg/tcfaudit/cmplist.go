@@ -0,0 +1,116 @@
+package tcfaudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// CMPListURL is the list of the CMPs registered with IAB Europe.
+const CMPListURL = "https://cmplist.consensu.org/v2/cmp-list.json"
+
+// Names of the checks of the values a CMP reports against the CMP list, see VerifyCMP and VerifyTCStringCMP
+const (
+	CheckCMPRegistered = "cmp-registered"   // The ping's cmpId is that of a CMP on the list that is not deleted.
+	CheckCMPVersion    = "cmp-version"      // The ping's cmpVersion is set. The list does not hold the versions of the CMPs, so any positive version passes.
+	CheckTCStringCMPID = "tc-string-cmp-id" // The CMP's TC string decodes, and its CmpId and CmpVersion are those of its ping.
+)
+
+// RegisteredCMP is a CMP of the CMP list.
+type RegisteredCMP struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	IsCommercial bool   `json:"isCommercial"`
+	DeletedDate  string `json:"deletedDate"` // DeletedDate is the date from which the CMP is no longer approved, if any.
+}
+
+// Deleted reports whether the CMP is no longer approved at the time.
+func (c RegisteredCMP) Deleted(at time.Time) bool {
+	if c.DeletedDate == "" {
+		return false
+	}
+	deleted, err := time.Parse(time.RFC3339, c.DeletedDate)
+	return err != nil || !deleted.After(at)
+}
+
+// CMPList holds the registered CMPs by ID.
+type CMPList map[int]RegisteredCMP
+
+// FetchCMPList downloads and parses the CMP list at the URL.
+func FetchCMPList(url string, timeout time.Duration) (CMPList, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return ParseCMPList(resp.Body)
+}
+
+// ParseCMPList parses a CMP list in the format of CMPListURL.
+func ParseCMPList(r io.Reader) (CMPList, error) {
+	var list struct {
+		CMPs map[string]RegisteredCMP `json:"cmps"`
+	}
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode the CMP list: %w", err)
+	}
+	cmps := make(CMPList, len(list.CMPs))
+	for _, cmp := range list.CMPs {
+		cmps[cmp.ID] = cmp
+	}
+	return cmps, nil
+}
+
+// VerifyCMP checks the cmpId and cmpVersion the CMP reports in its ping against the list at the time.
+func VerifyCMP(list CMPList, ping tcf.Ping, at time.Time) []tcf.ConformanceCheck {
+	registered := tcf.ConformanceCheck{Name: CheckCMPRegistered, Result: tcf.CheckPass}
+	cmp, found := list[ping.CmpID]
+	switch {
+	case ping.CmpID == 0:
+		registered.Result, registered.Detail = tcf.CheckFail, "ping reports no cmpId"
+	case !found:
+		registered.Result, registered.Detail = tcf.CheckFail, fmt.Sprintf("cmpId %d is not on the CMP list", ping.CmpID)
+	case cmp.Deleted(at):
+		registered.Result, registered.Detail = tcf.CheckFail, fmt.Sprintf("cmpId %d (%s) was deleted on %s", ping.CmpID, cmp.Name, cmp.DeletedDate)
+	default:
+		registered.Detail = cmp.Name
+	}
+
+	version := tcf.ConformanceCheck{Name: CheckCMPVersion, Result: tcf.CheckPass}
+	if ping.CmpVersion <= 0 {
+		version.Result, version.Detail = tcf.CheckFail, fmt.Sprintf("ping reports cmpVersion %d", ping.CmpVersion)
+	}
+	return []tcf.ConformanceCheck{registered, version}
+}
+
+// VerifyTCStringCMP checks that the TC string was created by the CMP that answered the ping, i.e. that its CmpId and
+// CmpVersion are those of the ping. A TC string of another CMP is a sign of a spoofed cmpId or of a misconfigured CMP.
+// The check is skipped without a TC string.
+func VerifyTCStringCMP(ping tcf.Ping, tcString string) tcf.ConformanceCheck {
+	if tcString == "" {
+		return tcf.ConformanceCheck{Name: CheckTCStringCMPID, Result: tcf.CheckSkipped, Detail: "no TC string"}
+	}
+	decoded, err := iabtcfv2.Decode(tcString)
+	if err != nil {
+		return tcf.ConformanceCheck{Name: CheckTCStringCMPID, Result: tcf.CheckFail, Detail: "invalid TC string: " + err.Error()}
+	}
+
+	check := tcf.ConformanceCheck{Name: CheckTCStringCMPID, Result: tcf.CheckPass}
+	switch core := decoded.CoreString; {
+	case core.CmpId != ping.CmpID:
+		check.Result, check.Detail = tcf.CheckFail, fmt.Sprintf("TC string CmpId %d, ping cmpId %d", core.CmpId, ping.CmpID)
+	case ping.CmpVersion > 0 && core.CmpVersion != ping.CmpVersion:
+		check.Result, check.Detail = tcf.CheckFail, fmt.Sprintf("TC string CmpVersion %d, ping cmpVersion %d", core.CmpVersion, ping.CmpVersion)
+	}
+	return check
+}
@@ -0,0 +1,159 @@
+package tcfaudit
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+)
+
+const (
+	maxPurposeID        = 24 // maxPurposeID is the size of the purpose bit fields in the core string.
+	maxSpecialFeatureID = 12 // maxSpecialFeatureID is the size of the special feature bit field in the core string.
+)
+
+// Diff lists the fields of the generated TC string that the CMP changed in the TC string it returned.
+// Vendor IDs are listed as compact ranges, e.g. "1-50,52", to keep the diff small.
+type Diff struct {
+	Error                  string               `json:"error,omitempty"`
+	Fields                 map[string][2]string `json:"fields,omitempty"` // Fields maps each changed scalar field to its generated and returned value.
+	PurposesAdded          []int                `json:"purposesAdded,omitempty"`
+	PurposesDropped        []int                `json:"purposesDropped,omitempty"`
+	PurposesLIAdded        []int                `json:"purposesLIAdded,omitempty"`
+	PurposesLIDropped      []int                `json:"purposesLIDropped,omitempty"`
+	SpecialFeaturesAdded   []int                `json:"specialFeaturesAdded,omitempty"`
+	SpecialFeaturesDropped []int                `json:"specialFeaturesDropped,omitempty"`
+	VendorsAdded           string               `json:"vendorsAdded,omitempty"`
+	VendorsDropped         string               `json:"vendorsDropped,omitempty"`
+	VendorsLIAdded         string               `json:"vendorsLIAdded,omitempty"`
+	VendorsLIDropped       string               `json:"vendorsLIDropped,omitempty"`
+}
+
+// DiffTCStrings decodes both TC strings and returns the differences between them.
+func DiffTCStrings(generated string, returned string) Diff {
+	if returned == "" {
+		return Diff{Error: "CMP returned no TC string"}
+	}
+
+	gen, err := iabtcfv2.Decode(generated)
+	if err != nil {
+		return Diff{Error: fmt.Sprintf("failed to decode generated TC string: %v", err)}
+	}
+	ret, err := iabtcfv2.Decode(returned)
+	if err != nil {
+		return Diff{Error: fmt.Sprintf("failed to decode returned TC string: %v", err)}
+	}
+
+	diff := Diff{Fields: diffCoreFields(gen.CoreString, ret.CoreString)}
+	diff.PurposesAdded, diff.PurposesDropped = diffIDs(maxPurposeID, gen.IsPurposeAllowed, ret.IsPurposeAllowed)
+	diff.PurposesLIAdded, diff.PurposesLIDropped = diffIDs(maxPurposeID, gen.IsPurposeLIAllowed, ret.IsPurposeLIAllowed)
+	diff.SpecialFeaturesAdded, diff.SpecialFeaturesDropped = diffIDs(maxSpecialFeatureID, gen.IsSpecialFeatureAllowed, ret.IsSpecialFeatureAllowed)
+
+	added, dropped := diffIDs(max(gen.CoreString.MaxVendorId, ret.CoreString.MaxVendorId), gen.IsVendorAllowed, ret.IsVendorAllowed)
+	diff.VendorsAdded, diff.VendorsDropped = CompactRanges(added), CompactRanges(dropped)
+
+	added, dropped = diffIDs(max(gen.CoreString.MaxVendorIdLI, ret.CoreString.MaxVendorIdLI), gen.IsVendorLIAllowed, ret.IsVendorLIAllowed)
+	diff.VendorsLIAdded, diff.VendorsLIDropped = CompactRanges(added), CompactRanges(dropped)
+
+	return diff
+}
+
+// Empty reports whether the CMP kept the generated TC string.
+func (d Diff) Empty() bool {
+	return reflect.DeepEqual(d, Diff{})
+}
+
+// GrantsChanged reports whether the CMP changed the consent or legitimate interest granted to purposes or vendors. CMPs
+// rewrite the other fields, such as their ID or the timestamps, as a matter of course, and a diff with an Error could
+// not compare the strings, so neither makes a CMP non-compliant.
+func (d Diff) GrantsChanged() bool {
+	if d.Error != "" {
+		return false
+	}
+	return len(d.PurposesAdded) > 0 || len(d.PurposesDropped) > 0 || len(d.PurposesLIAdded) > 0 || len(d.PurposesLIDropped) > 0 ||
+		d.VendorsAdded != "" || d.VendorsDropped != "" || d.VendorsLIAdded != "" || d.VendorsLIDropped != ""
+}
+
+// ParseDiff parses a diff from its Summary, as written to the Consent Diff columns. An empty summary is an empty diff.
+func ParseDiff(summary string) (Diff, error) {
+	var d Diff
+	if summary == "" {
+		return d, nil
+	}
+	err := json.Unmarshal([]byte(summary), &d)
+	return d, err
+}
+
+// Summary returns the diff as a compact JSON object, which is "{}" when it is empty.
+func (d Diff) Summary() string {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// diffCoreFields returns the scalar core string fields that differ, mapped to their generated and returned value.
+func diffCoreFields(gen, ret *iabtcfv2.CoreString) map[string][2]string {
+	fields := map[string][2]string{}
+	compare := func(name string, a, b interface{}) {
+		if a != b {
+			fields[name] = [2]string{fmt.Sprint(a), fmt.Sprint(b)}
+		}
+	}
+
+	compare("version", gen.Version, ret.Version)
+	compare("created", gen.Created.UTC().Format(time.RFC3339), ret.Created.UTC().Format(time.RFC3339))
+	compare("lastUpdated", gen.LastUpdated.UTC().Format(time.RFC3339), ret.LastUpdated.UTC().Format(time.RFC3339))
+	compare("cmpId", gen.CmpId, ret.CmpId)
+	compare("cmpVersion", gen.CmpVersion, ret.CmpVersion)
+	compare("consentScreen", gen.ConsentScreen, ret.ConsentScreen)
+	compare("consentLanguage", gen.ConsentLanguage, ret.ConsentLanguage)
+	compare("vendorListVersion", gen.VendorListVersion, ret.VendorListVersion)
+	compare("tcfPolicyVersion", gen.TcfPolicyVersion, ret.TcfPolicyVersion)
+	compare("isServiceSpecific", gen.IsServiceSpecific, ret.IsServiceSpecific)
+	compare("useNonStandardStacks", gen.UseNonStandardStacks, ret.UseNonStandardStacks)
+	compare("purposeOneTreatment", gen.PurposeOneTreatment, ret.PurposeOneTreatment)
+	compare("publisherCC", gen.PublisherCC, ret.PublisherCC)
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// diffIDs checks the IDs 1 to max against both predicates and returns the IDs only allowed by the returned string
+// (added) and those only allowed by the generated string (dropped).
+func diffIDs(max int, generated, returned func(int) bool) (added []int, dropped []int) {
+	for id := 1; id <= max; id++ {
+		a, b := generated(id), returned(id)
+		if b && !a {
+			added = append(added, id)
+		} else if a && !b {
+			dropped = append(dropped, id)
+		}
+	}
+	return
+}
+
+// CompactRanges formats ascending IDs as comma separated ranges, e.g. [1 2 3 5] becomes "1-3,5".
+func CompactRanges(ids []int) string {
+	var ranges []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(ids[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(ids[i])+"-"+strconv.Itoa(ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
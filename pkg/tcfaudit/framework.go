@@ -0,0 +1,234 @@
+package tcfaudit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// Names of the frameworks registered by the package
+const (
+	FrameworkTCFEU     = "tcf-eu"     // The IAB Europe TCF v2, see ConsentProfile.TCString.
+	FrameworkTCFCanada = "tcf-canada" // The IAB Canada TCF v1, see ConsentProfile.CanadaTCString.
+	FrameworkLGPD      = "lgpd"       // Brazil's LGPD, which has no standard consent string, so its CMPs are only detected.
+)
+
+// ErrNoConsentString is returned by the frameworks without a standard consent string.
+var ErrNoConsentString = errors.New("the framework has no consent string")
+
+// Framework is the consent framework of a jurisdiction. It expresses the consent of a profile as the framework's
+// consent string and detects the CMPs implementing it on a page. Register the frameworks of further jurisdictions with
+// RegisterFramework.
+type Framework interface {
+	// Name identifies the framework, e.g. in the output of the checks.
+	Name() string
+
+	// ConsentString returns the consent string of the profile for the CMP, or ErrNoConsentString.
+	ConsentString(p ConsentProfile, cmp CMP) (string, error)
+
+	// Detect reports whether the page's CMP implements the framework, along with the evidence found.
+	Detect(s browser.Session) (bool, string, error)
+}
+
+// Injector is implemented by the frameworks whose CMPs neither answer through the TCF v2 API nor read the consent
+// from the storage of tcf.StorageFor, e.g. TCF Canada, whose CMPs implement GPP. The checks then find the CMP, store
+// the consent string and read it back through the framework.
+type Injector interface {
+	// CMP returns the page's CMP, as it reports itself through the framework's API.
+	CMP(s browser.Session) (CMP, error)
+
+	// Storage returns where the framework's CMPs read the consent of returning users from.
+	Storage() tcf.Storage
+
+	// ReadBack returns the consent string the page's CMP applies, or "" if it applies none.
+	ReadBack(s browser.Session) (string, error)
+
+	// Diff compares the injected consent string with the one read back.
+	Diff(injected string, returned string) Diff
+}
+
+// frameworks holds the registered frameworks by name.
+var frameworks = map[string]Framework{}
+
+func init() {
+	RegisterFramework(tcfEU{})
+	RegisterFramework(tcfCanada{})
+	RegisterFramework(lgpd{})
+}
+
+// RegisterFramework registers the framework under its name, replacing any framework of the same name.
+func RegisterFramework(f Framework) {
+	frameworks[f.Name()] = f
+}
+
+// LookupFramework returns the framework registered under the name.
+func LookupFramework(name string) (Framework, error) {
+	f, found := frameworks[name]
+	if !found {
+		return nil, fmt.Errorf("unknown framework %q, use one of %s", name, strings.Join(FrameworkNames(), ", "))
+	}
+	return f, nil
+}
+
+// FrameworkNames returns the names of the registered frameworks, sorted.
+func FrameworkNames() []string {
+	names := make([]string, 0, len(frameworks))
+	for name := range frameworks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tcfEU is the IAB Europe TCF v2, detected through the page's __tcfapi or __tcfapiLocator frame.
+type tcfEU struct{}
+
+func (tcfEU) Name() string { return FrameworkTCFEU }
+
+func (tcfEU) ConsentString(p ConsentProfile, cmp CMP) (string, error) {
+	return p.TCString(cmp), nil
+}
+
+func (tcfEU) Detect(s browser.Session) (bool, string, error) {
+	mode, err := tcf.DetectMode(s)
+	if err != nil || mode == tcf.ModeNone {
+		return false, "", err
+	}
+	return true, "__tcfapi " + mode, nil
+}
+
+const (
+	// JavaScript resolving to the CMP, the sections it supports and applies and the GPP string of the page's GPP CMP,
+	// or null if it has no __gpp or does not answer within a second. The callback is awaited, as GPP 1.1 CMPs call it asynchronously.
+	gppPingJS = `
+			new Promise((resolve) => {
+				if (typeof window.__gpp !== 'function') {
+					resolve(null);
+					return;
+				}
+				setTimeout(() => resolve(null), 1000);
+				try {
+					const answer = (pingData) => resolve(pingData ? {cmpId: Number(pingData.cmpId) || 0, cmpVersion: Number(pingData.cmpVersion) || 0, supportedAPIs: (pingData.supportedAPIs || []).map(String), applicableSections: (pingData.applicableSections || []).map(Number), sectionList: (pingData.sectionList || []).map(Number), gppString: String(pingData.gppString || '')} : null);
+					const pingData = window.__gpp('ping', answer);
+					if (pingData) {
+						answer(pingData);
+					}
+				} catch (e) {
+					resolve(null);
+				}
+			})
+		`
+
+	// GPP section of TCF Canada, which supporting CMPs list as "5:tcfcav1" or "tcfcav1"
+	gppCanadaSection = 5
+	gppCanadaAPI     = "tcfcav1"
+)
+
+// tcfCanada is the IAB Canada TCF v1, detected through the page's GPP CMP supporting its section. Its consent string
+// is injected as the section of a GPP string and read back from the GPP CMP.
+type tcfCanada struct{}
+
+func (tcfCanada) CMP(s browser.Session) (CMP, error) {
+	ping, err := pingGPP(s)
+	if err != nil {
+		return CMP{}, err
+	}
+	return CMPFromPing(tcf.Ping{CmpID: ping.CmpID, CmpVersion: ping.CmpVersion}), nil
+}
+
+func (tcfCanada) Storage() tcf.Storage {
+	return GPPStorage(gppCanadaSection)
+}
+
+func (tcfCanada) ReadBack(s browser.Session) (string, error) {
+	ping, err := pingGPP(s)
+	if err != nil {
+		return "", err
+	}
+	return ping.section(gppCanadaSection), nil
+}
+
+func (tcfCanada) Diff(injected string, returned string) Diff {
+	return DiffCanadaTCStrings(injected, returned)
+}
+
+func (tcfCanada) Name() string { return FrameworkTCFCanada }
+
+func (tcfCanada) ConsentString(p ConsentProfile, cmp CMP) (string, error) {
+	return p.CanadaTCString(cmp), nil
+}
+
+func (tcfCanada) Detect(s browser.Session) (bool, string, error) {
+	ping, err := pingGPP(s)
+	if errors.Is(err, errNoGPP) {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	for _, api := range ping.SupportedAPIs {
+		if api == gppCanadaAPI || strings.HasSuffix(api, ":"+gppCanadaAPI) {
+			return true, "__gpp supports " + api, nil
+		}
+	}
+	for _, section := range ping.ApplicableSections {
+		if section == gppCanadaSection {
+			return true, fmt.Sprintf("__gpp applies section %d", section), nil
+		}
+	}
+	return false, "", nil
+}
+
+const (
+	// Script hosts and cookie or local storage names of the CMPs serving Brazilian sites under the LGPD, e.g. AdOpt,
+	// Privacy Tools and LGPD cookie banners
+	lgpdPattern = `goadopt\.io|privacytools\.com\.br|lgpd`
+
+	// JavaScript returning the script URLs, cookie names and local storage keys matching lgpdPattern
+	lgpdJS = `
+			(() => {
+				const pattern = new RegExp('` + lgpdPattern + `', 'i');
+				const evidence = [];
+				for (const script of document.scripts) {
+					if (script.src && pattern.test(script.src)) {
+						evidence.push('script:' + script.src);
+					}
+				}
+				for (const cookie of document.cookie.split(';')) {
+					const name = cookie.split('=')[0].trim();
+					if (name && pattern.test(name)) {
+						evidence.push('cookie:' + name);
+					}
+				}
+				try {
+					for (let i = 0; i < localStorage.length; i++) {
+						if (pattern.test(localStorage.key(i))) {
+							evidence.push('localStorage:' + localStorage.key(i));
+						}
+					}
+				} catch (e) {
+				}
+				return evidence;
+			})()
+		`
+)
+
+// lgpd is Brazil's LGPD, whose CMPs are detected by their scripts and storage, as they share no API.
+type lgpd struct{}
+
+func (lgpd) Name() string { return FrameworkLGPD }
+
+func (lgpd) ConsentString(ConsentProfile, CMP) (string, error) {
+	return "", ErrNoConsentString
+}
+
+func (lgpd) Detect(s browser.Session) (bool, string, error) {
+	var evidence []string
+	if err := s.Evaluate(lgpdJS, &evidence); err != nil || len(evidence) == 0 {
+		return false, "", err
+	}
+	return true, strings.Join(evidence, "; "), nil
+}
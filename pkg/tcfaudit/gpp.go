@@ -0,0 +1,106 @@
+package tcfaudit
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// Fields of the GPP header with fixed values
+const (
+	gppHeaderType    = 3
+	gppHeaderVersion = 1
+)
+
+// GPPStorage holds the __gpp cookie and local storage item with the GPP string, and __gpp_sid with the IDs of its
+// sections, which GPP CMPs read the consent of returning users from.
+func GPPStorage(sectionID int) tcf.Storage {
+	gppString := func(section string, _ time.Time) string {
+		return GPPString(sectionID, section)
+	}
+	sectionIDs := func(string, time.Time) string {
+		return strconv.Itoa(sectionID)
+	}
+	return tcf.Storage{
+		Name: "gpp",
+		Items: []tcf.StorageItem{
+			{Name: "__gpp", Cookie: true, Value: gppString},
+			{Name: "__gpp_sid", Cookie: true, Value: sectionIDs},
+			{Name: "__gpp", Value: gppString},
+			{Name: "__gpp_sid", Value: sectionIDs},
+		},
+	}
+}
+
+// GPPString returns the GPP string holding the encoded section as its only section.
+func GPPString(sectionID int, section string) string {
+	var header bitWriter
+	header.write(gppHeaderType, 6)
+	header.write(gppHeaderVersion, 6)
+	header.write(1, 12) // NumRanges of the section IDs
+	header.write(0, 1)  // IsARange
+	header.writeFibonacci(sectionID)
+	return header.encode() + "~" + section
+}
+
+// gppPing is the answer of the page's GPP CMP to ping, see gppPingJS.
+type gppPing struct {
+	CmpID              int      `json:"cmpId"`
+	CmpVersion         int      `json:"cmpVersion"`
+	SupportedAPIs      []string `json:"supportedAPIs"`
+	ApplicableSections []int    `json:"applicableSections"`
+	SectionList        []int    `json:"sectionList"`
+	GPPString          string   `json:"gppString"`
+}
+
+// errNoGPP is returned when the page has no GPP CMP answering ping.
+var errNoGPP = errors.New("the page has no GPP CMP")
+
+// pingGPP returns the answer of the page's GPP CMP to ping, or errNoGPP.
+func pingGPP(s browser.Session) (gppPing, error) {
+	var ping *gppPing
+	if err := s.Evaluate(gppPingJS, &ping); err != nil {
+		return gppPing{}, err
+	}
+	if ping == nil {
+		return gppPing{}, errNoGPP
+	}
+	return *ping, nil
+}
+
+// section returns the encoded section with the ID from the GPP string the CMP applies, or "" if it holds none.
+func (p gppPing) section(sectionID int) string {
+	i := slices.Index(p.SectionList, sectionID)
+	parts := strings.Split(p.GPPString, "~")
+	if i < 0 || i+1 >= len(parts) {
+		return ""
+	}
+	return parts[i+1]
+}
+
+// writeFibonacci writes the positive integer in Fibonacci coding, as GPP encodes the section IDs of its header: a bit
+// per Fibonacci number from 1 up, set for those the integer is the sum of, followed by a set bit.
+func (w *bitWriter) writeFibonacci(n int) {
+	fibs := []int{1, 2}
+	for fibs[len(fibs)-1] <= n {
+		fibs = append(fibs, fibs[len(fibs)-1]+fibs[len(fibs)-2])
+	}
+	bits := make([]uint64, len(fibs))
+	last := 0
+	for i := len(fibs) - 1; i >= 0; i-- {
+		if fibs[i] <= n {
+			n -= fibs[i]
+			bits[i] = 1
+			last = max(last, i)
+		}
+	}
+	for _, bit := range bits[:last+1] {
+		w.write(bit, 1)
+	}
+	w.write(1, 1)
+}
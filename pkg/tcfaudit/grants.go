@@ -0,0 +1,52 @@
+package tcfaudit
+
+import (
+	"github.com/SirDataFR/iabtcfv2"
+)
+
+// Grants are the consents and legitimate interests a TC string grants, e.g. those a CMP sets by default before the
+// user made a choice.
+type Grants struct {
+	CmpID           int
+	CmpVersion      int
+	Purposes        []int // Purposes are the purposes consented to.
+	PurposesLI      []int // PurposesLI are the purposes whose legitimate interest is established.
+	SpecialFeatures []int // SpecialFeatures are the special features opted in to.
+	Vendors         []int // Vendors are the vendors consented to.
+	VendorsLI       []int // VendorsLI are the vendors whose legitimate interest is established.
+}
+
+// DecodeGrants decodes the TC string and returns what it grants.
+func DecodeGrants(tcString string) (Grants, error) {
+	decoded, err := iabtcfv2.Decode(tcString)
+	if err != nil {
+		return Grants{}, err
+	}
+	core := decoded.CoreString
+	return Grants{
+		CmpID:           core.CmpId,
+		CmpVersion:      core.CmpVersion,
+		Purposes:        allowedIDs(maxPurposeID, decoded.IsPurposeAllowed),
+		PurposesLI:      allowedIDs(maxPurposeID, decoded.IsPurposeLIAllowed),
+		SpecialFeatures: allowedIDs(maxSpecialFeatureID, decoded.IsSpecialFeatureAllowed),
+		Vendors:         allowedIDs(core.MaxVendorId, decoded.IsVendorAllowed),
+		VendorsLI:       allowedIDs(core.MaxVendorIdLI, decoded.IsVendorLIAllowed),
+	}, nil
+}
+
+// Consented reports whether the TC string grants any consent or special feature opt-in. Legitimate interests are
+// established without the user's action, so they do not count.
+func (g Grants) Consented() bool {
+	return len(g.Purposes) > 0 || len(g.SpecialFeatures) > 0 || len(g.Vendors) > 0
+}
+
+// allowedIDs returns the IDs 1 to max allowed by the predicate.
+func allowedIDs(max int, allowed func(int) bool) []int {
+	var ids []int
+	for id := 1; id <= max; id++ {
+		if allowed(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
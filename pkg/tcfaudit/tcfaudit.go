@@ -0,0 +1,179 @@
+// Package tcfaudit is the stable API of the compliance checks: it generates TC strings from consent profiles, audits
+// how a page's CMP handles an injected consent string through any browser.Session, and compares TC strings. Other
+// tools can build their own orchestration on top of it, driving the browser with whatever automation library they
+// use.
+//
+// The package follows semantic versioning, see Version. It is part of the repository's module, whose releases are
+// tagged with the version of the package, e.g. v0.1.0, so it is fetched with
+// `go get github.com/CLendering/IAB-vendor-compliance@v0.1.0`. Until v1.0.0, a new minor version may change exported
+// identifiers in incompatible ways; from then on, only a new major version does.
+package tcfaudit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// Version is the semantic version of the package's API.
+const Version = "v0.1.0"
+
+const (
+	// Defaults for CMPs that do not report their version or the vendor list version in their ping response
+	DefaultCmpVersion = 1
+	DefaultGvlVersion = 189
+
+	DefaultPublisherCC = "NL" // DefaultPublisherCC is the publisher country code of profiles that set none.
+	MaxVendorID        = 1200 // MaxVendorID is the highest vendor ID granted by AcceptAll.
+)
+
+// CMP identifies the CMP a TC string is generated for.
+type CMP struct {
+	ID         int
+	Version    int
+	GvlVersion int // GvlVersion is the version of the vendor list the CMP uses.
+}
+
+// CMPFromPing returns the CMP that answered the ping, using the defaults for the versions it does not report.
+func CMPFromPing(ping tcf.Ping) CMP {
+	cmp := CMP{ID: ping.CmpID, Version: ping.CmpVersion, GvlVersion: ping.GvlVersion}
+	if cmp.Version == 0 {
+		cmp.Version = DefaultCmpVersion
+	}
+	if cmp.GvlVersion == 0 {
+		cmp.GvlVersion = DefaultGvlVersion
+	}
+	return cmp
+}
+
+// IDRange is an inclusive range of vendor IDs.
+type IDRange struct {
+	From int
+	To   int
+}
+
+// ConsentProfile is the consent a user gives, from which a TC string is generated for a CMP.
+type ConsentProfile struct {
+	Name            string
+	Purposes        []int     // Purposes are the purposes consented to.
+	PurposesLI      []int     // PurposesLI are the purposes whose legitimate interest was made transparent and not objected to.
+	SpecialFeatures []int     // SpecialFeatures are the special features opted in to.
+	Vendors         []IDRange // Vendors are the vendors consented to.
+	VendorsLI       []IDRange // VendorsLI are the vendors whose legitimate interest was made transparent and not objected to.
+	PublisherCC     string    // PublisherCC is the publisher's country code, DefaultPublisherCC if empty.
+}
+
+// Consent profiles used by the checks
+var (
+	// AcceptAll consents to purposes 1 to 10 and all vendors up to MaxVendorID.
+	AcceptAll = ConsentProfile{
+		Name:     "accept-all",
+		Purposes: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		Vendors:  []IDRange{{From: 1, To: MaxVendorID}},
+	}
+
+	// RejectAll consents to no purposes and no vendors.
+	RejectAll = ConsentProfile{Name: "reject-all"}
+
+	// LegitimateInterestOnly consents to nothing, but does not object to the legitimate interest of all vendors up to
+	// MaxVendorID for the purposes that may rely on it, 2 and 7 to 10. Vendors that store identifiers or are called
+	// under this profile either rely on legitimate interest or ignore the missing consent.
+	LegitimateInterestOnly = ConsentProfile{
+		Name:       "legitimate-interest-only",
+		PurposesLI: []int{2, 7, 8, 9, 10},
+		VendorsLI:  []IDRange{{From: 1, To: MaxVendorID}},
+	}
+)
+
+// AllVendorsExcept returns the profile consenting to the purposes of AcceptAll and to all vendors up to MaxVendorID
+// but the given one, under which the vendor is gated only if it reads its own vendor consent.
+func AllVendorsExcept(vendorID int) ConsentProfile {
+	profile := ConsentProfile{Name: fmt.Sprintf("all-vendors-except-%d", vendorID), Purposes: AcceptAll.Purposes}
+	if vendorID > 1 {
+		profile.Vendors = append(profile.Vendors, IDRange{From: 1, To: vendorID - 1})
+	}
+	if vendorID < MaxVendorID {
+		profile.Vendors = append(profile.Vendors, IDRange{From: vendorID + 1, To: MaxVendorID})
+	}
+	return profile
+}
+
+// OnlyVendor returns the profile consenting to the purposes of AcceptAll and to the given vendor only.
+func OnlyVendor(vendorID int) ConsentProfile {
+	return ConsentProfile{
+		Name:     fmt.Sprintf("only-vendor-%d", vendorID),
+		Purposes: AcceptAll.Purposes,
+		Vendors:  []IDRange{{From: vendorID, To: vendorID}},
+	}
+}
+
+// Build returns the TC data of the profile for the CMP, with a core string and a publisher TC segment.
+func (p ConsentProfile) Build(cmp CMP) *iabtcfv2.TCData {
+	publisherCC := p.PublisherCC
+	if publisherCC == "" {
+		publisherCC = DefaultPublisherCC
+	}
+
+	core := &iabtcfv2.CoreString{
+		Version:                2,
+		Created:                time.Now(),
+		LastUpdated:            time.Now(),
+		CmpId:                  cmp.ID,
+		CmpVersion:             cmp.Version,
+		ConsentScreen:          2,
+		ConsentLanguage:        "EN",
+		VendorListVersion:      cmp.GvlVersion,
+		TcfPolicyVersion:       2,
+		IsServiceSpecific:      true,
+		SpecialFeatureOptIns:   idSet(p.SpecialFeatures),
+		UseNonStandardStacks:   false,
+		PurposesConsent:        idSet(p.Purposes),
+		PurposesLITransparency: idSet(p.PurposesLI),
+		PurposeOneTreatment:    true,
+		PublisherCC:            publisherCC,
+		VendorsConsent:         map[int]bool{},
+		VendorsLITransparency:  map[int]bool{},
+	}
+
+	// Vendor consent is range encoded, legitimate interest as a bit field
+	if len(p.Vendors) > 0 {
+		core.IsRangeEncoding = true
+		core.NumEntries = len(p.Vendors)
+		for _, r := range p.Vendors {
+			core.RangeEntries = append(core.RangeEntries, &iabtcfv2.RangeEntry{StartVendorID: r.From, EndVendorID: r.To})
+			core.MaxVendorId = max(core.MaxVendorId, r.To)
+		}
+	}
+	for _, r := range p.VendorsLI {
+		for id := r.From; id <= r.To; id++ {
+			core.VendorsLITransparency[id] = true
+		}
+		core.MaxVendorIdLI = max(core.MaxVendorIdLI, r.To)
+	}
+
+	return &iabtcfv2.TCData{
+		CoreString: core,
+		PublisherTC: &iabtcfv2.PublisherTC{
+			SegmentType:               3,
+			PubPurposesConsent:        map[int]bool{},
+			PubPurposesLITransparency: map[int]bool{},
+		},
+	}
+}
+
+// TCString returns the TC string of the profile for the CMP.
+func (p ConsentProfile) TCString(cmp CMP) string {
+	return p.Build(cmp).ToTCString()
+}
+
+// idSet returns the IDs as a set.
+func idSet(ids []int) map[int]bool {
+	set := map[int]bool{}
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,150 @@
+package tcfaudit
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testCMP = CMP{ID: 28, Version: 3, GvlVersion: 200}
+
+// ids returns the IDs from from to to, in ascending order.
+func ids(from int, to int) []int {
+	var ids []int
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		profile       ConsentProfile
+		purposes      []int
+		ranges        [][2]int
+		maxVendorID   int
+		vendorsLI     int // vendorsLI is the number of vendors whose legitimate interest is established.
+		maxVendorIDLI int
+		publisherCC   string
+	}{
+		{profile: AcceptAll, purposes: ids(1, 10), ranges: [][2]int{{1, MaxVendorID}}, maxVendorID: MaxVendorID, publisherCC: DefaultPublisherCC},
+		{profile: RejectAll, publisherCC: DefaultPublisherCC},
+		{profile: LegitimateInterestOnly, vendorsLI: MaxVendorID, maxVendorIDLI: MaxVendorID, publisherCC: DefaultPublisherCC},
+		{profile: OnlyVendor(755), purposes: ids(1, 10), ranges: [][2]int{{755, 755}}, maxVendorID: 755, publisherCC: DefaultPublisherCC},
+		{profile: AllVendorsExcept(1), purposes: ids(1, 10), ranges: [][2]int{{2, MaxVendorID}}, maxVendorID: MaxVendorID, publisherCC: DefaultPublisherCC},
+		{profile: AllVendorsExcept(MaxVendorID), purposes: ids(1, 10), ranges: [][2]int{{1, MaxVendorID - 1}}, maxVendorID: MaxVendorID - 1, publisherCC: DefaultPublisherCC},
+		{profile: ConsentProfile{Name: "publisher", Purposes: []int{1}, PublisherCC: "DE"}, purposes: []int{1}, publisherCC: "DE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile.Name, func(t *testing.T) {
+			data := tt.profile.Build(testCMP)
+			core := data.CoreString
+			if core.CmpId != testCMP.ID || core.CmpVersion != testCMP.Version || core.VendorListVersion != testCMP.GvlVersion {
+				t.Errorf("CMP = %d v%d, vendor list %d, want %d v%d, vendor list %d", core.CmpId, core.CmpVersion, core.VendorListVersion, testCMP.ID, testCMP.Version, testCMP.GvlVersion)
+			}
+			if core.PublisherCC != tt.publisherCC {
+				t.Errorf("PublisherCC = %q, want %q", core.PublisherCC, tt.publisherCC)
+			}
+			if got := setIDs(core.PurposesConsent); !reflect.DeepEqual(got, tt.purposes) {
+				t.Errorf("purposes = %v, want %v", got, tt.purposes)
+			}
+
+			var ranges [][2]int
+			for _, r := range core.RangeEntries {
+				ranges = append(ranges, [2]int{r.StartVendorID, r.EndVendorID})
+			}
+			if !reflect.DeepEqual(ranges, tt.ranges) || core.NumEntries != len(tt.ranges) || core.IsRangeEncoding != (len(tt.ranges) > 0) {
+				t.Errorf("vendor ranges = %v (%d entries, range encoded %v), want %v", ranges, core.NumEntries, core.IsRangeEncoding, tt.ranges)
+			}
+			if core.MaxVendorId != tt.maxVendorID {
+				t.Errorf("MaxVendorId = %d, want %d", core.MaxVendorId, tt.maxVendorID)
+			}
+			if len(core.VendorsLITransparency) != tt.vendorsLI || core.MaxVendorIdLI != tt.maxVendorIDLI {
+				t.Errorf("vendors LI = %d up to %d, want %d up to %d", len(core.VendorsLITransparency), core.MaxVendorIdLI, tt.vendorsLI, tt.maxVendorIDLI)
+			}
+			if data.PublisherTC == nil || data.PublisherTC.SegmentType != 3 {
+				t.Errorf("PublisherTC = %+v, want a publisher TC segment", data.PublisherTC)
+			}
+		})
+	}
+}
+
+// setIDs returns the IDs set in the bit field, in ascending order.
+func setIDs(set map[int]bool) []int {
+	var ids []int
+	for id := 1; id <= maxPurposeID; id++ {
+		if set[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestCanadaTCString(t *testing.T) {
+	tests := []struct {
+		profile ConsentProfile
+		want    Grants
+	}{
+		{profile: AcceptAll, want: Grants{Purposes: ids(1, 10), Vendors: ids(1, MaxVendorID)}},
+		{profile: RejectAll, want: Grants{}},
+		{profile: LegitimateInterestOnly, want: Grants{PurposesLI: []int{2, 7, 8, 9, 10}, VendorsLI: ids(1, MaxVendorID)}},
+		{profile: AllVendorsExcept(3), want: Grants{Purposes: ids(1, 10), Vendors: append([]int{1, 2}, ids(4, MaxVendorID)...)}},
+		{profile: ConsentProfile{Name: "special-features", SpecialFeatures: []int{1, 2}, Vendors: []IDRange{{From: 5, To: 5}}}, want: Grants{SpecialFeatures: []int{1, 2}, Vendors: []int{5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile.Name, func(t *testing.T) {
+			got, err := DecodeCanadaGrants(tt.profile.CanadaTCString(testCMP))
+			if err != nil {
+				t.Fatalf("DecodeCanadaGrants() error = %v", err)
+			}
+			tt.want.CmpID, tt.want.CmpVersion = testCMP.ID, testCMP.Version
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeCanadaGrants() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffCanadaTCStrings(t *testing.T) {
+	acceptAll := AcceptAll.CanadaTCString(testCMP)
+	tests := []struct {
+		name     string
+		returned string
+		changed  bool
+		want     Diff
+	}{
+		{name: "kept", returned: acceptAll, want: Diff{}},
+		{name: "other CMP", returned: AcceptAll.CanadaTCString(CMP{ID: 7, Version: 3}), want: Diff{Fields: map[string][2]string{"cmpId": {"28", "7"}}}},
+		{name: "rejected", returned: RejectAll.CanadaTCString(testCMP), changed: true, want: Diff{PurposesDropped: ids(1, 10), VendorsDropped: "1-1200"}},
+		{name: "nothing returned", returned: "", want: Diff{Error: "CMP returned no TC string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffCanadaTCStrings(acceptAll, tt.returned)
+			if !reflect.DeepEqual(diff, tt.want) {
+				t.Errorf("DiffCanadaTCStrings() = %+v, want %+v", diff, tt.want)
+			}
+			if diff.GrantsChanged() != tt.changed {
+				t.Errorf("GrantsChanged() = %v, want %v", diff.GrantsChanged(), tt.changed)
+			}
+		})
+	}
+}
+
+func TestGPPString(t *testing.T) {
+	tests := []struct {
+		sectionID int
+		want      string
+	}{
+		{sectionID: 2, want: "DBABMA~section"},
+		{sectionID: gppCanadaSection, want: "DBABDA~section"},
+	}
+	for _, tt := range tests {
+		if got := GPPString(tt.sectionID, "section"); got != tt.want {
+			t.Errorf("GPPString(%d) = %q, want %q", tt.sectionID, got, tt.want)
+		}
+		ping := gppPing{SectionList: []int{tt.sectionID}, GPPString: tt.want}
+		if got := ping.section(tt.sectionID); got != "section" {
+			t.Errorf("section(%d) of %q = %q, want %q", tt.sectionID, tt.want, got, "section")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Package verdict is the taxonomy of the outcomes of injecting consent into a page's CMP, shared by the CMP check and
+// the adtech-vendor check so their results are read the same way. Both write the Verdict of every page as a CSV column
+// and as JSON lines of Records. The CMP check's numeric conditions map onto the verdicts of the pages whose CMP
+// answered, see FromCondition.
+package verdict
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+)
+
+// Verdict is the outcome of injecting consent into a page's CMP.
+type Verdict string
+
+// Verdicts
+const (
+	ConsentHonored      Verdict = "consent-honored"       // The CMP kept the injected TC string and its banner hidden (condition 1).
+	BannerReshown       Verdict = "banner-reshown"        // The CMP kept the injected TC string but showed its banner again (condition 2).
+	TCStringRegenerated Verdict = "tc-string-regenerated" // The CMP kept its banner hidden but returned another TC string (condition 3).
+	ConsentIgnored      Verdict = "consent-ignored"       // The CMP showed its banner again and returned another TC string (condition 0).
+	NoCMP               Verdict = "no-cmp"                // The page has no TCF API.
+	APITimeout          Verdict = "api-timeout"           // The page has a TCF API, but the CMP did not answer in time.
+	Error               Verdict = "error"                 // The page could not be checked, e.g. as it failed to load.
+)
+
+// All are the verdicts, in the order they are reported.
+var All = []Verdict{ConsentHonored, BannerReshown, TCStringRegenerated, ConsentIgnored, NoCMP, APITimeout, Error}
+
+// conditions are the CMP check's conditions of the verdicts of the pages whose CMP answered.
+var conditions = map[Verdict]string{
+	ConsentIgnored:      "0",
+	ConsentHonored:      "1",
+	BannerReshown:       "2",
+	TCStringRegenerated: "3",
+}
+
+// Classify returns the verdict of a page whose CMP answered after the reload, from whether it showed its banner and
+// whether it returned the injected TC string.
+func Classify(bannerShown bool, tcStringKept bool) Verdict {
+	switch {
+	case !bannerShown && tcStringKept:
+		return ConsentHonored
+	case bannerShown && tcStringKept:
+		return BannerReshown
+	case !bannerShown:
+		return TCStringRegenerated
+	}
+	return ConsentIgnored
+}
+
+// TCStringKept reports whether the TC string returned by the CMP is the injected one. The segments following the core
+// string, such as the publisher TC segment CMPs append, are ignored.
+func TCStringKept(injected string, returned string) bool {
+	return injected != "" && injected == strings.Split(returned, ".")[0]
+}
+
+// FromCondition returns the verdict of a condition of the CMP check, e.g. in the results of earlier runs.
+func FromCondition(condition string) (Verdict, bool) {
+	for v, c := range conditions {
+		if c == condition {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Condition returns the CMP check's condition of the verdict, or "" for the verdicts of pages whose CMP did not answer.
+func (v Verdict) Condition() string {
+	return conditions[v]
+}
+
+// Parse returns the verdict named s.
+func Parse(s string) (Verdict, error) {
+	for _, v := range All {
+		if string(v) == s {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unknown verdict %q", s)
+}
+
+// NewRecord returns the record of the page's verdict, with its condition, at the current time.
+func NewRecord(tool string, domain string, page string, v Verdict) Record {
+	return Record{Tool: tool, Domain: domain, Page: page, Verdict: v, Condition: v.Condition(), Time: clock.System.Now()}
+}
+
+// Record is the verdict of a page, as written to the JSON lines files of the checks.
+type Record struct {
+	Tool      string    `json:"tool"`
+	Domain    string    `json:"domain"`
+	Page      string    `json:"page"`
+	Verdict   Verdict   `json:"verdict"`
+	Condition string    `json:"condition,omitempty"` // Condition is the CMP check's condition of the verdict, see Verdict.Condition.
+	CmpID     int       `json:"cmpId,omitempty"`
+	Detail    string    `json:"detail,omitempty"` // Detail is the error of pages that could not be checked.
+	Time      time.Time `json:"time"`
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiffCSV is the name of the file the diff subcommand writes the changes between two scans to.
+const DiffCSV = "diff.csv"
+
+// Changes between two scans of a domain
+const (
+	changeDomainAdded      = "domain-added"      // The domain was only scanned in the new scan.
+	changeDomainRemoved    = "domain-removed"    // The domain was only scanned in the old scan.
+	changeCookieAdded      = "cookie-added"      // A third party cookie is only set in the new scan.
+	changeCookieRemoved    = "cookie-removed"    // A third party cookie is only set in the old scan.
+	changeVendorGained     = "vendor-gained"     // A vendor is only matched to the cookies of the new scan.
+	changeVendorLost       = "vendor-lost"       // A vendor is only matched to the cookies of the old scan.
+	changeViolationAdded   = "violation-added"   // A cookie is only set for purposes without consent in the new scan.
+	changeViolationRemoved = "violation-removed" // A cookie is only set for purposes without consent in the old scan.
+	changeCMP              = "cmp-changed"
+	changeCondition        = "condition-changed" // The CMP check's condition changed.
+	changeTCFAPIMode       = "tcf-mode-changed"
+	changeVerdict          = "verdict-changed"
+)
+
+// change is a difference between two scans of a domain. Old and New are the values in each scan, if the change is
+// not the addition or removal of Item.
+type change struct {
+	Domain string
+	Kind   string
+	Item   string
+	Old    string
+	New    string
+}
+
+// datasetInputs returns the inputs of a scan kept in a directory laid out as the repository, e.g. a copy of the
+// outputs of a past run. The default inputs are relative to this directory, one level below the repository's root.
+func datasetInputs(root string) inputs {
+	path := func(input string) string {
+		return filepath.Join(root, strings.TrimPrefix(input, "../"))
+	}
+	return inputs{cookies: path(CookiesFile), modes: path(TCFModesFile), results: path(ResultsDir), cmp: path(CMPResultsFile)}
+}
+
+// runDiff compares the scans kept in the directories oldDir and newDir, writes the changes of every domain to
+// DiffCSV in outputDir and prints the number of changes of each kind.
+func runDiff(oldDir string, newDir string, outputDir string) error {
+	if oldDir == "" || newDir == "" {
+		return fmt.Errorf("usage: go run . [flags] diff <old> <new>")
+	}
+	for _, dir := range []string{oldDir, newDir} {
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+	}
+	oldReports, newReports := loadReports(datasetInputs(oldDir)), loadReports(datasetInputs(newDir))
+	for _, reports := range []map[string]*domainReport{oldReports, newReports} {
+		for _, r := range reports {
+			r.TC.decode()
+			r.judge()
+		}
+	}
+
+	changes := diffReports(oldReports, newReports)
+	rows := [][]string{{"Domain", "Change", "Item", "Old", "New"}}
+	kinds := map[string]int{}
+	domains := map[string]bool{}
+	for _, c := range changes {
+		rows = append(rows, []string{c.Domain, c.Kind, c.Item, c.Old, c.New})
+		kinds[c.Kind]++
+		domains[c.Domain] = true
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(outputDir, DiffCSV)
+	if err := writeCSV(path, rows); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %d changes on %d of %d domains to %s\n", len(changes), len(domains), len(domainUnion(oldReports, newReports)), path)
+	for _, c := range counts(kinds, len(changes)) {
+		fmt.Printf("  %-18s %d\n", c.Label, c.Count)
+	}
+	return nil
+}
+
+// domainUnion returns the domains of either scan, sorted.
+func domainUnion(oldReports map[string]*domainReport, newReports map[string]*domainReport) []string {
+	var domains []string
+	for domain := range oldReports {
+		domains = append(domains, domain)
+	}
+	for domain := range newReports {
+		if oldReports[domain] == nil {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// diffReports returns the changes between the old and the new report of every domain, by domain.
+func diffReports(oldReports map[string]*domainReport, newReports map[string]*domainReport) []change {
+	var changes []change
+	for _, domain := range domainUnion(oldReports, newReports) {
+		o, n := oldReports[domain], newReports[domain]
+		switch {
+		case o == nil:
+			changes = append(changes, change{Domain: domain, Kind: changeDomainAdded, New: n.Verdict})
+			continue
+		case n == nil:
+			changes = append(changes, change{Domain: domain, Kind: changeDomainRemoved, Old: o.Verdict})
+			continue
+		}
+
+		changes = append(changes, diffSets(domain, cookieSet(o), cookieSet(n), changeCookieAdded, changeCookieRemoved)...)
+		changes = append(changes, diffSets(domain, vendorSet(o), vendorSet(n), changeVendorGained, changeVendorLost)...)
+		changes = append(changes, diffSets(domain, violationSet(o), violationSet(n), changeViolationAdded, changeViolationRemoved)...)
+		for _, field := range []struct {
+			kind     string
+			old, new string
+		}{
+			{changeCMP, o.cmp(), n.cmp()},
+			{changeCondition, o.Condition, n.Condition},
+			{changeTCFAPIMode, o.TCFAPIMode, n.TCFAPIMode},
+			{changeVerdict, o.Verdict, n.Verdict},
+		} {
+			if field.old != field.new {
+				changes = append(changes, change{Domain: domain, Kind: field.kind, Old: field.old, New: field.new})
+			}
+		}
+	}
+	return changes
+}
+
+// diffSets returns a change of kind added for every item only in newItems and of kind removed for every item only in
+// oldItems, with the items' values, sorted by item.
+func diffSets(domain string, oldItems map[string]string, newItems map[string]string, added string, removed string) []change {
+	var changes []change
+	for item, value := range newItems {
+		if _, ok := oldItems[item]; !ok {
+			changes = append(changes, change{Domain: domain, Kind: added, Item: item, New: value})
+		}
+	}
+	for item, value := range oldItems {
+		if _, ok := newItems[item]; !ok {
+			changes = append(changes, change{Domain: domain, Kind: removed, Item: item, Old: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Item != changes[j].Item {
+			return changes[i].Item < changes[j].Item
+		}
+		return changes[i].Kind < changes[j].Kind
+	})
+	return changes
+}
+
+// cookieSet returns the domain's cookies, as name@domain, with the vendors they were matched to.
+func cookieSet(r *domainReport) map[string]string {
+	set := map[string]string{}
+	for _, c := range r.Cookies {
+		key := c.Name + "@" + strings.TrimPrefix(c.Domain, ".")
+		if c.VendorID != "" {
+			set[key] = c.VendorName + " (" + c.VendorID + ")"
+		} else if _, ok := set[key]; !ok {
+			set[key] = ""
+		}
+	}
+	return set
+}
+
+// vendorSet returns the vendors matched to the domain's cookies, as name (ID), with the number of their cookies.
+func vendorSet(r *domainReport) map[string]string {
+	cookies := map[string]int{}
+	for _, c := range r.Cookies {
+		if c.VendorID != "" {
+			cookies[c.VendorName+" ("+c.VendorID+")"]++
+		}
+	}
+	set := map[string]string{}
+	for vendor, n := range cookies {
+		set[vendor] = fmt.Sprintf("%d cookies", n)
+	}
+	return set
+}
+
+// violationSet returns the domain's cookies set for purposes without consent, as vendor: name@domain, with those
+// purposes.
+func violationSet(r *domainReport) map[string]string {
+	set := map[string]string{}
+	for _, v := range r.Violations {
+		set[v.VendorName+" ("+v.VendorID+"): "+v.Cookie+"@"+strings.TrimPrefix(v.CookieDomain, ".")] = v.WithoutConsent
+	}
+	return set
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+)
+
+const (
+	// EvidenceDir is the directory of the exchanges that set the cookies, kept by the adtech-vendor check with
+	// CaptureEvidence set, relative to this directory.
+	EvidenceDir  = VendorDir + "/evidence"
+	EvidenceFile = "cookies.json" // EvidenceFile is the file of the exchanges in the directory of each domain.
+
+	// BundlesDir is the directory, inside the report's, holding an evidence bundle per violation-level finding, as
+	// <domain>/<n>-<rule>-<cookie>.zip. Each bundle holds the finding, the raw Set-Cookie header, the request and
+	// response that set the cookie, the TC string in place at the time, decoded, and the screenshot of that stage
+	BundlesDir = "evidence"
+)
+
+// violationRules are the rules whose findings are violations about a cookie, which get an evidence bundle.
+var violationRules = map[string]bool{ruleCookieBeforeConsent: true, rulePurposeWithoutConsent: true}
+
+// exchange is the exchange that first set a cookie, as written to EvidenceFile by the adtech-vendor check.
+type exchange struct {
+	Name      string `json:"name"`
+	Domain    string `json:"domain"`
+	SetCookie string `json:"setCookie"`
+	Request   struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Proto   string      `json:"proto"`
+		Headers http.Header `json:"headers"`
+	} `json:"request"`
+	Response struct {
+		Status  string      `json:"status"`
+		Proto   string      `json:"proto"`
+		Headers http.Header `json:"headers"`
+	} `json:"response"`
+	Page       string     `json:"page"`
+	SetAt      time.Time  `json:"setAt"`
+	InjectedAt *time.Time `json:"injectedAt"`
+	TCString   string     `json:"tcString"`
+	Stage      string     `json:"stage"`
+}
+
+// bundleFinding is the finding.json of an evidence bundle.
+type bundleFinding struct {
+	Domain           string     `json:"domain"`
+	Rule             string     `json:"rule"`
+	Description      string     `json:"description"`
+	VendorID         string     `json:"vendorId"`
+	Vendor           string     `json:"vendor"`
+	Detail           string     `json:"detail"`
+	Cookie           string     `json:"cookie"`
+	CookieDomain     string     `json:"cookieDomain"`
+	ExchangeCaptured bool       `json:"exchangeCaptured"` // ExchangeCaptured reports whether the exchange that set the cookie is in the bundle.
+	Page             string     `json:"page,omitempty"`
+	SetAt            *time.Time `json:"setAt,omitempty"`
+	InjectedAt       *time.Time `json:"injectedAt,omitempty"`
+	Stage            string     `json:"stage,omitempty"`
+	Screenshot       string     `json:"screenshot,omitempty"` // Screenshot is the name of the screenshot in the bundle.
+	Generated        time.Time  `json:"generated"`
+}
+
+// bundleTCString is the tc-string.json of an evidence bundle.
+type bundleTCString struct {
+	TCString          string     `json:"tcString"`
+	DecodeError       string     `json:"decodeError,omitempty"`
+	CmpID             int        `json:"cmpId,omitempty"`
+	CmpVersion        int        `json:"cmpVersion,omitempty"`
+	Created           *time.Time `json:"created,omitempty"`
+	LastUpdated       *time.Time `json:"lastUpdated,omitempty"`
+	VendorListVersion int        `json:"vendorListVersion,omitempty"`
+	Purposes          []int      `json:"purposesConsented"`
+	Vendors           int        `json:"vendorsConsented"`
+	VendorConsent     bool       `json:"vendorConsent"` // VendorConsent reports whether the TC string grants the finding's vendor consent.
+}
+
+// writeBundles writes an evidence bundle for every violation-level finding, and returns the number of bundles written.
+// The exchanges are read from the evidence directory and the screenshots from the screenshot directory of the
+// adtech-vendor check.
+func writeBundles(dir string, evidenceDir string, screenshotDir string, domains []*domainReport, rules map[string]rule) (int, error) {
+	written := 0
+	for _, r := range domains {
+		exchanges := readExchanges(filepath.Join(evidenceDir, r.Domain, EvidenceFile))
+		n := 0
+		for _, f := range r.Findings {
+			if !violationRules[f.Rule] || f.Cookie == "" {
+				continue
+			}
+			n++
+			name := fmt.Sprintf("%d-%s-%s", n, f.Rule, strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(f.Cookie), "-"), "-"))
+			e := findExchange(exchanges, f.Cookie, f.CookieDomain)
+			if err := writeBundle(filepath.Join(dir, r.Domain, name+".zip"), name, r.Domain, f, rules[f.Rule].Description, e, screenshotDir); err != nil {
+				return written, fmt.Errorf("writing the evidence of %s on %s: %w", f.Cookie, r.Domain, err)
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+// readExchanges reads the exchanges of a domain. A missing or unreadable file yields none, so the bundles only hold the
+// findings.
+func readExchanges(path string) []exchange {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var exchanges []exchange
+	if err := json.Unmarshal(data, &exchanges); err != nil {
+		fmt.Fprintln(os.Stderr, "Skipping evidence", path+":", err)
+		return nil
+	}
+	return exchanges
+}
+
+// findExchange returns the exchange that set the cookie, or nil if it was not captured.
+func findExchange(exchanges []exchange, name string, domain string) *exchange {
+	for i := range exchanges {
+		if exchanges[i].Name == name && strings.TrimPrefix(exchanges[i].Domain, ".") == strings.TrimPrefix(domain, ".") {
+			return &exchanges[i]
+		}
+	}
+	return nil
+}
+
+// writeBundle writes the evidence of the finding as a zip at path, with its files in a directory of the given name.
+func writeBundle(path string, name string, domain string, f finding, description string, e *exchange, screenshotDir string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(out)
+
+	finding := bundleFinding{
+		Domain:       domain,
+		Rule:         f.Rule,
+		Description:  description,
+		VendorID:     f.VendorID,
+		Vendor:       f.Vendor,
+		Detail:       f.Detail,
+		Cookie:       f.Cookie,
+		CookieDomain: f.CookieDomain,
+		Generated:    time.Now(),
+	}
+	files := map[string][]byte{}
+	if e != nil {
+		setAt := e.SetAt
+		finding.ExchangeCaptured = true
+		finding.Page, finding.SetAt, finding.InjectedAt, finding.Stage = e.Page, &setAt, e.InjectedAt, e.Stage
+		files["set-cookie.txt"] = []byte(e.SetCookie + "\n")
+		files["request.txt"] = []byte(fmt.Sprintf("%s %s %s\n%s", e.Request.Method, e.Request.URL, e.Request.Proto, formatHeaders(e.Request.Headers)))
+		files["response.txt"] = []byte(fmt.Sprintf("%s %s\n%s", e.Response.Proto, e.Response.Status, formatHeaders(e.Response.Headers)))
+		if files["tc-string.json"], err = json.MarshalIndent(decodeBundleTCString(e.TCString, f.VendorID), "", "  "); err != nil {
+			return closeBundle(out, archive, err)
+		}
+
+		screenshot := filepath.Join(screenshotDir, domain, e.Stage+".jpg")
+		if data, err := os.ReadFile(screenshot); err == nil {
+			finding.Screenshot = "screenshot-" + e.Stage + ".jpg"
+			files[finding.Screenshot] = data
+		}
+	}
+	if files["finding.json"], err = json.MarshalIndent(finding, "", "  "); err != nil {
+		return closeBundle(out, archive, err)
+	}
+
+	names := make([]string, 0, len(files))
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	for _, file := range names {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name + "/" + file, Method: zip.Deflate, Modified: finding.Generated})
+		if err != nil {
+			return closeBundle(out, archive, err)
+		}
+		if _, err := w.Write(files[file]); err != nil {
+			return closeBundle(out, archive, err)
+		}
+	}
+	return closeBundle(out, archive, nil)
+}
+
+// closeBundle closes the zip and its file, returning err or else the first error closing them.
+func closeBundle(out io.Closer, archive *zip.Writer, err error) error {
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// formatHeaders formats the headers as in an HTTP/1.1 message, sorted by name.
+func formatHeaders(headers http.Header) string {
+	var b strings.Builder
+	if err := headers.WriteSubset(&b, nil); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// decodeBundleTCString decodes the TC string in place when the cookie was set.
+func decodeBundleTCString(tcString string, vendorID string) bundleTCString {
+	decoded := bundleTCString{TCString: tcString, Purposes: []int{}}
+	if tcString == "" {
+		return decoded
+	}
+	tc, err := iabtcfv2.Decode(tcString)
+	if err != nil {
+		decoded.DecodeError = err.Error()
+		return decoded
+	}
+
+	core := tc.CoreString
+	created, lastUpdated := core.Created, core.LastUpdated
+	decoded.CmpID, decoded.CmpVersion, decoded.VendorListVersion = core.CmpId, core.CmpVersion, core.VendorListVersion
+	decoded.Created, decoded.LastUpdated = &created, &lastUpdated
+	for id := 1; id <= maxPurposeID; id++ {
+		if tc.IsPurposeAllowed(id) {
+			decoded.Purposes = append(decoded.Purposes, id)
+		}
+	}
+	for id := 1; id <= core.MaxVendorId; id++ {
+		if tc.IsVendorAllowed(id) {
+			decoded.Vendors++
+		}
+	}
+	if id, err := strconv.Atoi(vendorID); err == nil {
+		decoded.VendorConsent = tc.IsVendorAllowed(id)
+	}
+	return decoded
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+)
+
+// PacketsDir is the directory, inside the report's, holding an evidence packet per vendor with violations. Each packet
+// is self-contained, with the screenshots copied into it, so it can be archived and sent to the vendor or the CMP.
+const PacketsDir = "packets"
+
+// slugPattern matches the characters replaced in the names of packet directories.
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// evidence is a cookie a vendor set for purposes without consent, with the consent in place at the time.
+type evidence struct {
+	violation
+	SetAt      string
+	RequestURL string
+	Page       string
+}
+
+// packetDomain holds the evidence gathered on a single domain.
+type packetDomain struct {
+	Domain           string
+	CmpID            int
+	Injected         string
+	InjectedPurposes []int
+	VendorConsent    bool // VendorConsent reports whether the injected consent string grants the vendor consent.
+	Returned         string
+	Evidence         []evidence
+	Screenshots      []string // Screenshots holds the paths of the screenshots copied into the packet, relative to it.
+	screenshotFiles  []string // screenshotFiles holds the paths the screenshots are copied from.
+}
+
+// packet is the evidence of the violations of a single vendor.
+type packet struct {
+	VendorID   string
+	VendorName string
+	Generated  time.Time
+	Domains    []packetDomain
+}
+
+// writePackets writes an evidence packet for every vendor that set cookies for purposes without consent, and returns
+// the number of packets written.
+func writePackets(dir string, domains []*domainReport) (int, error) {
+	packets := map[string]*packet{}
+	for _, r := range domains {
+		byVendor := map[string][]violation{}
+		for _, v := range r.Violations {
+			byVendor[v.VendorID] = append(byVendor[v.VendorID], v)
+		}
+
+		for id, violations := range byVendor {
+			if packets[id] == nil {
+				packets[id] = &packet{VendorID: id, VendorName: violations[0].VendorName, Generated: time.Now()}
+			}
+			packets[id].Domains = append(packets[id].Domains, newPacketDomain(r, id, violations))
+		}
+	}
+
+	for _, p := range packets {
+		sort.Slice(p.Domains, func(i, j int) bool { return p.Domains[i].Domain < p.Domains[j].Domain })
+		if err := writePacket(filepath.Join(dir, packetName(p)), p); err != nil {
+			return 0, fmt.Errorf("writing the packet of vendor %s: %w", p.VendorID, err)
+		}
+	}
+	return len(packets), nil
+}
+
+// newPacketDomain gathers the evidence of the vendor's violations on the domain, with the timestamps and request URLs
+// of the cookies and the consent injected at the time, decoded.
+func newPacketDomain(r *domainReport, vendorID string, violations []violation) packetDomain {
+	d := packetDomain{Domain: r.Domain, CmpID: r.TC.CmpID, Injected: r.TC.Generated, Returned: r.TC.Returned}
+	if tc, err := iabtcfv2.Decode(r.TC.Generated); err == nil {
+		for id := 1; id <= maxPurposeID; id++ {
+			if tc.IsPurposeAllowed(id) {
+				d.InjectedPurposes = append(d.InjectedPurposes, id)
+			}
+		}
+		if id, err := strconv.Atoi(vendorID); err == nil {
+			d.VendorConsent = tc.IsVendorAllowed(id)
+		}
+	}
+
+	for _, v := range violations {
+		e := evidence{violation: v}
+		for _, c := range r.Cookies {
+			if c.Name == v.Cookie && strings.TrimPrefix(c.Domain, ".") == strings.TrimPrefix(v.CookieDomain, ".") {
+				e.SetAt, e.RequestURL, e.Page = c.SetAt, c.RequestURL, c.Page
+				break
+			}
+		}
+		d.Evidence = append(d.Evidence, e)
+	}
+
+	for _, path := range r.ScreenshotFiles {
+		d.Screenshots = append(d.Screenshots, "screenshots/"+r.Domain+"-"+filepath.Base(path))
+	}
+	d.screenshotFiles = r.ScreenshotFiles
+	return d
+}
+
+// packetName returns the name of the vendor's packet directory.
+func packetName(p *packet) string {
+	slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(p.VendorName), "-"), "-")
+	return p.VendorID + "-" + slug
+}
+
+// writePacket writes the packet's index.html and evidence.csv to dir, and copies the screenshots into it.
+func writePacket(dir string, p *packet) error {
+	if err := os.MkdirAll(filepath.Join(dir, "screenshots"), 0755); err != nil {
+		return err
+	}
+
+	rows := [][]string{{"Website", "Cookie Name", "Cookie Domain", "Set At", "Request URL", "Page", "Disclosed Purposes", "Granted Purposes", "Purposes Without Consent", "Injected Consent String", "Vendor Consent", "Returned Consent String"}}
+	for _, d := range p.Domains {
+		for _, e := range d.Evidence {
+			rows = append(rows, []string{d.Domain, e.Cookie, e.CookieDomain, e.SetAt, e.RequestURL, e.Page, e.Disclosed, e.Granted, e.WithoutConsent, d.Injected, fmt.Sprint(d.VendorConsent), d.Returned})
+		}
+	}
+	if err := writeCSV(filepath.Join(dir, "evidence.csv"), rows); err != nil {
+		return err
+	}
+
+	for _, d := range p.Domains {
+		for i, file := range d.screenshotFiles {
+			if err := copyFile(file, filepath.Join(dir, d.Screenshots[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return render(filepath.Join(dir, "index.html"), packetTemplate, p)
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+var packetTemplate = template.Must(template.New("packet").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.VendorName}} ({{.VendorID}}) - TCF purpose violations</title>` + style + `
+</head>
+<body>
+	<h1>TCF purpose violations by {{.VendorName}} (vendor ID {{.VendorID}})</h1>
+	<p>
+		Generated {{.Generated.Format "2006-01-02"}}. On the {{len .Domains}} domains below, cookies disclosed by the vendor
+		in the Global Vendor List were set for purposes the consent string in place did not grant. Each domain lists the
+		consent that was injected before the cookies were captured, the cookies with the time they were set and the request
+		that set them, and screenshots of the consent banner. The same evidence is in evidence.csv.
+	</p>
+
+	{{range .Domains}}
+	<h2>{{.Domain}}</h2>
+	<table>
+		{{if .CmpID}}<tr><th>CMP ID</th><td>{{.CmpID}}</td></tr>{{end}}
+		<tr><th>Injected consent string</th><td><code>{{.Injected}}</code></td></tr>
+		<tr><th>Purposes consented</th><td>{{.InjectedPurposes}}</td></tr>
+		<tr><th>Vendor consent</th><td>{{.VendorConsent}}</td></tr>
+		<tr><th>Consent string returned after reload</th><td><code>{{.Returned}}</code></td></tr>
+	</table>
+	<table>
+		<tr><th>Cookie</th><th>Cookie domain</th><th>Set at</th><th>Request URL</th><th>Page</th><th>Disclosed purposes</th><th>Purposes without consent</th></tr>
+		{{range .Evidence}}
+		<tr>
+			<td>{{.Cookie}}</td><td>{{.CookieDomain}}</td><td>{{.SetAt}}</td><td><code>{{.RequestURL}}</code></td><td>{{.Page}}</td>
+			<td>{{.Disclosed}}</td><td>{{.WithoutConsent}}</td>
+		</tr>
+		{{end}}
+	</table>
+	{{if .Screenshots}}
+	<p>On initial load, after consent injection and after reload:</p>
+	<div class="screenshots">{{range .Screenshots}}<a href="{{.}}"><img src="{{.}}"></a>{{end}}</div>
+	{{end}}
+	{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,613 @@
+// report renders the results of the compliance checks as HTML: a report per domain with the cookies found, the vendors
+// they were matched to, the analysis of the TC strings, the banner screenshots and a verdict, and a summary of all
+// domains with the top violating vendors, the market share of the CMPs and the breakdown of the CMP check's conditions.
+// The findings on each domain are scored by the rules in rules.yaml, see score.go, ranking the domains and vendors.
+//
+// Usage:
+//
+//	go run . [flags]                   write index.html and a page per domain to the -out directory, see -h for the input files
+//	go run . [flags] diff <old> <new>  write the changes between two scans of the same domains to diff.csv in the -out directory, see diff.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Default locations of the inputs, relative to this directory. Missing inputs are skipped, leaving their sections empty
+	VendorDir      = "../vendor-compliance-check"
+	CookiesFile    = VendorDir + "/output.csv"    // CookiesFile is the output of extract-third-party-cookies.go.
+	TCFModesFile   = VendorDir + "/tcf_modes.csv" // TCFModesFile holds the TCF API mode and error of every scanned domain.
+	ScreenshotDir  = VendorDir + "/screenshots"   // ScreenshotDir holds a directory of screenshots per domain.
+	ResultsDir     = VendorDir + "/cross-reference-gvl"
+	CMPResultsFile = "../cmp-compliance-check/output.csv" // CMPResultsFile is the output of inject-custom-consent.go.
+	OutputDir      = "report"
+
+	// Names of the result files written by reference-gvl.go
+	MatchedResultsCSV   = "matched_results.csv"
+	UnmatchedResultsCSV = "unmatched_results.csv"
+	PurposeViolationCSV = "purpose_violations.csv"
+
+	// CMPListURL is the list of registered CMPs, used to name the CMPs in the summary. CMPs are shown by ID if it cannot be fetched.
+	CMPListURL = "https://cmplist.consensu.org/v2/cmp-list.json"
+
+	TopVendors = 20 // TopVendors specifies the number of violating vendors listed in the summary.
+
+	maxPurposeID = 11
+)
+
+// conditions describes the conditions written by inject-custom-consent.go, comparing the banner's visibility and the TC
+// string after reload with the injected consent.
+var conditions = map[string]string{
+	"0": "Banner reshown and consent string changed",
+	"1": "Consent respected: banner hidden and consent string kept",
+	"2": "Banner reshown despite valid consent",
+	"3": "Consent string changed without reshowing the banner",
+}
+
+// screenshotStages lists the screenshots taken by extract-third-party-cookies.go, in the order they are taken.
+var screenshotStages = []string{"1-initial-load", "2-after-injection", "3-after-reload"}
+
+// Verdicts of a domain
+const (
+	verdictCompliant    = "Compliant"
+	verdictNonCompliant = "Non-compliant"
+	verdictInconclusive = "Inconclusive"
+)
+
+// cookie is a third party cookie captured on a domain, with the vendor it was matched to.
+type cookie struct {
+	Domain    string
+	Name      string
+	Expires   string
+	Page      string
+	ServerSet string
+	// SetBeforeInjection is "true" if the cookie was first set before the consent was injected.
+	SetBeforeInjection string
+	SetAt              string // SetAt is the time at which the cookie was first set.
+	RequestURL         string // RequestURL is the URL, without its query, of the request whose response set the cookie.
+	VendorID           string
+	VendorName         string
+	Purposes           string
+}
+
+// violation is a cookie set for purposes without consent.
+type violation struct {
+	VendorID       string
+	VendorName     string
+	Cookie         string
+	CookieDomain   string
+	Disclosed      string
+	Granted        string
+	WithoutConsent string
+}
+
+// tcAnalysis is the injected TC string compared with the one the CMP returned after reload.
+type tcAnalysis struct {
+	Generated         string
+	Returned          string
+	Diff              string
+	EventStatusBefore string
+	EventStatusAfter  string
+	CmpID             int
+	VendorListVersion int
+	Purposes          []int
+	Vendors           int
+	DecodeError       string
+}
+
+// domainReport holds everything known about a single domain.
+type domainReport struct {
+	Domain          string
+	Verdict         string
+	Reasons         []string
+	TCFAPIMode      string
+	Error           string
+	CMPRoute        string
+	Condition       string
+	CmpID           string
+	TC              tcAnalysis
+	Cookies         []cookie
+	Violations      []violation
+	Unmatched       []string // Unmatched holds the cookies, as name@domain, not matched to any vendor.
+	Screenshots     []string // Screenshots holds the paths of the screenshots relative to the domain's page.
+	ScreenshotFiles []string // ScreenshotFiles holds the paths of the screenshots relative to this directory.
+	Findings        []finding
+	RuleScores      []ruleScore
+	Score           float64
+}
+
+// count is a labelled number shown in the summary.
+type count struct {
+	Label   string
+	Count   int
+	Percent float64
+}
+
+// summary holds the aggregates shown on the index page.
+type summary struct {
+	Generated  time.Time
+	Domains    []*domainReport
+	Verdicts   []count
+	Vendors    []count
+	CMPs       []count
+	Conditions []count
+	TopDomains []*domainReport
+	TopVendors []*vendorScore
+	Estimates  []estimate
+	// EffectiveSize is the effective sample size of the estimates, which equals the number of domains if they are
+	// weighted equally.
+	EffectiveSize float64
+	Weighted      bool // Weighted reports whether the domains were weighted by a weights file.
+}
+
+func main() {
+	cookiesFile := flag.String("cookies", CookiesFile, "cookies captured by the adtech-vendor check")
+	modesFile := flag.String("modes", TCFModesFile, "TCF API modes file of the adtech-vendor check")
+	screenshotDir := flag.String("screenshots", ScreenshotDir, "directory of the banner screenshots")
+	evidenceDir := flag.String("evidence", EvidenceDir, "directory of the exchanges that set the cookies")
+	resultsDir := flag.String("results", ResultsDir, "directory of the cross-referenced results")
+	cmpFile := flag.String("cmp", CMPResultsFile, "results of the CMP check")
+	outputDir := flag.String("out", OutputDir, "directory the report is written to")
+	rulesFile := flag.String("rules", RulesFile, "rules scoring the findings")
+	weightsFile := flag.String("weights", WeightsFile, "sampling weights of the domains, weighting the prevalence estimates")
+	flag.Parse()
+
+	if flag.Arg(0) == "diff" {
+		if err := runDiff(flag.Arg(1), flag.Arg(2), *outputDir); err != nil {
+			fmt.Fprintln(os.Stderr, "Error diffing the scans:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	rules, err := loadRules(*rulesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading rules:", err)
+		os.Exit(1)
+	}
+	weights := map[string]float64{}
+	if *weightsFile != "" {
+		if weights, err = loadWeights(*weightsFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading weights:", err)
+			os.Exit(1)
+		}
+	}
+
+	reports := loadReports(inputs{cookies: *cookiesFile, modes: *modesFile, results: *resultsDir, cmp: *cmpFile})
+
+	domainsDir := filepath.Join(*outputDir, "domains")
+	if err := os.MkdirAll(domainsDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating output directory:", err)
+		os.Exit(1)
+	}
+
+	var domains []*domainReport
+	for _, r := range reports {
+		r.TC.decode()
+		r.judge()
+		r.collectFindings()
+		r.score(rules)
+		r.ScreenshotFiles = screenshotFiles(*screenshotDir, r.Domain)
+		r.Screenshots = relativePaths(r.ScreenshotFiles, domainsDir)
+		domains = append(domains, r)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Score != domains[j].Score {
+			return domains[i].Score > domains[j].Score
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+	vendorScores := scoreVendors(domains, rules)
+
+	for _, r := range domains {
+		if err := render(filepath.Join(domainsDir, pageName(r.Domain)), domainTemplate, r); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing report of", r.Domain+":", err)
+			os.Exit(1)
+		}
+	}
+	index := summarize(domains, vendorScores, fetchCMPNames(CMPListURL))
+	index.Estimates, index.EffectiveSize = estimatePrevalence(domains, weights, rules)
+	index.Weighted = *weightsFile != ""
+	if err := render(filepath.Join(*outputDir, "index.html"), summaryTemplate, index); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing summary:", err)
+		os.Exit(1)
+	}
+	packets, err := writePackets(filepath.Join(*outputDir, PacketsDir), domains)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing evidence packets:", err)
+		os.Exit(1)
+	}
+	bundles, err := writeBundles(filepath.Join(*outputDir, BundlesDir), *evidenceDir, *screenshotDir, domains, rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing evidence bundles:", err)
+		os.Exit(1)
+	}
+	if err := writeScores(filepath.Join(*outputDir, DomainScoresCSV), filepath.Join(*outputDir, VendorScoresCSV), domains, vendorScores); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing scores:", err)
+		os.Exit(1)
+	}
+	if err := writeEstimates(filepath.Join(*outputDir, EstimatesCSV), index.Estimates, index.EffectiveSize); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing prevalence estimates:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote the report of %d domains to %s, %d evidence packets to %s and %d evidence bundles to %s\n", len(domains), filepath.Join(*outputDir, "index.html"), packets, filepath.Join(*outputDir, PacketsDir), bundles, filepath.Join(*outputDir, BundlesDir))
+}
+
+// inputs are the paths of the files the reports are read from.
+type inputs struct {
+	cookies string // cookies is the output of extract-third-party-cookies.go.
+	modes   string // modes is the TCF API modes file of the adtech-vendor check.
+	results string // results is the directory of the results of reference-gvl.go.
+	cmp     string // cmp is the output of inject-custom-consent.go.
+}
+
+// loadReports reads the results of the checks from the input files into a report per domain.
+func loadReports(in inputs) map[string]*domainReport {
+	reports := map[string]*domainReport{}
+	get := func(domain string) *domainReport {
+		if reports[domain] == nil {
+			reports[domain] = &domainReport{Domain: domain}
+		}
+		return reports[domain]
+	}
+
+	// Rows of the cookies file are: Website, Domain, Name, Value, Path, Expires, IsExpired, Generated Consent String,
+	// API Consent String, Consent Diff, EventStatus b4, EventStatus after, Status Updated, Page, Set Without JavaScript,
+	// Set Before Injection, Set At, Request URL
+	for _, row := range readRows(in.cookies) {
+		if len(row) < 12 {
+			continue
+		}
+		r := get(row[0])
+		r.TC = tcAnalysis{Generated: row[7], Returned: row[8], Diff: row[9], EventStatusBefore: row[10], EventStatusAfter: row[11]}
+		c := cookie{Domain: row[1], Name: row[2], Expires: row[5]}
+		if len(row) > 13 {
+			c.Page = row[13]
+		}
+		if len(row) > 14 {
+			c.ServerSet = row[14]
+		}
+		if len(row) > 15 {
+			c.SetBeforeInjection = row[15]
+		}
+		if len(row) > 17 {
+			c.SetAt, c.RequestURL = row[16], row[17]
+		}
+		r.Cookies = append(r.Cookies, c)
+	}
+
+	// Rows of the TCF API modes file are: Website, TCF API Mode, Error, Attempts, CMP Route
+	for _, row := range readRows(in.modes) {
+		if len(row) < 2 {
+			continue
+		}
+		r := get(row[0])
+		r.TCFAPIMode = row[1]
+		if len(row) > 2 {
+			r.Error = row[2]
+		}
+		if len(row) > 4 {
+			r.CMPRoute = row[4]
+		}
+	}
+
+	// Rows of the CMP check's results are: Domain, Condition, CmpID, FinalTCString, GeneratedTCString, Page. Only the
+	// condition on the homepage is kept.
+	for _, row := range readRows(in.cmp) {
+		if len(row) < 3 || (len(row) > 5 && row[5] != "" && get(row[0]).Condition != "") {
+			continue
+		}
+		r := get(row[0])
+		r.Condition, r.CmpID = row[1], row[2]
+	}
+
+	// Rows of matched_results.csv are: Website, Vendor Name, Vendor ID, Purposes, Cookie Name, Cookie Domain, Cookie Purposes, Type,
+	// Match Type, Confidence
+	for _, row := range readRows(filepath.Join(in.results, MatchedResultsCSV)) {
+		if len(row) < 7 || reports[row[0]] == nil {
+			continue
+		}
+		cookies := reports[row[0]].Cookies
+		for i := range cookies {
+			if c := &cookies[i]; c.Name == row[4] && strings.TrimPrefix(c.Domain, ".") == strings.TrimPrefix(row[5], ".") {
+				c.VendorID, c.VendorName, c.Purposes = row[2], row[1], row[6]
+			}
+		}
+	}
+
+	// Rows of unmatched_results.csv are: Website, Cookie Name, Cookie Domain, Type
+	for _, row := range readRows(filepath.Join(in.results, UnmatchedResultsCSV)) {
+		if len(row) < 3 {
+			continue
+		}
+		r := get(row[0])
+		r.Unmatched = append(r.Unmatched, row[1]+"@"+row[2])
+	}
+
+	// Rows of purpose_violations.csv are: Website, Vendor Name, Vendor ID, Cookie Name, Cookie Domain, Disclosed Purposes,
+	// Granted Purposes, Purposes Without Consent, Type
+	for _, row := range readRows(filepath.Join(in.results, PurposeViolationCSV)) {
+		if len(row) < 8 {
+			continue
+		}
+		r := get(row[0])
+		r.Violations = append(r.Violations, violation{VendorID: row[2], VendorName: row[1], Cookie: row[3], CookieDomain: row[4], Disclosed: row[5], Granted: row[6], WithoutConsent: row[7]})
+	}
+
+	return reports
+}
+
+// readRows reads the rows of a CSV file, skipping its header. Files compressed according to outfile.Compression are
+// decompressed. A missing or unreadable file is reported and yields no rows.
+func readRows(path string) [][]string {
+	file, err := outfile.OpenReader(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: skipping", path+":", err)
+		return nil
+	}
+	defer file.Close()
+
+	reader := csvfile.NewReader(file)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, "Warning: error reading", path+":", err)
+	}
+	if len(rows) > 0 && len(rows[0]) > 0 && (rows[0][0] == "Website" || rows[0][0] == "Domain") {
+		rows = rows[1:]
+	}
+	return rows
+}
+
+// decode decodes the TC string returned by the CMP, or the generated one if the CMP returned none.
+func (a *tcAnalysis) decode() {
+	tcString := a.Returned
+	if tcString == "" {
+		tcString = a.Generated
+	}
+	if tcString == "" {
+		return
+	}
+
+	tc, err := iabtcfv2.Decode(tcString)
+	if err != nil {
+		a.DecodeError = err.Error()
+		return
+	}
+	a.CmpID, a.VendorListVersion = tc.CoreString.CmpId, tc.CoreString.VendorListVersion
+	for id := 1; id <= maxPurposeID; id++ {
+		if tc.IsPurposeAllowed(id) {
+			a.Purposes = append(a.Purposes, id)
+		}
+	}
+	for id := 1; id <= tc.CoreString.MaxVendorId; id++ {
+		if tc.IsVendorAllowed(id) {
+			a.Vendors++
+		}
+	}
+}
+
+// grantsChanged reports whether the CMP changed the consent or legitimate interest the injected TC string granted to
+// purposes or vendors, see tcfaudit.Diff.GrantsChanged. Otherwise it returns why the strings could not be compared, if
+// they could not.
+func (a tcAnalysis) grantsChanged() (bool, string) {
+	diff, err := tcfaudit.ParseDiff(a.Diff)
+	if err != nil {
+		return false, "unreadable consent diff: " + err.Error()
+	}
+	return diff.GrantsChanged(), diff.Error
+}
+
+// judge sets the verdict of the domain and the reasons for it. A domain is non-compliant if a vendor set cookies for
+// purposes without consent, the CMP changed the consent granted by the injected TC string or reshowed the banner, and
+// inconclusive if it was not scanned successfully, has no TCF API or its TC strings could not be compared.
+func (r *domainReport) judge() {
+	if len(r.Violations) > 0 {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("%d cookies set for purposes without consent", len(r.Violations)))
+	}
+	changed, diffError := r.TC.grantsChanged()
+	if changed {
+		r.Reasons = append(r.Reasons, "the CMP changed the injected consent after reload")
+	}
+	if r.Condition != "" && r.Condition != "1" {
+		r.Reasons = append(r.Reasons, "CMP check condition "+r.Condition+": "+conditions[r.Condition])
+	}
+
+	switch {
+	case len(r.Reasons) > 0:
+		r.Verdict = verdictNonCompliant
+	case r.Error != "" && r.Error != "tcf-missing":
+		r.Verdict = verdictInconclusive
+		r.Reasons = append(r.Reasons, "scan error: "+r.Error)
+	case r.TCFAPIMode == "none" || r.TCFAPIMode == "" && r.Condition == "":
+		r.Verdict = verdictInconclusive
+		r.Reasons = append(r.Reasons, "no TCF API found")
+	case diffError != "":
+		r.Verdict = verdictInconclusive
+		r.Reasons = append(r.Reasons, "TC strings not compared: "+diffError)
+	default:
+		r.Verdict = verdictCompliant
+	}
+}
+
+// screenshotFiles returns the paths of the screenshots taken of the domain, in the order they were taken.
+func screenshotFiles(dir string, domain string) []string {
+	var paths []string
+	for _, stage := range screenshotStages {
+		path := filepath.Join(dir, domain, stage+".jpg")
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// relativePaths returns the paths relative to dir, as used in links from the pages in dir.
+func relativePaths(paths []string, dir string) []string {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+
+	var relative []string
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(absDir, absPath); err == nil {
+			relative = append(relative, filepath.ToSlash(rel))
+		}
+	}
+	return relative
+}
+
+// fetchCMPNames returns the names of the registered CMPs by ID, or nil if the list cannot be fetched.
+func fetchCMPNames(url string) map[string]string {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: showing CMPs by ID, error fetching the CMP list:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		CMPs map[string]struct {
+			Name string `json:"name"`
+		} `json:"cmps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: showing CMPs by ID, error decoding the CMP list:", err)
+		return nil
+	}
+
+	names := map[string]string{}
+	for id, cmp := range list.CMPs {
+		names[id] = cmp.Name
+	}
+	return names
+}
+
+// summarize aggregates the domain reports, which are ranked by score, and lists the highest scoring domains and
+// vendors. CMPs are identified by the CMP check's result, or the CMP ID in the TC
+// string returned on the domain if it was not checked.
+func summarize(domains []*domainReport, vendorScores []*vendorScore, cmpNames map[string]string) summary {
+	verdicts := map[string]int{}
+	vendors := map[string]int{}
+	cmps := map[string]int{}
+	conditionCounts := map[string]int{}
+	for _, r := range domains {
+		verdicts[r.Verdict]++
+
+		seen := map[string]bool{}
+		for _, v := range r.Violations {
+			label := v.VendorName + " (" + v.VendorID + ")"
+			if !seen[label] {
+				seen[label] = true
+				vendors[label]++
+			}
+		}
+
+		if cmpID := r.cmp(); cmpID != "" {
+			if name, ok := cmpNames[cmpID]; ok {
+				cmpID = name + " (" + cmpID + ")"
+			}
+			cmps[cmpID]++
+		}
+
+		if r.Condition != "" {
+			conditionCounts[r.Condition+": "+conditions[r.Condition]]++
+		}
+	}
+
+	topVendors := counts(vendors, len(domains))
+	if len(topVendors) > TopVendors {
+		topVendors = topVendors[:TopVendors]
+	}
+	topDomains := domains
+	if len(topDomains) > TopScores {
+		topDomains = topDomains[:TopScores]
+	}
+	if len(vendorScores) > TopScores {
+		vendorScores = vendorScores[:TopScores]
+	}
+	return summary{
+		Generated:  time.Now(),
+		TopDomains: topDomains,
+		TopVendors: vendorScores,
+		Domains:    domains,
+		Verdicts:   counts(verdicts, len(domains)),
+		Vendors:    topVendors,
+		CMPs:       counts(cmps, len(domains)),
+		Conditions: counts(conditionCounts, len(domains)),
+	}
+}
+
+// cmp returns the ID of the domain's CMP, as found by the CMP check or in the TC string returned on the domain if it
+// was not checked, or an empty string if it is not known.
+func (r *domainReport) cmp() string {
+	cmpID := r.CmpID
+	if cmpID == "" && r.TC.CmpID != 0 {
+		cmpID = strconv.Itoa(r.TC.CmpID)
+	}
+	if cmpID == "0" {
+		return ""
+	}
+	return cmpID
+}
+
+// counts returns the counts of the labels, highest first, with their share of total.
+func counts(labels map[string]int, total int) []count {
+	var result []count
+	for label, n := range labels {
+		percent := 0.0
+		if total > 0 {
+			percent = 100 * float64(n) / float64(total)
+		}
+		result = append(result, count{Label: label, Count: n, Percent: percent})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Label < result[j].Label
+	})
+	return result
+}
+
+// pageName returns the name of the file holding the report of the domain.
+func pageName(domain string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(domain) + ".html"
+}
+
+// render executes the template with the data and writes the result to path.
+func render(path string, tmpl *template.Template, data interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+)
+
+const (
+	// RulesFile holds the weights of the findings, relative to this directory.
+	RulesFile = "rules.yaml"
+
+	// Names of the score files written next to the report, ranking the domains and vendors by score
+	DomainScoresCSV = "domain_scores.csv"
+	VendorScoresCSV = "vendor_scores.csv"
+
+	TopScores = 20 // TopScores specifies the number of domains and vendors listed in the summary's rankings.
+)
+
+// IDs of the rules, which name the findings they score
+const (
+	ruleCookieBeforeConsent   = "cookie-before-consent"
+	rulePurposeWithoutConsent = "purpose-without-consent"
+	ruleTCStringIgnored       = "tc-string-ignored"
+	ruleUndisclosedDomain     = "undisclosed-cookie-domain"
+	ruleBannerReshown         = "banner-reshown"
+)
+
+// ruleIDs lists the rules in the order their columns appear in the score files.
+var ruleIDs = []string{ruleCookieBeforeConsent, rulePurposeWithoutConsent, ruleTCStringIgnored, ruleUndisclosedDomain, ruleBannerReshown}
+
+// rule weights the findings of one kind.
+type rule struct {
+	Description string  `yaml:"description"`
+	Weight      float64 `yaml:"weight"`
+	Max         float64 `yaml:"max"` // Max caps the score of the rule per domain, 0 leaves it uncapped.
+}
+
+// finding is an observation scored by a rule, attributed to a vendor if it is known.
+type finding struct {
+	Rule     string
+	VendorID string
+	Vendor   string
+	Detail   string
+
+	// Cookie and CookieDomain identify the cookie the finding is about, if it is about one.
+	Cookie       string
+	CookieDomain string
+}
+
+// ruleScore is the score of the findings of one rule.
+type ruleScore struct {
+	Rule        string
+	Description string
+	Count       int
+	Score       float64
+}
+
+// vendorScore is the score of a vendor across all domains.
+type vendorScore struct {
+	ID      string
+	Name    string
+	Domains int
+	Counts  map[string]int
+	Score   float64
+}
+
+// loadRules reads the rules from the YAML file, rejecting rules that are not known.
+func loadRules(path string) (map[string]rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Rules map[string]rule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, id := range ruleIDs {
+		known[id] = true
+	}
+	for id := range config.Rules {
+		if !known[id] {
+			return nil, fmt.Errorf("unknown rule %q", id)
+		}
+	}
+	return config.Rules, nil
+}
+
+// collectFindings lists the findings on the domain.
+func (r *domainReport) collectFindings() {
+	for _, c := range r.Cookies {
+		if c.SetBeforeInjection == "true" {
+			r.Findings = append(r.Findings, finding{Rule: ruleCookieBeforeConsent, VendorID: c.VendorID, Vendor: c.VendorName, Detail: c.Name + " on " + c.Domain, Cookie: c.Name, CookieDomain: c.Domain})
+		}
+	}
+	for _, v := range r.Violations {
+		r.Findings = append(r.Findings, finding{Rule: rulePurposeWithoutConsent, VendorID: v.VendorID, Vendor: v.VendorName, Detail: v.Cookie + " for purposes " + v.WithoutConsent, Cookie: v.Cookie, CookieDomain: v.CookieDomain})
+	}
+	if changed, _ := r.TC.grantsChanged(); changed {
+		r.Findings = append(r.Findings, finding{Rule: ruleTCStringIgnored, Detail: r.TC.Diff})
+	} else if r.Condition == "0" || r.Condition == "3" {
+		r.Findings = append(r.Findings, finding{Rule: ruleTCStringIgnored, Detail: "CMP check condition " + r.Condition})
+	}
+	for _, u := range r.Unmatched {
+		r.Findings = append(r.Findings, finding{Rule: ruleUndisclosedDomain, Detail: u})
+	}
+	if r.Condition == "0" || r.Condition == "2" {
+		r.Findings = append(r.Findings, finding{Rule: ruleBannerReshown, Detail: "CMP check condition " + r.Condition})
+	}
+}
+
+// scoreFindings returns the score of each rule for the findings, and the total.
+func scoreFindings(findings []finding, rules map[string]rule) ([]ruleScore, float64) {
+	counts := map[string]int{}
+	for _, f := range findings {
+		counts[f.Rule]++
+	}
+
+	var scores []ruleScore
+	total := 0.0
+	for _, id := range ruleIDs {
+		if counts[id] == 0 {
+			continue
+		}
+		s := rules[id].Weight * float64(counts[id])
+		if max := rules[id].Max; max > 0 && s > max {
+			s = max
+		}
+		scores = append(scores, ruleScore{Rule: id, Description: rules[id].Description, Count: counts[id], Score: s})
+		total += s
+	}
+	return scores, total
+}
+
+// score scores the findings on the domain.
+func (r *domainReport) score(rules map[string]rule) {
+	r.RuleScores, r.Score = scoreFindings(r.Findings, rules)
+}
+
+// scoreVendors returns the scores of the vendors the findings on the domains are attributed to, highest first. The
+// findings of a vendor are scored per domain, so caps apply per domain.
+func scoreVendors(domains []*domainReport, rules map[string]rule) []*vendorScore {
+	vendors := map[string]*vendorScore{}
+	for _, r := range domains {
+		byVendor := map[string][]finding{}
+		for _, f := range r.Findings {
+			if f.VendorID != "" {
+				byVendor[f.VendorID] = append(byVendor[f.VendorID], f)
+			}
+		}
+
+		for id, findings := range byVendor {
+			v := vendors[id]
+			if v == nil {
+				v = &vendorScore{ID: id, Name: findings[0].Vendor, Counts: map[string]int{}}
+				vendors[id] = v
+			}
+			scores, total := scoreFindings(findings, rules)
+			for _, s := range scores {
+				v.Counts[s.Rule] += s.Count
+			}
+			v.Domains++
+			v.Score += total
+		}
+	}
+
+	var result []*vendorScore
+	for _, v := range vendors {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// writeScores writes the domains and vendors, highest score first, to the score files.
+func writeScores(domainsPath string, vendorsPath string, domains []*domainReport, vendors []*vendorScore) error {
+	ranked := append([]*domainReport(nil), domains...)
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+
+	rows := [][]string{append([]string{"Website", "Score", "Verdict"}, ruleIDs...)}
+	for _, r := range ranked {
+		counts := map[string]int{}
+		for _, s := range r.RuleScores {
+			counts[s.Rule] = s.Count
+		}
+		rows = append(rows, append([]string{r.Domain, formatScore(r.Score), r.Verdict}, ruleCounts(counts)...))
+	}
+	if err := writeCSV(domainsPath, rows); err != nil {
+		return err
+	}
+
+	rows = [][]string{append([]string{"Vendor ID", "Vendor Name", "Score", "Domains"}, ruleIDs...)}
+	for _, v := range vendors {
+		rows = append(rows, append([]string{v.ID, v.Name, formatScore(v.Score), strconv.Itoa(v.Domains)}, ruleCounts(v.Counts)...))
+	}
+	return writeCSV(vendorsPath, rows)
+}
+
+// ruleCounts returns the counts of the findings in the order of ruleIDs.
+func ruleCounts(counts map[string]int) []string {
+	var columns []string
+	for _, id := range ruleIDs {
+		columns = append(columns, strconv.Itoa(counts[id]))
+	}
+	return columns
+}
+
+// formatScore formats a score without trailing zeros.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// writeCSV writes the rows to a new CSV file at path.
+func writeCSV(path string, rows [][]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := csvfile.NewWriter(file, true)
+	if err := writer.WriteAll(rows); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// WeightsFile attaches a sampling weight, e.g. the traffic of the domain, to the domains with the columns Domain
+	// and Weight. The domains file of the checks can hold the weights in its second column, which the checks ignore.
+	// Leave it empty to weight all domains equally.
+	WeightsFile   = ""
+	DefaultWeight = 1.0 // DefaultWeight is the weight of the domains missing from the weights file.
+
+	// EstimatesCSV is the name of the file written next to the report with the prevalence estimates.
+	EstimatesCSV = "prevalence.csv"
+
+	confidenceZ = 1.96 // confidenceZ is the z-score of the confidence level of the intervals, 95%.
+)
+
+// estimate is the prevalence of an outcome among the domains, weighted by the domains' sampling weights, with its
+// confidence interval.
+type estimate struct {
+	Label    string
+	Domains  int     // Domains is the number of domains with the outcome.
+	Share    float64 // Share is the unweighted percentage of domains with the outcome.
+	Weighted float64 // Weighted is the weighted percentage of domains with the outcome.
+	Low      float64
+	High     float64
+}
+
+// outcome is a property of a domain whose prevalence is estimated.
+type outcome struct {
+	label string
+	has   func(r *domainReport) bool
+}
+
+// loadWeights reads the sampling weights of the domains from the weights file.
+func loadWeights(path string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, row := range readRows(path) {
+		if len(row) < 2 || strings.TrimSpace(row[1]) == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			return nil, fmt.Errorf("invalid weight %q of %s", row[1], row[0])
+		}
+		weights[row[0]] = weight
+	}
+	return weights, nil
+}
+
+// estimatePrevalence estimates the prevalence of each verdict and of the findings of each rule from the domains,
+// weighted by weights. The confidence intervals are Wilson score intervals using the effective sample size of the
+// weights, i.e. Kish's (Σw)²/Σw², which is also returned.
+func estimatePrevalence(domains []*domainReport, weights map[string]float64, rules map[string]rule) ([]estimate, float64) {
+	weightOf := func(r *domainReport) float64 {
+		if weight, ok := weights[r.Domain]; ok {
+			return weight
+		}
+		return DefaultWeight
+	}
+
+	total, squares := 0.0, 0.0
+	for _, r := range domains {
+		w := weightOf(r)
+		total += w
+		squares += w * w
+	}
+	if total == 0 {
+		return nil, 0
+	}
+	effective := total * total / squares
+
+	outcomes := []outcome{
+		{verdictNonCompliant, func(r *domainReport) bool { return r.Verdict == verdictNonCompliant }},
+		{verdictCompliant, func(r *domainReport) bool { return r.Verdict == verdictCompliant }},
+		{verdictInconclusive, func(r *domainReport) bool { return r.Verdict == verdictInconclusive }},
+	}
+	for _, id := range ruleIDs {
+		id := id
+		label := id
+		if description := rules[id].Description; description != "" {
+			label = description
+		}
+		outcomes = append(outcomes, outcome{label, func(r *domainReport) bool { return hasFinding(r, id) }})
+	}
+
+	var estimates []estimate
+	for _, o := range outcomes {
+		n, weighted := 0, 0.0
+		for _, r := range domains {
+			if o.has(r) {
+				n++
+				weighted += weightOf(r)
+			}
+		}
+		p := weighted / total
+		low, high := wilsonInterval(p, effective)
+		estimates = append(estimates, estimate{
+			Label:    o.label,
+			Domains:  n,
+			Share:    100 * float64(n) / float64(len(domains)),
+			Weighted: 100 * p,
+			Low:      100 * low,
+			High:     100 * high,
+		})
+	}
+	return estimates, effective
+}
+
+// hasFinding reports whether the domain has a finding of the rule.
+func hasFinding(r *domainReport, rule string) bool {
+	for _, f := range r.Findings {
+		if f.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// wilsonInterval returns the Wilson score interval of the proportion p observed in a sample of size n.
+func wilsonInterval(p float64, n float64) (float64, float64) {
+	z2 := confidenceZ * confidenceZ
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	margin := confidenceZ / (1 + z2/n) * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+// writeEstimates writes the prevalence estimates to path.
+func writeEstimates(path string, estimates []estimate, effective float64) error {
+	rows := [][]string{{"Outcome", "Domains", "Share", "Weighted Share", "CI Low", "CI High", "Effective Sample Size"}}
+	for _, e := range estimates {
+		rows = append(rows, []string{e.Label, strconv.Itoa(e.Domains), formatPercent(e.Share), formatPercent(e.Weighted), formatPercent(e.Low), formatPercent(e.High), strconv.FormatFloat(effective, 'f', 1, 64)})
+	}
+	return writeCSV(path, rows)
+}
+
+// formatPercent formats a percentage with one decimal.
+func formatPercent(p float64) string {
+	return strconv.FormatFloat(p, 'f', 1, 64)
+}
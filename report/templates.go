@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+)
+
+// style is shared by the summary and the domain pages.
+const style = `
+	<style>
+		body { font-family: sans-serif; margin: 2em; color: #222; }
+		table { border-collapse: collapse; margin-bottom: 2em; }
+		th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+		th { background: #f0f0f0; }
+		code { word-break: break-all; }
+		.Compliant { color: #1a7f37; }
+		.Non-compliant { color: #cf222e; }
+		.Inconclusive { color: #9a6700; }
+		.screenshots img { max-width: 32%; border: 1px solid #ccc; margin-right: 1%; }
+	</style>
+`
+
+var funcs = template.FuncMap{
+	"page":    pageName,
+	"score":   formatScore,
+	"percent": func(p float64) string { return fmt.Sprintf("%.1f%%", p) },
+}
+
+// countsTable renders a list of counts with their share of the domains.
+const countsTable = `
+	{{define "counts"}}
+		<table>
+			<tr><th></th><th>Domains</th><th>Share</th></tr>
+			{{range .}}<tr><td>{{.Label}}</td><td>{{.Count}}</td><td>{{percent .Percent}}</td></tr>{{end}}
+		</table>
+	{{end}}
+`
+
+var summaryTemplate = template.Must(template.New("summary").Funcs(funcs).Parse(countsTable + `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>TCF compliance summary</title>` + style + `
+</head>
+<body>
+	<h1>TCF compliance summary</h1>
+	<p>{{len .Domains}} domains, generated {{.Generated.Format "2006-01-02 15:04"}}</p>
+
+	<h2>Highest scoring domains</h2>
+	<table>
+		<tr><th>Domain</th><th>Score</th><th>Verdict</th></tr>
+		{{range .TopDomains}}<tr><td><a href="domains/{{page .Domain}}">{{.Domain}}</a></td><td>{{score .Score}}</td><td class="{{.Verdict}}">{{.Verdict}}</td></tr>{{end}}
+	</table>
+
+	<h2>Highest scoring vendors</h2>
+	<table>
+		<tr><th>Vendor</th><th>Score</th><th>Domains</th></tr>
+		{{range .TopVendors}}<tr><td>{{.Name}} ({{.ID}})</td><td>{{score .Score}}</td><td>{{.Domains}}</td></tr>{{end}}
+	</table>
+
+	<h2>Prevalence</h2>
+	<p>
+		{{if .Weighted}}Weighted by the sampling weights of the domains, with an effective sample size of {{printf "%.1f" .EffectiveSize}}.{{else}}All domains weighted equally.{{end}}
+		The intervals are 95% Wilson score intervals.
+	</p>
+	<table>
+		<tr><th>Outcome</th><th>Domains</th><th>Share</th><th>Weighted share</th><th>95% CI</th></tr>
+		{{range .Estimates}}<tr><td>{{.Label}}</td><td>{{.Domains}}</td><td>{{percent .Share}}</td><td>{{percent .Weighted}}</td><td>{{percent .Low}} – {{percent .High}}</td></tr>{{end}}
+	</table>
+
+	<h2>Verdicts</h2>
+	{{template "counts" .Verdicts}}
+
+	<h2>Top violating vendors</h2>
+	<p>Vendors setting cookies for purposes without consent, by the number of domains.</p>
+	{{template "counts" .Vendors}}
+
+	<h2>CMP market share</h2>
+	{{template "counts" .CMPs}}
+
+	<h2>CMP check conditions</h2>
+	{{template "counts" .Conditions}}
+
+	<h2>Domains</h2>
+	<table>
+		<tr><th>Domain</th><th>Score</th><th>Verdict</th><th>TCF API</th><th>Cookies</th><th>Violations</th><th>Reasons</th></tr>
+		{{range .Domains}}
+		<tr>
+			<td><a href="domains/{{page .Domain}}">{{.Domain}}</a></td>
+			<td>{{score .Score}}</td>
+			<td class="{{.Verdict}}">{{.Verdict}}</td>
+			<td>{{.TCFAPIMode}}</td>
+			<td>{{len .Cookies}}</td>
+			<td>{{len .Violations}}</td>
+			<td>{{range $i, $r := .Reasons}}{{if $i}}; {{end}}{{$r}}{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+</body>
+</html>
+`))
+
+var domainTemplate = template.Must(template.New("domain").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.Domain}} - TCF compliance report</title>` + style + `
+</head>
+<body>
+	<p><a href="../index.html">Summary</a></p>
+	<h1>{{.Domain}}</h1>
+	<h2 class="{{.Verdict}}">{{.Verdict}}</h2>
+	{{if .Reasons}}<ul>{{range .Reasons}}<li>{{.}}</li>{{end}}</ul>{{end}}
+
+	<h2>Score: {{score .Score}}</h2>
+	{{if .RuleScores}}
+	<table>
+		<tr><th>Finding</th><th>Count</th><th>Score</th></tr>
+		{{range .RuleScores}}<tr><td>{{.Description}} ({{.Rule}})</td><td>{{.Count}}</td><td>{{score .Score}}</td></tr>{{end}}
+	</table>
+	<table>
+		<tr><th>Finding</th><th>Vendor</th><th>Detail</th></tr>
+		{{range .Findings}}<tr><td>{{.Rule}}</td><td>{{if .VendorID}}{{.Vendor}} ({{.VendorID}}){{end}}</td><td><code>{{.Detail}}</code></td></tr>{{end}}
+	</table>
+	{{end}}
+
+	<h2>TCF API</h2>
+	<table>
+		<tr><th>Mode</th><td>{{.TCFAPIMode}}</td></tr>
+		{{if .Error}}<tr><th>Error</th><td>{{.Error}}</td></tr>{{end}}
+		{{if .CMPRoute}}<tr><th>CMP route</th><td>{{.CMPRoute}}</td></tr>{{end}}
+		{{if .Condition}}<tr><th>CMP check</th><td>Condition {{.Condition}}, CMP {{.CmpID}}</td></tr>{{end}}
+	</table>
+
+	<h2>TC string analysis</h2>
+	<table>
+		<tr><th>Injected</th><td><code>{{.TC.Generated}}</code></td></tr>
+		<tr><th>Returned after reload</th><td><code>{{.TC.Returned}}</code></td></tr>
+		<tr><th>Consent diff</th><td><code>{{.TC.Diff}}</code></td></tr>
+		<tr><th>Event status</th><td>{{.TC.EventStatusBefore}} before reload, {{.TC.EventStatusAfter}} after</td></tr>
+		{{if .TC.DecodeError}}
+		<tr><th>Decoding</th><td>{{.TC.DecodeError}}</td></tr>
+		{{else if .TC.CmpID}}
+		<tr><th>CMP ID</th><td>{{.TC.CmpID}}</td></tr>
+		<tr><th>Vendor list version</th><td>{{.TC.VendorListVersion}}</td></tr>
+		<tr><th>Purposes consented</th><td>{{.TC.Purposes}}</td></tr>
+		<tr><th>Vendors consented</th><td>{{.TC.Vendors}}</td></tr>
+		{{end}}
+	</table>
+
+	<h2>Cookies</h2>
+	<table>
+		<tr><th>Domain</th><th>Name</th><th>Expires</th><th>Page</th><th>Set without JavaScript</th><th>Set before injection</th><th>Vendor</th><th>Disclosed purposes</th></tr>
+		{{range .Cookies}}
+		<tr>
+			<td>{{.Domain}}</td><td>{{.Name}}</td><td>{{.Expires}}</td><td>{{.Page}}</td><td>{{.ServerSet}}</td><td>{{.SetBeforeInjection}}</td>
+			<td>{{if .VendorID}}{{.VendorName}} ({{.VendorID}}){{end}}</td><td>{{.Purposes}}</td>
+		</tr>
+		{{end}}
+	</table>
+
+	{{if .Violations}}
+	<h2>Purpose violations</h2>
+	<table>
+		<tr><th>Vendor</th><th>Cookie</th><th>Cookie domain</th><th>Disclosed purposes</th><th>Granted purposes</th><th>Without consent</th></tr>
+		{{range .Violations}}
+		<tr>
+			<td>{{.VendorName}} ({{.VendorID}})</td><td>{{.Cookie}}</td><td>{{.CookieDomain}}</td>
+			<td>{{.Disclosed}}</td><td>{{.Granted}}</td><td>{{.WithoutConsent}}</td>
+		</tr>
+		{{end}}
+	</table>
+	{{end}}
+
+	{{if .Screenshots}}
+	<h2>Banner screenshots</h2>
+	<p>On initial load, after consent injection and after reload.</p>
+	<div class="screenshots">{{range .Screenshots}}<a href="{{.}}"><img src="{{.}}"></a>{{end}}</div>
+	{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+const (
+	// ResultsDir is the default directory of the cross-referenced results, relative to this directory.
+	ResultsDir = "../vendor-compliance-check/cross-reference-gvl"
+
+	// Names of the result files written by reference-gvl.go
+	MatchedResultsCSV   = "matched_results.csv"
+	UnmatchedResultsCSV = "unmatched_results.csv"
+	PurposeViolationCSV = "purpose_violations.csv"
+
+	DefaultMinDomains = 100 // DefaultMinDomains is the number of domains above which unmatched cookies are listed by default.
+)
+
+// queries lists the usage and description of each query, shown in the usage message.
+var queries = [][2]string{
+	{"vendor <id>", "domains on which the vendor's cookies were set, e.g. without consent in a deny-all crawl"},
+	{"unmatched [domains]", "cookies not matched to a vendor on more than the given number of domains (default 100)"},
+	{"violations [id]", "vendors setting cookies for purposes without consent, or the violations of a single vendor"},
+}
+
+// runQuery runs the named query against the result files in dir and prints its result.
+func runQuery(dir string, args []string) error {
+	switch {
+	case args[0] == "vendor" && len(args) == 2:
+		return queryVendor(dir, args[1])
+	case args[0] == "unmatched" && len(args) <= 2:
+		minDomains := DefaultMinDomains
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid number of domains %q", args[1])
+			}
+			minDomains = n
+		}
+		return queryUnmatched(dir, minDomains)
+	case args[0] == "violations" && len(args) <= 2:
+		vendorID := ""
+		if len(args) == 2 {
+			vendorID = args[1]
+		}
+		return queryViolations(dir, vendorID)
+	}
+	return fmt.Errorf("unknown query %q, see -h for the available queries", strings.Join(args, " "))
+}
+
+// readResults reads the rows of a result file, skipping the header if it has one. Result files compressed according
+// to outfile.Compression are decompressed.
+func readResults(dir string, name string) ([][]string, error) {
+	file, err := outfile.OpenReader(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csvfile.NewReader(file)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(rows) > 0 && len(rows[0]) > 0 && rows[0][0] == "Website" {
+		rows = rows[1:]
+	}
+	return rows, nil
+}
+
+// queryVendor prints the domains on which cookies of the vendor were matched, with the names of those cookies.
+// Rows of matched_results.csv are: Website, Vendor Name, Vendor ID, Purposes, Cookie Name, Cookie Domain, Cookie Purposes, Type,
+// Match Type, Confidence.
+func queryVendor(dir string, vendorID string) error {
+	rows, err := readResults(dir, MatchedResultsCSV)
+	if err != nil {
+		return err
+	}
+
+	cookies := map[string]map[string]bool{}
+	vendorName := ""
+	for _, row := range rows {
+		if len(row) < 6 || row[2] != vendorID {
+			continue
+		}
+		vendorName = row[1]
+		if cookies[row[0]] == nil {
+			cookies[row[0]] = map[string]bool{}
+		}
+		cookies[row[0]][row[4]] = true
+	}
+
+	domains := make([]string, 0, len(cookies))
+	for domain := range cookies {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	fmt.Printf("Vendor %s (%s) set cookies on %d domains\n", vendorID, vendorName, len(cookies))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tCOOKIES")
+	for _, domain := range domains {
+		fmt.Fprintf(w, "%s\t%s\n", domain, strings.Join(sortedKeys(cookies[domain]), ", "))
+	}
+	return w.Flush()
+}
+
+// queryUnmatched prints the cookies that were not matched to a vendor on more than minDomains domains, most widespread
+// first. Rows of unmatched_results.csv are: Website, Cookie Name, Cookie Domain, Type.
+func queryUnmatched(dir string, minDomains int) error {
+	rows, err := readResults(dir, UnmatchedResultsCSV)
+	if err != nil {
+		return err
+	}
+
+	type cookie struct{ name, domain string }
+	domains := map[cookie]map[string]bool{}
+	for _, row := range rows {
+		if len(row) < 3 {
+			continue
+		}
+		c := cookie{row[1], row[2]}
+		if domains[c] == nil {
+			domains[c] = map[string]bool{}
+		}
+		domains[c][row[0]] = true
+	}
+
+	var widespread []cookie
+	for c, d := range domains {
+		if len(d) > minDomains {
+			widespread = append(widespread, c)
+		}
+	}
+	sort.Slice(widespread, func(i, j int) bool {
+		a, b := widespread[i], widespread[j]
+		if len(domains[a]) != len(domains[b]) {
+			return len(domains[a]) > len(domains[b])
+		}
+		return a.name+a.domain < b.name+b.domain
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COOKIE\tCOOKIE DOMAIN\tDOMAINS")
+	for _, c := range widespread {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", c.name, c.domain, len(domains[c]))
+	}
+	return w.Flush()
+}
+
+// queryViolations prints, per vendor, the number of domains on which it set cookies for purposes without consent and
+// those purposes, or for a single vendor the violations per domain. Rows of purpose_violations.csv are: Website, Vendor
+// Name, Vendor ID, Cookie Name, Cookie Domain, Disclosed Purposes, Granted Purposes, Purposes Without Consent, Type.
+func queryViolations(dir string, vendorID string) error {
+	rows, err := readResults(dir, PurposeViolationCSV)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if vendorID != "" {
+		fmt.Fprintln(w, "DOMAIN\tCOOKIE\tPURPOSES WITHOUT CONSENT")
+		for _, row := range rows {
+			if len(row) >= 8 && row[2] == vendorID {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", row[0], row[3], row[7])
+			}
+		}
+		return w.Flush()
+	}
+
+	type vendor struct{ id, name string }
+	domains := map[vendor]map[string]bool{}
+	purposes := map[vendor]map[string]bool{}
+	for _, row := range rows {
+		if len(row) < 8 {
+			continue
+		}
+		v := vendor{row[2], row[1]}
+		if domains[v] == nil {
+			domains[v] = map[string]bool{}
+			purposes[v] = map[string]bool{}
+		}
+		domains[v][row[0]] = true
+		for _, p := range strings.Fields(strings.Trim(row[7], "[]")) {
+			purposes[v][p] = true
+		}
+	}
+
+	var vendors []vendor
+	for v := range domains {
+		vendors = append(vendors, v)
+	}
+	sort.Slice(vendors, func(i, j int) bool {
+		if len(domains[vendors[i]]) != len(domains[vendors[j]]) {
+			return len(domains[vendors[i]]) > len(domains[vendors[j]])
+		}
+		return vendors[i].id < vendors[j].id
+	})
+
+	fmt.Fprintln(w, "VENDOR ID\tVENDOR\tDOMAINS\tPURPOSES WITHOUT CONSENT")
+	for _, v := range vendors {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", v.id, v.name, len(domains[v]), strings.Join(sortedPurposes(purposes[v]), " "))
+	}
+	return w.Flush()
+}
+
+// sortedKeys returns the keys of the set in ascending order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedPurposes returns the purpose IDs of the set in ascending numeric order.
+func sortedPurposes(set map[string]bool) []string {
+	ids := sortedKeys(set)
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	return ids
+}
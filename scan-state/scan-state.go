@@ -0,0 +1,143 @@
+// scan-state inspects and resets the progress the compliance checks store in the shared state database.
+//
+// Usage:
+//
+//	go run . [-db path] tools                     list the tools that have stored state
+//	go run . [-db path] list <tool> [status]      list the domains of a tool, optionally only those with the given status
+//	go run . [-db path] show <tool> <domain>      print the full state of a domain as JSON
+//	go run . [-db path] reset <tool> [domain...]  remove the state of the given domains, or of all domains of the tool
+//	go run . [-results dir] query <query>         answer a common question from the cross-referenced results, see query.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+)
+
+// StateFile is the default location of the state database, relative to this directory.
+const StateFile = "../scan-state.db"
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: scan-state [-db path] tools | list <tool> [status] | show <tool> <domain> | reset <tool> [domain...]")
+	fmt.Fprintln(os.Stderr, "       scan-state [-results dir] query <query>")
+	fmt.Fprintln(os.Stderr, "queries:")
+	for _, q := range queries {
+		fmt.Fprintf(os.Stderr, "  %-22s%s\n", q[0], q[1])
+	}
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	dbPath := flag.String("db", StateFile, "path of the state database")
+	resultsDir := flag.String("results", ResultsDir, "directory of the cross-referenced results")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	// Queries run against the result files, not the state database
+	if args[0] == "query" {
+		if len(args) < 2 {
+			usage()
+		}
+		if err := runQuery(*resultsDir, args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	store, err := state.Open(*dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening state database:", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case args[0] == "tools" && len(args) == 1:
+		err = listTools(store)
+	case args[0] == "list" && (len(args) == 2 || len(args) == 3):
+		status := ""
+		if len(args) == 3 {
+			status = args[2]
+		}
+		err = listDomains(store, args[1], status)
+	case args[0] == "show" && len(args) == 3:
+		err = showDomain(store, args[1], args[2])
+	case args[0] == "reset" && len(args) >= 2:
+		err = store.Reset(args[1], args[2:]...)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// listTools prints the tools that have stored state along with the number of domains per status.
+func listTools(store state.Storage) error {
+	tools, err := store.Tools()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOOL\tRUNNING\tDONE\tPARTIAL\tFAILED\tSKIPPED")
+	for _, tool := range tools {
+		records, err := store.List(tool)
+		if err != nil {
+			return err
+		}
+		counts := map[string]int{}
+		for _, r := range records {
+			counts[r.Status]++
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", tool, counts[state.StatusRunning], counts[state.StatusDone], counts[state.StatusPartial], counts[state.StatusFailed], counts[state.StatusSkipped])
+	}
+	return w.Flush()
+}
+
+// listDomains prints the state of the domains of a tool, only those with the given status if it is not empty.
+func listDomains(store state.Storage, tool string, status string) error {
+	records, err := store.List(tool)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tSTATUS\tATTEMPTS\tUPDATED\tLAST ERROR")
+	for _, r := range records {
+		if status != "" && r.Status != status {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Domain, r.Status, r.Attempts, r.Updated.Format(time.RFC3339), r.LastError)
+	}
+	return w.Flush()
+}
+
+// showDomain prints the full state of a domain, including the paths of its artifacts, as JSON.
+func showDomain(store state.Storage, tool string, domain string) error {
+	r, err := store.Get(tool, domain)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("no state for %s in %s", domain, tool)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
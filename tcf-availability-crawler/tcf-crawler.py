@@ -280,6 +280,8 @@ if __name__ == '__main__':
     TCF_WAIT_INTERVAL = 0.25
     INPUT_FILE = 'domains.csv'
     OUTPUT_FILE = 'results.csv'
+    CSV_DELIMITER = ','  # Must match csvfile.Delimiter in pkg/csvfile, e.g. ';' for locales using a decimal comma
+    CSV_WRITE_BOM = False  # Start the output with a UTF-8 byte order mark, as some spreadsheet applications need
 
     settings = Settings(
         driver_pool_size=DRIVER_POOL_SIZE,
@@ -291,9 +293,10 @@ if __name__ == '__main__':
         tcf_wait_interval=TCF_WAIT_INTERVAL
     )
 
-    with open(INPUT_FILE) as f, open(OUTPUT_FILE, 'w') as csvfile:
-        reader = csv.reader(f)
-        writer = csv.writer(csvfile, lineterminator='\n')
+    with open(INPUT_FILE, encoding='utf-8-sig') as f, \
+            open(OUTPUT_FILE, 'w', encoding='utf-8-sig' if CSV_WRITE_BOM else 'utf-8', newline='') as csvfile:
+        reader = csv.reader(f, delimiter=CSV_DELIMITER)
+        writer = csv.writer(csvfile, delimiter=CSV_DELIMITER, lineterminator='\n')
         writer.writerow(['Domain', 'TCF API Available'])
         csvfile.flush()
 
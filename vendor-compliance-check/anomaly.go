@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+const (
+	// Scans that succeed with results that are most likely caused by a transient failure, such as a site with a CMP
+	// setting no cookies, are scanned again so the failure does not end up in the dataset. Every anomalous scan and the
+	// outcome of its re-crawls are recorded in AnomaliesFile
+	AnomalyRecrawls     = 1                // AnomalyRecrawls specifies the number of times an anomalous domain is scanned again, 0 disables re-crawls.
+	AnomalyRecrawlDelay = 30 * time.Second // AnomalyRecrawlDelay specifies the time waited before re-crawling an anomalous domain.
+	AnomaliesFile       = "anomalies.csv"
+)
+
+// Anomalies of a successful scan
+const (
+	anomalyNoCookies     = "no-cookies"      // The TCF API was found, but no cookies were set, not even by the CMP.
+	anomalyEmptyTCString = "empty-tc-string" // The CMP reported a CMP ID, but returned no TC string after reload.
+)
+
+// Outcomes of an anomalous scan
+const (
+	outcomeRecrawling = "recrawling" // The domain is scanned again.
+	outcomeResolved   = "resolved"   // The re-crawl was not anomalous, and replaces the anomalous scan.
+	outcomePersisting = "persisting" // The last re-crawl was anomalous too, so the anomaly is most likely genuine.
+)
+
+// detectAnomalies returns the anomalies of a successful scan of a domain. Failed scans are retried by runWithRetries.
+func detectAnomalies(cookies []*http.Cookie, result scanResult) []string {
+	if result.Err != nil || result.ErrorClass != "" {
+		return nil
+	}
+
+	var anomalies []string
+	if len(cookies) == 0 && result.TCFAPIMode != tcf.ModeNone {
+		anomalies = append(anomalies, anomalyNoCookies)
+	}
+	// The generated TC string is only built once the CMP answered the ping with its CMP ID
+	if result.TCString != "" && result.APITCString == "" {
+		anomalies = append(anomalies, anomalyEmptyTCString)
+	}
+	return anomalies
+}
+
+// runWithRecrawls scans the domain with runWithRetries, and scans it again up to AnomalyRecrawls times while the
+// results are anomalous, keeping the results of the last scan. It returns the rows of the anomalies file recording
+// every anomalous scan and the outcome of the re-crawls.
+func runWithRecrawls(allocCtx context.Context, domain string, budget time.Duration, options scanOptions) ([]*http.Cookie, scanResult, [][]string) {
+	target := targetURL(domain)
+	var rows [][]string
+	for recrawl := 0; ; recrawl++ {
+		cookies, result := runWithRetries(allocCtx, target, budget, options)
+		anomalies := detectAnomalies(cookies, result)
+
+		switch {
+		case len(anomalies) == 0:
+			if recrawl > 0 {
+				rows = append(rows, anomalyRow(domain, recrawl, nil, outcomeResolved))
+			}
+			return cookies, result, rows
+		case recrawl >= AnomalyRecrawls:
+			rows = append(rows, anomalyRow(domain, recrawl, anomalies, outcomePersisting))
+			return cookies, result, rows
+		}
+
+		logging.FromContext(allocCtx).Warn("Re-crawling anomalous domain", "anomalies", anomalies, "recrawl", recrawl+1, "delay", AnomalyRecrawlDelay)
+		rows = append(rows, anomalyRow(domain, recrawl, anomalies, outcomeRecrawling))
+		time.Sleep(AnomalyRecrawlDelay)
+	}
+}
+
+// anomalyRow returns the row of the anomalies file recording the anomalies of the domain's scan, 0 being the first
+// scan and every further one a re-crawl.
+func anomalyRow(domain string, recrawl int, anomalies []string, outcome string) []string {
+	return []string{domain, strconv.Itoa(recrawl), strings.Join(anomalies, "; "), outcome, time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	// Request blocking makes the proxy answer the requests to some hosts with 403 Forbidden instead of forwarding them,
+	// to observe how the site behaves without them: -block blocks the listed vendor domains, e.g. to test whether a page
+	// breaks when a single vendor is rejected (consent-or-pay and bundling), and -cmp-baseline only lets the requests
+	// to the site itself and to the CMPs through, for clean baseline runs. The blocked requests and the exceptions thrown
+	// by the page are written to BlockingFile
+	BlockedDomains = ""    // BlockedDomains specifies the default of -block, the comma separated domains, or a file listing a domain per line, whose requests are blocked.
+	CMPBaseline    = false // CMPBaseline specifies the default of -cmp-baseline.
+	BlockingFile   = "blocking.csv"
+	MaxExceptions  = 5 // MaxExceptions specifies the number of distinct exception messages written per domain.
+
+	// Reasons of blocking a request
+	blockedDomain      = "blocked-domain"  // The host is one of the blocked domains or their subdomains.
+	blockedNotAllowed  = "not-allowlisted" // The host is neither part of the site nor a CMP in a CMP baseline run.
+	blockedResponseMsg = "Blocked by the vendor compliance check"
+)
+
+// CMPHosts are the domains serving the CMPs, whose requests are let through in CMP baseline runs along with the
+// site's own.
+var CMPHosts = []string{
+	"consensu.org", "cookielaw.org", "onetrust.com", "cookiepro.com", "privacy-center.org", "didomi.io", "cookiebot.com",
+	"cookiebot.eu", "usercentrics.eu", "quantcast.com", "privacy-mgmt.com", "sp-prod.net", "trustarc.com", "truste.com",
+	"iubenda.com", "consentmanager.net", "sirdata.com", "sirdata.io", "sfbx.io", "appconsent.io", "axept.io",
+	"fundingchoicesmessages.google.com",
+}
+
+var (
+	blockFlag       = flag.String("block", BlockedDomains, "comma separated domains, or a file listing a domain per line, whose requests the proxy blocks")
+	cmpBaselineFlag = flag.Bool("cmp-baseline", CMPBaseline, "only let the requests to the scanned site and to the CMPs through the proxy, for a clean baseline run")
+)
+
+// blockedDomains holds the domains parsed from -block, read once.
+var blockedDomains struct {
+	once    sync.Once
+	domains []string
+}
+
+// blockingEnabled reports whether the proxy blocks any requests.
+func blockingEnabled() bool {
+	return *blockFlag != "" || *cmpBaselineFlag
+}
+
+// blockingMode returns the blocking in force, as written to BlockingFile.
+func blockingMode() string {
+	var modes []string
+	if *blockFlag != "" {
+		modes = append(modes, "block")
+	}
+	if *cmpBaselineFlag {
+		modes = append(modes, "cmp-baseline")
+	}
+	return strings.Join(modes, "+")
+}
+
+// getBlockedDomains returns the domains of -block, reading them from the file it names if it is one. Lines starting
+// with # are comments.
+func getBlockedDomains() []string {
+	blockedDomains.once.Do(func() {
+		list := *blockFlag
+		if data, err := os.ReadFile(list); err == nil {
+			list = strings.ReplaceAll(string(data), "\n", ",")
+		}
+		for _, domain := range strings.Split(list, ",") {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain != "" && !strings.HasPrefix(domain, "#") {
+				blockedDomains.domains = append(blockedDomains.domains, domain)
+			}
+		}
+		slog.Info("Blocking requests", "domains", len(blockedDomains.domains), "cmpBaseline", *cmpBaselineFlag)
+	})
+	return blockedDomains.domains
+}
+
+// matchesDomain reports whether the host is one of the domains or a subdomain of one.
+func matchesDomain(host string, domains []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockReason returns why a request to the host of the party is blocked, or an empty string if it is let through.
+func blockReason(host string, party string) string {
+	if *blockFlag != "" && matchesDomain(host, getBlockedDomains()) {
+		return blockedDomain
+	}
+	if *cmpBaselineFlag && party != partyFirst && !matchesDomain(host, CMPHosts) {
+		return blockedNotAllowed
+	}
+	return ""
+}
+
+// blockedResponse returns the response the proxy answers a blocked request with.
+func blockedResponse(req *http.Request) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, blockedResponseMsg)
+}
+
+// blockingLog collects the requests blocked by the proxy by host, and the exceptions thrown by the page.
+type blockingLog struct {
+	mu         sync.Mutex
+	hosts      map[string]int // hosts maps each blocked host to the number of its requests blocked.
+	exceptions []string       // exceptions holds the distinct messages of the exceptions thrown by the page.
+	thrown     int
+}
+
+// newBlockingLog returns an empty log.
+func newBlockingLog() *blockingLog {
+	return &blockingLog{hosts: map[string]int{}}
+}
+
+// addBlocked records a blocked request to the host.
+func (l *blockingLog) addBlocked(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hosts[host]++
+}
+
+// addException records an exception thrown by the page.
+func (l *blockingLog) addException(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.thrown++
+	for _, seen := range l.exceptions {
+		if seen == message {
+			return
+		}
+	}
+	l.exceptions = append(l.exceptions, message)
+}
+
+// get returns what was recorded so far.
+func (l *blockingLog) get() blockingResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := blockingResult{Exceptions: append([]string(nil), l.exceptions...), Thrown: l.thrown}
+	for host, count := range l.hosts {
+		result.Hosts = append(result.Hosts, blockedHost{Host: host, Requests: count})
+	}
+	sort.Slice(result.Hosts, func(i, j int) bool { return result.Hosts[i].Host < result.Hosts[j].Host })
+	return result
+}
+
+// blockedHost is a host whose requests were blocked.
+type blockedHost struct {
+	Host     string
+	Requests int
+}
+
+// blockingResult holds the requests blocked while scanning a domain and the exceptions the page threw.
+type blockingResult struct {
+	Hosts      []blockedHost
+	Exceptions []string // Exceptions holds the distinct exception messages.
+	Thrown     int      // Thrown is the number of exceptions thrown.
+}
+
+// blockingRow builds the blocking CSV row of the domain. Pages that break without the blocked hosts show up as
+// exceptions, a missing TCF API or a failed scan.
+func blockingRow(domain string, result scanResult) []string {
+	var hosts []string
+	requests := 0
+	for _, h := range result.Blocking.Hosts {
+		hosts = append(hosts, fmt.Sprintf("%s:%d", h.Host, h.Requests))
+		requests += h.Requests
+	}
+	exceptions := result.Blocking.Exceptions
+	if len(exceptions) > MaxExceptions {
+		exceptions = exceptions[:MaxExceptions]
+	}
+	return []string{domain, blockingMode(), strconv.Itoa(requests), strings.Join(hosts, " "), strconv.Itoa(result.Blocking.Thrown), strings.Join(exceptions, " | "), result.TCFAPIMode, result.ErrorClass}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// A run budget time-boxes the whole run, the domains left when it runs out are marked as skipped in the state database
+	RunBudget       = 0 * time.Hour    // RunBudget specifies the maximum wall-clock duration of a run, 0 disables the budget.
+	MinDomainBudget = 30 * time.Second // MinDomainBudget specifies the least time given to a domain, fewer domains are processed rather than every domain getting less.
+)
+
+// runBudget splits the time left of the RunBudget over the domains left.
+type runBudget struct {
+	deadline time.Time
+}
+
+// newRunBudget starts the budget of a run.
+func newRunBudget() runBudget {
+	return runBudget{deadline: time.Now().Add(RunBudget)}
+}
+
+// domainBudget returns the time allotted to the next domain, given the number of domains left including it: the time
+// left divided evenly over these domains, but at least MinDomainBudget. It returns false once less than
+// MinDomainBudget is left, and always returns true without a limit if the budget is disabled.
+func (b runBudget) domainBudget(domainsLeft int) (time.Duration, bool) {
+	if RunBudget <= 0 {
+		return 0, true
+	}
+
+	left := time.Until(b.deadline)
+	if left < MinDomainBudget {
+		return 0, false
+	}
+
+	share := left / time.Duration(domainsLeft)
+	if share < MinDomainBudget {
+		share = MinDomainBudget
+	}
+	return share, true
+}
+
+// withBudget limits the domain context to the given budget. The returned cancel function also cancels the domain context.
+func withBudget(ctx context.Context, cancelCtx context.CancelFunc, budget time.Duration) (context.Context, context.CancelFunc) {
+	budgetCtx, cancelBudget := context.WithTimeout(ctx, budget)
+	return budgetCtx, func() {
+		cancelBudget()
+		cancelCtx()
+	}
+}
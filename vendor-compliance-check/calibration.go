@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// Calibrate visits the CalibrationDomains before the run starts and aborts if a check fails on all of them.
+const Calibrate = false
+
+// CalibrationDomains are domains known to implement the TCF, used to verify that the crawler works in the current
+// environment. Only a check that fails on every one of them aborts the run, so a single site changing its CMP does not.
+var CalibrationDomains = []string{"www.lemonde.fr", "www.spiegel.de", "www.corriere.it"}
+
+// calibrationCheck is a check run against the result of each calibration domain.
+type calibrationCheck struct {
+	name   string
+	hint   string // hint describes what to look into when no calibration domain passes the check.
+	passed func(proxyRequests int64, result scanResult) bool
+}
+
+var calibrationChecks = []calibrationCheck{
+	{
+		name: "proxy",
+		hint: "no requests went through the proxy, check that Chrome can reach the proxy's port on " + proxyListenAddr(),
+		passed: func(proxyRequests int64, result scanResult) bool {
+			return proxyRequests > 0
+		},
+	},
+	{
+		name: "tcf_api",
+		hint: "the TCF API was not detected, check network access to the sites and -tcf-timeout",
+		passed: func(proxyRequests int64, result scanResult) bool {
+			return result.TCFAPIMode != "" && result.TCFAPIMode != tcf.ModeNone
+		},
+	},
+	{
+		name: "consent_injection",
+		hint: "no TC string was generated and injected, check the ping probe of package tcf used by setConsent",
+		passed: func(proxyRequests int64, result scanResult) bool {
+			return result.TCString != ""
+		},
+	},
+	{
+		name: "tc_string_probe",
+		hint: "the CMP returned no TC string after reload, check the getTCData probe and that the injected consent is stored",
+		passed: func(proxyRequests int64, result scanResult) bool {
+			return result.APITCString != ""
+		},
+	},
+	{
+		name: "event_status_probe",
+		hint: "no eventStatus was returned, check the getTCData probe",
+		passed: func(proxyRequests int64, result scanResult) bool {
+			return result.EventStatusBeforeRL != "" || result.EventStatusAfterRL != ""
+		},
+	},
+}
+
+// calibrate scans the CalibrationDomains without writing any results and reports whether every check passed on at
+// least one of them, logging a hint for each check that did not.
+func calibrate(allocCtx context.Context) bool {
+	slog.Info("Starting calibration", "domains", CalibrationDomains)
+
+	passes := map[string]int{}
+	for _, domain := range CalibrationDomains {
+		logger, stopDomainLogging := startDomainLogging(domain)
+		ctx, cancelCtx := createDomainContext(logging.NewContext(allocCtx, logger))
+
+		before := metrics.proxyRequests.Load()
+		_, result := run(targetURL(domain), ctx, defaultScanOptions())
+		proxyRequests := metrics.proxyRequests.Load() - before
+
+		for _, check := range calibrationChecks {
+			passed := check.passed(proxyRequests, result)
+			if passed {
+				passes[check.name]++
+			}
+			logger.Info("Calibration check", "check", check.name, "passed", passed)
+		}
+
+		cancelCtx()
+		stopDomainLogging()
+	}
+
+	failed := false
+	for _, check := range calibrationChecks {
+		if passes[check.name] == 0 {
+			slog.Error("Calibration check failed on all domains", "check", check.name, "hint", check.hint)
+			failed = true
+		}
+	}
+	if !failed {
+		slog.Info("Calibration passed")
+	}
+	return !failed
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// CMP latency measurement records how fast the CMP loads on the initial visit and after reload: the time from the
+	// start of the navigation until __tcfapi is defined in the top frame and until the CMP reports its first event and
+	// tcloaded, and the requests to the CMP hosts, see CMPHosts, with the size and origin of their scripts. CMPs served
+	// from the site's own domain are only timed
+	MeasureCMPLatency = false
+	CMPLatencyFile    = "cmp_latency.csv"
+
+	// JavaScript run in the top frame of every new document, which records when __tcfapi is defined and the time and
+	// status of the first event the CMP reports, and of tcloaded, in milliseconds since the navigation started.
+	cmpTimingJS = `
+			(function () {
+				if (window !== window.top) {
+					return;
+				}
+				const timings = {apiReady: -1, firstEvent: '', firstEventMs: -1, tcLoaded: -1};
+				window.__vendorComplianceCMPTimings = timings;
+
+				const started = Date.now();
+				const poll = () => {
+					if (typeof window.__tcfapi !== 'function') {
+						if (Date.now() - started < 30000) {
+							setTimeout(poll, 20);
+						}
+						return;
+					}
+					timings.apiReady = Math.round(performance.now());
+					window.__tcfapi('addEventListener', 2, (tcData, success) => {
+						if (!success || !tcData) {
+							return;
+						}
+						const ms = Math.round(performance.now());
+						if (timings.firstEventMs < 0) {
+							timings.firstEvent = tcData.eventStatus || '';
+							timings.firstEventMs = ms;
+						}
+						if (tcData.eventStatus === 'tcloaded' && timings.tcLoaded < 0) {
+							timings.tcLoaded = ms;
+						}
+					});
+				};
+				poll();
+			})()
+		`
+	cmpTimingLogJS = `window.__vendorComplianceCMPTimings || {apiReady: -1, firstEvent: '', firstEventMs: -1, tcLoaded: -1}`
+)
+
+// cmpTimings are the times of a visit, in milliseconds since the navigation started, -1 for those that did not happen.
+type cmpTimings struct {
+	APIReady     float64 `json:"apiReady"`
+	FirstEvent   string  `json:"firstEvent"` // FirstEvent is the eventStatus of the first event, e.g. cmpuishown or tcloaded.
+	FirstEventMs float64 `json:"firstEventMs"`
+	TCLoaded     float64 `json:"tcLoaded"`
+}
+
+// cmpLatency holds the timings of the CMP on the initial visit and after reload, and the requests to the CMP hosts
+// during both.
+type cmpLatency struct {
+	Initial  cmpTimings
+	Reload   cmpTimings
+	requests *cmpRequestLog
+}
+
+// cmpRequestLog collects the requests to the CMP hosts until it is stopped.
+type cmpRequestLog struct {
+	mu       sync.Mutex
+	stopped  bool
+	requests int
+	scripts  map[network.RequestID]string // scripts maps the requests for scripts to their URLs, until they finish loading.
+	sizes    map[string]float64           // sizes maps the URL of each script loaded to its encoded size in bytes.
+}
+
+// measureCMPLatency returns a chromedp Action which makes every following document in the tab record the CMP's
+// timings, and starts collecting the requests to the CMP hosts. It does nothing unless MeasureCMPLatency is set.
+func measureCMPLatency(latency *cmpLatency) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !MeasureCMPLatency {
+			return nil
+		}
+		log := &cmpRequestLog{scripts: map[network.RequestID]string{}, sizes: map[string]float64{}}
+		latency.Initial = cmpTimings{APIReady: -1, FirstEventMs: -1, TCLoaded: -1}
+		latency.Reload = latency.Initial
+		latency.requests = log
+		chromedp.ListenTarget(ctx, log.handle)
+		_, err := page.AddScriptToEvaluateOnNewDocument(cmpTimingJS).Do(ctx)
+		return err
+	})
+}
+
+// captureCMPTimings returns a chromedp Action which stores the CMP's timings on the current document in timings, and
+// stops collecting requests if last is set. It does nothing unless MeasureCMPLatency is set.
+func captureCMPTimings(latency *cmpLatency, timings *cmpTimings, last bool) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !MeasureCMPLatency {
+			return nil
+		}
+		if last && latency.requests != nil {
+			latency.requests.stop()
+		}
+		if err := chromedp.Evaluate(cmpTimingLogJS, timings).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error collecting CMP timings", "error", err)
+		}
+		return nil
+	})
+}
+
+// handle records the requests to the CMP hosts and the encoded size of their scripts.
+func (l *cmpRequestLog) handle(ev interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		if u, err := url.Parse(ev.Request.URL); err == nil && matchesDomain(u.Hostname(), CMPHosts) {
+			l.requests++
+			if ev.Type == network.ResourceTypeScript {
+				l.scripts[ev.RequestID] = ev.Request.URL
+			}
+		}
+	case *network.EventLoadingFinished:
+		if scriptURL, found := l.scripts[ev.RequestID]; found {
+			delete(l.scripts, ev.RequestID)
+			// Scripts loaded again after reload are usually served from the cache, so the first load counts
+			if _, loaded := l.sizes[scriptURL]; !loaded {
+				l.sizes[scriptURL] = ev.EncodedDataLength
+			}
+		}
+	}
+}
+
+// stop stops collecting requests.
+func (l *cmpRequestLog) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+}
+
+// summary returns the number of requests to the CMP hosts, and the number, total size and origins of the scripts
+// loaded from them.
+func (l *cmpRequestLog) summary() (requests int, scripts int, bytes float64, origins []string) {
+	if l == nil {
+		return 0, 0, 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seen := map[string]bool{}
+	for scriptURL, size := range l.sizes {
+		bytes += size
+		if u, err := url.Parse(scriptURL); err == nil && !seen[u.Host] {
+			seen[u.Host] = true
+			origins = append(origins, u.Scheme+"://"+u.Host)
+		}
+	}
+	sort.Strings(origins)
+	return l.requests, len(l.sizes), bytes, origins
+}
+
+// millis formats a time in milliseconds, or returns an empty string for -1.
+func millis(ms float64) string {
+	if ms < 0 {
+		return ""
+	}
+	return strconv.Itoa(int(ms))
+}
+
+// cmpLatencyRow builds the CMP latency CSV row of the domain.
+func cmpLatencyRow(domain string, result scanResult) []string {
+	latency := result.CMPLatency
+	requests, scripts, bytes, origins := latency.requests.summary()
+	return []string{
+		domain,
+		millis(latency.Initial.APIReady),
+		latency.Initial.FirstEvent,
+		millis(latency.Initial.FirstEventMs),
+		millis(latency.Initial.TCLoaded),
+		millis(latency.Reload.APIReady),
+		millis(latency.Reload.TCLoaded),
+		strconv.Itoa(requests),
+		strconv.Itoa(scripts),
+		fmt.Sprint(int64(bytes)),
+		strings.Join(origins, " "),
+		result.TCFAPIMode,
+		result.ErrorClass,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// CMP verification checks the cmpId and cmpVersion the page's CMP reports in its ping on initial load against the
+	// CMPs registered with IAB Europe, and the CmpId and CmpVersion of the CMP's TC strings, on initial load and after
+	// reload, against the ping. Mismatches, a known pattern of spoofed or misconfigured CMPs, fail and are logged
+	VerifyCMPMetadata   = false
+	CMPVerificationFile = "cmp_verification.csv"
+	FetchCMPListTimeout = 30 * time.Second // FetchCMPListTimeout specifies the maximum duration of downloading the CMP list.
+
+	// Stages of the TC strings checked against the ping
+	stageInitialLoad = "initial load"
+	stageAfterReload = "after reload"
+)
+
+// cmpList holds the registered CMPs, fetched from tcfaudit.CMPListURL at the start of the run if VerifyCMPMetadata is set.
+var cmpList tcfaudit.CMPList
+
+// loadCMPList fetches the CMP list, ending the run if it cannot be fetched.
+func loadCMPList() {
+	var err error
+	if cmpList, err = tcfaudit.FetchCMPList(tcfaudit.CMPListURL, FetchCMPListTimeout); err != nil {
+		fatal("Error fetching the CMP list", "url", tcfaudit.CMPListURL, "error", err)
+	}
+	slog.Info("Fetched the CMP list", "cmps", len(cmpList))
+}
+
+// capturePing returns a chromedp Action which stores the CMP's ping response. It does nothing unless VerifyCMPMetadata
+// is set.
+func capturePing(ping *tcf.Ping) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !VerifyCMPMetadata {
+			return nil
+		}
+		var err error
+		if *ping, err = tcf.GetPing(chromedpSession{ctx}); err != nil {
+			logging.FromContext(ctx).Warn("Error querying the ping", "error", err)
+		}
+		return nil
+	})
+}
+
+// cmpVerificationRows builds the CMP verification CSV rows, one per check, with the stage of the TC strings checked.
+// Domains whose CMP did not answer the ping have no rows.
+func cmpVerificationRows(domain string, result scanResult) [][]string {
+	ping := result.Ping
+	if ping.CmpID == 0 && ping.CmpVersion == 0 && !ping.CmpLoaded {
+		return nil
+	}
+
+	type stagedCheck struct {
+		stage string
+		check tcf.ConformanceCheck
+	}
+	var checks []stagedCheck
+	for _, check := range tcfaudit.VerifyCMP(cmpList, ping, time.Now()) {
+		checks = append(checks, stagedCheck{stageInitialLoad, check})
+	}
+	checks = append(checks,
+		stagedCheck{stageInitialLoad, verifyCMPTCString(ping, result.InitialTCString, result)},
+		stagedCheck{stageAfterReload, verifyCMPTCString(ping, result.APITCString, result)},
+	)
+
+	var rows [][]string
+	for _, c := range checks {
+		if c.check.Result == tcf.CheckFail {
+			slog.Warn("CMP verification failed", "check", c.check.Name, "stage", c.stage, "detail", c.check.Detail)
+		}
+		rows = append(rows, []string{domain, strconv.Itoa(ping.CmpID), strconv.Itoa(ping.CmpVersion), c.check.Name, c.stage, c.check.Result, c.check.Detail})
+	}
+	return rows
+}
+
+// verifyCMPTCString checks the TC string the CMP returned against its ping, skipping the check if the CMP returned the
+// TC string injected or pre-seeded by the crawler, as its CmpId is the crawler's rather than the CMP's.
+func verifyCMPTCString(ping tcf.Ping, tcString string, result scanResult) tcf.ConformanceCheck {
+	if tcString != "" && tcString == result.TCString {
+		return tcf.ConformanceCheck{Name: tcfaudit.CheckTCStringCMPID, Result: tcf.CheckSkipped, Detail: "the CMP returned the injected TC string"}
+	}
+	return tcfaudit.VerifyTCStringCMP(ping, tcString)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+const (
+	// CMP conformance checking tests the page's __tcfapi against the TCF specification on initial load, before the
+	// consent is injected: whether the stub queues calls made before the CMP loads, whether ping returns the mandatory
+	// fields, whether addEventListener and removeEventListener work and whether getTCData rejects invalid versions
+	CheckCMPConformance = false
+	CMPConformanceFile  = "cmp_conformance.csv"
+)
+
+// registerStubMonitor returns a chromedp Action which makes every following document in the tab probe the first
+// __tcfapi the page defines, see tcf.StubMonitorJS. It does nothing unless CheckCMPConformance is set.
+func registerStubMonitor() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CheckCMPConformance {
+			return nil
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(tcf.StubMonitorJS).Do(ctx)
+		return err
+	})
+}
+
+// checkConformance returns a chromedp Action which stores the conformance checklist of the page's __tcfapi. It does
+// nothing unless CheckCMPConformance is set.
+func checkConformance(checks *[]tcf.ConformanceCheck) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CheckCMPConformance {
+			return nil
+		}
+		var err error
+		if *checks, err = tcf.CheckConformance(chromedpSession{ctx}); err != nil {
+			logging.FromContext(ctx).Warn("Error checking CMP conformance", "error", err)
+			return nil
+		}
+		for _, check := range *checks {
+			if check.Result == tcf.CheckFail {
+				logging.FromContext(ctx).Warn("CMP conformance check failed", "check", check.Name, "detail", check.Detail)
+			}
+		}
+		return nil
+	})
+}
+
+// conformanceRows builds the CMP conformance CSV rows, one per check of the domain's checklist.
+func conformanceRows(domain string, result scanResult) [][]string {
+	var rows [][]string
+	for _, check := range result.Conformance {
+		rows = append(rows, []string{domain, result.TCFAPIMode, check.Name, check.Result, check.Detail})
+	}
+	return rows
+}
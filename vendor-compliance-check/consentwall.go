@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Consent wall detection classifies the banner of each domain for consent-or-pay research, by comparing the page
+	// on initial load, before the consent is injected, with the page after reload. A page is walled if overlays cover at
+	// least WallCoverage of the viewport and the page behind them is locked: scrolling is disabled, it is blurred, or
+	// less than WallInteractable of the links in the viewport can be clicked. Walls whose overlays mention paying, see
+	// PayKeywords, or whose page loads a pur provider, see PurProviders, are pay or okay walls. The text length of both
+	// stages tells whether content was withheld until consent
+	DetectConsentWalls = false
+	ConsentWallsFile   = "consent_walls.csv"
+	WallCoverage       = 0.6 // WallCoverage is the share of the viewport overlays have to cover for a wall.
+	WallInteractable   = 0.2 // WallInteractable is the share of clickable links in the viewport below which the page is locked.
+	WallTextGrowth     = 1.5 // WallTextGrowth is the growth of the visible text after consent from which content was withheld.
+
+	// Classes of banners
+	wallNone    = "none"         // No overlay covers half the viewport, though a smaller banner may be shown.
+	wallBanner  = "banner"       // Overlays cover half the viewport, but the page behind them can be used.
+	wallConsent = "consent-wall" // The page cannot be used until a choice is made.
+	wallPay     = "pay-or-okay"  // The page cannot be used until consent is given or a subscription is taken.
+
+	// Stages of the consent wall probes
+	wallBeforeConsent = "before consent"
+	wallAfterConsent  = "after consent"
+)
+
+// PurProviders are the hosts of the pur providers, which sell access to sites without tracking, as part of a pay or
+// okay wall.
+var PurProviders = []string{"contentpass.net", "contentpass.de"}
+
+// PayKeywords are the words of the overlays offering to pay for the site instead of consenting, lowercased.
+var PayKeywords = []string{
+	"pur-abo", "pur abo", "werbefrei", "ohne werbung", "ohne tracking", "abonnieren", "abonnement", "ad-free", "ad free",
+	"without ads", "subscribe", "subscription", "sans publicité", "sans cookies", "abonnez",
+	"senza pubblicità", "abbonati", "contentpass", "per month", "pro monat", "par mois", "al mese",
+}
+
+// consentWallJS returns the JavaScript measuring the current page, see wallProbe. Overlays are the fixed or sticky
+// elements covering at least half the viewport, found at a 5x5 grid of points of the viewport.
+func consentWallJS() string {
+	providers, _ := json.Marshal(PurProviders)
+	keywords, _ := json.Marshal(PayKeywords)
+	return `
+		(() => {
+			const providers = ` + string(providers) + `;
+			const keywords = ` + string(keywords) + `;
+			const width = window.innerWidth, height = window.innerHeight;
+
+			const fixedAncestor = (el) => {
+				for (let e = el; e && e !== document.documentElement; e = e.parentElement || (e.getRootNode() && e.getRootNode().host)) {
+					const position = getComputedStyle(e).position;
+					if (position === 'fixed' || position === 'sticky') {
+						return e;
+					}
+				}
+				return null;
+			};
+			const overlays = new Set();
+			let covered = 0, points = 0;
+			for (let i = 1; i <= 5; i++) {
+				for (let j = 1; j <= 5; j++) {
+					points++;
+					const fixed = fixedAncestor(document.elementFromPoint(width * i / 6, height * j / 6));
+					if (!fixed) {
+						continue;
+					}
+					const rect = fixed.getBoundingClientRect();
+					if (rect.width * rect.height >= width * height / 2) {
+						overlays.add(fixed);
+						covered++;
+					}
+				}
+			}
+
+			let links = 0, clickable = 0;
+			for (const link of document.querySelectorAll('a[href], button')) {
+				if ([...overlays].some((overlay) => overlay.contains(link))) {
+					continue;
+				}
+				const rect = link.getBoundingClientRect();
+				const x = rect.left + rect.width / 2, y = rect.top + rect.height / 2;
+				if (rect.width === 0 || rect.height === 0 || x < 0 || y < 0 || x >= width || y >= height) {
+					continue;
+				}
+				links++;
+				const top = document.elementFromPoint(x, y);
+				if (top && (top === link || link.contains(top))) {
+					clickable++;
+				}
+				if (links >= 100) {
+					break;
+				}
+			}
+
+			const style = (el) => el ? getComputedStyle(el) : null;
+			const html = style(document.documentElement), body = style(document.body);
+			const scrollLocked = [html, body].some((s) => s && (s.overflowY === 'hidden' || s.overflow === 'hidden')) ||
+				(!!body && body.position === 'fixed');
+			const blurred = [...(document.body ? document.body.children : [])].some((el) =>
+				!overlays.has(el) && getComputedStyle(el).filter.includes('blur'));
+
+			const overlayText = [...overlays].map((overlay) => overlay.innerText || '').join(' ').toLowerCase();
+			const sources = performance.getEntriesByType('resource').map((entry) => entry.name)
+				.concat([...document.querySelectorAll('iframe[src], script[src]')].map((el) => el.src));
+			const hosts = new Set();
+			for (const source of sources) {
+				try {
+					hosts.add(new URL(source).hostname);
+				} catch (e) {}
+			}
+
+			return {
+				coverage: covered / points,
+				interactable: links === 0 ? 1 : clickable / links,
+				scrollLocked: scrollLocked,
+				blurred: blurred,
+				textLength: document.body ? document.body.innerText.length : 0,
+				providers: providers.filter((provider) => [...hosts].some((host) => host === provider || host.endsWith('.' + provider))),
+				keywords: keywords.filter((keyword) => overlayText.includes(keyword)),
+			};
+		})()
+	`
+}
+
+// wallProbe is the state of the page at a stage of the scan.
+type wallProbe struct {
+	Coverage     float64  `json:"coverage"`     // Coverage is the share of the viewport covered by overlays.
+	Interactable float64  `json:"interactable"` // Interactable is the share of the links in the viewport, outside the overlays, that can be clicked.
+	ScrollLocked bool     `json:"scrollLocked"`
+	Blurred      bool     `json:"blurred"`    // Blurred reports whether the page behind the overlays is blurred.
+	TextLength   int      `json:"textLength"` // TextLength is the length of the visible text of the page.
+	Providers    []string `json:"providers"`  // Providers are the PurProviders the page loaded.
+	Keywords     []string `json:"keywords"`   // Keywords are the PayKeywords of the overlays.
+}
+
+// walled reports whether the page cannot be used behind its overlays.
+func (p wallProbe) walled() bool {
+	return p.Coverage >= WallCoverage && (p.ScrollLocked || p.Blurred || p.Interactable < WallInteractable)
+}
+
+// consentWall holds the probes of the page before and after consent.
+type consentWall struct {
+	Before *wallProbe
+	After  *wallProbe
+}
+
+// probeConsentWall returns a chromedp Action which stores the state of the current page at the stage. It does nothing
+// unless DetectConsentWalls is set.
+func probeConsentWall(stage string, wall *consentWall) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !DetectConsentWalls {
+			return nil
+		}
+		var probe wallProbe
+		if err := chromedp.Evaluate(consentWallJS(), &probe).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error probing the consent wall", "stage", stage, "error", err)
+			return nil
+		}
+		if stage == wallBeforeConsent {
+			wall.Before = &probe
+		} else {
+			wall.After = &probe
+		}
+		return nil
+	})
+}
+
+// classify returns the class of the banner shown before consent, see the wall constants.
+func (w consentWall) classify() string {
+	switch {
+	case w.Before == nil:
+		return ""
+	case w.Before.walled() && (len(w.Before.Providers) > 0 || len(w.Before.Keywords) > 0):
+		return wallPay
+	case w.Before.walled():
+		return wallConsent
+	case w.Before.Coverage > 0:
+		return wallBanner
+	}
+	return wallNone
+}
+
+// consentWallRow builds the consent wall CSV row of the domain, or nil if the page was not probed before consent. The
+// columns after consent are empty if the page was not probed after reload.
+func consentWallRow(domain string, result scanResult) []string {
+	wall := result.ConsentWall
+	if wall.Before == nil {
+		return nil
+	}
+	before := *wall.Before
+	afterCoverage, afterInteractable, afterScrollLocked, afterTextLength, withheld, unblocked := "", "", "", "", "", ""
+	if after := wall.After; after != nil {
+		afterCoverage, afterInteractable = formatShare(after.Coverage), formatShare(after.Interactable)
+		afterScrollLocked, afterTextLength = strconv.FormatBool(after.ScrollLocked), strconv.Itoa(after.TextLength)
+		withheld = strconv.FormatBool(float64(after.TextLength) >= float64(before.TextLength)*WallTextGrowth)
+		unblocked = strconv.FormatBool(before.walled() && !after.walled())
+	}
+	return []string{
+		domain,
+		wall.classify(),
+		formatShare(before.Coverage),
+		afterCoverage,
+		formatShare(before.Interactable),
+		afterInteractable,
+		strconv.FormatBool(before.ScrollLocked),
+		afterScrollLocked,
+		strconv.FormatBool(before.Blurred),
+		strconv.Itoa(before.TextLength),
+		afterTextLength,
+		withheld,
+		unblocked,
+		strings.Join(before.Providers, ","),
+		strings.Join(before.Keywords, ","),
+	}
+}
+
+// formatShare formats a share between 0 and 1 with two decimals.
+func formatShare(share float64) string {
+	return strconv.FormatFloat(share, 'f', 2, 64)
+}
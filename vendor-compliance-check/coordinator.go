@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+)
+
+const (
+	// Large domain lists can be scanned by several machines at once: `go run . coordinate` serves the pending domains of
+	// DomainsFile to workers, which are crawlers started with `go run . -coordinator http://<host>:8091`. A worker leases
+	// a domain, renews the lease with heartbeats while scanning it and acknowledges it along with the rows it would have
+	// written, which the coordinator writes to its own output files and records in the state database. Domains whose
+	// lease expires, e.g. because the worker crashed, are handed out again
+	CoordinatorAddr   = ":8091"          // CoordinatorAddr specifies the address on which the coordinator serves the work queue.
+	LeaseTimeout      = time.Minute      // LeaseTimeout specifies how long a lease is held without a heartbeat.
+	HeartbeatInterval = 15 * time.Second // HeartbeatInterval specifies how often a worker renews the lease of the domain it is scanning.
+	MaxLeaseExpiries  = 3                // MaxLeaseExpiries specifies how many leases of a domain may expire before it is marked as failed, so a domain crashing the workers is not handed out forever.
+)
+
+// lease is a domain handed out to a worker.
+type lease struct {
+	ID      string       `json:"lease"`
+	Domain  string       `json:"domain"`
+	Worker  string       `json:"worker"`
+	Expires time.Time    `json:"expires"`
+	Left    int          `json:"left"`              // Left is the number of domains not handed out yet, including the leased one.
+	Options *scanOptions `json:"options,omitempty"` // Options are the domain's options, if its row of the domains file overrides the coordinator's.
+}
+
+// leaseRequest is the body of POST /lease.
+type leaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+// heartbeatRequest is the body of POST /heartbeat.
+type heartbeatRequest struct {
+	Lease string `json:"lease"`
+}
+
+// ackRequest is the body of POST /ack, acknowledging the scan of a leased domain.
+type ackRequest struct {
+	Lease   string       `json:"lease"`
+	Skipped string       `json:"skipped,omitempty"` // Skipped is the reason the domain was not scanned, if it was not.
+	Error   string       `json:"error,omitempty"`   // Error is the error with which the scan failed, see scanError.
+	Partial bool         `json:"partial,omitempty"` // Partial reports whether the scan was cut short by the worker's run budget, see scanError.
+	Outputs []outputRows `json:"outputs"`
+}
+
+// outputRows are the rows written to an output file for a domain.
+type outputRows struct {
+	Name   string     `json:"name"` // Name is the configured name of the file, e.g. OutputFile.
+	Header []string   `json:"header"`
+	Rows   [][]string `json:"rows"`
+}
+
+// coordinatorStatus is the response of GET /status.
+type coordinatorStatus struct {
+	Queued int      `json:"queued"`
+	Leased []*lease `json:"leased"`
+	Acked  int      `json:"acked"`
+}
+
+// coordinator hands out the pending domains to workers and writes the results they acknowledge.
+type coordinator struct {
+	store state.Storage
+
+	mu       sync.Mutex
+	queue    []string
+	leases   map[string]*lease // leases holds the current leases by ID.
+	expiries map[string]int    // expiries counts the expired leases of each domain.
+	acked    int
+	files    map[string]*csvOutput // files holds the output files opened, by name.
+}
+
+// coordinate serves the work queue on CoordinatorAddr until the process is stopped.
+func coordinate() {
+	domains, err := readDomains()
+	if err != nil {
+		fatal("Error reading domains", "error", err)
+	}
+	store, err := state.Open(StateFile)
+	if err != nil {
+		fatal("Error opening state database", "error", err)
+	}
+	domains = pendingDomains(store, orderDomains(domains))
+	recordRun()
+
+	openExporter()
+	defer closeExporter()
+	defer startProgress()()
+	if err := openVerdictsFile(); err != nil {
+		fatal("Error opening verdicts file", "error", err)
+	}
+	defer func() { verdictsFile.Close() }()
+
+	c := &coordinator{store: store, queue: domains, leases: map[string]*lease{}, expiries: map[string]int{}, files: map[string]*csvOutput{}}
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, output := range c.files {
+			output.Close()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", c.handleLease)
+	mux.HandleFunc("/heartbeat", c.handleHeartbeat)
+	mux.HandleFunc("/ack", c.handleAck)
+	mux.HandleFunc("/status", c.handleStatus)
+
+	slog.Info("Serving work queue", "addr", CoordinatorAddr, "domains", len(domains))
+	if err := http.ListenAndServe(CoordinatorAddr, mux); err != nil {
+		fatal("Error serving work queue", "addr", CoordinatorAddr, "error", err)
+	}
+}
+
+// expireLeases hands out the domains of expired leases again, or marks them as failed once MaxLeaseExpiries of their
+// leases expired. It is called with the lock held.
+func (c *coordinator) expireLeases() {
+	for id, l := range c.leases {
+		if time.Now().Before(l.Expires) {
+			continue
+		}
+		delete(c.leases, id)
+		progress.drop(l.Worker)
+		c.expiries[l.Domain]++
+		if c.expiries[l.Domain] >= MaxLeaseExpiries {
+			slog.Error("Giving up on domain whose leases keep expiring", "domain", l.Domain, "worker", l.Worker, "expiries", c.expiries[l.Domain])
+			err := fmt.Errorf("%d leases expired without an acknowledgement", c.expiries[l.Domain])
+			if err := c.store.Finish(stateTool(l.Domain), l.Domain, err, nil); err != nil {
+				slog.Error("Error saving domain state", "domain", l.Domain, "error", err)
+			}
+			c.acked++
+			continue
+		}
+		slog.Warn("Lease expired, handing out domain again", "domain", l.Domain, "worker", l.Worker)
+		c.queue = append([]string{l.Domain}, c.queue...)
+	}
+}
+
+// handleLease leases the next domain to the worker. It responds with 204 if all domains are leased, as expiring leases
+// may hand them out again, and with 410 once all domains are acknowledged.
+func (c *coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST to lease a domain")
+		return
+	}
+	var request leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases()
+
+	for len(c.queue) > 0 {
+		domain, left := c.queue[0], len(c.queue)
+		c.queue = c.queue[1:]
+
+		// The coordinator owns the domains it serves, so domains left running by a lost worker are claimed right away
+		err := c.store.Claim(stateTool(domain), domain, 0)
+		if errors.Is(err, state.ErrSkip) {
+			continue
+		}
+		if err != nil {
+			c.queue = append([]string{domain}, c.queue...)
+			slog.Error("Error claiming domain", "domain", domain, "error", err)
+			writeError(w, http.StatusInternalServerError, "error claiming the domain")
+			return
+		}
+
+		l := &lease{ID: newJobID(), Domain: domain, Worker: request.Worker, Expires: time.Now().Add(LeaseTimeout), Left: left}
+		if options, found := domainOverrides[domain]; found {
+			l.Options = &options
+		}
+		c.leases[l.ID] = l
+		progress.begin(l.Worker, domain, len(c.queue)+len(c.leases), optionsFor(domain).Timeout)
+		slog.Info("Leased domain", "domain", domain, "worker", request.Worker, "left", left)
+		writeJSON(w, http.StatusOK, l)
+		return
+	}
+
+	if len(c.leases) > 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusGone, "all domains are done")
+}
+
+// handleHeartbeat renews the lease in the request body, responding with 410 if it expired.
+func (c *coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST to renew a lease")
+		return
+	}
+	var request heartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases()
+
+	l, ok := c.leases[request.Lease]
+	if !ok {
+		writeError(w, http.StatusGone, fmt.Sprintf("lease %q expired or is unknown", request.Lease))
+		return
+	}
+	l.Expires = time.Now().Add(LeaseTimeout)
+	writeJSON(w, http.StatusOK, l)
+}
+
+// handleAck writes the rows of the acknowledged domain to the output files and records its result in the state
+// database, responding with 410 if its lease expired, in which case the rows are dropped.
+func (c *coordinator) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST to acknowledge a domain")
+		return
+	}
+	var request ackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases()
+
+	l, ok := c.leases[request.Lease]
+	if !ok {
+		writeError(w, http.StatusGone, fmt.Sprintf("lease %q expired or is unknown", request.Lease))
+		return
+	}
+
+	if request.Skipped != "" {
+		delete(c.leases, l.ID)
+		c.acked++
+		skipDomain(c.store, l.Domain, request.Skipped)
+		progress.drop(l.Worker)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Only write the outputs the coordinator would write itself, so workers cannot write to arbitrary files. Others,
+	// e.g. of a worker built with more outputs enabled, are dropped rather than failing the domain
+	artifacts := map[string]bool{}
+	for _, path := range domainArtifacts(l.Domain) {
+		artifacts[path] = true
+	}
+	var known []outputRows
+	for _, o := range request.Outputs {
+		if !artifacts[outfile.Path(rotation.Name(o.Name))] {
+			slog.Warn("Ignoring unknown output file", "file", o.Name, "domain", l.Domain, "worker", l.Worker)
+			continue
+		}
+		known = append(known, o)
+	}
+
+	// Start new parts of the output files once the current ones hold RotateEvery domains, or the date changes
+	if rotation.Next() {
+		rotateOutputFiles()
+	}
+	var findings []string
+	errorClass := ""
+	for _, o := range known {
+		output, err := c.file(o.Name, o.Header)
+		if err != nil {
+			slog.Error("Error opening output file", "file", o.Name, "error", err)
+			writeError(w, http.StatusInternalServerError, "error opening the output file")
+			return
+		}
+		output.WriteAll(o.Rows)
+		if o.Name == TCFModesFile {
+			for _, v := range writeVerdictRows(o.Header, o.Rows) {
+				findings = append(findings, verdictFindings(v)...)
+			}
+			if request.Error != "" && len(o.Rows) > 0 && len(o.Rows[0]) > 2 {
+				errorClass = o.Rows[0][2]
+			}
+		}
+	}
+	flushOutputFiles()
+
+	var scanErr error
+	switch {
+	case request.Partial:
+		scanErr = fmt.Errorf("%w: the worker's run budget ran out", state.ErrPartial)
+	case request.Error != "":
+		scanErr = errors.New(request.Error)
+	}
+	if err := c.store.Finish(stateTool(l.Domain), l.Domain, scanErr, domainArtifacts(l.Domain)); err != nil {
+		slog.Error("Error saving domain state", "domain", l.Domain, "error", err)
+	}
+	delete(c.leases, l.ID)
+	c.acked++
+	progress.end(l.Worker, l.Domain, errorClass, findings)
+	metrics.domainsProcessed.Add(1)
+	slog.Info("Done with domain", "domain", l.Domain, "worker", l.Worker, "error", request.Error)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStatus returns the number of queued and acknowledged domains and the current leases.
+func (c *coordinator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases()
+
+	status := coordinatorStatus{Queued: len(c.queue), Leased: []*lease{}, Acked: c.acked}
+	for _, l := range c.leases {
+		status.Leased = append(status.Leased, l)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// file returns the output file with the given name, opening it with the header on first use.
+func (c *coordinator) file(name string, header []string) (*csvOutput, error) {
+	if output, ok := c.files[name]; ok {
+		return output, nil
+	}
+	output, err := openCSVOutput(name, header)
+	if err != nil {
+		return nil, err
+	}
+	c.files[name] = output
+	return output, nil
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,255 @@
+//go:build ignore
+
+// analyze-identifiers tells the cookies holding identifiers apart from those holding functional flags, by the length,
+// entropy and uniqueness of their values across the scanned websites, and lists the identifier values found on several
+// websites. As every website is scanned in a fresh browser profile, such values are synced between the websites' third
+// parties, or derived from the device rather than generated per user.
+//
+// Usage:
+//
+//	go run analyze-identifiers.go   write identifier_analysis.csv and shared_identifiers.csv from deny_all_vendors.csv
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+// Constants used in this program
+const (
+	cookiesFileName           = "deny_all_vendors.csv"
+	identifierAnalysisFile    = "identifier_analysis.csv"
+	sharedIdentifiersFileName = "shared_identifiers.csv"
+
+	// Values are identifiers if they are at least MinIdentifierLength characters long and carry at least
+	// MinIdentifierBits bits of entropy, i.e. their length times the Shannon entropy of their characters, and if the
+	// cookie is set on several websites, it takes different values on most of them. Timestamps, language codes and
+	// flags such as "true" or "1" fall short of these.
+	MinIdentifierLength = 8
+	MinIdentifierBits   = 40.0
+	MinUniqueRatio      = 0.5 // MinUniqueRatio is the share of distinct values among the websites setting a cookie below which its values are shared defaults rather than identifiers.
+
+	// MinSharedWebsites is the number of websites an identifier value must be found on to be listed as shared.
+	MinSharedWebsites = 2
+)
+
+// Columns of the cookies CSV
+const (
+	websiteColumn          = 0
+	domainColumn           = 1
+	nameColumn             = 2
+	valueColumn            = 3
+	generatedConsentColumn = 7 // generatedConsentColumn holds the injected TC string, which is not an identifier of the user.
+)
+
+// cookieKey identifies a cookie across websites.
+type cookieKey struct {
+	name   string
+	domain string
+}
+
+// observation is a value of a cookie on a website.
+type observation struct {
+	website string
+	value   string
+}
+
+func main() {
+	rows := readRows(cookiesFileName)
+
+	// Collect the values of each cookie across the websites, skipping the injected consent
+	cookies := map[cookieKey][]observation{}
+	var order []cookieKey
+	for _, row := range rows {
+		if len(row) <= valueColumn || row[websiteColumn] == "Website" {
+			continue
+		}
+		value := decodeValue(row[valueColumn])
+		if len(row) > generatedConsentColumn && row[generatedConsentColumn] != "" && value == row[generatedConsentColumn] {
+			continue
+		}
+		key := cookieKey{name: row[nameColumn], domain: strings.TrimPrefix(row[domainColumn], ".")}
+		if cookies[key] == nil {
+			order = append(order, key)
+		}
+		cookies[key] = append(cookies[key], observation{website: row[websiteColumn], value: value})
+	}
+
+	analysisFile, analysisWriter := createWriter(identifierAnalysisFile)
+	defer analysisFile.Close()
+	defer analysisWriter.Flush()
+	analysisWriter.Write([]string{"Cookie Name", "Cookie Domain", "Websites", "Distinct Values", "Unique Ratio", "Median Length", "Median Entropy Bits", "Identifier"})
+
+	// Index the identifier values by value, to find those on several websites
+	shared := map[string][]observation{}
+	identifierCookies := map[string][]cookieKey{}
+	identifiers := 0
+	for _, key := range order {
+		observations := cookies[key]
+		websites, distinct := map[string]bool{}, map[string]bool{}
+		var lengths []int
+		var bits []float64
+		for _, o := range observations {
+			websites[o.website] = true
+			distinct[o.value] = true
+			lengths = append(lengths, len(o.value))
+			bits = append(bits, entropyBits(o.value))
+		}
+		uniqueRatio := float64(len(distinct)) / float64(len(websites))
+		medianLength, medianBits := medianInt(lengths), medianFloat(bits)
+		identifier := medianLength >= MinIdentifierLength && medianBits >= MinIdentifierBits && (len(websites) == 1 || uniqueRatio >= MinUniqueRatio)
+		if identifier {
+			identifiers++
+			for _, o := range observations {
+				if len(o.value) >= MinIdentifierLength && entropyBits(o.value) >= MinIdentifierBits {
+					shared[o.value] = append(shared[o.value], o)
+					identifierCookies[o.value] = append(identifierCookies[o.value], key)
+				}
+			}
+		}
+
+		analysisWriter.Write([]string{key.name, key.domain, strconv.Itoa(len(websites)), strconv.Itoa(len(distinct)), strconv.FormatFloat(uniqueRatio, 'f', 2, 64),
+			strconv.Itoa(medianLength), strconv.FormatFloat(medianBits, 'f', 1, 64), fmt.Sprint(identifier)})
+	}
+	if err := analysisWriter.Error(); err != nil {
+		slog.Error("Error writing identifier analysis", "file", identifierAnalysisFile, "error", err)
+		os.Exit(1)
+	}
+
+	sharedFile, sharedWriter := createWriter(sharedIdentifiersFileName)
+	defer sharedFile.Close()
+	defer sharedWriter.Flush()
+	sharedWriter.Write([]string{"Value", "Websites", "Cookies", "Cookie Domains", "Synced Across Domains", "Website List"})
+
+	values := make([]string, 0, len(shared))
+	for value, observations := range shared {
+		if len(distinctWebsites(observations)) >= MinSharedWebsites {
+			values = append(values, value)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if a, b := len(distinctWebsites(shared[values[i]])), len(distinctWebsites(shared[values[j]])); a != b {
+			return a > b
+		}
+		return values[i] < values[j]
+	})
+	for _, value := range values {
+		websites := distinctWebsites(shared[value])
+		names, domains := map[string]bool{}, map[string]bool{}
+		for _, key := range identifierCookies[value] {
+			names[key.name] = true
+			domains[key.domain] = true
+		}
+
+		// A value set by several cookie domains was passed from one third party to another, rather than recognized by one
+		syncedAcrossDomains := len(domains) > 1
+		if syncedAcrossDomains {
+			slog.Warn("Identifier synced across domains", "value", value, "domains", sortedKeys(domains), "websites", len(websites))
+		}
+		sharedWriter.Write([]string{value, strconv.Itoa(len(websites)), strings.Join(sortedKeys(names), "; "), strings.Join(sortedKeys(domains), "; "),
+			fmt.Sprint(syncedAcrossDomains), strings.Join(websites, "; ")})
+	}
+	if err := sharedWriter.Error(); err != nil {
+		slog.Error("Error writing shared identifiers", "file", sharedIdentifiersFileName, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Analyzed cookie values", "cookies", len(order), "identifiers", identifiers, "shared", len(values))
+}
+
+// readRows reads the rows of a CSV file, which may be compressed.
+func readRows(name string) [][]string {
+	file, err := outfile.OpenReader(name)
+	if err != nil {
+		slog.Error("Error opening cookies", "file", name, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	reader := csvfile.NewReader(file)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		slog.Error("Error reading cookies", "file", name, "error", err)
+		os.Exit(1)
+	}
+	return rows
+}
+
+// createWriter creates an output file, compressed according to its name or outfile.Compression, along with a CSV
+// writer.
+func createWriter(name string) (*outfile.File, *csv.Writer) {
+	file, err := outfile.Create(name)
+	if err != nil {
+		slog.Error("Error creating output file", "file", name, "error", err)
+		os.Exit(1)
+	}
+	return file, csvfile.NewWriter(file, file.New)
+}
+
+// decodeValue returns the cookie value URL decoded, so encoded and plain copies of an identifier compare equal.
+func decodeValue(value string) string {
+	if decoded, err := url.QueryUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// entropyBits returns the Shannon entropy of the value's characters times its length, an estimate of the number of
+// bits of information it holds.
+func entropyBits(value string) float64 {
+	if value == "" {
+		return 0
+	}
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range value {
+		counts[r]++
+		n++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy * float64(n)
+}
+
+// distinctWebsites returns the websites of the observations, sorted.
+func distinctWebsites(observations []observation) []string {
+	websites := map[string]bool{}
+	for _, o := range observations {
+		websites[o.website] = true
+	}
+	return sortedKeys(websites)
+}
+
+// sortedKeys returns the keys of the set in ascending order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// medianInt returns the median of the numbers, which must not be empty.
+func medianInt(numbers []int) int {
+	sort.Ints(numbers)
+	return numbers[len(numbers)/2]
+}
+
+// medianFloat returns the median of the numbers, which must not be empty.
+func medianFloat(numbers []float64) float64 {
+	sort.Float64s(numbers)
+	return numbers[len(numbers)/2]
+}
@@ -0,0 +1,333 @@
+//go:build ignore
+
+// enrich-unmatched attributes the cookies reference-gvl.go could not match to a GVL vendor to companies and
+// categories, using the Open Cookie Database, DuckDuckGo's Tracker Radar and the EasyPrivacy filter list, so the
+// unmatched results can be followed up even when their owner is not in the GVL.
+//
+// Usage:
+//
+//	go run enrich-unmatched.go   write enriched_unmatched.csv from unmatched_results.csv
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+// Constants used in this program
+const (
+	unmatchedFileName = "unmatched_results.csv"
+	enrichedFileName  = "enriched_unmatched.csv"
+
+	// TrackerListDir is the directory the lists are downloaded to on first use. Lists already in it are used as they
+	// are, so lists bundled there keep runs offline and reproducible; set RefreshTrackerLists to download them again.
+	TrackerListDir      = "tracker-lists"
+	RefreshTrackerLists = false
+
+	openCookieDatabaseURL = "https://raw.githubusercontent.com/jkwakman/Open-Cookie-Database/master/open-cookie-database.csv"
+	trackerRadarURL       = "https://staticcdn.duckduckgo.com/trackerblocking/v5/current/extension-tds.json"
+	easyPrivacyURL        = "https://easylist.to/easylist/easyprivacy.txt"
+)
+
+// Sources a cookie can be attributed by
+const (
+	sourceOpenCookieDatabase = "open-cookie-database"
+	sourceTrackerRadar       = "tracker-radar"
+	sourceEasyPrivacy        = "easyprivacy"
+)
+
+// cookieDefinition is a cookie described in the Open Cookie Database.
+type cookieDefinition struct {
+	Name        string
+	Category    string
+	Description string
+	Controller  string // Controller is the company setting the cookie.
+	Wildcard    bool   // Wildcard reports whether the name is a prefix, e.g. "_ga_" for "_ga_<container ID>".
+}
+
+// trackerEntry is a tracker domain of the Tracker Radar.
+type trackerEntry struct {
+	Owner struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"owner"`
+	Categories []string `json:"categories"`
+}
+
+// trackerLists holds the lists the unmatched cookies are looked up in.
+type trackerLists struct {
+	cookies     map[string]cookieDefinition // cookies holds the cookies of the Open Cookie Database by name.
+	prefixes    []cookieDefinition          // prefixes holds the wildcard cookies of the Open Cookie Database, longest first.
+	trackers    map[string]trackerEntry     // trackers holds the Tracker Radar entries by domain.
+	easyPrivacy map[string]bool             // easyPrivacy holds the domains blocked by EasyPrivacy.
+}
+
+// enrichment is what the lists tell about a cookie.
+type enrichment struct {
+	Company     string
+	Category    string
+	Description string
+	Tracker     bool     // Tracker reports whether the cookie's domain is a tracker according to the Tracker Radar or EasyPrivacy.
+	Sources     []string // Sources are the lists the cookie or its domain was found in.
+}
+
+func main() {
+	lists := &trackerLists{
+		cookies:     map[string]cookieDefinition{},
+		trackers:    map[string]trackerEntry{},
+		easyPrivacy: map[string]bool{},
+	}
+	lists.loadOpenCookieDatabase(fetchList("open-cookie-database.csv", openCookieDatabaseURL))
+	lists.loadTrackerRadar(fetchList("tracker-radar.json", trackerRadarURL))
+	lists.loadEasyPrivacy(fetchList("easyprivacy.txt", easyPrivacyURL))
+	slog.Info("Loaded tracker lists", "cookies", len(lists.cookies)+len(lists.prefixes), "trackers", len(lists.trackers), "easyprivacy", len(lists.easyPrivacy))
+
+	input, err := outfile.OpenReader(unmatchedFileName)
+	if err != nil {
+		slog.Error("Error opening unmatched results", "file", unmatchedFileName, "error", err)
+		os.Exit(1)
+	}
+	defer input.Close()
+	reader := csvfile.NewReader(input)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		slog.Error("Error reading unmatched results", "file", unmatchedFileName, "error", err)
+		os.Exit(1)
+	}
+
+	output, err := outfile.Create(enrichedFileName)
+	if err != nil {
+		slog.Error("Error creating output file", "file", enrichedFileName, "error", err)
+		os.Exit(1)
+	}
+	defer output.Close()
+	writer := csvfile.NewWriter(output, output.New)
+	defer writer.Flush()
+
+	writer.Write([]string{"Website", "Cookie Name", "Cookie Domain", "Type", "Company", "Category", "Description", "Tracker", "Sources"})
+	attributed := 0
+	for _, row := range rows {
+		if len(row) < 3 {
+			continue
+		}
+		kind := "cookie"
+		if len(row) > 3 {
+			kind = row[3]
+		}
+		e := lists.enrich(row[1], row[2])
+		if len(e.Sources) > 0 {
+			attributed++
+		}
+		writer.Write([]string{row[0], row[1], row[2], kind, e.Company, e.Category, e.Description, fmt.Sprint(e.Tracker), strings.Join(e.Sources, "; ")})
+	}
+	if err := writer.Error(); err != nil {
+		slog.Error("Error writing enriched results", "file", enrichedFileName, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Enriched unmatched cookies", "cookies", len(rows), "attributed", attributed, "file", enrichedFileName)
+}
+
+// fetchList returns the path of the list in TrackerListDir, downloading it from url if it is not there yet or
+// RefreshTrackerLists is set.
+func fetchList(name, url string) string {
+	path := filepath.Join(TrackerListDir, name)
+	if _, err := os.Stat(path); err == nil && !RefreshTrackerLists {
+		return path
+	}
+
+	slog.Info("Downloading tracker list", "url", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		slog.Error("Error downloading tracker list", "url", url, "error", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Error downloading tracker list", "url", url, "status", resp.StatusCode)
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(TrackerListDir, 0755); err != nil {
+		slog.Error("Error creating tracker list directory", "dir", TrackerListDir, "error", err)
+		os.Exit(1)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Error("Error creating tracker list", "file", path, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		slog.Error("Error writing tracker list", "file", path, "error", err)
+		os.Exit(1)
+	}
+	return path
+}
+
+// loadOpenCookieDatabase reads the Open Cookie Database CSV, locating its columns by their header.
+func (l *trackerLists) loadOpenCookieDatabase(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Error("Error opening Open Cookie Database", "file", path, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil || len(rows) == 0 {
+		slog.Error("Error reading Open Cookie Database", "file", path, "error", err)
+		os.Exit(1)
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	for _, row := range rows[1:] {
+		definition := cookieDefinition{
+			Name:        field(row, "Cookie / Data Key name"),
+			Category:    field(row, "Category"),
+			Description: field(row, "Description"),
+			Controller:  field(row, "Data Controller"),
+			Wildcard:    field(row, "Wildcard match") == "1",
+		}
+		if definition.Name == "" {
+			continue
+		}
+		if definition.Wildcard {
+			l.prefixes = append(l.prefixes, definition)
+		} else {
+			l.cookies[definition.Name] = definition
+		}
+	}
+	sort.SliceStable(l.prefixes, func(i, j int) bool { return len(l.prefixes[i].Name) > len(l.prefixes[j].Name) })
+}
+
+// loadTrackerRadar reads the trackers of the Tracker Radar's tracker data set.
+func (l *trackerLists) loadTrackerRadar(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Error opening Tracker Radar", "file", path, "error", err)
+		os.Exit(1)
+	}
+	var tds struct {
+		Trackers map[string]trackerEntry `json:"trackers"`
+	}
+	if err := json.Unmarshal(data, &tds); err != nil {
+		slog.Error("Error reading Tracker Radar", "file", path, "error", err)
+		os.Exit(1)
+	}
+	l.trackers = tds.Trackers
+}
+
+// loadEasyPrivacy reads the domains of the EasyPrivacy rules blocking a whole domain, i.e. "||example.com^". Exception
+// rules and rules for paths are ignored.
+func (l *trackerLists) loadEasyPrivacy(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Error("Error opening EasyPrivacy", "file", path, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(rule, "||") {
+			continue
+		}
+		domain, rest, found := strings.Cut(strings.TrimPrefix(rule, "||"), "^")
+		if !found || strings.ContainsAny(domain, "/*") || (rest != "" && !strings.HasPrefix(rest, "$")) {
+			continue
+		}
+		l.easyPrivacy[strings.ToLower(domain)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Error reading EasyPrivacy", "file", path, "error", err)
+		os.Exit(1)
+	}
+}
+
+// enrich looks up the cookie by name in the Open Cookie Database and its domain, or the closest parent domain listed,
+// in the Tracker Radar and EasyPrivacy. The company and category are taken from the Open Cookie Database, or from the
+// Tracker Radar if the cookie is not described there.
+func (l *trackerLists) enrich(name, domain string) enrichment {
+	var e enrichment
+	name = strings.TrimSpace(name)
+	definition, ok := l.cookies[name]
+	if !ok {
+		for _, prefix := range l.prefixes {
+			if strings.HasPrefix(name, prefix.Name) {
+				definition, ok = prefix, true
+				break
+			}
+		}
+	}
+	if ok {
+		e.Company, e.Category, e.Description = definition.Controller, definition.Category, definition.Description
+		e.Sources = append(e.Sources, sourceOpenCookieDatabase)
+	}
+
+	for _, parent := range parentDomains(domain) {
+		tracker, ok := l.trackers[parent]
+		if !ok {
+			continue
+		}
+		if e.Company == "" {
+			e.Company = tracker.Owner.DisplayName
+			if e.Company == "" {
+				e.Company = tracker.Owner.Name
+			}
+		}
+		if e.Category == "" {
+			e.Category = strings.Join(tracker.Categories, "; ")
+		}
+		e.Tracker = true
+		e.Sources = append(e.Sources, sourceTrackerRadar)
+		break
+	}
+
+	for _, parent := range parentDomains(domain) {
+		if l.easyPrivacy[parent] {
+			e.Tracker = true
+			e.Sources = append(e.Sources, sourceEasyPrivacy)
+			break
+		}
+	}
+	return e
+}
+
+// parentDomains returns the domain, without the leading dot of domain cookies, followed by each of its parent
+// domains, e.g. "a.b.example.com", "b.example.com", "example.com".
+func parentDomains(domain string) []string {
+	domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+	var domains []string
+	for strings.Contains(domain, ".") {
+		domains = append(domains, domain)
+		domain = domain[strings.Index(domain, ".")+1:]
+	}
+	return domains
+}
@@ -1,3 +1,18 @@
+//go:build ignore
+
+// gvl-to-csv extracts the vendors and their disclosures from the Global Vendor List to a CSV file, and archives
+// snapshots of the GVL so scan results can be interpreted against the version in force when they were produced.
+//
+// Usage:
+//
+//	go run gvl-to-csv.go                       write the current GVL to gvl_data.csv and gvl_data.db, archiving a snapshot of it
+//	go run gvl-to-csv.go snapshot              only archive a snapshot of the current GVL
+//	go run gvl-to-csv.go csv <snapshot>        write the GVL of an archived snapshot to gvl_data.csv
+//	go run gvl-to-csv.go store <snapshot>      write the GVL of an archived snapshot to the store gvl_data.db
+//	go run gvl-to-csv.go diff <old> <new>      list the changes between two snapshots
+//	go run gvl-to-csv.go version <version>...  write archived GVL versions to gvl_data_v<version>.csv, see reference-gvl.go
+//	go run gvl-to-csv.go audit                 check the current GVL's vendors against their device disclosures, see gvl_audit.csv
+//	go run gvl-to-csv.go health                check how the current GVL's device disclosures are served, see gvl_disclosure_health.csv
 package main
 
 import (
@@ -5,20 +20,69 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/gvl"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
 )
 
 // Constants used in this program
 const (
-	vendorListURL  = "https://vendor-list.consensu.org/v2/vendor-list.json"
+	vendorListURL  = "https://vendor-list.consensu.org/v3/vendor-list.json"
 	outputFileName = "gvl_data.csv"
+
+	// storeFileName is the GVL store written along with the CSV file, which keeps each disclosure whole rather than
+	// joining the disclosures of a vendor into cells, see pkg/gvl. Set MatchGVL or GvlCSV to it to match against it.
+	storeFileName = "gvl_data.db"
+
+	// SnapshotDir is the directory the snapshots are archived in, each named after the GVL version and the time it
+	// was fetched. Leave it empty to not archive a snapshot when writing the CSV file from the current GVL.
+	SnapshotDir = "gvl-snapshots"
+
+	// versionFileName is the name of the CSV file written for an archived GVL version.
+	versionFileName = "gvl_data_v%d.csv"
+
+	auditFileName     = "gvl_audit.csv"  // auditFileName is the name of the CSV file the audit subcommand writes the issues found to.
+	disclosureTimeout = 30 * time.Second // disclosureTimeout specifies the maximum duration of fetching a device disclosure.
+	maxPurposeID      = 11               // maxPurposeID is the highest purpose ID defined by the TCF v2.2 policies.
+
+	healthFileName = "gvl_disclosure_health.csv" // healthFileName is the name of the CSV file the health subcommand writes the vendors' conformance to.
+	slowDisclosure = 3 * time.Second             // slowDisclosure specifies the response time above which a disclosure is reported as slow.
+	healthOrigin   = "https://cmp.example"       // healthOrigin is the origin the disclosures are requested from, as a CMP would.
 )
 
+// client fetches the GVL and the device disclosures.
+var client gvl.Client = gvl.HTTPClient{DisclosureTimeout: disclosureTimeout}
+
+// archiveURLs are the locations of the archived GVL versions, tried in order. Versions published before the v3 vendor
+// list are only archived as v2.
+var archiveURLs = []string{
+	"https://vendor-list.consensu.org/v3/archives/vendor-list-v%d.json",
+	"https://vendor-list.consensu.org/v2/archives/vendor-list-v%d.json",
+}
+
 // VendorList represents the structure of the vendor list found on  the vendorListURL.
 type VendorList struct {
-	Vendors map[string]Vendor `json:"vendors"`
+	VendorListVersion int               `json:"vendorListVersion"`
+	LastUpdated       string            `json:"lastUpdated"`
+	Vendors           map[string]Vendor `json:"vendors"`
+}
+
+// Snapshot is an archived version of the GVL with the device disclosures of its vendors, keyed by vendor ID.
+type Snapshot struct {
+	Fetched     time.Time                    `json:"fetched"`
+	VendorList  *VendorList                  `json:"vendorList"`
+	Disclosures map[string]*DeviceDisclosure `json:"disclosures"`
 }
 
 // Vendor represents the details of a vendor present in the VendorList.
@@ -27,80 +91,541 @@ type Vendor struct {
 	ID                         int    `json:"id"`
 	DeviceStorageDisclosureUrl string `json:"deviceStorageDisclosureUrl"`
 	Purposes                   []int  `json:"purposes"`
+	LegIntPurposes             []int  `json:"legIntPurposes"` // LegIntPurposes are the purposes the vendor relies on legitimate interest for.
+	DeletedDate                string `json:"deletedDate"`    // DeletedDate is set once the vendor is removed from the GVL.
 }
 
-// DeviceDisclosure represents the structure of the device disclosure data.
-type DeviceDisclosure struct {
-	Disclosures []Disclosure `json:"disclosures"`
-	Domains     []Domain     `json:"domains"`
+// DeviceDisclosure, Disclosure and Domain are the device disclosure of a vendor and its entries, as parsed by
+// gvl.ParseDisclosure.
+type (
+	DeviceDisclosure = gvl.DeviceDisclosure
+	Disclosure       = gvl.Disclosure
+	Domain           = gvl.Domain
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gvl-to-csv [snapshot | csv <snapshot> | store <snapshot> | diff <old snapshot> <new snapshot> | version <version>... | audit | health]")
+	os.Exit(2)
 }
 
-// Disclosure represents the details of a specific disclosure.
-type Disclosure struct {
-	Identifier    string   `json:"identifier"`
-	Type          string   `json:"type"`
-	MaxAgeSeconds *int     `json:"maxAgeSeconds"`
-	CookieRefresh bool     `json:"cookieRefresh"`
-	Domains       []string `json:"domains"`
-	Purposes      []int    `json:"purposes"`
+// The main function where the program starts
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		snapshot := fetchSnapshot(fetchVendorList(vendorListURL))
+		if SnapshotDir != "" {
+			saveSnapshot(snapshot)
+		}
+		createVendorCSV(snapshot, outputFileName)
+		writeStore(snapshot, storeFileName)
+		return
+	}
+
+	switch {
+	case args[0] == "snapshot" && len(args) == 1:
+		saveSnapshot(fetchSnapshot(fetchVendorList(vendorListURL)))
+	case args[0] == "csv" && len(args) == 2:
+		createVendorCSV(loadSnapshot(args[1]), outputFileName)
+	case args[0] == "store" && len(args) == 2:
+		writeStore(loadSnapshot(args[1]), storeFileName)
+	case args[0] == "diff" && len(args) == 3:
+		diffSnapshots(loadSnapshot(args[1]), loadSnapshot(args[2]))
+	case args[0] == "version" && len(args) > 1:
+		for _, arg := range args[1:] {
+			version, err := strconv.Atoi(arg)
+			if err != nil {
+				usage()
+			}
+			createVendorCSV(archivedSnapshot(version), fmt.Sprintf(versionFileName, version))
+		}
+	case args[0] == "audit" && len(args) == 1:
+		auditVendors(fetchVendorList(vendorListURL))
+	case args[0] == "health" && len(args) == 1:
+		checkDisclosureHealth(fetchVendorList(vendorListURL))
+	default:
+		usage()
+	}
 }
 
-// Domain represents the domain related to a vendor.
-type Domain struct {
-	Domain string `json:"domain"`
-	Use    string `json:"use"`
+// fetchSnapshot fetches the device disclosures of the vendors in the vendor list. Vendors whose disclosure cannot be
+// fetched are left out, unless they were deleted from the GVL.
+func fetchSnapshot(vendorList *VendorList) *Snapshot {
+	snapshot := &Snapshot{Fetched: time.Now().UTC(), VendorList: vendorList, Disclosures: map[string]*DeviceDisclosure{}}
+
+	for id, vendor := range snapshot.VendorList.Vendors {
+		deviceDisclosure, err := gvl.FetchDisclosure(client, vendor.DeviceStorageDisclosureUrl)
+		if err != nil {
+			slog.Warn("Error fetching device disclosure", "vendor", vendor.ID, "error", err)
+			// Deleted vendors often no longer host their disclosure, but are kept to flag them where they are still active
+			if vendor.DeletedDate == "" {
+				continue
+			}
+			deviceDisclosure = &DeviceDisclosure{}
+		}
+		snapshot.Disclosures[id] = deviceDisclosure
+	}
+	return snapshot
 }
 
-// The main function where the program starts
-func main() {
-	vendorList := fetchVendorList(vendorListURL)
-	createVendorCSV(vendorList, outputFileName)
+// saveSnapshot archives the snapshot in SnapshotDir.
+func saveSnapshot(snapshot *Snapshot) {
+	writeSnapshot(filepath.Join(SnapshotDir, fmt.Sprintf("gvl-v%d-%s.json", snapshot.VendorList.VendorListVersion, snapshot.Fetched.Format("20060102T150405Z"))), snapshot)
 }
 
-// fetchVendorList retrieves the vendor list from the provided URL.
-func fetchVendorList(url string) *VendorList {
-	resp, err := http.Get(url)
+// writeSnapshot writes the snapshot to a file named name.
+func writeSnapshot(name string, snapshot *Snapshot) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		slog.Error("Error creating snapshot directory", "dir", filepath.Dir(name), "error", err)
+		os.Exit(1)
+	}
+
+	file, err := outfile.Create(name)
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("Error creating snapshot", "file", name, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(snapshot); err != nil {
+		slog.Error("Error writing snapshot", "file", file.Name, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Archived GVL snapshot", "file", file.Name, "version", snapshot.VendorList.VendorListVersion, "vendors", len(snapshot.VendorList.Vendors))
+}
+
+// archivedSnapshot returns a snapshot of the archived GVL version, cached in SnapshotDir. The IAB only archives the
+// vendor list, so the disclosures are the ones the vendors host when the snapshot is first taken.
+func archivedSnapshot(version int) *Snapshot {
+	name := filepath.Join(SnapshotDir, fmt.Sprintf("gvl-v%d-archive.json", version))
+	if _, err := os.Stat(outfile.Path(name)); err == nil {
+		return loadSnapshot(name)
+	}
+
+	for _, archiveURL := range archiveURLs {
+		vendorList, err := getVendorList(fmt.Sprintf(archiveURL, version))
+		if err != nil {
+			slog.Warn("Error fetching archived vendor list", "version", version, "error", err)
+			continue
+		}
+
+		snapshot := fetchSnapshot(vendorList)
+		writeSnapshot(name, snapshot)
+		return snapshot
+	}
+
+	slog.Error("GVL version not found in the archives", "version", version)
+	os.Exit(1)
+	return nil
+}
+
+// loadSnapshot reads an archived snapshot, decompressing it if needed.
+func loadSnapshot(path string) *Snapshot {
+	file, err := outfile.OpenReader(path)
+	if err != nil {
+		slog.Error("Error opening snapshot", "file", path, "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(file).Decode(&snapshot); err != nil {
+		slog.Error("Error parsing snapshot", "file", path, "error", err)
+		os.Exit(1)
+	}
+	return &snapshot
+}
+
+// diffSnapshots prints the vendors added to, removed from and deleted in the GVL between the two snapshots, and
+// the changes to the purposes and cookie disclosures of the vendors in both.
+func diffSnapshots(from *Snapshot, to *Snapshot) {
+	fmt.Printf("GVL v%d (fetched %s) -> v%d (fetched %s)\n\n", from.VendorList.VendorListVersion, from.Fetched.Format(time.RFC3339), to.VendorList.VendorListVersion, to.Fetched.Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tVENDOR ID\tVENDOR NAME\tDETAIL")
+	for _, id := range vendorIDs(from, to) {
+		before, inOld := from.VendorList.Vendors[id]
+		after, inNew := to.VendorList.Vendors[id]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "added\t%s\t%s\tpurposes %v\n", id, after.Name, after.Purposes)
+			continue
+		case !inNew:
+			fmt.Fprintf(w, "removed\t%s\t%s\t\n", id, before.Name)
+			continue
+		}
+
+		if before.DeletedDate == "" && after.DeletedDate != "" {
+			fmt.Fprintf(w, "deleted\t%s\t%s\t%s\n", id, after.Name, after.DeletedDate)
+		}
+		if fmt.Sprint(before.Purposes) != fmt.Sprint(after.Purposes) {
+			fmt.Fprintf(w, "purposes\t%s\t%s\t%v -> %v\n", id, after.Name, before.Purposes, after.Purposes)
+		}
+
+		beforeCookies := cookieDisclosures(from.Disclosures[id])
+		afterCookies := cookieDisclosures(to.Disclosures[id])
+		for _, name := range sortedKeys(afterCookies) {
+			if previous, found := beforeCookies[name]; !found {
+				fmt.Fprintf(w, "cookie added\t%s\t%s\t%s %v\n", id, after.Name, name, afterCookies[name])
+			} else if previous != afterCookies[name] {
+				fmt.Fprintf(w, "cookie changed\t%s\t%s\t%s %v -> %v\n", id, after.Name, name, previous, afterCookies[name])
+			}
+		}
+		for _, name := range sortedKeys(beforeCookies) {
+			if _, found := afterCookies[name]; !found {
+				fmt.Fprintf(w, "cookie removed\t%s\t%s\t%s\n", id, after.Name, name)
+			}
+		}
+	}
+	w.Flush()
+}
+
+// vendorIDs returns the IDs of the vendors in either snapshot, in ascending order.
+func vendorIDs(from *Snapshot, to *Snapshot) []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, vendors := range []map[string]Vendor{from.VendorList.Vendors, to.VendorList.Vendors} {
+		for id := range vendors {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// cookieDisclosures returns the cookies disclosed in the device disclosure, keyed by name, with their domains and
+// purposes.
+func cookieDisclosures(deviceDisclosure *DeviceDisclosure) map[string]string {
+	cookies := map[string]string{}
+	if deviceDisclosure == nil {
+		return cookies
+	}
+	for _, disclosure := range deviceDisclosure.Disclosures {
+		if disclosure.Type == "cookie" {
+			cookies[disclosure.Identifier] = fmt.Sprintf("domains %v purposes %v", disclosure.Domains, disclosure.Purposes)
+		}
+	}
+	return cookies
+}
+
+// sortedKeys returns the keys of the map in ascending order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Issues found by the audit subcommand
+const (
+	issueMissingURL         = "missing-url"         // The vendor declares no device storage disclosure URL.
+	issueUnreachable        = "unreachable"         // The disclosure cannot be fetched, or is not served with 200 OK.
+	issueMalformedJSON      = "malformed-json"      // The disclosure is not valid JSON in the disclosure format.
+	issueUndeclaredPurpose  = "undeclared-purpose"  // A disclosure claims a purpose the vendor declares neither for consent nor for legitimate interest.
+	issueUnknownPurpose     = "unknown-purpose"     // A disclosure claims a purpose ID that is not defined.
+	issueStorageUndisclosed = "storage-undisclosed" // The vendor declares purpose 1, storing and accessing information, but discloses no identifiers.
+)
+
+// auditIssue is an inconsistency between a vendor's GVL entry and its device disclosure.
+type auditIssue struct {
+	Vendor     Vendor
+	Issue      string
+	Identifier string // Identifier is the disclosure's identifier, if the issue concerns a single disclosure.
+	Type       string
+	Detail     string
+}
+
+// auditVendors fetches the device disclosure of every vendor in the vendor list that is not deleted, writes the
+// inconsistencies between the vendor's GVL entry and its disclosure to auditFileName and prints the number of issues
+// of each kind. The audit is independent of any scan.
+func auditVendors(vendorList *VendorList) {
+	var issues []auditIssue
+	audited := 0
+	snapshot := &Snapshot{VendorList: vendorList}
+	for _, id := range vendorIDs(snapshot, snapshot) {
+		vendor := vendorList.Vendors[id]
+		if vendor.DeletedDate != "" {
+			continue
+		}
+		audited++
+		issues = append(issues, auditVendor(vendor)...)
+	}
+
+	outputFile, err := outfile.Create(auditFileName)
+	if err != nil {
+		slog.Error("Error creating output file", "file", auditFileName, "error", err)
+		os.Exit(1)
+	}
+	defer outputFile.Close()
+	writer := csvfile.NewWriter(outputFile, outputFile.New)
+	defer writer.Flush()
+
+	rows := [][]string{{"Vendor ID", "Vendor Name", "Issue", "Identifier", "Type", "Detail", "Device Disclosure URL"}}
+	counts := map[string]int{}
+	vendors := map[int]bool{}
+	for _, issue := range issues {
+		rows = append(rows, []string{strconv.Itoa(issue.Vendor.ID), issue.Vendor.Name, issue.Issue, issue.Identifier, issue.Type, issue.Detail, issue.Vendor.DeviceStorageDisclosureUrl})
+		counts[issue.Issue]++
+		vendors[issue.Vendor.ID] = true
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		slog.Error("Error writing audit", "file", auditFileName, "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("GVL v%d: %d issues on %d of %d vendors, written to %s\n\n", vendorList.VendorListVersion, len(issues), len(vendors), audited, auditFileName)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ISSUE\tCOUNT")
+	for _, issue := range []string{issueMissingURL, issueUnreachable, issueMalformedJSON, issueUndeclaredPurpose, issueUnknownPurpose, issueStorageUndisclosed} {
+		fmt.Fprintf(w, "%s\t%d\n", issue, counts[issue])
+	}
+	w.Flush()
+}
+
+// auditVendor fetches the vendor's device disclosure and returns the issues found in it. A disclosure that cannot be
+// fetched or parsed is a single issue.
+func auditVendor(vendor Vendor) []auditIssue {
+	url := vendor.DeviceStorageDisclosureUrl
+	if url == "" {
+		return []auditIssue{{Vendor: vendor, Issue: issueMissingURL}}
+	}
+	body, err := client.Disclosure(url)
+	if err != nil {
+		slog.Warn("Error fetching device disclosure", "vendor", vendor.ID, "error", err)
+		return []auditIssue{{Vendor: vendor, Issue: issueUnreachable, Detail: err.Error()}}
+	}
+	deviceDisclosure, err := gvl.ParseDisclosure(body)
+	if err != nil {
+		return []auditIssue{{Vendor: vendor, Issue: issueMalformedJSON, Detail: err.Error()}}
+	}
+
+	declared := map[int]bool{}
+	for _, purposes := range [][]int{vendor.Purposes, vendor.LegIntPurposes} {
+		for _, purpose := range purposes {
+			declared[purpose] = true
+		}
+	}
+
+	var issues []auditIssue
+	if declared[1] && len(deviceDisclosure.Disclosures) == 0 {
+		issues = append(issues, auditIssue{Vendor: vendor, Issue: issueStorageUndisclosed, Detail: fmt.Sprintf("purposes %v", vendor.Purposes)})
+	}
+	for _, disclosure := range deviceDisclosure.Disclosures {
+		var undeclared, unknown []int
+		for _, purpose := range disclosure.Purposes {
+			switch {
+			case purpose < 1 || purpose > maxPurposeID:
+				unknown = append(unknown, purpose)
+			case !declared[purpose]:
+				undeclared = append(undeclared, purpose)
+			}
+		}
+		if len(undeclared) > 0 {
+			issues = append(issues, auditIssue{Vendor: vendor, Issue: issueUndeclaredPurpose, Identifier: disclosure.Identifier, Type: disclosure.Type,
+				Detail: fmt.Sprintf("claims %v, declares %v and legitimate interest %v", undeclared, vendor.Purposes, vendor.LegIntPurposes)})
+		}
+		if len(unknown) > 0 {
+			issues = append(issues, auditIssue{Vendor: vendor, Issue: issueUnknownPurpose, Identifier: disclosure.Identifier, Type: disclosure.Type, Detail: fmt.Sprintf("claims %v", unknown)})
+		}
+	}
+	return issues
+}
+
+// Issues found by the health subcommand. The TCF requires device storage disclosures to be served over HTTPS, with
+// CORS allowing any origin, so CMPs can read them from the browser.
+const (
+	healthNotHTTPS      = "not-https"          // The URL, or the URL it redirects to, is not HTTPS.
+	healthUnreachable   = "unreachable"        // The disclosure cannot be fetched, or is not served with 200 OK.
+	healthSlow          = "slow"               // The disclosure took longer than slowDisclosure to fetch.
+	healthNoCORS        = "no-cors"            // Access-Control-Allow-Origin allows neither any origin nor healthOrigin.
+	healthWrongType     = "wrong-content-type" // The disclosure is not served as JSON.
+	healthInvalidSchema = "invalid-schema"     // The disclosure does not follow the device storage disclosure format.
+	healthMissingURL    = "missing-url"        // The vendor declares no device storage disclosure URL.
+)
+
+// disclosureHealth is how a vendor's device disclosure is served.
+type disclosureHealth struct {
+	Vendor       Vendor
+	Status       int
+	ResponseTime time.Duration
+	AllowOrigin  string // AllowOrigin is the Access-Control-Allow-Origin header of the response.
+	ContentType  string
+	SchemaErrors []string
+	Issues       []string
+	Err          error // Err is the error fetching the disclosure, if any.
+}
+
+// checkDisclosureHealth fetches the device disclosure of every vendor in the vendor list that is not deleted, writes
+// how it is served to healthFileName, a row per vendor, and prints the number of vendors with each issue.
+func checkDisclosureHealth(vendorList *VendorList) {
+	outputFile, err := outfile.Create(healthFileName)
+	if err != nil {
+		slog.Error("Error creating output file", "file", healthFileName, "error", err)
+		os.Exit(1)
+	}
+	defer outputFile.Close()
+	writer := csvfile.NewWriter(outputFile, outputFile.New)
+	defer writer.Flush()
+
+	rows := [][]string{{"Vendor ID", "Vendor Name", "Device Disclosure URL", "Status Code", "Response Time (ms)", "Access-Control-Allow-Origin", "Content Type", "Schema Errors", "Issues", "Error", "Conformant"}}
+	counts := map[string]int{}
+	checked, conformant := 0, 0
+	snapshot := &Snapshot{VendorList: vendorList}
+	for _, id := range vendorIDs(snapshot, snapshot) {
+		vendor := vendorList.Vendors[id]
+		if vendor.DeletedDate != "" {
+			continue
+		}
+		checked++
+		health := checkVendorDisclosure(vendor)
+		for _, issue := range health.Issues {
+			counts[issue]++
+		}
+		if len(health.Issues) == 0 {
+			conformant++
+		}
+
+		status, responseTime, errText := "", "", ""
+		if health.Status != 0 {
+			status = strconv.Itoa(health.Status)
+		}
+		if health.ResponseTime > 0 {
+			responseTime = strconv.FormatInt(health.ResponseTime.Milliseconds(), 10)
+		}
+		if health.Err != nil {
+			errText = health.Err.Error()
+		}
+		rows = append(rows, []string{id, vendor.Name, vendor.DeviceStorageDisclosureUrl, status, responseTime, health.AllowOrigin, health.ContentType,
+			strings.Join(health.SchemaErrors, "; "), strings.Join(health.Issues, " "), errText, strconv.FormatBool(len(health.Issues) == 0)})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		slog.Error("Error writing disclosure health", "file", healthFileName, "error", err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
+	fmt.Printf("GVL v%d: %d of %d vendors serve a conformant disclosure, written to %s\n\n", vendorList.VendorListVersion, conformant, checked, healthFileName)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ISSUE\tVENDORS")
+	for _, issue := range []string{healthMissingURL, healthNotHTTPS, healthUnreachable, healthSlow, healthNoCORS, healthWrongType, healthInvalidSchema} {
+		fmt.Fprintf(w, "%s\t%d\n", issue, counts[issue])
+	}
+	w.Flush()
+}
+
+// checkVendorDisclosure fetches the vendor's device disclosure from healthOrigin and checks its scheme, status,
+// response time, CORS header, content type and format.
+func checkVendorDisclosure(vendor Vendor) disclosureHealth {
+	health := disclosureHealth{Vendor: vendor}
+	url := vendor.DeviceStorageDisclosureUrl
+	if url == "" {
+		health.Issues = []string{healthMissingURL}
+		return health
+	}
+	https := strings.HasPrefix(strings.ToLower(url), "https://")
+	if !https {
+		health.Issues = append(health.Issues, healthNotHTTPS)
+	}
+
+	req, err := newDisclosureRequest(url)
+	if err != nil {
+		health.Err = err
+		health.Issues = append(health.Issues, healthUnreachable)
+		return health
+	}
+	req.Header.Set("Origin", healthOrigin)
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: disclosureTimeout}).Do(req)
+	if err != nil {
+		health.Err = err
+		health.Issues = append(health.Issues, healthUnreachable)
+		return health
+	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	health.ResponseTime = time.Since(start)
+	health.Status = resp.StatusCode
+	health.AllowOrigin = resp.Header.Get("Access-Control-Allow-Origin")
+	health.ContentType = resp.Header.Get("Content-Type")
+
+	if https && resp.Request.URL.Scheme != "https" {
+		health.Issues = append(health.Issues, healthNotHTTPS)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if err == nil {
+			err = fmt.Errorf("status code: %d", resp.StatusCode)
+		}
+		health.Err = err
+		health.Issues = append(health.Issues, healthUnreachable)
+		return health
+	}
+	if health.ResponseTime > slowDisclosure {
+		health.Issues = append(health.Issues, healthSlow)
+	}
+	if health.AllowOrigin != "*" && health.AllowOrigin != healthOrigin {
+		health.Issues = append(health.Issues, healthNoCORS)
+	}
+	if mediaType, _, err := mime.ParseMediaType(health.ContentType); err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		health.Issues = append(health.Issues, healthWrongType)
+	}
+	if health.SchemaErrors = gvl.ValidateDisclosure(body); len(health.SchemaErrors) > 0 {
+		health.Issues = append(health.Issues, healthInvalidSchema)
+	}
+	return health
+}
+
+// fetchVendorList retrieves the vendor list from the provided URL.
+func fetchVendorList(url string) *VendorList {
+	vendorList, err := getVendorList(url)
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("Error fetching vendor list", "url", url, "error", err)
 		os.Exit(1)
 	}
+	return vendorList
+}
+
+// getVendorList retrieves and parses the vendor list at the URL.
+func getVendorList(url string) (*VendorList, error) {
+	body, err := client.VendorList(url)
+	if err != nil {
+		return nil, err
+	}
 
 	var vendorList VendorList
 	err = json.Unmarshal(body, &vendorList)
 	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to parse vendor list from %s: %v", url, err)
 	}
 
-	return &vendorList
+	return &vendorList, nil
 }
 
-// createVendorCSV creates a CSV file from the provided VendorList data.
-func createVendorCSV(vendorList *VendorList, fileName string) {
-	outputFile, err := os.Create(fileName)
+// createVendorCSV creates a CSV file from the vendors of the snapshot and their disclosures.
+func createVendorCSV(snapshot *Snapshot, fileName string) {
+	outputFile, err := outfile.Create(fileName)
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("Error creating output file", "file", fileName, "error", err)
 		os.Exit(1)
 	}
 	defer outputFile.Close()
 
-	writer := csv.NewWriter(outputFile)
+	writer := csvfile.NewWriter(outputFile, outputFile.New)
 	defer writer.Flush()
 
 	writeHeader(writer)
 
 	// Iterate through the vendors in the Global Vendor List
-	for _, vendor := range vendorList.Vendors {
-		deviceDisclosure, err := fetchDeviceDisclosure(vendor.DeviceStorageDisclosureUrl)
-		if err != nil {
-			fmt.Println("Error:", err)
+	for id, vendor := range snapshot.VendorList.Vendors {
+		deviceDisclosure, found := snapshot.Disclosures[id]
+		if !found {
 			continue
 		}
 
@@ -108,19 +633,48 @@ func createVendorCSV(vendorList *VendorList, fileName string) {
 	}
 }
 
+// writeStore writes the vendors of the snapshot and their disclosures to the GVL store named name. Vendors whose
+// disclosure could not be fetched are left out, as in the CSV file.
+func writeStore(snapshot *Snapshot, name string) {
+	dataset := &gvl.Dataset{Version: snapshot.VendorList.VendorListVersion, LastUpdated: snapshot.VendorList.LastUpdated, Fetched: snapshot.Fetched}
+	for _, id := range vendorIDs(snapshot, snapshot) {
+		deviceDisclosure, found := snapshot.Disclosures[id]
+		if !found {
+			continue
+		}
+		vendor := snapshot.VendorList.Vendors[id]
+
+		stored := gvl.Vendor{ID: vendor.ID, Name: vendor.Name, Purposes: vendor.Purposes, LegIntPurposes: vendor.LegIntPurposes, DisclosureURL: vendor.DeviceStorageDisclosureUrl, DeletedDate: vendor.DeletedDate}
+		for _, domain := range deviceDisclosure.Domains {
+			stored.Domains = append(stored.Domains, gvl.Domain{Domain: domain.Domain, Use: domain.Use})
+		}
+		dataset.Vendors = append(dataset.Vendors, stored)
+		for i, d := range deviceDisclosure.Disclosures {
+			dataset.Disclosures = append(dataset.Disclosures, gvl.Disclosure{VendorID: vendor.ID, Index: i, Identifier: d.Identifier, Type: d.Type,
+				MaxAgeSeconds: d.MaxAgeSeconds, CookieRefresh: d.CookieRefresh, Domains: d.Domains, Purposes: d.Purposes})
+		}
+	}
+
+	if err := gvl.WriteStore(name, dataset); err != nil {
+		slog.Error("Error writing GVL store", "file", name, "error", err)
+		os.Exit(1)
+	}
+}
+
 // writeHeader writes the header row to the CSV file.
 func writeHeader(writer *csv.Writer) {
-	header := []string{"Vendor Name", "Vendor ID", "Purposes", "Device Disclosure URL", "Cookie Domains", "Cookie Names", "Cookie Purposes", "Vendor Domains", "Vendor Uses"}
+	header := []string{"Vendor Name", "Vendor ID", "Purposes", "Device Disclosure URL", "Cookie Domains", "Cookie Names", "Cookie Purposes", "Vendor Domains", "Vendor Uses", "Storage Domains", "Storage Identifiers", "Storage Purposes", "Deleted Date", "LI Purposes"}
 	err := writer.Write(header)
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("Error writing header", "error", err)
 		os.Exit(1)
 	}
 }
 
 // writeVendor writes the vendor information to the CSV file.
 func writeVendor(writer *csv.Writer, vendor Vendor, deviceDisclosure *DeviceDisclosure) {
-	cookieDomains, cookieIdentifiers, cookiePurposes := processDisclosures(deviceDisclosure.Disclosures)
+	cookieDomains, cookieIdentifiers, cookiePurposes := processDisclosures(deviceDisclosure.Disclosures, "cookie")
+	storageDomains, storageIdentifiers, storagePurposes := processDisclosures(deviceDisclosure.Disclosures, "web")
 	vendorDomains, vendorUses := processDomains(deviceDisclosure.Domains)
 
 	row := []string{
@@ -133,18 +687,24 @@ func writeVendor(writer *csv.Writer, vendor Vendor, deviceDisclosure *DeviceDisc
 		strings.Join(cookiePurposes, "; "),
 		strings.Join(vendorDomains, "; "),
 		strings.Join(vendorUses, "; "),
+		strings.Join(storageDomains, "; "),
+		strings.Join(storageIdentifiers, "; "),
+		strings.Join(storagePurposes, "; "),
+		vendor.DeletedDate,
+		fmt.Sprintf("%v", vendor.LegIntPurposes),
 	}
 	err := writer.Write(row)
 	if err != nil {
-		fmt.Println("Error:", err)
+		slog.Error("Error writing vendor", "vendor", vendor.ID, "error", err)
 		os.Exit(1)
 	}
 }
 
-// processDisclosures processes disclosures and returns cookieDomains, cookieIdentifiers, cookiePurposes
-func processDisclosures(disclosures []Disclosure) (cookieDomains, cookieIdentifiers, cookiePurposes []string) {
+// processDisclosures processes the disclosures of the given type, "cookie" or "web" for localStorage, sessionStorage
+// and IndexedDB, and returns their domains, identifiers and purposes
+func processDisclosures(disclosures []Disclosure, disclosureType string) (cookieDomains, cookieIdentifiers, cookiePurposes []string) {
 	for _, disclosure := range disclosures {
-		if disclosure.Type == "cookie" {
+		if disclosure.Type == disclosureType {
 			cookieIdentifiers = append(cookieIdentifiers, disclosure.Identifier)
 			cookieDomains = append(cookieDomains, strings.Join(disclosure.Domains, ", "))
 			cookiePurposes = append(cookiePurposes, fmt.Sprintf("%v", disclosure.Purposes))
@@ -162,40 +722,13 @@ func processDomains(domains []Domain) (vendorDomains, vendorUses []string) {
 	return
 }
 
-// fetchDeviceDisclosure fetches device disclosure from a given URL
-func fetchDeviceDisclosure(url string) (*DeviceDisclosure, error) {
-	if url == "" {
-		return &DeviceDisclosure{}, nil
-	}
-
-	// Create a custom HTTP client with a user-agent
-	client := &http.Client{}
+// newDisclosureRequest returns a request for the device disclosure at the given URL, with the user agent gvl.HTTPClient
+// requests it with.
+func newDisclosureRequest(url string) (*http.Request, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.110 Safari/537.3")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch device disclosure from %s, status code: %d", url, resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var deviceDisclosure DeviceDisclosure
-	err = json.Unmarshal(body, &deviceDisclosure)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal device disclosure JSON from %s: %v", url, err)
-	}
-
-	return &deviceDisclosure, nil
+	req.Header.Set("User-Agent", gvl.DisclosureUserAgent)
+	return req, nil
 }
@@ -1,48 +1,264 @@
+//go:build ignore
+
 package main
 
 import (
 	"encoding/csv"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/gvl"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
 )
 
 // Define constants for file names
 const (
 	CookiesCSV          = "deny_all_vendors.csv"
-	GvlCSV              = "gvl_data.csv"
+	GvlCSV              = "gvl_data.csv" // GvlCSV may also be the gvl_data.db store of gvl-to-csv.go, whose matches cite the exact disclosure entry.
 	MatchedResultsCSV   = "matched_results.csv"
 	UnmatchedResultsCSV = "unmatched_results.csv"
 	PartialMatchCSV     = "partial_match_results.csv"
+	PurposeViolationCSV = "purpose_violations.csv"
+	RetiredVendorsCSV   = "retired_vendors.csv"
+	CloakedCookiesCSV   = "cloaked_cookies.csv"
+
+	// StorageCSV is the storage.csv written by the crawl with CaptureStorage set, whose localStorage, sessionStorage and
+	// IndexedDB identifiers are classified along with the cookies. Leave it empty to only classify cookies.
+	StorageCSV = ""
+
+	// CustomVendorsCSV declares the vendors outside the GVL, e.g. those the publisher relies on under another legal
+	// basis, with the columns Vendor Name, Legal Basis, Domains and Cookie Names, the latter two separated by ";". An
+	// empty Cookie Names column matches every cookie on the domains. Cookies matched to these vendors rather than to a
+	// GVL vendor are listed in CustomMatchCSV instead of the unmatched or partial match results. Leave it empty to
+	// only match against the GVL.
+	CustomVendorsCSV = ""
+	CustomMatchCSV   = "custom_vendor_results.csv"
+
+	// PinGVLVersion matches the cookies of each website against the GVL version its CMP reported, i.e. the vendor list
+	// version of the injected TC string, read from GvlVersionCSV as written by `go run gvl-to-csv.go version`. Cookies
+	// of versions without such a file, or whose version is unknown, are matched against GvlCSV. Retired vendors and
+	// cloaked cookies are always checked against GvlCSV, which knows of the latest deletions.
+	PinGVLVersion = false
+	GvlVersionCSV = "gvl_data_v%d.csv"
+
+	// LegitimateInterestCSV lists the vendors that set cookies on websites crawled with LegitimateInterestMode, i.e.
+	// without consent but with the legitimate interest of all vendors established, and with RequestsCSV, the
+	// requests.csv of the crawl with LogRequests set, the vendors that received third party requests on them. Cookies
+	// are marked purpose-1-without-consent, as storing information on the device is purpose 1, which legitimate
+	// interest cannot cover. Requests of vendors declaring legitimate interest purposes in the GVL are marked
+	// legitimate-interest, those of vendors declaring none consent-only, as they ignored the missing consent. Leave
+	// RequestsCSV empty to only check cookies.
+	LegitimateInterestCSV = "legitimate_interest.csv"
+	RequestsCSV           = ""
 )
 
+// generatedConsentColumn is the column of the cookies CSV holding the TC string injected during the crawl, from
+// which the purposes the user consented to are taken.
+const generatedConsentColumn = 7
+
+// Columns of the cookies CSV holding the TC string the CMP returned after reload, the time the cookie was set and the
+// canonical name of the CNAME-cloaked subdomain that set it
+const (
+	apiConsentColumn = 8
+	setAtColumn      = 16
+	cnameColumn      = 19
+)
+
+// Columns of the GVL CSV holding the date the vendor was deleted from the GVL, if it was, and the purposes it relies on
+// legitimate interest for
+const (
+	deletedDateColumn = 12
+	liPurposesColumn  = 13
+)
+
+// Verdicts of a vendor active on a website crawled without consent
+const (
+	verdictLegitimateInterest = "legitimate-interest"       // The vendor declares purposes it relies on legitimate interest for.
+	verdictConsentOnly        = "consent-only"              // The vendor declares no legitimate interest purposes, so it needed the missing consent.
+	verdictPurposeOne         = "purpose-1-without-consent" // The vendor stored a cookie, i.e. information on the device, which needs consent to purpose 1.
+)
+
+// maxPurposeID is the highest purpose ID checked in the injected TC string.
+const maxPurposeID = 24
+
 func main() {
 	cookies := readCSV(CookiesCSV)
-	vendors := readCSV(GvlCSV)
+	latest := newGVLData(loadGVL(GvlCSV))
+	var customVendors [][]string
+	if CustomVendorsCSV != "" {
+		customVendors = readCSV(CustomVendorsCSV)
+	}
 
-	matchedWriter := createCSVWriter(MatchedResultsCSV)
+	matchedFile, matchedWriter := createCSVWriter(MatchedResultsCSV)
+	defer matchedFile.Close()
 	defer matchedWriter.Flush()
 
-	unmatchedWriter := createCSVWriter(UnmatchedResultsCSV)
+	unmatchedFile, unmatchedWriter := createCSVWriter(UnmatchedResultsCSV)
+	defer unmatchedFile.Close()
 	defer unmatchedWriter.Flush()
 
-	partialMatchWriter := createCSVWriter(PartialMatchCSV)
+	partialMatchFile, partialMatchWriter := createCSVWriter(PartialMatchCSV)
+	defer partialMatchFile.Close()
 	defer partialMatchWriter.Flush()
 
+	purposeViolationFile, purposeViolationWriter := createCSVWriter(PurposeViolationCSV)
+	defer purposeViolationFile.Close()
+	defer purposeViolationWriter.Flush()
+	writePurposeViolationHeader(purposeViolationWriter)
+
+	retiredFile, retiredWriter := createCSVWriter(RetiredVendorsCSV)
+	defer retiredFile.Close()
+	defer retiredWriter.Flush()
+	writeRetiredVendorHeader(retiredWriter)
+
+	customFile, customWriter := createCSVWriter(CustomMatchCSV)
+	defer customFile.Close()
+	defer customWriter.Flush()
+	writeCustomMatchHeader(customWriter)
+
 	// Iterate through cookies
 	for _, cookie := range cookies {
-		processCookie(cookie, vendors, matchedWriter, unmatchedWriter, partialMatchWriter)
+		processCookie(cookie, "cookie", gvl.CookieColumns, gvlFor(cookie, latest).cookies, matchedWriter, unmatchedWriter, partialMatchWriter, purposeViolationWriter, retiredWriter, customVendors, customWriter)
+	}
+
+	// Iterate through the web storage identifiers, if any
+	if StorageCSV != "" {
+		for _, identifier := range storageIdentifiers(readCSV(StorageCSV)) {
+			processCookie(identifier.row, identifier.kind, gvl.StorageColumns, gvlFor(identifier.row, latest).storage, matchedWriter, unmatchedWriter, partialMatchWriter, purposeViolationWriter, retiredWriter, customVendors, customWriter)
+		}
+	}
+
+	checkRetiredConsent(retiredWriter, cookies, latest.vendors)
+
+	cloakedFile, cloakedWriter := createCSVWriter(CloakedCookiesCSV)
+	defer cloakedFile.Close()
+	defer cloakedWriter.Flush()
+	checkCloakedCookies(cloakedWriter, cookies, latest.cookies)
+
+	var requests [][]string
+	if RequestsCSV != "" {
+		requests = readCSV(RequestsCSV)
+	}
+	legitimateInterestFile, legitimateInterestWriter := createCSVWriter(LegitimateInterestCSV)
+	defer legitimateInterestFile.Close()
+	defer legitimateInterestWriter.Flush()
+	checkLegitimateInterest(legitimateInterestWriter, cookies, requests, latest.cookies)
+}
+
+// storageIdentifier is a web storage identifier in the layout of a cookie row, so it is classified the same way.
+type storageIdentifier struct {
+	row  []string
+	kind string // kind is localStorage, sessionStorage or indexedDB.
+}
+
+// storageIdentifiers converts the rows of the storage CSV, i.e. Website, Phase, Origin, Third Party, Type, Name, Key,
+// Value and Generated Consent String, to cookie rows holding the website, the origin's host, the identifier, its value
+// and the injected TC string. Identifiers recorded in several phases or for several IndexedDB entries are only
+// returned once.
+func storageIdentifiers(rows [][]string) []storageIdentifier {
+	seen := map[string]bool{}
+	var identifiers []storageIdentifier
+	for _, row := range rows {
+		if len(row) < 9 || row[0] == "Website" {
+			continue
+		}
+		host := row[2]
+		if u, err := url.Parse(row[2]); err == nil {
+			host = u.Hostname()
+		}
+
+		key := strings.Join([]string{row[0], host, row[4], row[5]}, "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		identifiers = append(identifiers, storageIdentifier{row: []string{row[0], host, row[5], row[7], "", "", "", row[8]}, kind: row[4]})
+	}
+	return identifiers
+}
+
+// gvlData holds the vendors of a GVL CSV, indexed once by the cookies and by the web storage identifiers they
+// disclose, so each identifier is matched with a few lookups rather than compared to every vendor.
+type gvlData struct {
+	vendors [][]string
+	cookies *gvl.Index
+	storage *gvl.Index
+}
+
+// newGVLData indexes the vendors of a GVL CSV or store.
+func newGVLData(g *gvl.GVL) *gvlData {
+	return &gvlData{vendors: g.Vendors, cookies: g.Index(gvl.CookieColumns), storage: g.Index(gvl.StorageColumns)}
+}
+
+// gvlVersions caches the GVL versions read so far, holding nil for versions without a CSV file.
+var gvlVersions = map[int]*gvlData{}
+
+// gvlFor returns the GVL version the cookie's consent was generated for if PinGVLVersion is set, or the latest GVL
+// otherwise or if that version has not been written.
+func gvlFor(cookie []string, latest *gvlData) *gvlData {
+	if !PinGVLVersion {
+		return latest
+	}
+	version := gvlVersion(cookie)
+	if version == 0 {
+		return latest
+	}
+
+	data, found := gvlVersions[version]
+	if !found {
+		name := fmt.Sprintf(GvlVersionCSV, version)
+		if _, err := os.Stat(outfile.Path(name)); err == nil {
+			data = newGVLData(loadGVL(name))
+		} else {
+			fmt.Fprintf(os.Stderr, "GVL version %d not found, matching its cookies against %s. Run `go run gvl-to-csv.go version %d` to write %s.\n", version, GvlCSV, version, name)
+		}
+		gvlVersions[version] = data
+	}
+	if data == nil {
+		return latest
+	}
+	return data
+}
+
+// gvlVersion returns the vendor list version of the TC string injected for the cookie's website, or of the one its
+// CMP returned, or 0 if neither can be decoded.
+func gvlVersion(cookie []string) int {
+	for _, column := range []int{generatedConsentColumn, apiConsentColumn} {
+		if len(cookie) <= column || cookie[column] == "" {
+			continue
+		}
+		if tcData, err := iabtcfv2.Decode(cookie[column]); err == nil && tcData != nil && tcData.CoreString != nil {
+			return tcData.CoreString.VendorListVersion
+		}
 	}
+	return 0
 }
 
-// readCSV reads a CSV file and returns its content.
+// loadGVL reads a GVL CSV, decompressing it if needed, or a GVL store.
+func loadGVL(filename string) *gvl.GVL {
+	g, err := gvl.Load(filename)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// readCSV reads a CSV file, decompressing it if needed, and returns its content.
 func readCSV(filename string) [][]string {
-	file, err := os.Open(filename)
+	file, err := outfile.OpenReader(filename)
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
+	reader := csvfile.NewReader(file)
 	records, err := reader.ReadAll()
 	if err != nil {
 		panic(err)
@@ -50,56 +266,37 @@ func readCSV(filename string) [][]string {
 	return records
 }
 
-// createCSVWriter creates and returns a CSV writer
-func createCSVWriter(filename string) *csv.Writer {
-	file, err := os.Create(filename)
+// createCSVWriter creates a CSV file, compressed according to its name or outfile.Compression, and returns it along
+// with a CSV writer.
+func createCSVWriter(filename string) (*outfile.File, *csv.Writer) {
+	file, err := outfile.Create(filename)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
 
-	return csv.NewWriter(file)
+	return file, csvfile.NewWriter(file, file.New)
 }
 
-// processCookie processes a single cookie by checking it against vendors and writing match results.
-func processCookie(cookie []string, vendors [][]string, matchedWriter, unmatchedWriter, partialMatchWriter *csv.Writer) {
+// processCookie processes a single cookie, or web storage identifier of the given kind, by matching it against the
+// vendors' disclosures in the index, built from the given columns, and writing match results.
+func processCookie(cookie []string, kind string, columns gvl.IdentifierColumns, index *gvl.Index, matchedWriter, unmatchedWriter, partialMatchWriter, purposeViolationWriter, retiredWriter *csv.Writer, customVendors [][]string, customWriter *csv.Writer) {
 	cookieDomain := strings.ReplaceAll(cookie[1], " ", "")
 	cookieName := strings.ReplaceAll(cookie[2], " ", "")
-	foundMatch := false
-	partialMatch := false
-	var partialMatchVendor []string
-
-	// Iterate through vendors
-	for _, vendor := range vendors {
-		vendorDomains, vendorCookies := extractVendorData(vendor)
-
-		if domainMatched := findDomainMatch(cookieDomain, vendorDomains); domainMatched {
-			partialMatch = true
-			partialMatchVendor = vendor
-			for i, vendorCookie := range vendorCookies {
-				if cookieName == vendorCookie {
-					foundMatch = true
-					writeMatchResult(matchedWriter, cookie, vendor, cookieName, cookieDomain, i)
-					break
-				}
-			}
-		}
 
-		if foundMatch {
-			break
-		}
+	match := index.Match(cookieName, cookieDomain)
+	foundMatch := match.Vendor != nil
+	if foundMatch {
+		writeMatchResult(matchedWriter, cookie, kind, columns, match, cookieName, cookieDomain)
+		checkCookiePurposes(purposeViolationWriter, cookie, kind, columns, match, cookieName, cookieDomain)
+		checkRetiredVendor(retiredWriter, cookie, kind, match.Vendor, cookieName, cookieDomain)
 	}
 
-	writePartialOrUnmatchedResult(partialMatch, foundMatch, partialMatchWriter, unmatchedWriter, cookie, partialMatchVendor, cookieName, cookieDomain)
-}
+	// Cookies not disclosed in the GVL may be declared by a vendor outside it
+	if !foundMatch && matchCustomVendor(customWriter, cookie, kind, customVendors, cookieName, cookieDomain) {
+		return
+	}
 
-// extractVendorData extracts vendor data from a row in the GVL data.
-func extractVendorData(vendor []string) ([]string, []string) {
-	vendorCookieDomains := strings.Split(strings.ReplaceAll(vendor[4], " ", ""), ";")
-	vendorGeneralDomains := strings.Split(strings.ReplaceAll(vendor[7], " ", ""), ";")
-	vendorDomains := append(vendorCookieDomains, vendorGeneralDomains...)
-	vendorCookies := strings.Split(strings.ReplaceAll(vendor[5], " ", ""), ";")
-	return vendorDomains, vendorCookies
+	writePartialOrUnmatchedResult(match.Partial != nil, foundMatch, partialMatchWriter, unmatchedWriter, cookie, kind, match.Partial, cookieName, cookieDomain)
 }
 
 // findDomainMatch checks if a cookie's domain matches a vendor's domains.
@@ -112,9 +309,11 @@ func findDomainMatch(cookieDomain string, vendorDomains []string) bool {
 	return false
 }
 
-// writeMatchResult writes a match result to the matchedWriter.
-func writeMatchResult(matchedWriter *csv.Writer, cookie, vendor []string, cookieName, cookieDomain string, i int) {
-	row := []string{cookie[0], vendor[0], vendor[1], vendor[2], cookieName, cookieDomain, vendor[6]}
+// writeMatchResult writes a match result to the matchedWriter, with whether the vendor disclosed the identifier itself
+// or a pattern matching it, the confidence of the match and, if matched against the GVL store, the disclosure entry.
+func writeMatchResult(matchedWriter *csv.Writer, cookie []string, kind string, columns gvl.IdentifierColumns, match gvl.Match, cookieName, cookieDomain string) {
+	vendor := match.Vendor
+	row := []string{cookie[0], vendor[0], vendor[1], vendor[2], cookieName, cookieDomain, vendor[columns.Purposes], kind, match.Kind, match.Confidence, match.Citation()}
 	err := matchedWriter.Write(row)
 	if err != nil {
 		panic(err)
@@ -122,19 +321,19 @@ func writeMatchResult(matchedWriter *csv.Writer, cookie, vendor []string, cookie
 }
 
 // writePartialOrUnmatchedResult writes the results to the appropriate writer based on the match status.
-func writePartialOrUnmatchedResult(partialMatch, foundMatch bool, partialMatchWriter, unmatchedWriter *csv.Writer, cookie, partialMatchVendor []string, cookieName, cookieDomain string) {
+func writePartialOrUnmatchedResult(partialMatch, foundMatch bool, partialMatchWriter, unmatchedWriter *csv.Writer, cookie []string, kind string, partialMatchVendor []string, cookieName, cookieDomain string) {
 	if !foundMatch {
 		if partialMatch {
-			writePartialMatchResult(partialMatchWriter, cookie, partialMatchVendor, cookieName, cookieDomain)
+			writePartialMatchResult(partialMatchWriter, cookie, kind, partialMatchVendor, cookieName, cookieDomain)
 		} else {
-			writeUnmatchedResult(unmatchedWriter, cookie, cookieName, cookieDomain)
+			writeUnmatchedResult(unmatchedWriter, cookie, kind, cookieName, cookieDomain)
 		}
 	}
 }
 
 // writePartialMatchResult writes a partial match result to the partialMatchWriter.
-func writePartialMatchResult(partialMatchWriter *csv.Writer, cookie, partialMatchVendor []string, cookieName, cookieDomain string) {
-	row := []string{cookie[0], partialMatchVendor[0], partialMatchVendor[1], partialMatchVendor[2], cookieName, cookieDomain}
+func writePartialMatchResult(partialMatchWriter *csv.Writer, cookie []string, kind string, partialMatchVendor []string, cookieName, cookieDomain string) {
+	row := []string{cookie[0], partialMatchVendor[0], partialMatchVendor[1], partialMatchVendor[2], cookieName, cookieDomain, kind}
 	err := partialMatchWriter.Write(row)
 	if err != nil {
 		panic(err)
@@ -142,14 +341,340 @@ func writePartialMatchResult(partialMatchWriter *csv.Writer, cookie, partialMatc
 }
 
 // writeUnmatchedResult writes an unmatched result to the unmatchedWriter.
-func writeUnmatchedResult(unmatchedWriter *csv.Writer, cookie []string, cookieName, cookieDomain string) {
-	row := []string{cookie[0], cookieName, cookieDomain}
+func writeUnmatchedResult(unmatchedWriter *csv.Writer, cookie []string, kind string, cookieName, cookieDomain string) {
+	row := []string{cookie[0], cookieName, cookieDomain, kind}
 	err := unmatchedWriter.Write(row)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// checkCookiePurposes writes a purpose violation if the matched cookie is disclosed for purposes the user did not
+// consent to in the TC string injected during the crawl. Cookies whose consent string cannot be decoded are skipped.
+func checkCookiePurposes(purposeViolationWriter *csv.Writer, cookie []string, kind string, columns gvl.IdentifierColumns, match gvl.Match, cookieName, cookieDomain string) {
+	granted, ok := grantedPurposes(cookie)
+	if !ok {
+		return
+	}
+
+	vendor := match.Vendor
+	disclosed := disclosedPurposes(match, columns)
+	var withoutConsent []int
+	for _, purpose := range disclosed {
+		if !granted[purpose] {
+			withoutConsent = append(withoutConsent, purpose)
+		}
+	}
+	if len(withoutConsent) == 0 {
+		return
+	}
+
+	row := []string{cookie[0], vendor[0], vendor[1], cookieName, cookieDomain, fmt.Sprint(disclosed), fmt.Sprint(sortedPurposes(granted)), fmt.Sprint(withoutConsent), kind}
+	err := purposeViolationWriter.Write(row)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// writePurposeViolationHeader writes the header row of the purpose violations CSV.
+func writePurposeViolationHeader(purposeViolationWriter *csv.Writer) {
+	header := []string{"Website", "Vendor Name", "Vendor ID", "Cookie Name", "Cookie Domain", "Disclosed Purposes", "Granted Purposes", "Purposes Without Consent", "Type"}
+	err := purposeViolationWriter.Write(header)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// grantedPurposes decodes the TC string injected for the cookie's website and returns the purposes consented to.
+func grantedPurposes(cookie []string) (map[int]bool, bool) {
+	if len(cookie) <= generatedConsentColumn {
+		return nil, false
+	}
+	tcData, err := iabtcfv2.Decode(cookie[generatedConsentColumn])
+	if err != nil {
+		return nil, false
+	}
+
+	granted := map[int]bool{}
+	for purpose := 1; purpose <= maxPurposeID; purpose++ {
+		if tcData.IsPurposeAllowed(purpose) {
+			granted[purpose] = true
+		}
+	}
+	return granted, true
+}
+
+// disclosedPurposes returns the purposes of the matched disclosure entry, or else parses the purposes the vendor
+// disclosed for the matched identifier in the given columns, e.g. "[1 3 4]".
+func disclosedPurposes(match gvl.Match, columns gvl.IdentifierColumns) []int {
+	if match.Disclosure != nil {
+		return match.Disclosure.Purposes
+	}
+	i := match.Identifier
+	cookiePurposes := strings.Split(match.Vendor[columns.Purposes], ";")
+	if i >= len(cookiePurposes) {
+		return nil
+	}
+
+	var purposes []int
+	for _, field := range strings.Fields(strings.Trim(strings.TrimSpace(cookiePurposes[i]), "[]")) {
+		if purpose, err := strconv.Atoi(field); err == nil {
+			purposes = append(purposes, purpose)
+		}
+	}
+	return purposes
+}
+
+// sortedPurposes returns the purposes in the set in ascending order.
+func sortedPurposes(set map[int]bool) []int {
+	var purposes []int
+	for purpose := 1; purpose <= maxPurposeID; purpose++ {
+		if set[purpose] {
+			purposes = append(purposes, purpose)
+		}
+	}
+	return purposes
+}
+
+// writeCustomMatchHeader writes the header row of the custom vendor results CSV.
+func writeCustomMatchHeader(customWriter *csv.Writer) {
+	header := []string{"Website", "Vendor Name", "Legal Basis", "Cookie Name", "Cookie Domain", "Type"}
+	err := customWriter.Write(header)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// matchCustomVendor writes the cookie to the custom vendor results if a vendor of the custom vendor list declares it,
+// and reports whether one did.
+func matchCustomVendor(customWriter *csv.Writer, cookie []string, kind string, customVendors [][]string, cookieName, cookieDomain string) bool {
+	for _, vendor := range customVendors {
+		if len(vendor) < 4 || vendor[0] == "Vendor Name" {
+			continue
+		}
+		domains := strings.Split(strings.ReplaceAll(vendor[2], " ", ""), ";")
+		if !findDomainMatch(cookieDomain, domains) {
+			continue
+		}
+		names := strings.ReplaceAll(vendor[3], " ", "")
+		if names != "" && !contains(strings.Split(names, ";"), cookieName) {
+			continue
+		}
+
+		row := []string{cookie[0], vendor[0], vendor[1], cookieName, cookieDomain, kind}
+		err := customWriter.Write(row)
+		if err != nil {
+			panic(err)
+		}
+		return true
+	}
+	return false
+}
+
+// contains reports whether the list contains the value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRetiredVendorHeader writes the header row of the retired vendors CSV.
+func writeRetiredVendorHeader(retiredWriter *csv.Writer) {
+	header := []string{"Website", "Vendor Name", "Vendor ID", "Deleted Date", "Activity", "Detail", "Observed At"}
+	err := retiredWriter.Write(header)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// deletedDate returns the date the vendor was deleted from the GVL, or false if it was not or the GVL data was written
+// before the column was added.
+func deletedDate(vendor []string) (time.Time, bool) {
+	if len(vendor) <= deletedDateColumn || vendor[deletedDateColumn] == "" {
+		return time.Time{}, false
+	}
+	deleted, err := time.Parse(time.RFC3339, vendor[deletedDateColumn])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deleted, true
+}
+
+// observedAt returns the time the cookie was set, or an empty string if it was not recorded.
+func observedAt(cookie []string) string {
+	if len(cookie) <= setAtColumn {
+		return ""
+	}
+	return cookie[setAtColumn]
+}
+
+// observedAfter reports whether the activity at the observed time, in RFC 3339, happened after the vendor's deletion.
+// Activity whose time was not recorded is assumed to be recent.
+func observedAfter(observed string, deleted time.Time) bool {
+	at, err := time.Parse(time.RFC3339, observed)
+	return err != nil || at.After(deleted)
+}
+
+// checkRetiredVendor writes the matched cookie to the retired vendors CSV if its vendor was deleted from the GVL
+// before the cookie was set.
+func checkRetiredVendor(retiredWriter *csv.Writer, cookie []string, kind string, vendor []string, cookieName, cookieDomain string) {
+	deleted, ok := deletedDate(vendor)
+	if !ok || !observedAfter(observedAt(cookie), deleted) {
+		return
+	}
+
+	row := []string{cookie[0], vendor[0], vendor[1], vendor[deletedDateColumn], kind, cookieName + " on " + cookieDomain, observedAt(cookie)}
+	err := retiredWriter.Write(row)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// checkRetiredConsent writes the vendors deleted from the GVL that the TC string returned by a website's CMP still
+// grants consent to. The TC string of each website is taken from its first cookie carrying one.
+func checkRetiredConsent(retiredWriter *csv.Writer, cookies [][]string, vendors [][]string) {
+	checked := map[string]bool{}
+	for _, cookie := range cookies {
+		if len(cookie) <= apiConsentColumn || cookie[apiConsentColumn] == "" || checked[cookie[0]] {
+			continue
+		}
+		tcData, err := iabtcfv2.Decode(cookie[apiConsentColumn])
+		if err != nil || tcData == nil {
+			continue
+		}
+		checked[cookie[0]] = true
+
+		for _, vendor := range vendors {
+			deleted, ok := deletedDate(vendor)
+			if !ok || !observedAfter(observedAt(cookie), deleted) {
+				continue
+			}
+			id, err := strconv.Atoi(vendor[1])
+			if err != nil || !tcData.IsVendorAllowed(id) {
+				continue
+			}
+
+			row := []string{cookie[0], vendor[0], vendor[1], vendor[deletedDateColumn], "consent", "granted in the API Consent String", observedAt(cookie)}
+			err = retiredWriter.Write(row)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// checkCloakedCookies writes the cookies set by subdomains of the website that are CNAMEs to a domain disclosed by a
+// vendor of the index, i.e. third party cookies disguised as first party ones that host matching misses, along with
+// the vendor.
+func checkCloakedCookies(cloakedWriter *csv.Writer, cookies [][]string, index *gvl.Index) {
+	err := cloakedWriter.Write([]string{"Website", "Cookie Name", "Cookie Domain", "CNAME", "Vendor Name", "Vendor ID"})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, cookie := range cookies {
+		if len(cookie) <= cnameColumn || cookie[cnameColumn] == "" || cookie[0] == "Website" {
+			continue
+		}
+		cname := strings.TrimSuffix(cookie[cnameColumn], ".")
+		vendor := index.VendorOnDomain(cname)
+		if vendor == nil {
+			continue
+		}
+
+		row := []string{cookie[0], cookie[2], cookie[1], cname, vendor[0], vendor[1]}
+		err := cloakedWriter.Write(row)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// checkLegitimateInterest writes the vendors that set cookies, or received third party requests, on the websites
+// whose injected TC string grants no consent but establishes legitimate interest, along with whether they declare
+// legitimate interest purposes. Requests are listed once per website and vendor, with the first request's URL.
+func checkLegitimateInterest(legitimateInterestWriter *csv.Writer, cookies [][]string, requests [][]string, index *gvl.Index) {
+	err := legitimateInterestWriter.Write([]string{"Website", "Vendor Name", "Vendor ID", "Activity", "Detail", "Consent Purposes", "LI Purposes", "Verdict"})
+	if err != nil {
+		panic(err)
+	}
+
+	websites := map[string]bool{}
+	for _, cookie := range cookies {
+		if !legitimateInterestOnly(cookie) {
+			continue
+		}
+		websites[cookie[0]] = true
+		if vendor := index.VendorOnDomain(cookie[1]); vendor != nil {
+			writeLegitimateInterestResult(legitimateInterestWriter, cookie[0], vendor, "cookie", cookie[2]+" on "+cookie[1])
+		}
+	}
+
+	reported := map[string]bool{}
+	for _, request := range requests {
+		if len(request) < 4 || !websites[request[0]] || request[3] != "third-party" {
+			continue
+		}
+		requestURL, err := url.Parse(request[1])
+		if err != nil {
+			continue
+		}
+		vendor := index.VendorOnDomain(requestURL.Hostname())
+		if vendor == nil || reported[request[0]+" "+vendor[1]] {
+			continue
+		}
+		reported[request[0]+" "+vendor[1]] = true
+		writeLegitimateInterestResult(legitimateInterestWriter, request[0], vendor, "request", request[1])
+	}
+}
+
+// writeLegitimateInterestResult writes the vendor's activity on the website with its verdict. Setting a cookie is
+// purpose 1 activity, which the TCF only allows with consent, so it is non-compliant whatever legitimate interest
+// purposes the vendor declares.
+func writeLegitimateInterestResult(legitimateInterestWriter *csv.Writer, website string, vendor []string, activity, detail string) {
+	liPurposes := ""
+	if len(vendor) > liPurposesColumn {
+		liPurposes = vendor[liPurposesColumn]
+	}
+	verdict := verdictConsentOnly
+	switch {
+	case activity == "cookie":
+		verdict = verdictPurposeOne
+	case strings.Trim(liPurposes, "[] ") != "":
+		verdict = verdictLegitimateInterest
+	}
+
+	row := []string{website, vendor[0], vendor[1], activity, detail, vendor[2], liPurposes, verdict}
+	err := legitimateInterestWriter.Write(row)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// legitimateInterestOnly reports whether the TC string injected for the cookie's website grants no purpose consent but
+// establishes the legitimate interest of some purposes, as with LegitimateInterestMode.
+func legitimateInterestOnly(cookie []string) bool {
+	if len(cookie) <= generatedConsentColumn {
+		return false
+	}
+	tcData, err := iabtcfv2.Decode(cookie[generatedConsentColumn])
+	if err != nil || tcData == nil || tcData.CoreString == nil {
+		return false
+	}
+
+	established := false
+	for purpose := 1; purpose <= maxPurposeID; purpose++ {
+		if tcData.CoreString.PurposesConsent[purpose] {
+			return false
+		}
+		established = established || tcData.CoreString.PurposesLITransparency[purpose]
+	}
+	return established
+}
+
 // domainMatches checks if the cookie domain matches the vendor domain.
 func domainMatches(cookieDomain, vendorDomain string) bool {
 	// Split both domains into segments
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+const (
+	// The progress of a run is reported on the terminal, so a crawl of several days can be watched without reading the
+	// logs: with -progress tui, or by default when stderr is a terminal, a dashboard redrawn every DashboardRefresh
+	// shows the domains done, a progress bar per worker with the domain it scans, the domains per minute, the failures
+	// by class, the last findings and the last warnings, while the log records go to DashboardLogFile. Otherwise, and
+	// with -progress lines, a progress line is logged every ProgressInterval. -progress off reports neither
+	Progress          = progressAuto
+	DashboardRefresh  = time.Second
+	ProgressInterval  = time.Minute
+	DashboardLogFile  = "crawler.log" // DashboardLogFile is the file in LogDir the log records are written to while the dashboard is shown.
+	DashboardFindings = 5             // DashboardFindings specifies the number of findings and of warnings shown.
+
+	// Modes of -progress
+	progressAuto  = "auto"  // The dashboard on a terminal, progress lines otherwise.
+	progressTUI   = "tui"   // The dashboard.
+	progressLines = "lines" // A progress line every ProgressInterval.
+	progressOff   = "off"
+
+	localWorker = "local" // localWorker is the name of the scanner of this process in the dashboard.
+	barWidth    = 30      // barWidth is the number of characters of the progress bars.
+)
+
+var progressFlag = flag.String("progress", Progress, "how the progress of the run is reported: auto, tui for the dashboard, lines for a progress line every minute, or off")
+
+// workerProgress is the domain a worker is scanning.
+type workerProgress struct {
+	domain  string
+	started time.Time
+	timeout time.Duration
+	done    int // done counts the domains the worker finished.
+}
+
+// runProgress keeps track of the progress of the run, for the dashboard and the progress lines.
+type runProgress struct {
+	mu        sync.Mutex
+	started   time.Time
+	done      int
+	remaining int // remaining is the number of domains that are not done, including those being scanned.
+	workers   map[string]*workerProgress
+	failures  map[string]int // failures counts the domains by the class of the error their scan failed with.
+	findings  []string       // findings holds the last DashboardFindings findings, the oldest first.
+	warnings  []string       // warnings holds the last DashboardFindings warnings and errors logged, the oldest first.
+}
+
+// progress is the progress of the run of this process.
+var progress = &runProgress{started: time.Now(), workers: map[string]*workerProgress{}, failures: map[string]int{}}
+
+// stopProgress stops reporting the progress, restoring the logger the dashboard replaced. It is called by fatal, so
+// the error is shown on the terminal.
+var stopProgress = func() {}
+
+// begin records that the worker started scanning the domain, with the number of domains not done yet.
+func (p *runProgress) begin(worker string, domain string, remaining int, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w, ok := p.workers[worker]
+	if !ok {
+		w = &workerProgress{}
+		p.workers[worker] = w
+	}
+	w.domain, w.started, w.timeout = domain, time.Now(), timeout
+	p.remaining = remaining
+}
+
+// end records that the worker finished the domain, failing with the error class if it is not empty, and the findings
+// of the scan.
+func (p *runProgress) end(worker string, domain string, errorClass string, findings []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w, ok := p.workers[worker]; ok {
+		w.domain = ""
+		w.done++
+	}
+	p.done++
+	p.remaining = max(p.remaining-1, 0)
+	if errorClass != "" {
+		p.failures[errorClass]++
+	}
+	for _, finding := range findings {
+		p.findings = appendLast(p.findings, time.Now().Format("15:04:05")+" "+domain+" "+finding)
+	}
+}
+
+// drop records that the worker stopped scanning its domain without finishing it, e.g. as its lease expired.
+func (p *runProgress) drop(worker string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w, ok := p.workers[worker]; ok {
+		w.domain = ""
+	}
+}
+
+// warn records a warning or error logged while the dashboard is shown.
+func (p *runProgress) warn(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.warnings = appendLast(p.warnings, message)
+}
+
+// appendLast appends the line, keeping the last DashboardFindings lines.
+func appendLast(lines []string, line string) []string {
+	lines = append(lines, line)
+	if len(lines) > DashboardFindings {
+		lines = lines[len(lines)-DashboardFindings:]
+	}
+	return lines
+}
+
+// rate returns the domains finished per minute since the start of the run.
+func (p *runProgress) rate() float64 {
+	minutes := time.Since(p.started).Minutes()
+	if minutes <= 0 {
+		return 0
+	}
+	return float64(p.done) / minutes
+}
+
+// eta returns the estimated time until the domains not done yet are, 0 if it cannot be estimated yet.
+func (p *runProgress) eta() time.Duration {
+	rate := p.rate()
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.remaining) / rate * float64(time.Minute)).Round(time.Minute)
+}
+
+// failureSummary returns the failures by class, e.g. "dns 3, nav-timeout 12", in the order of the classes.
+func (p *runProgress) failureSummary() string {
+	classes := make([]string, 0, len(p.failures))
+	for class := range p.failures {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	summary := make([]string, len(classes))
+	for i, class := range classes {
+		summary[i] = fmt.Sprintf("%s %d", class, p.failures[class])
+	}
+	return strings.Join(summary, ", ")
+}
+
+// render writes the dashboard.
+func (p *runProgress) render(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b strings.Builder
+	total := p.done + p.remaining
+	share := 0.0
+	if total > 0 {
+		share = float64(p.done) / float64(total)
+	}
+	fmt.Fprintf(&b, "Vendor compliance check  %s  %d/%d domains (%.1f%%)\n", bar(share), p.done, total, 100*share)
+	eta := "-"
+	if d := p.eta(); d > 0 {
+		eta = d.String()
+	}
+	fmt.Fprintf(&b, "Elapsed %s  Rate %.1f domains/min  ETA %s  Cookies %d  Proxy requests %d\n\n",
+		time.Since(p.started).Round(time.Second), p.rate(), eta, metrics.cookiesCaptured.Load(), metrics.proxyRequests.Load())
+
+	names := make([]string, 0, len(p.workers))
+	for name := range p.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("Workers\n")
+	for _, name := range names {
+		worker := p.workers[name]
+		if worker.domain == "" {
+			fmt.Fprintf(&b, "  %-16s %-32s %s  idle, %d done\n", truncate(name, 16), "", bar(0), worker.done)
+			continue
+		}
+		elapsed := time.Since(worker.started)
+		share := 0.0
+		if worker.timeout > 0 {
+			share = min(elapsed.Seconds()/worker.timeout.Seconds(), 1)
+		}
+		fmt.Fprintf(&b, "  %-16s %-32s %s  %s/%s, %d done\n", truncate(name, 16), truncate(worker.domain, 32), bar(share),
+			elapsed.Round(time.Second), worker.timeout, worker.done)
+	}
+
+	failures := p.failureSummary()
+	if failures == "" {
+		failures = "none"
+	}
+	fmt.Fprintf(&b, "\nFailures  %s\n", failures)
+	b.WriteString("\nLast findings\n")
+	for _, finding := range p.findings {
+		fmt.Fprintf(&b, "  %s\n", truncate(finding, 120))
+	}
+	b.WriteString("\nLast warnings\n")
+	for _, warning := range p.warnings {
+		fmt.Fprintf(&b, "  %s\n", truncate(warning, 120))
+	}
+
+	// Move to the top left corner and clear the screen before drawing, so the dashboard replaces the previous one
+	io.WriteString(w, "\x1b[H\x1b[2J"+b.String())
+}
+
+// logLine logs a progress line.
+func (p *runProgress) logLine(logger *slog.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := 0
+	for _, worker := range p.workers {
+		if worker.domain != "" {
+			active++
+		}
+	}
+	logger.Info("Progress", "done", p.done, "remaining", p.remaining, "perMinute", fmt.Sprintf("%.1f", p.rate()), "eta", p.eta(), "active", active, "failures", p.failureSummary())
+}
+
+// bar returns a progress bar filled to the share.
+func bar(share float64) string {
+	filled := int(share * barWidth)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "]"
+}
+
+// truncate cuts s to n characters.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+// isTerminal reports whether the file is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts reporting the progress of the run as configured by -progress. With the dashboard, the log
+// records are written to DashboardLogFile instead of stderr, the warnings also being shown on the dashboard. The
+// returned function stops reporting, drawing the dashboard a last time.
+func startProgress() func() {
+	mode := *progressFlag
+	if mode == progressAuto {
+		mode = progressLines
+		if isTerminal(os.Stderr) {
+			mode = progressTUI
+		}
+	}
+	if mode == progressOff {
+		return func() {}
+	}
+
+	logger := slog.Default()
+	interval := ProgressInterval
+	var logFile *os.File
+	if mode == progressTUI {
+		var err error
+		if err = os.MkdirAll(LogDir, 0755); err == nil {
+			logFile, err = os.OpenFile(filepath.Join(LogDir, DashboardLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
+		if err != nil {
+			slog.Error("Error opening dashboard log file, reporting progress lines instead", "error", err)
+			mode = progressLines
+		} else {
+			slog.SetDefault(slog.New(logging.Tee(newLogHandler(logFile), warningHandler{})))
+			interval = DashboardRefresh
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	stopped := make(chan struct{})
+	var once sync.Once
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if mode == progressTUI {
+					progress.render(os.Stderr)
+				} else {
+					progress.logLine(logger)
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(stopped)
+			if mode == progressTUI {
+				progress.render(os.Stderr)
+				slog.SetDefault(logger)
+				logFile.Close()
+			} else {
+				progress.logLine(logger)
+			}
+		})
+	}
+	stopProgress = stop
+	return stop
+}
+
+// warningHandler records the warnings and errors logged on the dashboard.
+type warningHandler struct {
+	attrs []slog.Attr
+}
+
+// Enabled reports whether the level is at least slog.LevelWarn.
+func (h warningHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+// Handle records the message, with the domain it was logged for, if any.
+func (h warningHandler) Handle(_ context.Context, r slog.Record) error {
+	message := r.Time.Format("15:04:05") + " " + r.Level.String() + " " + r.Message
+	for _, attr := range h.attrs {
+		if attr.Key == "domain" {
+			message += " (" + attr.Value.String() + ")"
+		}
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "error" {
+			message += ": " + attr.Value.String()
+		}
+		return true
+	})
+	progress.warn(message)
+	return nil
+}
+
+// WithAttrs returns a warningHandler with the attributes added.
+func (h warningHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return warningHandler{append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+// WithGroup returns the handler, as groups are not shown.
+func (h warningHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// failureClass returns the class of the error the scan failed with, or "" if it did not fail.
+func failureClass(result scanResult) string {
+	if result.Err == nil || result.ErrorClass == errorTCFMissing {
+		return ""
+	}
+	return result.ErrorClass
+}
+
+// scanFindings returns the findings of the scan shown on the dashboard: its verdict if the CMP did not honor the
+// consent, and the number of findings of each kind notified, see domainFindings.
+func scanFindings(domain string, cookies []*http.Cookie, result scanResult, matcher *gvlMatcher) []string {
+	findings := verdictFindings(scanVerdict(result))
+	counts := map[string]int{}
+	var kinds []string
+	for _, finding := range domainFindings(domain, cookies, result, matcher) {
+		if counts[finding.Kind] == 0 {
+			kinds = append(kinds, finding.Kind)
+		}
+		counts[finding.Kind]++
+	}
+	for _, kind := range kinds {
+		findings = append(findings, fmt.Sprintf("%s x%d", kind, counts[kind]))
+	}
+	return findings
+}
+
+// verdictFindings returns the verdict as a finding if the CMP did not honor the consent.
+func verdictFindings(v verdict.Verdict) []string {
+	switch v {
+	case verdict.BannerReshown, verdict.TCStringRegenerated, verdict.ConsentIgnored:
+		return []string{string(v)}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/device"
+)
+
+const (
+	// Device emulation scans the sites as a mobile visitor, as many CMPs serve a different banner and vendor set on
+	// mobile: with -device iphone, android or tablet, the viewport, touch input and user agent of the preset are
+	// emulated in the tab before the first navigation, including the user agent client hints telling the site it is
+	// visited from a mobile device. The Device column of the output and of TCFModesFile tags every row with the preset
+	Device = deviceDesktop // Device specifies the default of -device, the preset the sites are visited as.
+
+	// Device presets
+	deviceDesktop = "desktop" // The browser as it was started, without emulation.
+	deviceIPhone  = "iphone"  // An iPhone 15 running Safari.
+	deviceAndroid = "android" // A Pixel 5 running Chrome.
+	deviceTablet  = "tablet"  // An iPad Pro 11 running Safari.
+)
+
+var deviceFlag = flag.String("device", Device, "device preset the sites are visited as: desktop, iphone, android or tablet")
+
+// devicePreset is a device the sites can be visited as, with the platform reported in its user agent client hints.
+type devicePreset struct {
+	info     device.Info
+	platform string
+}
+
+// devicePresets are the presets of -device other than deviceDesktop.
+var devicePresets = map[string]devicePreset{
+	deviceIPhone:  {device.IPhone15.Device(), "iOS"},
+	deviceAndroid: {device.Pixel5.Device(), "Android"},
+	deviceTablet:  {device.IPadPro11.Device(), "iOS"},
+}
+
+// checkDevice stops the run if -device is not a known preset.
+func checkDevice() {
+	if _, found := devicePresets[*deviceFlag]; found || *deviceFlag == deviceDesktop {
+		return
+	}
+	names := []string{deviceDesktop}
+	for name := range devicePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	fatal("Unknown device preset", "device", *deviceFlag, "presets", strings.Join(names, ", "))
+}
+
+// emulateDevice returns a chromedp Action which makes the tab emulate the preset of -device. For deviceDesktop it only
+// appends the -identify token to the user agent, see politeness.go.
+func emulateDevice() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		preset, found := devicePresets[*deviceFlag]
+		if !found {
+			return identifyCrawler().Do(ctx)
+		}
+		info := preset.info
+		orientation := &emulation.ScreenOrientation{Type: emulation.OrientationTypePortraitPrimary}
+		if info.Landscape {
+			orientation = &emulation.ScreenOrientation{Type: emulation.OrientationTypeLandscapePrimary, Angle: 90}
+		}
+		metadata := &emulation.UserAgentMetadata{
+			Platform: preset.platform,
+			Mobile:   info.Mobile,
+			Model:    info.Name,
+		}
+		err := chromedp.Tasks{
+			emulation.SetUserAgentOverride(identifiedUserAgent(info.UserAgent)).WithUserAgentMetadata(metadata),
+			emulation.SetDeviceMetricsOverride(info.Width, info.Height, info.Scale, info.Mobile).WithScreenOrientation(orientation),
+			emulation.SetTouchEmulationEnabled(info.Touch),
+		}.Do(ctx)
+		if err != nil {
+			return fmt.Errorf("emulating %s: %w", *deviceFlag, err)
+		}
+		return nil
+	})
+}
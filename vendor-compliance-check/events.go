@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Event tracking registers a TCF event listener as soon as the CMP loads and records every eventStatus it reports
+	TrackEventStatus = false // TrackEventStatus records the sequence of eventStatus transitions on initial load and after reload.
+	EventStatusFile  = "event_status.csv"
+
+	// JavaScript run in the top frame of every new document, which waits for __tcfapi and records each event it reports.
+	// The time of each event is in milliseconds since the navigation started.
+	eventListenerJS = `
+			(function () {
+				if (window !== window.top) {
+					return;
+				}
+				window.__vendorComplianceEvents = [];
+
+				const started = Date.now();
+				const register = () => {
+					if (typeof window.__tcfapi !== 'function') {
+						if (Date.now() - started < 30000) {
+							setTimeout(register, 50);
+						}
+						return;
+					}
+					window.__tcfapi('addEventListener', 2, (tcData, success) => {
+						if (success && tcData) {
+							window.__vendorComplianceEvents.push({
+								eventStatus: tcData.eventStatus || '',
+								cmpStatus: tcData.cmpStatus || '',
+								ms: Math.round(performance.now()),
+							});
+						}
+					});
+				};
+				register();
+			})()
+		`
+	eventLogJS = `window.__vendorComplianceEvents || []`
+)
+
+// tcfEvent is a single event reported to the TCF event listener.
+type tcfEvent struct {
+	EventStatus string  `json:"eventStatus"`
+	CmpStatus   string  `json:"cmpStatus"`
+	Millis      float64 `json:"ms"`
+}
+
+// registerEventListener returns a chromedp Action which makes every following document in the tab register the TCF
+// event listener. It does nothing unless TrackEventStatus is set.
+func registerEventListener() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !TrackEventStatus {
+			return nil
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(eventListenerJS).Do(ctx)
+		return err
+	})
+}
+
+// collectEvents returns a chromedp Action which stores the events recorded on the current document so far. It does
+// nothing unless TrackEventStatus is set.
+func collectEvents(events *[]tcfEvent) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !TrackEventStatus {
+			return nil
+		}
+		if err := chromedp.Evaluate(eventLogJS, events).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error collecting TCF events", "error", err)
+		}
+		return nil
+	})
+}
+
+// eventRows builds the event status CSV rows for the events recorded during a single stage of the scan.
+func eventRows(domain string, stage string, events []tcfEvent) [][]string {
+	var rows [][]string
+	for i, event := range events {
+		rows = append(rows, []string{domain, stage, strconv.Itoa(i + 1), event.EventStatus, event.CmpStatus, fmt.Sprint(int(event.Millis))})
+	}
+	return rows
+}
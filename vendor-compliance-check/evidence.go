@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Evidence capture keeps, for every cookie captured, the exchange that first set it: the raw Set-Cookie header, the
+	// request and response headers, when it was set and the TC string stored at the time, with a reference to the
+	// screenshot of that stage of the scan. It is written to <EvidenceDir>/<host>/cookies.json, next to the
+	// screenshots, and packaged by the report as a zip per violation-level finding. Request and response bodies are not
+	// kept
+	CaptureEvidence = false
+	EvidenceDir     = "evidence" // EvidenceDir specifies the directory in which a sub-directory per domain is created.
+	EvidenceFile    = "cookies.json"
+)
+
+// exchangeRequest is the request of an exchange, with all its headers.
+type exchangeRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+}
+
+// exchangeResponse is the response of an exchange, with all its headers.
+type exchangeResponse struct {
+	Status  string      `json:"status"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+}
+
+// cookieEvidence is the exchange that first set a cookie during the scan.
+type cookieEvidence struct {
+	Name       string           `json:"name"`
+	Domain     string           `json:"domain"`    // Domain is the cookie's Domain attribute, as in the Domain column of the output.
+	SetCookie  string           `json:"setCookie"` // SetCookie is the raw Set-Cookie header that set the cookie.
+	Request    exchangeRequest  `json:"request"`
+	Response   exchangeResponse `json:"response"`
+	Page       string           `json:"page"` // Page is the page the browser was on when the cookie was set.
+	SetAt      time.Time        `json:"setAt"`
+	InjectedAt *time.Time       `json:"injectedAt,omitempty"` // InjectedAt is when the consent was injected, if it was.
+
+	// TCString is the TC string stored when the cookie was set: the injected one once it was injected, before that the
+	// one the CMP returned on initial load, if CaptureInitialConsent or VerifyCMPMetadata is set.
+	TCString   string `json:"tcString"`
+	Stage      string `json:"stage"`                // Stage is the screenshot stage showing the consent in place when the cookie was set.
+	Screenshot string `json:"screenshot,omitempty"` // Screenshot is the path of the screenshot of Stage, if CaptureScreenshots is set.
+}
+
+// evidenceLog collects the exchanges setting the cookies of a scan, keeping the first for each cookie.
+type evidenceLog struct {
+	mu        sync.Mutex
+	exchanges map[string]cookieEvidence
+}
+
+// newEvidenceLog returns an empty log.
+func newEvidenceLog() *evidenceLog {
+	return &evidenceLog{exchanges: map[string]cookieEvidence{}}
+}
+
+// add records the response as the evidence of the cookie, unless the cookie was set before.
+func (l *evidenceLog) add(c *http.Cookie, resp *http.Response, page string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, found := l.exchanges[cookieKey(c)]; found {
+		return
+	}
+
+	l.exchanges[cookieKey(c)] = cookieEvidence{
+		Name:      c.Name,
+		Domain:    c.Domain,
+		SetCookie: rawSetCookie(resp.Header, c.Name),
+		Request: exchangeRequest{
+			Method:  resp.Request.Method,
+			URL:     resp.Request.URL.String(),
+			Proto:   resp.Request.Proto,
+			Headers: resp.Request.Header.Clone(),
+		},
+		Response: exchangeResponse{Status: resp.Status, Proto: resp.Proto, Headers: resp.Header.Clone()},
+		Page:     page,
+		SetAt:    time.Now(),
+	}
+}
+
+// rawSetCookie returns the Set-Cookie header setting the cookie with the given name.
+func rawSetCookie(header http.Header, name string) string {
+	for _, line := range header.Values("Set-Cookie") {
+		if strings.HasPrefix(strings.TrimSpace(line), name+"=") {
+			return line
+		}
+	}
+	return ""
+}
+
+// get returns the evidence of the cookies in the order they were set, with the consent in place at the time.
+func (l *evidenceLog) get(targetURL string, result scanResult) []cookieEvidence {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	host := ""
+	if u, err := url.Parse(targetURL); err == nil {
+		host = u.Host
+	}
+	var evidence []cookieEvidence
+	for _, e := range l.exchanges {
+		e.TCString, e.Stage = result.InitialTCString, "1-initial-load"
+		if !result.InjectedAt.IsZero() {
+			injectedAt := result.InjectedAt
+			e.InjectedAt = &injectedAt
+			if !e.SetAt.Before(injectedAt) {
+				e.TCString, e.Stage = result.TCString, "3-after-reload"
+			}
+		}
+		if CaptureScreenshots {
+			e.Screenshot = filepath.Join(ScreenshotDir, host, e.Stage+".jpg")
+		}
+		evidence = append(evidence, e)
+	}
+	sort.Slice(evidence, func(i, j int) bool { return evidence[i].SetAt.Before(evidence[j].SetAt) })
+	return evidence
+}
+
+// writeEvidence writes the evidence of the cookies to <EvidenceDir>/<host>/cookies.json. Failing to write it does not
+// abort the run.
+func writeEvidence(targetURL string, evidence []cookieEvidence) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		slog.Error("Error parsing URL", "url", targetURL, "error", err)
+		return
+	}
+
+	dir := filepath.Join(EvidenceDir, u.Host)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("Error creating evidence directory", "error", err)
+		return
+	}
+	data, err := json.MarshalIndent(evidence, "", "  ")
+	if err != nil {
+		slog.Error("Error encoding evidence", "error", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, EvidenceFile), data, 0644); err != nil {
+		slog.Error("Error writing evidence", "error", err)
+	}
+}
@@ -1,126 +1,130 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/SirDataFR/iabtcfv2"
+	"github.com/chromedp/cdproto/cdp"
 	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
 	"github.com/elazarl/goproxy"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/notify"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
 )
 
 const (
-	// Set the address and port for the proxy server
-	proxyAddr = "localhost:8080"
-
-	// JavaScript to extract CMP related details
-	cmpIDJS         = "function getcmpID() {let cmpId = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {cmpId = PingReturn.cmpId}); return cmpId } getcmpID()"
-	cmpVerJS        = "let cmpv = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {cmpv = PingReturn.cmpVersion}); cmpv"
-	gvlVerJS        = "let gvl = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {gvl = PingReturn.gvlVersion}); gvl"
-	displayStatusJS = "let ds = 0; window.__tcfapi('ping', 2, (PingReturn,success) => {ds = PingReturn.displayStatus}); ds"
-	tcStringJS      = `
-			new Promise((resolve) => {
-				if (typeof window.__tcfapi === 'function') {
-					callGetTCData();
-				} else {
-					window.addEventListener('cmpLoaded', callGetTCData);
-				}
-
-				function callGetTCData() {
-					window.__tcfapi('getTCData', 2, (tcData, success) => {
-						if (success) {
-							resolve({tcString: tcData.tcString});
-						} else {
-							resolve(null);
-						}
-					});
-				}
-			})
-		`
-	tcEventStatusJS = `
-			new Promise((resolve) => {
-				if (typeof window.__tcfapi === 'function') {
-					callGetTCData();
-				} else {
-					window.addEventListener('cmpLoaded', callGetTCData);
-				}
-
-				function callGetTCData() {
-					window.__tcfapi('getTCData', 2, (tcData, success) => {
-						if (success) {
-							resolve({tcEventStatus: tcData.eventStatus});
-						} else {
-							resolve(null);
-						}
-					});
-				}
-			})
-		`
+	// Set the address the proxy server of each scan listens on, on a port picked by the system
+	proxyAddr = "localhost:0"
 
 	// Set TimeOut values
 	ReadTimeout        = 30 * time.Second // ReadTimeout specifies the maximum duration for reading the entire HTTP request, including the request headers and body, from the client.
 	WriteTimeout       = 30 * time.Second // WriteTimeout specifies the maximum duration allowed for writing the HTTP response back to the client.
 	IdleTimeout        = 60 * time.Second // IdleTimeout specifies the maximum duration of idle time allowed after the last HTTP request has been served.
 	ShutdownTimeout    = 5 * time.Second  // ShutdownTimeout specifies the maximum duration of time allowed to gracefully shutdown the HTTP server.
-	RunTimeout         = 60 * time.Second // RunTimeout specifies the the maximum duration of time allowed to run chromedp for a single domain.
-	TCFTimeOut         = 10 * time.Second // TCFTimeOut  specifies the the maximum duration of time allowed to wait for the TCF API to become available.
-	TCFWaitInterval    = 1 * time.Second  // TCFWaitIntervalpecifies the the maximum duration of time between queries to the TCF API.
+	RunTimeout         = 60 * time.Second // RunTimeout specifies the default of -run-timeout, the maximum duration of time allowed to run chromedp for a single domain, see options.go.
+	TCFTimeOut         = 10 * time.Second // TCFTimeOut specifies the default of -tcf-timeout, the maximum duration of time allowed to wait for the TCF API to become available.
 	TCPKeepAlivePeriod = 30 * time.Second // TCPKeepAlivePeriod specifies the duration between TCP keep-alive probes sent by a server to check if a connection is alive.
 
+	// Returning-user mode pre-seeds a reject-all TC string before the first navigation, as if the user had
+	// already rejected consent elsewhere on the site, instead of injecting consent after the CMP has loaded
+	ReturningUserMode = false
+	PreSeedCmpID      = 1   // PreSeedCmpID specifies the CMP ID written into the pre-seeded TC string, as the site's CMP is not known before the first visit.
+	PreSeedCmpVersion = 1   // PreSeedCmpVersion specifies the CMP version written into the pre-seeded TC string.
+	PreSeedGvlVersion = 189 // PreSeedGvlVersion specifies the vendor list version written into the pre-seeded TC string.
+
+	// Legitimate-interest mode injects a TC string that grants no consent but establishes transparency for the
+	// legitimate interest of all vendors, see tcfaudit.LegitimateInterestOnly, instead of consenting to everything. The
+	// cookies and requests of such a run tell vendors relying on legitimate interest from those ignoring the missing
+	// consent, see LegitimateInterestCSV in reference-gvl.go
+	LegitimateInterestMode = false
+
+	// Screenshots are taken on initial load, after consent injection and after reload, and saved per domain
+	CaptureScreenshots = false
+	ScreenshotDir      = "screenshots" // ScreenshotDir specifies the directory in which a sub-directory per domain is created.
+	ScreenshotQuality  = 90            // ScreenshotQuality specifies the JPEG quality of the full-page screenshots.
+
 	// Specify input/output files
 	DomainsFile = "cat_1_rerun.csv"
 	OutputFile  = "output.csv"
 )
 
+// scanResult holds the consent related values captured while scanning a single domain
+type scanResult struct {
+	TCString            string // TCString is the consent string generated and injected by the crawler.
+	APITCString         string // APITCString is the consent string returned by the CMP after reload.
+	EventStatusBeforeRL string
+	EventStatusAfterRL  string
+	TCFAPIMode          string                 // TCFAPIMode is the mode in which the TCF API was present on initial load, see tcfmode.go.
+	Ping                tcf.Ping               // Ping is the CMP's ping response on initial load, if VerifyCMPMetadata is set.
+	InitialTCString     string                 // InitialTCString is the TC string the CMP returned on initial load, before the consent was injected, if CaptureInitialConsent or VerifyCMPMetadata is set.
+	Frameworks          []detectedFramework    // Frameworks holds the consent frameworks the site's CMP implements on initial load, if DetectFrameworks is set.
+	Conformance         []tcf.ConformanceCheck // Conformance holds the checklist of the page's __tcfapi on initial load, if CheckCMPConformance is set.
+	CMPPresence         []cmpPresence          // CMPPresence holds the CMPs found on initial load and after reload, if DetectMultipleCMPs is set.
+	ConsentWall         consentWall            // ConsentWall holds the state of the page before and after consent, if DetectConsentWalls is set.
+	CMPRoute            string                 // CMPRoute is the client-side route on which a late-mounted CMP was found, if not the landing page, see spa.go.
+	PageText            string                 // PageText is the visible text on initial load, used to detect the stacks presented by the CMP.
+	Pages               []pageResult           // Pages holds the values captured on sub-pages.
+	CookiePages         map[string]string      // CookiePages maps each captured cookie to the page on which it was first set.
+	CookieTimes         map[string]time.Time   // CookieTimes maps each captured cookie to the time at which it was first set.
+	CookieURLs          map[string]string      // CookieURLs maps each captured cookie to the URL of the request that first set it.
+	CookieParties       map[string]string      // CookieParties maps each captured cookie to the class of the host that first set it, see party.go.
+	CookieCNAMEs        map[string]string      // CookieCNAMEs maps each cookie first set by a CNAME-cloaked subdomain to the subdomain's canonical name.
+	Hosts               hostComparison         // Hosts holds the comparison between the www and apex variants of the site.
+	Subdomains          []subdomainResult      // Subdomains holds the values captured on the sampled subdomains.
+	EventsBeforeRL      []tcfEvent             // EventsBeforeRL holds the TCF events reported before reload, if TrackEventStatus is set.
+	EventsAfterRL       []tcfEvent             // EventsAfterRL holds the TCF events reported after reload, if TrackEventStatus is set.
+	ReturningUser       bool                   // ReturningUser reports whether the domain was scanned with a pre-seeded reject-all decision, see ReturningUserMode.
+	InjectedAt          time.Time              // InjectedAt is the time at which the consent was injected.
+	ServerCookies       []*http.Cookie         // ServerCookies holds the third party cookies set with JavaScript disabled, if VisitWithoutJS is set.
+	Requests            []requestRecord        // Requests holds the requests sent while scanning, if LogRequests is set.
+	Transmissions       []consentTransmission  // Transmissions holds the consent values sent to third parties, if DetectConsentTransmission is set.
+	Storage             []storageItem          // Storage holds the web storage entries of the page's frames, if CaptureStorage is set.
+	FrameMessages       []frameMessage         // FrameMessages holds the TCF messages received by the frames of the page, if TrackFrameConsent or InspectIframes is set.
+	FeatureCalls        []featureCall          // FeatureCalls holds the calls of the page's frames to the geolocation and fingerprinting APIs, if DetectSpecialFeatures is set.
+	CookieSyncs         []cookieSync           // CookieSyncs holds the third party cookie values passed to other third parties, if DetectCookieSyncs is set.
+	USPSignals          map[string]uspHost     // USPSignals holds the requests to each third party host and the US privacy strings they carried, if USPrivacyMode is set.
+	TLSEndpoints        []tlsEndpoint          // TLSEndpoints holds the TLS endpoints the proxy connected to, if CaptureTLS is set.
+	Iframes             []iframeInfo           // Iframes holds the third party iframes of the page after reload and their storage, if InspectIframes is set.
+	Workers             []workerActivity       // Workers holds the requests sent by the page's workers and the storage writes of their origins, if CaptureWorkers is set.
+	CMPLatency          cmpLatency             // CMPLatency holds the CMP's timings and the requests to the CMP hosts on the homepage, if MeasureCMPLatency is set.
+	VendorGating        []vendorGating         // VendorGating holds how the vendors of -gate-vendors behaved with and without their consent.
+	Blocking            blockingResult         // Blocking holds the requests blocked by the proxy and the exceptions thrown by the page, if -block or -cmp-baseline is set.
+	Err                 error                  // Err is the error that ended the scan of the homepage, if any.
+	ErrorClass          string                 // ErrorClass is the class of Err, or tcf-missing if the TCF API was not found, see retry.go.
+	Attempts            int                    // Attempts is the number of times the domain was scanned.
+	Truncated           bool                   // Truncated reports whether the domain's share of the run budget ran out before its scan completed, see runWithRetries.
+}
+
 // type for TCP KeepAlive Listener
 type tcpKeepAliveListener struct {
 	*net.TCPListener
 }
 
-// saveProgress stores the progress index into a file
-func saveProgress(index int) {
-	f, err := os.Create("progress.txt")
-	if err != nil {
-		log.Printf("Error creating progress file: %v", err)
-		return
-	}
-	defer f.Close()
-
-	_, err = f.WriteString(strconv.Itoa(index))
-	if err != nil {
-		log.Printf("Error writing progress file: %v", err)
-	}
-}
-
-// loadProgress retrieves the progress index from a file
-func loadProgress() int {
-	data, err := ioutil.ReadFile("progress.txt")
-	if err != nil {
-		log.Printf("Error reading progress file: %v", err)
-		return 0
-	}
-
-	index, err := strconv.Atoi(string(data))
-	if err != nil {
-		log.Printf("Error converting progress to int: %v", err)
-		return 0
-	}
-
-	return index
-}
-
 // isCookieExpired checks if a cookie has expired
 func isCookieExpired(cookie *http.Cookie) bool {
 	if cookie == nil {
@@ -147,24 +151,19 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 	return conn, nil
 }
 
-// waitForTcfApi waits for the TCF API to load on the webpage, or until the specified timeout has passed
+// waitForTcfApi waits for the TCF API to load on the webpage, or until the specified timeout has passed, and records
+// how long it took. On pages with only a __tcfapiLocator frame it installs the postMessage based client, see
+// tcf.WaitForAPI. Pages on which it does not load are not an error, as detectTcfMode classifies them.
 func waitForTcfApi(timeout time.Duration) chromedp.Action {
 	return chromedp.ActionFunc(func(ctx context.Context) error {
-		var isApiReady bool
-		var cmpId float64 = 0
-		startTime := time.Now()
-
-		for !isApiReady || cmpId == 0 {
-			chromedp.Evaluate(`typeof window.__tcfapi === 'function'`, &isApiReady).Do(ctx)
-			chromedp.EvaluateAsDevTools(cmpIDJS, &cmpId).Do(ctx)
-			time.Sleep(TCFWaitInterval)
-
-			// Break the loop if it has been running for more than the specified timeout
-			if time.Since(startTime) > timeout {
-				break
-			}
+		latency, err := tcf.WaitForAPI(chromedpSession{ctx}, timeout)
+		if err != nil {
+			logging.FromContext(ctx).Debug("TCF API not ready", "timeout", timeout, "error", err)
+			return nil
 		}
-
+		logging.FromContext(ctx).Debug("TCF API ready", "latency", latency)
+		metrics.tcfReady.Add(1)
+		metrics.tcfReadyNanos.Add(int64(latency))
 		return nil
 	})
 }
@@ -173,133 +172,119 @@ func waitForTcfApi(timeout time.Duration) chromedp.Action {
 // then generates a valid TC (Transparency & Consent Framework) string,
 // and stores it in a cookie and local storage on the domain.
 // setConsent function sets up user's consent data.
+// Nothing is injected in US privacy mode, as granting consent through the TCF would mask the effect of the opt-out.
 func setConsent(tcString *string) chromedp.Action {
 	return chromedp.ActionFunc(func(ctx context.Context) error {
-		intCmpID, err := evaluateJSAndGetInteger(ctx, cmpIDJS)
-		if err != nil {
-			return err
+		if USPrivacyMode {
+			return nil
 		}
 
-		intCmpVer, err := evaluateJSAndGetInteger(ctx, cmpVerJS, 1) // set a default value
-		if err != nil {
-			return err
+		session := chromedpSession{ctx}
+		// Frameworks such as TCF Canada are injected through their own API and storage, see jurisdiction.go
+		if injector, ok := consentInjector(); ok {
+			cmp, err := injector.CMP(session)
+			if err != nil {
+				return err
+			}
+			consentString := consentString(consentProfile(), cmp)
+			*tcString = consentString
+			storage, err := tcf.Store(session, injector.Storage(), consentString)
+			if err != nil {
+				return err
+			}
+			logging.FromContext(ctx).Debug("Injected consent", "storage", storage, "framework", Framework)
+			return nil
 		}
 
-		intGvlVer, err := evaluateJSAndGetInteger(ctx, gvlVerJS, 189) // set a default value
+		ping, err := tcf.GetPing(session)
 		if err != nil {
 			return err
 		}
 
-		tcData := buildTCData(intCmpID, intCmpVer, intGvlVer)
-
-		consentString := tcData.ToTCString()
+		// Consent to all purposes and vendors, or only establish their legitimate interest, using defaults for CMPs which do
+		// not report their version or the vendor list version
+		consentString := consentString(consentProfile(), tcfaudit.CMPFromPing(ping))
 
 		*tcString = consentString
-		return storeConsentInBrowser(ctx, consentString)
+		storage, err := tcf.StoreConsent(session, ping.CmpID, consentString)
+		if err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Debug("Injected consent", "storage", storage)
+		return nil
 	})
 }
 
-// evaluateJSAndGetInteger evaluates a JavaScript snippet and returns the resulting value as an integer.
-func evaluateJSAndGetInteger(ctx context.Context, js string, defaultValue ...int) (int, error) {
-	var value float64 = -1
-	if err := chromedp.EvaluateAsDevTools(js, &value).Do(ctx); err != nil {
-		return 0, err
-	}
-
-	if value != -1 {
-		return int(value), nil
-	}
-
-	if len(defaultValue) > 0 {
-		return defaultValue[0], nil
-	}
-	return 0, nil
-}
-
-// buildTCData builds and returns a pointer to a TCData object.
-func buildTCData(intCmpID, intCmpVer, intGvlVer int) *iabtcfv2.TCData {
-	return &iabtcfv2.TCData{
-		CoreString: &iabtcfv2.CoreString{
-			Version:              2,
-			Created:              time.Now(),
-			LastUpdated:          time.Now(),
-			CmpId:                intCmpID,
-			CmpVersion:           intCmpVer,
-			ConsentScreen:        2,
-			ConsentLanguage:      "EN",
-			VendorListVersion:    intGvlVer,
-			TcfPolicyVersion:     2,
-			IsServiceSpecific:    true,
-			SpecialFeatureOptIns: map[int]bool{},
-			UseNonStandardStacks: false,
-			PurposesConsent: map[int]bool{
-				1:  true,
-				2:  true,
-				3:  true,
-				4:  true,
-				5:  true,
-				6:  true,
-				7:  true,
-				8:  true,
-				9:  true,
-				10: true,
-			},
-			PurposesLITransparency: map[int]bool{},
-			PurposeOneTreatment:    true,
-			PublisherCC:            "NL",
-			IsRangeEncoding:        true,
-			VendorsConsent:         map[int]bool{},
-			MaxVendorId:            1200,
-			NumEntries:             1,
-			RangeEntries: []*iabtcfv2.RangeEntry{
-				{
-					StartVendorID: 1,
-					EndVendorID:   1200,
-				},
-			},
-			VendorsLITransparency: map[int]bool{},
-		},
-		PublisherTC: &iabtcfv2.PublisherTC{
-			SegmentType:               3,
-			PubPurposesConsent:        map[int]bool{},
-			PubPurposesLITransparency: map[int]bool{},
-		},
-	}
-}
-
-// storeConsentInBrowser stores the consent string in a cookie and local storage.
-func storeConsentInBrowser(ctx context.Context, consentString string) error {
-	// save the TC string in a cookie and local storage on the domain
-	jsActions := []string{
-		"document.cookie = 'euconsent-v2=" + consentString + "';document.cookie = 'eupubconsent-v2=" + consentString + "';",
-		"localStorage.setItem('euconsent-v2', '" + consentString + "');",
-		"localStorage.setItem('eupubconsent-v2', '" + consentString + "');",
-	}
-
-	for _, js := range jsActions {
-		if err := chromedp.EvaluateAsDevTools(js, nil).Do(ctx); err != nil {
+// consentProfile returns the profile whose TC string is injected, see LegitimateInterestMode, with the special feature
+// opt-ins, see OptInPreciseGeolocation and OptInDeviceScanning.
+func consentProfile() tcfaudit.ConsentProfile {
+	profile := tcfaudit.AcceptAll
+	if LegitimateInterestMode {
+		profile = tcfaudit.LegitimateInterestOnly
+	}
+	profile.SpecialFeatures = specialFeatureOptIns()
+	return profile
+}
+
+// preSeedConsent returns a chromedp Action which stores a reject-all TC string for the target URL before the first navigation,
+// so the CMP finds it on load the same way it would for a returning user.
+func preSeedConsent(targetURL string, tcString *string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		consentString := consentString(tcfaudit.RejectAll, tcfaudit.CMP{ID: PreSeedCmpID, Version: PreSeedCmpVersion, GvlVersion: PreSeedGvlVersion})
+
+		// Frameworks such as TCF Canada are read from their own storage, see jurisdiction.go
+		storage := tcf.DefaultStorage
+		if injector, ok := consentInjector(); ok {
+			storage = injector.Storage()
+		}
+
+		// Local storage is only reachable once a document exists, so seed it from a script that runs before the page's own scripts.
+		// The script only writes the keys that are missing, so it does not overwrite whatever the CMP stores on later loads.
+		now := time.Now()
+		expires := cdp.TimeSinceEpoch(now.AddDate(1, 0, 0))
+		var js strings.Builder
+		for _, item := range storage.Items {
+			value := consentString
+			if item.Value != nil {
+				value = item.Value(consentString, now)
+			}
+			if item.Cookie {
+				if err := network.SetCookie(item.Name, value).WithURL(targetURL).WithPath("/").WithExpires(&expires).Do(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			name, _ := json.Marshal(item.Name)
+			quoted, _ := json.Marshal(value)
+			fmt.Fprintf(&js, "if (localStorage.getItem(%s) === null) {localStorage.setItem(%s, %s);}", name, name, quoted)
+		}
+		if _, err := page.AddScriptToEvaluateOnNewDocument(js.String()).Do(ctx); err != nil {
 			return err
 		}
-	}
 
-	return nil
+		*tcString = consentString
+		return nil
+	})
 }
 
 // getTCstring is a function that returns a chromedp Action which fetches the TC string from a website.
 func getTCstring(apiResponse *string) chromedp.Action {
 	return chromedp.ActionFunc(func(ctx context.Context) error {
-
-		var jsonResponse struct {
-			TCString string `json:"tcString"`
+		if injector, ok := consentInjector(); ok {
+			consentString, err := injector.ReadBack(chromedpSession{ctx})
+			if err != nil {
+				logging.FromContext(ctx).Warn("Error querying the consent string", "framework", Framework, "error", err)
+			}
+			*apiResponse = consentString
+			return nil
 		}
 
-		if err := chromedp.Evaluate(tcStringJS, &jsonResponse, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
-			return p.WithAwaitPromise(true)
-		}).Do(ctx); err != nil {
-			log.Printf("Error querying the TC string: %v", err)
+		tcData, err := tcf.GetTCData(chromedpSession{ctx})
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error querying the TC string", "error", err)
 		}
 
-		*apiResponse = jsonResponse.TCString
+		*apiResponse = tcData.TCString
 		return nil
 	})
 }
@@ -307,18 +292,46 @@ func getTCstring(apiResponse *string) chromedp.Action {
 // getTcEventStatus is a function that returns a chromedp Action which fetches the CMP's eventStatus from a website.
 func getTcEventStatus(eventStatus *string) chromedp.Action {
 	return chromedp.ActionFunc(func(ctx context.Context) error {
+		tcData, err := tcf.GetTCData(chromedpSession{ctx})
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error querying the Event Status", "error", err)
+		}
+
+		*eventStatus = tcData.EventStatus
+		return nil
+	})
+}
+
+// captureScreenshot returns a chromedp Action which saves a full-page screenshot of the current page to
+// <ScreenshotDir>/<host>/<stage>.jpg, unless the domain is re-scanned. Failing to capture or save a screenshot does not
+// abort the run.
+func captureScreenshot(targetURL string, options scanOptions, stage string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CaptureScreenshots || options.Rescan {
+			return nil
+		}
 
-		var jsonResponse struct {
-			TcEventStatus string `json:"tcEventStatus"`
+		var buf []byte
+		if err := chromedp.FullScreenshot(&buf, ScreenshotQuality).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error capturing screenshot", "stage", stage, "error", err)
+			return nil
 		}
 
-		if err := chromedp.Evaluate(tcEventStatusJS, &jsonResponse, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
-			return p.WithAwaitPromise(true)
-		}).Do(ctx); err != nil {
-			log.Printf("Error querying the Event Status: %v", err)
+		u, err := url.Parse(targetURL)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error parsing URL", "url", targetURL, "error", err)
+			return nil
 		}
 
-		*eventStatus = jsonResponse.TcEventStatus
+		dir := filepath.Join(ScreenshotDir, u.Host)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logging.FromContext(ctx).Error("Error creating screenshot directory", "error", err)
+			return nil
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, stage+".jpg"), buf, 0644); err != nil {
+			logging.FromContext(ctx).Error("Error writing screenshot", "stage", stage, "error", err)
+		}
 		return nil
 	})
 }
@@ -327,9 +340,9 @@ func getTcEventStatus(eventStatus *string) chromedp.Action {
 func initializeProxyServer() *goproxy.ProxyHttpServer {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-	proxy.Verbose = true
-	customLogger := log.New(os.Stderr, "ProxyLog: ", log.LstdFlags)
-	proxy.Logger = customLogger
+	// The proxy logs every request it handles, so its output is only shown at debug level
+	proxy.Verbose = LogLevel <= slog.LevelDebug
+	proxy.Logger = slog.NewLogLogger(slog.Default().With("source", "proxy").Handler(), slog.LevelDebug)
 
 	return proxy
 }
@@ -356,59 +369,237 @@ func updateCookieList(cookies *[]*http.Cookie, newCookie *http.Cookie, mu *sync.
 	}
 }
 
+// cookieKey returns the key identifying a cookie in the cookie list
+func cookieKey(cookie *http.Cookie) string {
+	return cookie.Domain + "|" + cookie.Name
+}
+
+// Record the page on which a cookie was first set
+func recordCookiePage(cookiePages map[string]string, newCookie *http.Cookie, page string, mu *sync.Mutex) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, found := cookiePages[cookieKey(newCookie)]; !found {
+		cookiePages[cookieKey(newCookie)] = page
+	}
+}
+
+// Record the time at which a cookie was first set, and the URL, without its query, and the class of the request whose
+// response set it
+func recordCookieSource(cookieTimes map[string]time.Time, cookieURLs map[string]string, cookieParties map[string]string, cookieCNAMEs map[string]string, newCookie *http.Cookie, requestURL *url.URL, party string, cname string, mu *sync.Mutex) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, found := cookieTimes[cookieKey(newCookie)]; !found {
+		cookieTimes[cookieKey(newCookie)] = time.Now()
+		cookieURLs[cookieKey(newCookie)] = (&url.URL{Scheme: requestURL.Scheme, Host: requestURL.Host, Path: requestURL.Path}).String()
+		cookieParties[cookieKey(newCookie)] = party
+		if cname != "" {
+			cookieCNAMEs[cookieKey(newCookie)] = cname
+		}
+	}
+}
+
+// setBeforeInjection returns whether the cookie was first set before the consent was injected, or an empty string if
+// the consent was not injected.
+func setBeforeInjection(cookie *http.Cookie, result scanResult) string {
+	setAt, found := result.CookieTimes[cookieKey(cookie)]
+	if !found || result.InjectedAt.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(setAt.Before(result.InjectedAt))
+}
+
 // Run the Chrome Developer Protocol
-func runChromedp(ctx context.Context, targetURL string) (string, string, string, string) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, RunTimeout)
+func runChromedp(ctx context.Context, targetURL string, options scanOptions, tracker *pageTracker, frames *frameMessageLog) scanResult {
+	timeoutCtx, cancel := context.WithTimeout(ctx, options.Timeout)
 	defer cancel()
 
-	var tcString string
-	var apiTcString string
+	result := scanResult{ReturningUser: options.ReturningUser}
 
-	var eventStatusBeforeRL string
-	var eventStatusAfterRL string
+	// The consent is injected between the two visits, unless a returning user's rejection is already stored when the
+	// CMP first loads
+	seed := chromedp.Tasks{}
+	inject := chromedp.Tasks{
+		setConsent(&result.TCString),
+		markInjected(&result.InjectedAt),
+		captureScreenshot(targetURL, options, "2-after-injection"),
+		captureStorage("2-after-injection", &result.Storage),
+	}
+	if options.ReturningUser {
+		seed = chromedp.Tasks{
+			preSeedConsent(targetURL, &result.TCString),
+			markInjected(&result.InjectedAt),
+		}
+		inject = chromedp.Tasks{}
+	}
 
-	if err := chromedp.Run(timeoutCtx,
+	tasks := chromedp.Tasks{
 		network.Enable(),
-		chromedp.Navigate(targetURL),
-		waitForTcfApi(TCFTimeOut),
-		getTcEventStatus(&eventStatusBeforeRL),
-		setConsent(&tcString),
+		autoAttachWorkers(),
+		emulateDevice(),
+		seed,
+		seedUSPrivacy(targetURL),
+		registerEventListener(),
+		registerFrameSniffer(),
+		registerFeatureMonitor(),
+		registerStubMonitor(),
+		measureCMPLatency(&result.CMPLatency),
+		timedNavigate(targetURL),
+		waitForTcfApi(*tcfTimeout),
+		waitForSPAMount(targetURL, tracker, &result.CMPRoute),
+		detectTcfMode(&result.TCFAPIMode),
+		detectFrameworks(&result.Frameworks),
+		checkConformance(&result.Conformance),
+		capturePing(&result.Ping),
+		captureInitialConsent(&result.InitialTCString),
+		detectCMPs(stageInitialLoad, &result.CMPPresence),
+		probeConsentWall(wallBeforeConsent, &result.ConsentWall),
+		captureScreenshot(targetURL, options, "1-initial-load"),
+		captureStorage("1-initial-load", &result.Storage),
+		capturePageText(&result.PageText),
+		getTcEventStatus(&result.EventStatusBeforeRL),
+		captureCMPTimings(&result.CMPLatency, &result.CMPLatency.Initial, false),
+		inject,
+		collectEvents(&result.EventsBeforeRL),
+		setFrameStage(frames, "after reload"),
 		chromedp.Reload(),
-		waitForTcfApi(TCFTimeOut),
-		getTCstring(&apiTcString),
-		getTcEventStatus(&eventStatusAfterRL),
-		chromedp.Navigate("about:blank"),
-	); err != nil {
-		log.Printf("Encountered an error running chromedp: %v", err)
+		waitForTcfApi(*tcfTimeout),
+		captureScreenshot(targetURL, options, "3-after-reload"),
+		captureStorage("3-after-reload", &result.Storage),
+		inspectIframes(targetURL, &result.Iframes),
+		getTCstring(&result.APITCString),
+		detectCMPs(stageAfterReload, &result.CMPPresence),
+		probeConsentWall(wallAfterConsent, &result.ConsentWall),
+		getTcEventStatus(&result.EventStatusAfterRL),
+		collectEvents(&result.EventsAfterRL),
+		captureCMPTimings(&result.CMPLatency, &result.CMPLatency.Reload, true),
 	}
 
-	return tcString, apiTcString, eventStatusBeforeRL, eventStatusAfterRL
+	if err := chromedp.Run(timeoutCtx, tasks); err != nil {
+		logging.FromContext(ctx).Error("Encountered an error running chromedp", "error", err)
+		result.Err = err
+		result.ErrorClass = classifyError(err)
+		metrics.recordFailure(result.ErrorClass)
+	}
+	// Querying the CMP fails on sites without the TCF API, which is a result rather than a failed scan
+	if result.TCFAPIMode == tcf.ModeNone && (result.Err == nil || result.ErrorClass == errorChromedp) {
+		result.ErrorClass = errorTCFMissing
+	}
+
+	// Subdomains are discovered from the links on the homepage, so before any other page is visited
+	var subdomains []subdomainCandidate
+	if SubdomainSampleSize > 0 {
+		subdomains = discoverSubdomains(ctx, targetURL)
+	}
+
+	if SubPageLimit > 0 {
+		result.Pages = crawlSubPages(ctx, targetURL, tracker)
+	}
+
+	if CompareHostVariants {
+		hostsCtx, cancelHosts := context.WithTimeout(ctx, options.Timeout)
+		if err := chromedp.Run(hostsCtx, compareHostVariants(result.TCString, tracker, &result.Hosts)); err != nil {
+			logging.FromContext(ctx).Error("Encountered an error comparing host variants", "error", err)
+			metrics.recordFailure(classifyError(err))
+		}
+		cancelHosts()
+	}
+
+	if len(subdomains) > 0 {
+		result.Subdomains = checkSubdomains(ctx, subdomains, result.TCString, tracker)
+	}
+
+	if err := chromedp.Run(ctx, chromedp.Navigate("about:blank")); err != nil {
+		logging.FromContext(ctx).Error("Encountered an error running chromedp", "error", err)
+	}
+
+	return result
 }
 
 // run is a function that initiates a proxy server, captures cookies,
 // generates and sets user consent, and fetches the TC string from a target website.
 //
-// It accepts a target URL and a context, launches a headless browser
-// and navigates to the target URL.
+// It accepts a target URL, a context and the domain's scan options,
+// launches a headless browser and navigates to the target URL.
 //
-// The function returns all cookies captured, the generated TCF string,
+// The function returns all cookies captured, along with the generated TCF string,
 // the fetched TCF string, and the status of the TCF API before and after reload.
-func run(targetURL string, ctx context.Context) ([]*http.Cookie, string, string, string, string) {
+func run(targetURL string, ctx context.Context, options scanOptions) ([]*http.Cookie, scanResult) {
 
 	var cookies []*http.Cookie
+	var serverCookies []*http.Cookie
 	var mu sync.Mutex
+	cookiePages := map[string]string{}
+	cookieTimes := map[string]time.Time{}
+	cookieURLs := map[string]string{}
+	cookieParties := map[string]string{}
+	cookieCNAMEs := map[string]string{}
+	parties := newPartyClassifier(targetURL)
+	tracker := &pageTracker{url: targetURL}
+	transmissions := &transmissionLog{}
+	requests := &requestLog{}
+	frames := newFrameMessageLog()
+	features := &featureCallLog{}
+	syncs := newCookieSyncLog()
+	uspSignals := newUSPSignalLog()
+	endpoints := newTLSEndpointLog()
+	blocked := newBlockingLog()
+	workers := newWorkerLog(parties, tracker)
+	gating := &gatingLog{}
+	evidence := newEvidenceLog()
 	var wg sync.WaitGroup
+	logger := logging.FromContext(ctx)
 
 	proxy := initializeProxyServer()
+	// Verify the sites' certificates and record the TLS endpoints, see tls.go
+	if ManagedCA || CaptureTLS {
+		proxy.Tr = endpoints.transport(parties)
+	}
 
 	// Handle requests coming through the proxy server
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		if strings.Contains(req.URL.Host, targetURL) {
-			// add cookies to the request
-			for _, cookie := range cookies {
-				req.AddCookie(cookie)
+		metrics.proxyRequests.Add(1)
+		// The requests of the JavaScript-disabled visit are tagged by its tab, see nojs.go
+		tagNoJSRequest(req, ctx)
+		// Forward the request within the per host limits, see politeness.go
+		if politenessEnabled() {
+			ctx.RoundTripper = politeRoundTripper()
+		}
+		if !DetectConsentTransmission && !LogRequests && !DetectCookieSyncs && !USPrivacyMode && !blockingEnabled() && !vendorGatingEnabled() {
+			return req, nil
+		}
+
+		// Requests to CNAME-cloaked subdomains reach another site, so consent sent to them is sent to a third party
+		party, cname := parties.classify(req.URL.Hostname())
+		// Blocked requests are answered by the proxy and never reach the vendor, see blocking.go
+		if blockingEnabled() {
+			if reason := blockReason(req.URL.Hostname(), party); reason != "" {
+				logger.Debug("Blocked request", "url", req.URL.String(), "reason", reason)
+				blocked.addBlocked(req.URL.Hostname())
+				return req, blockedResponse(req)
+			}
+		}
+		// The requests of the vendor gating visits are only attributed to the vendors, see gating.go
+		if gating.addRequest(req) {
+			return req, nil
+		}
+		if LogRequests {
+			requests.add(requestRecord{URL: (&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}).String(), Page: tracker.Get(), Party: party, CNAME: cname})
+		}
+		if (DetectConsentTransmission || USPrivacyMode) && party != partyFirst {
+			found := findConsentTransmissions(req, tracker.Get())
+			if DetectConsentTransmission {
+				transmissions.add(found)
+			}
+			if USPrivacyMode {
+				uspSignals.add(req.URL.Hostname(), party, found)
 			}
 		}
+		if DetectCookieSyncs && party != partyFirst {
+			syncs.checkRequest(req, tracker.Get())
+			syncs.addCookies(req.URL.Hostname(), req.Cookies())
+		}
 
 		return req, nil
 	})
@@ -418,10 +609,32 @@ func run(targetURL string, ctx context.Context) ([]*http.Cookie, string, string,
 		wg.Add(1)
 		defer wg.Done()
 
-		if resp != nil && resp.Request != nil {
-			if !strings.Contains(resp.Request.URL.Host, targetURL) {
-				for _, newCookie := range resp.Cookies() {
-					updateCookieList(&cookies, newCookie, &mu)
+		// All cookies are captured, and classified by the host that set them
+		if resp != nil && resp.Request != nil && len(resp.Cookies()) > 0 {
+			party, cname := parties.classify(resp.Request.URL.Hostname())
+			for _, newCookie := range resp.Cookies() {
+				if gating.addCookie(resp.Request.URL.Hostname(), newCookie) {
+					continue
+				}
+				if isNoJSResponse(ctx) {
+					updateCookieList(&serverCookies, newCookie, &mu)
+					continue
+				}
+				updateCookieList(&cookies, newCookie, &mu)
+				recordCookiePage(cookiePages, newCookie, tracker.Get(), &mu)
+				recordCookieSource(cookieTimes, cookieURLs, cookieParties, cookieCNAMEs, newCookie, resp.Request.URL, party, cname, &mu)
+				if CaptureEvidence {
+					evidence.add(newCookie, resp, tracker.Get())
+				}
+			}
+		}
+
+		// The cookies of third parties and their redirects are recorded to detect cookie syncs, see sync.go
+		if DetectCookieSyncs && resp != nil && resp.Request != nil && !gating.active() {
+			if party, _ := parties.classify(resp.Request.URL.Hostname()); party != partyFirst {
+				syncs.addCookies(resp.Request.URL.Hostname(), resp.Cookies())
+				if isRedirect(resp) {
+					syncs.addRedirect(resp)
 				}
 			}
 		}
@@ -430,14 +643,16 @@ func run(targetURL string, ctx context.Context) ([]*http.Cookie, string, string,
 	})
 
 	// Start the proxy server using a custom listener
-	listener, err := net.Listen("tcp", proxyAddr)
+	listener, err := net.Listen("tcp", proxyListenAddr())
 	if err != nil {
-		log.Printf("Error creating listener: %v", err)
+		logger.Error("Error creating listener", "error", err)
+		metrics.recordFailure(errorProxy)
+		return nil, scanResult{Err: err, ErrorClass: errorProxy}
 	}
 	defer listener.Close()
 
 	server := &http.Server{
-		Addr:         proxyAddr,
+		Addr:         listener.Addr().String(),
 		Handler:      proxy,
 		ReadTimeout:  ReadTimeout,
 		WriteTimeout: WriteTimeout,
@@ -448,7 +663,7 @@ func run(targetURL string, ctx context.Context) ([]*http.Cookie, string, string,
 	// Start the proxy server in a separate goroutine (The Serve method of the proxy server is a blocking operation)
 	go func() {
 		if err := server.Serve(tcpKeepAliveListener{listener.(*net.TCPListener)}); err != nil && err != http.ErrServerClosed {
-			log.Printf("Error starting server: %v", err)
+			logger.Error("Error starting server", "error", err)
 		}
 	}()
 	// Wait for all goroutines to finish and gracefully shut down the server
@@ -461,21 +676,84 @@ func run(targetURL string, ctx context.Context) ([]*http.Cookie, string, string,
 		server.Shutdown(ctxShutdown)
 	}()
 
+	// The scan runs in a new browser context sending its requests through this scan's proxy, so concurrent scans do
+	// not share a proxy or cookies. The browser is started first, as browser contexts are created in it
+	if err := chromedp.Run(ctx); err != nil {
+		logger.Error("Error starting browser", "error", err)
+		class := classifyError(err)
+		metrics.recordFailure(class)
+		return nil, scanResult{Err: err, ErrorClass: class}
+	}
+	ctx = withScanProxy(ctx, listener.Addr())
+	ctx, cancelScan := chromedp.NewContext(ctx, newBrowserContext(ctx), chromedp.WithLogf(chromedpLogf(ctx)))
+	defer cancelScan()
+
 	// Listen for network events using chromedp
 	chromedp.ListenTarget(ctx, func(ev interface{}) {
 		switch ev := ev.(type) {
 		case *network.EventResponseReceived:
-			log.Printf("Received response for URL: %s", ev.Response.URL)
+			logger.Debug("Received response", "url", ev.Response.URL)
+		case *runtime.EventBindingCalled:
+			switch ev.Name {
+			case frameMessageBinding:
+				frames.add(ev.Payload)
+			case featureCallBinding:
+				features.add(ev.Payload)
+			}
+		case *target.EventAttachedToTarget:
+			if CaptureWorkers {
+				workers.attach(ctx, ev.TargetInfo)
+			}
+		case *storage.EventIndexedDBContentUpdated, *storage.EventCacheStorageContentUpdated:
+			workers.handleStorageEvent(ev)
+		case *runtime.EventExceptionThrown:
+			if blockingEnabled() {
+				blocked.addException(ev.ExceptionDetails.Error())
+			}
 		}
 	})
 
 	// Run chromedp commands and retrieve values
-	tcString, apiTcString, eventStatusBeforeRL, eventStatusAfterRL := runChromedp(ctx, targetURL)
+	result := runChromedp(ctx, targetURL, options, tracker, frames)
+
+	// Visit the homepage again with JavaScript disabled, capturing the cookies set by servers regardless of the CMP
+	if VisitWithoutJS && result.ErrorClass != errorProxy {
+		visitWithoutJS(ctx, targetURL, options.Timeout)
+	}
 
-	return cookies, tcString, apiTcString, eventStatusBeforeRL, eventStatusAfterRL
+	// Visit the homepage with and without the consent of each vendor of -gate-vendors, see gating.go
+	if vendorGatingEnabled() && result.TCFAPIMode != tcf.ModeNone && result.ErrorClass != errorProxy {
+		result.VendorGating = testVendorGating(ctx, targetURL, options.Timeout, gating)
+	}
+
+	mu.Lock()
+	result.CookiePages = cookiePages
+	result.CookieTimes = cookieTimes
+	result.CookieURLs = cookieURLs
+	result.CookieParties = cookieParties
+	result.CookieCNAMEs = cookieCNAMEs
+	result.ServerCookies = serverCookies
+	mu.Unlock()
+	result.Transmissions = transmissions.get()
+	result.Requests = requests.get()
+	result.FrameMessages = frames.get()
+	result.FeatureCalls = features.get()
+	result.CookieSyncs = syncs.get()
+	result.USPSignals = uspSignals.get()
+	result.TLSEndpoints = endpoints.get()
+	result.Blocking = blocked.get()
+	result.Workers = workers.get()
+	classifyFeatureCalls(result.FeatureCalls, parties)
+
+	// Keep the exchanges that set the cookies for the report's evidence bundles, see evidence.go
+	if CaptureEvidence && !options.Rescan {
+		writeEvidence(targetURL, evidence.get(targetURL, result))
+	}
+
+	return cookies, result
 }
 
-// Read domains from a CSV file
+// Read domains from a CSV file, recording the options of the rows overriding the run's in domainOverrides
 func readDomainsFromFile(filename string) ([]string, error) {
 	fd, err := os.Open(filename)
 	if err != nil {
@@ -483,116 +761,853 @@ func readDomainsFromFile(filename string) ([]string, error) {
 	}
 	defer fd.Close()
 
-	fileReader := csv.NewReader(fd)
+	return readDomainList(fd, filename)
+}
+
+// readDomainList reads the domains or URLs in the first column of a CSV or plain text list, skipping empty rows and
+// comments starting with #, and records the options of the rows overriding the run's in domainOverrides.
+func readDomainList(r io.Reader, name string) ([]string, error) {
+	fileReader := csvfile.NewReader(r)
+	fileReader.Comment = '#'
+	fileReader.FieldsPerRecord = -1
 	domains, err := fileReader.ReadAll()
 	if err != nil {
 		return nil, err
 	}
 
 	var result []string
-	for _, domain := range domains {
-		if len(domain) > 0 {
+	for i, domain := range domains {
+		if len(domain) > 0 && strings.TrimSpace(domain[0]) != "" {
+			domain[0] = strings.TrimSpace(domain[0])
 			result = append(result, domain[0])
+
+			options, overridden, err := parseOverrides(domain)
+			if err != nil {
+				return nil, fmt.Errorf("row %d of %s: %w", i+1, name, err)
+			}
+			if overridden {
+				domainOverrides[domain[0]] = options
+			}
 		}
 	}
 
 	return result, nil
 }
 
-// Open the output CSV file
-func openCSVFile(filename string) (*os.File, error) {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+// outputs holds the output CSV files opened, which are flushed after each domain and rotated together.
+var outputs []*csvOutput
+
+// rotation keeps track of the current part of the output files, see outfile.RotateEvery.
+var rotation = outfile.NewRotator()
+
+// csvOutput is an output CSV file along with the CSV writer writing to its current part.
+type csvOutput struct {
+	*csv.Writer
+	name     string   // name is the configured name of the file, without the part and compression extension.
+	header   []string // header is written to every new part.
+	file     *outfile.File
+	buffer   *bytes.Buffer // buffer holds the rows of a worker, which sends them to the coordinator instead of writing the file.
+	pending  [][]string    // pending holds the rows written since the last export, see export.go.
+	exported int           // exported counts the rows exported, which is the offset of the pending rows.
+	stamped  bool          // stamped reports whether the provenance of the run is appended to the rows, see reproducibility.go.
+}
+
+// openCSVOutput opens the current part of the output CSV file, writing the header if it is new.
+func openCSVOutput(name string, header []string) (*csvOutput, error) {
+	output := &csvOutput{name: name}
+	output.header, output.stamped = stampHeader(header)
+	if err := output.open(); err != nil {
 		return nil, err
 	}
-	return file, nil
+	outputs = append(outputs, output)
+	return output, nil
 }
 
-// Check if the file is empty
-func isEmptyFile(file *os.File) bool {
-	fileInfo, err := file.Stat()
+func (o *csvOutput) open() error {
+	if *coordinatorURL != "" {
+		o.buffer = &bytes.Buffer{}
+		o.Writer = csvfile.NewWriter(o.buffer, false)
+		return nil
+	}
+
+	file, err := openCSVFile(rotation.Name(o.name), o.header)
 	if err != nil {
-		return true
+		return err
+	}
+	o.file = file
+	o.Writer = newCSVWriter(file)
+
+	// Write header if the file is empty and has one
+	if isEmptyFile(file) {
+		if len(o.header) > 0 {
+			o.Writer.Write(o.header)
+			o.Flush()
+		}
+		if outfile.Rotating() {
+			if err := outfile.AddToManifest(o.name, file.Name); err != nil {
+				slog.Error("Error adding part to manifest", "file", file.Name, "error", err)
+			}
+		}
 	}
-	return fileInfo.Size() == 0
+	return o.Writer.Error()
+}
+
+// Write writes the row, stamped with the provenance of the run, queueing it for export if the rows are exported.
+func (o *csvOutput) Write(row []string) error {
+	row = o.stamp(row)
+	o.queue(row)
+	return o.Writer.Write(row)
+}
+
+// WriteAll writes the rows, stamped with the provenance of the run, and flushes the writer, queueing them for export
+// if the rows are exported.
+func (o *csvOutput) WriteAll(rows [][]string) error {
+	stamped := make([][]string, len(rows))
+	for i, row := range rows {
+		stamped[i] = o.stamp(row)
+		o.queue(stamped[i])
+	}
+	return o.Writer.WriteAll(stamped)
+}
+
+// stamp returns the row with the provenance of the run appended, if the output is stamped and the row does not already
+// have it, as the rows sent by workers do.
+func (o *csvOutput) stamp(row []string) []string {
+	if !o.stamped || len(row)+len(provenanceColumns) != len(o.header) {
+		return row
+	}
+	return append(row[:len(row):len(row)], currentRun.values()...)
+}
+
+// queue keeps a copy of the row for the next export. Workers leave the export to the coordinator.
+func (o *csvOutput) queue(row []string) {
+	if exporter != nil && o.buffer == nil {
+		o.pending = append(o.pending, append([]string(nil), row...))
+	}
+}
+
+// Close flushes the CSV writer and closes the current part.
+func (o *csvOutput) Close() error {
+	o.Flush()
+	if o.file == nil {
+		return nil
+	}
+	return o.file.Close()
+}
+
+// Open the output CSV file, compressed according to its name or outfile.Compression. The rows of a file written under
+// another header, e.g. by a run before columns were added, are migrated to the header first, see outfile.OpenCSV
+func openCSVFile(filename string, header []string) (*outfile.File, error) {
+	return outfile.OpenCSV(filename, header)
+}
+
+// newCSVWriter returns a CSV writer for the file in the configured format.
+func newCSVWriter(file *outfile.File) *csv.Writer {
+	return csvfile.NewWriter(file, file.New)
+}
+
+// Check if the file was empty when opened
+func isEmptyFile(file *outfile.File) bool {
+	return file.New
+}
+
+// flushOutputFiles writes out the data compressed so far, so the results of the domains processed are kept if the
+// run is stopped, and exports the rows written since the last flush.
+func flushOutputFiles() {
+	exportOutputs()
+	if verdictsFile != nil {
+		if err := verdictsFile.Flush(); err != nil {
+			slog.Error("Error flushing output file", "file", verdictsFile.Name, "error", err)
+		}
+	}
+	for _, output := range outputs {
+		output.Flush()
+		if output.file == nil {
+			continue
+		}
+		if err := output.file.Flush(); err != nil {
+			slog.Error("Error flushing output file", "file", output.file.Name, "error", err)
+		}
+	}
+}
+
+// rotateOutputFiles closes the current parts of the output files and opens the next ones. A file that fails to open
+// is fatal, as the results of the following domains would be lost.
+func rotateOutputFiles() {
+	for _, output := range outputs {
+		if err := output.Close(); err != nil {
+			slog.Error("Error closing output file", "file", output.file.Name, "error", err)
+		}
+		if err := output.open(); err != nil {
+			fatal("Error opening output file", "file", rotation.Name(output.name), "error", err)
+		}
+	}
+	if verdictsFile != nil {
+		if err := verdictsFile.Close(); err != nil {
+			slog.Error("Error closing output file", "file", verdictsFile.Name, "error", err)
+		}
+		if err := openVerdictsFile(); err != nil {
+			fatal("Error opening output file", "file", rotation.Name(VerdictsFile), "error", err)
+		}
+	}
+	slog.Info("Rotated output files")
 }
 
 // Create the Chrome context
 func createChromeContext() (context.Context, context.CancelFunc) {
-	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.ProxyServer(proxyAddr),
+	if *remoteChrome != "" {
+		allocCtx, cancel := createRemoteChromeContext()
+		if *isolateDomains {
+			return allocCtx, cancel
+		}
+		return withTabPool(allocCtx, cancel)
+	}
+	options := append(chromedp.DefaultExecAllocatorOptions[:],
 		chromedp.NoFirstRun,
 		chromedp.NoDefaultBrowserCheck,
 		chromedp.Flag("disable-blink-features", "AutomationControlled"),
-		chromedp.Flag("ignore-certificate-errors", true),
 		chromedp.Flag("headless", false),
-	)...)
-	return allocCtx, cancel
+	)
+	// Chrome accepts the proxy's certificates through the managed CA, or by ignoring certificate errors, see tls.go
+	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), append(options, chromeCertOptions()...)...)
+	if *isolateDomains {
+		return allocCtx, cancel
+	}
+	return withTabPool(allocCtx, cancel)
 }
 
-// Create a domain-specific Chrome context
+// Create a domain-specific Chrome context, holding the logger of the domain held by allocCtx, see startDomainLogging
 func createDomainContext(allocCtx context.Context) (context.Context, context.CancelFunc) {
-	ctx, cancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
+	logger := logging.FromContext(allocCtx)
+	// Unless domains are isolated, they are scanned in the shared browser of the pool, see tabpool.go
+	if pool := tabPoolFrom(allocCtx); pool != nil {
+		ctx, cancel := pool.acquire()
+		return logging.NewContext(ctx, logger), cancel
+	}
+	// A remote Chrome is shared by all domains, which are isolated in browser contexts instead
+	if *remoteChrome != "" {
+		return chromedp.NewContext(allocCtx, newBrowserContext(allocCtx), chromedp.WithLogf(chromedpLogf(allocCtx)))
+	}
+	ctx, cancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(chromedpLogf(allocCtx)))
 	return ctx, cancel
 }
 
 func main() {
-	// Read domains from CSV file
-	domains, err := readDomainsFromFile(DomainsFile)
-	if err != nil {
-		log.Fatal("Error reading domains:", err)
+	flag.Parse()
+	setupLogging()
+
+	// Run the scans of the schedules file whenever they are due instead of scanning once, see schedule.go
+	if flag.Arg(0) == "schedule" {
+		schedule(flag.Arg(1))
+		return
+	}
+
+	// Stop right away if the consent of the configured framework cannot be injected, see jurisdiction.go
+	consentFramework()
+
+	// Stop right away if the device preset of -device is unknown, see device.go
+	checkDevice()
+
+	// Stop right away if the vendors of -gate-vendors cannot be tested, see gating.go
+	checkVendorGating()
+
+	// Intercept TLS with the CA of the run rather than goproxy's, see tls.go
+	if ManagedCA {
+		setupManagedCA()
+	}
+
+	if MetricsAddr != "" {
+		serveMetrics()
 	}
 
+	// Check the reproducibility flags and record the seed, versions and configuration of the run, see reproducibility.go
+	startRun()
+
+	// Scan domains on request instead of from the domains file, see serve.go
+	if flag.Arg(0) == "serve" {
+		serve()
+		return
+	}
+
+	// Hand out the domains to workers instead of scanning them, see coordinator.go
+	if flag.Arg(0) == "coordinate" {
+		coordinate()
+		return
+	}
+
+	// Export the rows of the outputs with -export, see export.go, and write the verdicts, see verdicts.go. Workers leave
+	// both to the coordinator
+	if *coordinatorURL == "" {
+		openExporter()
+		defer closeExporter()
+		if err := openVerdictsFile(); err != nil {
+			fatal("Error opening verdicts file", "error", err)
+		}
+		defer func() { verdictsFile.Close() }()
+	}
+
+	// Report the progress on the dashboard or in progress lines, see dashboard.go
+	defer startProgress()()
+
+	// Read the domains from the domains file, or lease them from the coordinator with -coordinator
+	source := newDomainSource()
+
 	// Open the output CSV file
-	file, err := openCSVFile(OutputFile)
+	writer, err := openCSVOutput(OutputFile, []string{"Website", "Domain", "Name", "Value", "Path", "Expires", "IsExpired", "Generated Consent String", "API Consent String", "Consent Diff", "EventStatus b4", "EventStatus after", "Status Updated", "Page", "Set Without JavaScript", "Set Before Injection", "Set At", "Request URL", "Party", "CNAME", "Framework", "Device"})
 	if err != nil {
-		log.Fatal("Error opening output file:", err)
+		fatal("Error opening output file", "error", err)
+	}
+	defer writer.Close()
+
+	// Load the GVL to match the cookies against as they are captured
+	var matcher *gvlMatcher
+	if MatchGVL != "" {
+		matcher = newGVLMatcher()
+		defer matcher.matched.Close()
+		defer matcher.partial.Close()
+		defer matcher.unmatched.Close()
 	}
-	defer file.Close()
 
-	// Initialize CSV writer
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	// Set up the TCF API modes file, which holds a row for every domain, including those without cookies
+	modesWriter, err := openCSVOutput(TCFModesFile, []string{"Website", "TCF API Mode", "Error", "Attempts", "CMP Route", "Device", "Verdict"})
+	if err != nil {
+		fatal("Error opening TCF API modes file", "error", err)
+	}
+	defer modesWriter.Close()
 
-	// Write header if the file is empty
-	if isEmptyFile(file) {
-		writer.Write([]string{"Website", "Domain", "Name", "Value", "Path", "Expires", "IsExpired", "Generated Consent String", "API Consent String", "StringsEqual", "EventStatus b4", "EventStatus after", "Status Updated"})
-		writer.Flush()
+	// Set up the anomalies file, which records the anomalous scans and whether re-crawling them resolved the anomalies
+	anomaliesWriter, err := openCSVOutput(AnomaliesFile, []string{"Website", "Recrawl", "Anomalies", "Outcome", "Time"})
+	if err != nil {
+		fatal("Error opening anomalies file", "error", err)
+	}
+	defer anomaliesWriter.Close()
+
+	// Fetch the stack definitions and open the stacks CSV file
+	var stacks map[string]Stack
+	var stacksWriter *csvOutput
+	if ValidateStacks {
+		stacks, err = fetchStacks(VendorListURL)
+		if err != nil {
+			fatal("Error fetching stacks", "error", err)
+		}
+
+		stacksWriter, err = openCSVOutput(StacksFile, []string{"Website", "Stack IDs", "Stack Names", "Stack Issues"})
+		if err != nil {
+			fatal("Error opening stacks file", "error", err)
+		}
+		defer stacksWriter.Close()
+	}
+
+	// Open the sub-pages CSV file
+	var pagesWriter *csvOutput
+	if SubPageLimit > 0 {
+		pagesWriter, err = openCSVOutput(PagesFile, []string{"Website", "Page", "Depth", "Generated Consent String", "API Consent String", "Consent Diff", "EventStatus"})
+		if err != nil {
+			fatal("Error opening pages file", "error", err)
+		}
+		defer pagesWriter.Close()
+	}
+
+	// Open the host variants CSV file
+	var hostsWriter *csvOutput
+	if CompareHostVariants {
+		hostsWriter, err = openCSVOutput(HostVariantsFile, []string{"Website", "Primary Host", "Alternate Host", "Served Separately", "Consent Cookie Domains", "API Consent String", "Alternate API Consent String", "Alternate EventStatus", "Host Issues"})
+		if err != nil {
+			fatal("Error opening host variants file", "error", err)
+		}
+		defer hostsWriter.Close()
+	}
+
+	// Open the event status CSV file
+	var eventsWriter *csvOutput
+	if TrackEventStatus {
+		eventsWriter, err = openCSVOutput(EventStatusFile, []string{"Website", "Stage", "Sequence", "EventStatus", "CmpStatus", "Time (ms)"})
+		if err != nil {
+			fatal("Error opening event status file", "error", err)
+		}
+		defer eventsWriter.Close()
+	}
+
+	var transmissionsWriter *csvOutput
+	if DetectConsentTransmission {
+		transmissionsWriter, err = openCSVOutput(ConsentTransmissionsFile, []string{"Website", "Request URL", "Page", "Source", "Parameter", "Value", "After Injection", "Matches Generated Consent String", "Consent Diff"})
+		if err != nil {
+			fatal("Error opening consent transmissions file", "error", err)
+		}
+		defer transmissionsWriter.Close()
+	}
+
+	var requestsWriter *csvOutput
+	if LogRequests {
+		requestsWriter, err = openCSVOutput(RequestsFile, []string{"Website", "Request URL", "Page", "Party", "CNAME"})
+		if err != nil {
+			fatal("Error opening requests file", "error", err)
+		}
+		defer requestsWriter.Close()
+	}
+
+	var noJSWriter *csvOutput
+	if VisitWithoutJS {
+		noJSWriter, err = openCSVOutput(NoJSFile, []string{"Website", "Domain", "Name", "Value", "Path", "Expires", "Set With JavaScript"})
+		if err != nil {
+			fatal("Error opening JavaScript-disabled cookies file", "error", err)
+		}
+		defer noJSWriter.Close()
+	}
+
+	var framesWriter *csvOutput
+	if TrackFrameConsent {
+		framesWriter, err = openCSVOutput(FrameConsentFile, []string{"Website", "Stage", "Frame", "Top Frame", "Sender Origin", "Command", "Call ID", "EventStatus", "TC String", "Matches Top Frame", "Consent Diff"})
+		if err != nil {
+			fatal("Error opening frame consent file", "error", err)
+		}
+		defer framesWriter.Close()
+	}
+
+	var storageWriter *csvOutput
+	if CaptureStorage {
+		storageWriter, err = openCSVOutput(StorageFile, []string{"Website", "Phase", "Origin", "Third Party", "Type", "Name", "Key", "Value", "Generated Consent String"})
+		if err != nil {
+			fatal("Error opening storage file", "error", err)
+		}
+		defer storageWriter.Close()
+	}
+
+	var featuresWriter *csvOutput
+	if DetectSpecialFeatures {
+		featuresWriter, err = openCSVOutput(SpecialFeaturesFile, []string{"Website", "Frame", "Script", "Party", "Behavior", "API", "Calls", "Special Feature", "Opted In", "Before Injection", "Violation"})
+		if err != nil {
+			fatal("Error opening special features file", "error", err)
+		}
+		defer featuresWriter.Close()
+	}
+
+	var frameworksWriter *csvOutput
+	if DetectFrameworks {
+		frameworksWriter, err = openCSVOutput(FrameworksFile, []string{"Website", "Framework", "Evidence", "Injected Framework"})
+		if err != nil {
+			fatal("Error opening frameworks file", "error", err)
+		}
+		defer frameworksWriter.Close()
+	}
+
+	var conformanceWriter *csvOutput
+	if CheckCMPConformance {
+		conformanceWriter, err = openCSVOutput(CMPConformanceFile, []string{"Website", "TCF API Mode", "Check", "Result", "Detail"})
+		if err != nil {
+			fatal("Error opening CMP conformance file", "error", err)
+		}
+		defer conformanceWriter.Close()
+	}
+
+	var initialConsentWriter *csvOutput
+	if CaptureInitialConsent {
+		initialConsentWriter, err = openCSVOutput(InitialConsentFile, []string{"Website", "EventStatus", "Initial Consent String", "CMP ID", "CMP Version", "Purposes Consented", "Purposes LI", "Special Features Opted In", "Vendors Consented", "Vendors LI", "Vendor Count", "Pre-Ticked", "Decode Error"})
+		if err != nil {
+			fatal("Error opening initial consent file", "error", err)
+		}
+		defer initialConsentWriter.Close()
+	}
+
+	// Fetch the CMP list and open the CMP verification CSV file
+	var cmpVerificationWriter *csvOutput
+	if VerifyCMPMetadata {
+		loadCMPList()
+		cmpVerificationWriter, err = openCSVOutput(CMPVerificationFile, []string{"Website", "CMP ID", "CMP Version", "Check", "Stage", "Result", "Detail"})
+		if err != nil {
+			fatal("Error opening CMP verification file", "error", err)
+		}
+		defer cmpVerificationWriter.Close()
+	}
+
+	// Open the multiple CMPs CSV file
+	var multipleCMPsWriter *csvOutput
+	if DetectMultipleCMPs {
+		multipleCMPsWriter, err = openCSVOutput(MultipleCMPsFile, []string{"Website", "TCF API Mode", "__cmp Present", "__cmpLocator Frames", "__tcfapiLocator Frames", "CMP IDs Initial Load", "CMP IDs After Reload", "Conflicting", "Conflicts"})
+		if err != nil {
+			fatal("Error opening multiple CMPs file", "error", err)
+		}
+		defer multipleCMPsWriter.Close()
+	}
+
+	// Open the consent walls CSV file
+	var consentWallsWriter *csvOutput
+	if DetectConsentWalls {
+		consentWallsWriter, err = openCSVOutput(ConsentWallsFile, []string{"Website", "Classification", "Coverage Before", "Coverage After", "Interactable Before", "Interactable After", "Scroll Locked Before", "Scroll Locked After", "Blurred Before", "Text Length Before", "Text Length After", "Content Withheld", "Unblocked After Consent", "Pur Providers", "Pay Keywords"})
+		if err != nil {
+			fatal("Error opening consent walls file", "error", err)
+		}
+		defer consentWallsWriter.Close()
+	}
+
+	var syncsWriter *csvOutput
+	if DetectCookieSyncs {
+		syncsWriter, err = openCSVOutput(CookieSyncsFile, []string{"Website", "From Domain", "Cookie", "To Domain", "Request URL", "Parameter", "Redirect From", "Redirect Hop", "Page", "Profile", "Reject All"})
+		if err != nil {
+			fatal("Error opening cookie syncs file", "error", err)
+		}
+		defer syncsWriter.Close()
+	}
+
+	var uspWriter *csvOutput
+	if USPrivacyMode {
+		uspWriter, err = openCSVOutput(USPrivacyFile, []string{"Website", "Host", "Party", "Requests", "Requests With us_privacy", "us_privacy Values", "Opt-Out Forwarded", "Cookies Set", "Cookie Names"})
+		if err != nil {
+			fatal("Error opening US privacy file", "error", err)
+		}
+		defer uspWriter.Close()
+	}
+
+	var cmpLatencyWriter *csvOutput
+	if MeasureCMPLatency {
+		cmpLatencyWriter, err = openCSVOutput(CMPLatencyFile, []string{"Website", "API Ready (ms)", "First Event", "First Event (ms)", "tcloaded (ms)", "API Ready After Reload (ms)", "tcloaded After Reload (ms)", "CMP Requests", "CMP Scripts", "CMP Script Bytes", "CMP Script Origins", "TCF API Mode", "Error Class"})
+		if err != nil {
+			fatal("Error opening CMP latency file", "error", err)
+		}
+		defer cmpLatencyWriter.Close()
+	}
+
+	var gatingWriter *csvOutput
+	if vendorGatingEnabled() {
+		gatingWriter, err = openCSVOutput(VendorGatingFile, []string{"Website", "Vendor ID", "Vendor Name", "Verdict", "Requests With Consent", "Cookies With Consent", "Requests Without Consent", "Cookies Without Consent", "Hosts Without Consent", "Visit Errors", "TCF API Mode", "Error Class"})
+		if err != nil {
+			fatal("Error opening vendor gating file", "error", err)
+		}
+		defer gatingWriter.Close()
+	}
+
+	var blockingWriter *csvOutput
+	if blockingEnabled() {
+		blockingWriter, err = openCSVOutput(BlockingFile, []string{"Website", "Mode", "Blocked Requests", "Blocked Hosts", "Page Exceptions", "Exception Messages", "TCF API Mode", "Error Class"})
+		if err != nil {
+			fatal("Error opening blocking file", "error", err)
+		}
+		defer blockingWriter.Close()
+	}
+
+	var iframesWriter *csvOutput
+	if InspectIframes {
+		iframesWriter, err = openCSVOutput(IframesFile, []string{"Website", "Frame URL", "Origin", "Cookies", "localStorage Keys", "Storage Error", "TCF Calls", "Event Status", "TC String Received", "Matches Top Frame", "Stores Without Signal"})
+		if err != nil {
+			fatal("Error opening iframes file", "error", err)
+		}
+		defer iframesWriter.Close()
+	}
+
+	var workersWriter *csvOutput
+	if CaptureWorkers {
+		workersWriter, err = openCSVOutput(WorkersFile, []string{"Website", "Worker Type", "Worker URL", "Kind", "URL", "Name", "Party", "Cookies Set", "Page", "Time"})
+		if err != nil {
+			fatal("Error opening workers file", "error", err)
+		}
+		defer workersWriter.Close()
+	}
+
+	var tlsWriter *csvOutput
+	if CaptureTLS {
+		tlsWriter, err = openCSVOutput(TLSFile, []string{"Website", "Host", "Party", "TLS Version", "Cipher Suite", "Subject", "Issuer", "Not After", "Handshakes", "Verification Error"})
+		if err != nil {
+			fatal("Error opening TLS endpoints file", "error", err)
+		}
+		defer tlsWriter.Close()
+	}
+
+	var subdomainsWriter *csvOutput
+	if SubdomainSampleSize > 0 {
+		subdomainsWriter, err = openCSVOutput(SubdomainsFile, []string{"Website", "Subdomain", "Source", "Links", "API Consent String", "Consent Diff", "EventStatus", "Consent Cookie Sent"})
+		if err != nil {
+			fatal("Error opening subdomains file", "error", err)
+		}
+		defer subdomainsWriter.Close()
+	}
+
+	// Record the run now that the domains are ordered and the GVL is loaded. Workers leave it to the coordinator
+	if *coordinatorURL == "" {
+		recordRun()
 	}
 
 	// Set up Chrome with the HTTP proxy
 	allocCtx, cancel := createChromeContext()
 	defer cancel()
 
-	// Load last processed index
-	lastProcessedIndex := loadProgress()
+	// Verify that the proxy, consent injection and probes work before starting the run, rather than producing empty columns
+	if Calibrate && !calibrate(allocCtx) {
+		cancel()
+		fatal("Calibration failed, aborting the run")
+	}
+
+	// Process domains, keeping their outcomes to re-scan a sample of them with -rescan. Up to concurrentScans domains are
+	// scanned at a time, each taking a slot, while their rows are written to the outputs one domain at a time
+	budget := newRunBudget()
+	var scanned []scanOutcome
+	slots := make(chan int, concurrentScans(allocCtx))
+	for slot := range cap(slots) {
+		slots <- slot
+	}
+	var writing sync.Mutex
+	var scans sync.WaitGroup
+	for {
+		// Wait for a free slot before taking the next domain, as a worker holds the lease of a single domain at a time
+		slot := <-slots
+		domain, left, ok := source.next()
+		if !ok {
+			break
+		}
+
+		// Tag all records logged while processing the domain with it, passing the logger down with the scan's context
+		logger, stopDomainLogging := startDomainLogging(domain)
+
+		// Split the time left of the run budget over the domains left, skipping them once it is spent. Domains scanned at
+		// the same time share the time
+		domainBudget, ok := budget.domainBudget((left + cap(slots) - 1) / cap(slots))
+		if !ok {
+			logger.Warn("Run budget exhausted, skipping domain")
+			source.skip(domain, "run budget exhausted")
+			stopDomainLogging()
+			slots <- slot
+			continue
+		}
+
+		// Skip domains whose robots.txt disallows the scanned page with -robots, see politeness.go
+		if !robotsAllowed(targetURL(domain)) {
+			logger.Warn("Disallowed by robots.txt, skipping domain")
+			source.skip(domain, "disallowed by robots.txt")
+			stopDomainLogging()
+			slots <- slot
+			continue
+		}
 
-	// Process domains
-	for index, domain := range domains {
-		// Skip domains that have already been processed
-		if index < lastProcessedIndex {
+		// Skip domains that are being processed by another run
+		if !source.claim(domain) {
+			stopDomainLogging()
+			slots <- slot
 			continue
 		}
 
-		// Create a new Chrome context for each domain
-		ctx, cancelCtx := createDomainContext(allocCtx)
+		// Scan the domain in its slot, naming the slots in the dashboard when there are several
+		worker := localWorker
+		if cap(slots) > 1 {
+			worker = fmt.Sprintf("%s-%d", localWorker, slot+1)
+		}
+		scans.Add(1)
+		go func() {
+			defer func() {
+				slots <- slot
+				scans.Done()
+			}()
+
+			// Scan the domain in a new Chrome context, limited to its share of the run budget, retried on transient errors
+			// and re-crawled if the results are anomalous
+			if domainBudget > 0 {
+				logger.Debug("Allotted run budget", "budget", domainBudget)
+			}
+			progress.begin(worker, domain, left, optionsFor(domain).Timeout)
+			cookies, result, anomalies := runWithRecrawls(logging.NewContext(allocCtx, logger), domain, domainBudget, optionsFor(domain))
 
-		targetURL := "https://" + domain
-		cookies, tcString, apiTcString, eventStatusBeforeRL, eventStatusAfterRL := run(targetURL, ctx)
+			// Write the rows of one domain at a time
+			writing.Lock()
+			defer writing.Unlock()
 
-		// Write non-expired cookies to a CSV file
-		for _, c := range cookies {
-			if !isCookieExpired(c) {
-				writer.Write([]string{domain, c.Domain, c.Name, c.Value, c.Path, c.Expires.Format(time.RFC1123), fmt.Sprint(isCookieExpired(c)), tcString, apiTcString, fmt.Sprint(strings.Split(tcString, ".")[0] == strings.Split(apiTcString, ".")[0]), eventStatusBeforeRL, eventStatusAfterRL, fmt.Sprint(eventStatusBeforeRL != eventStatusAfterRL)})
-				writer.Flush()
+			// Start new parts of the output files once the current ones hold RotateEvery domains, or the date changes
+			if rotation.Next() {
+				rotateOutputFiles()
+			}
+
+			// Write the anomalies of the scan and its re-crawls
+			if len(anomalies) > 0 {
+				anomaliesWriter.WriteAll(anomalies)
+			}
+
+			// Write non-expired cookies to a CSV file
+			diff := consentDiffJSON(result.TCString, result.APITCString)
+			for _, c := range cookies {
+				if !isCookieExpired(c) {
+					writer.Write([]string{domain, c.Domain, c.Name, c.Value, c.Path, c.Expires.Format(time.RFC1123), fmt.Sprint(isCookieExpired(c)), result.TCString, result.APITCString, diff, result.EventStatusBeforeRL, result.EventStatusAfterRL, fmt.Sprint(result.EventStatusBeforeRL != result.EventStatusAfterRL), result.CookiePages[cookieKey(c)], serverSetColumn(c, result), setBeforeInjection(c, result), result.CookieTimes[cookieKey(c)].Format(time.RFC3339), result.CookieURLs[cookieKey(c)], result.CookieParties[cookieKey(c)], result.CookieCNAMEs[cookieKey(c)], Framework, *deviceFlag})
+					writer.Flush()
+					metrics.cookiesCaptured.Add(1)
+				}
+			}
+
+			// Match the cookies against the GVL
+			if MatchGVL != "" {
+				matcher.write(domain, cookies)
+			}
+
+			// Post the high-severity findings to the webhooks, see notifications.go
+			if notify.Enabled() {
+				notifyFindings(domain, cookies, result, matcher)
+			}
+
+			// Write the values captured on sub-pages
+			for _, p := range result.Pages {
+				pagesWriter.Write([]string{domain, p.URL, strconv.Itoa(p.Depth), result.TCString, p.APITCString, consentDiffJSON(result.TCString, p.APITCString), p.EventStatus})
+				pagesWriter.Flush()
+			}
+
+			// Write the comparison between the www and apex variants of the site
+			if CompareHostVariants {
+				hostsWriter.Write(hostComparisonRow(domain, result.APITCString, result.Hosts))
+				hostsWriter.Flush()
 			}
-		}
 
-		fmt.Printf("Done with domain: %v\n", domain)
-		saveProgress(index + 1)
-		cancelCtx()
+			// Write the sequence of TCF events reported before and after reload
+			if TrackEventStatus {
+				eventsWriter.WriteAll(eventRows(domain, "before reload", result.EventsBeforeRL))
+				eventsWriter.WriteAll(eventRows(domain, "after reload", result.EventsAfterRL))
+			}
+
+			// Write the consent values sent to third parties
+			for _, t := range result.Transmissions {
+				transmissionsWriter.Write(transmissionRow(domain, result, t))
+			}
+			if DetectConsentTransmission {
+				transmissionsWriter.Flush()
+			}
+
+			// Write the requests sent while scanning, with their classification
+			for _, r := range result.Requests {
+				requestsWriter.Write([]string{domain, r.URL, r.Page, r.Party, r.CNAME})
+			}
+			if LogRequests {
+				requestsWriter.Flush()
+			}
+
+			// Write the cookies set with JavaScript disabled
+			if VisitWithoutJS {
+				noJSWriter.WriteAll(noJSRows(domain, cookies, result.ServerCookies))
+			}
+
+			// Write the consent returned to each frame
+			if TrackFrameConsent {
+				framesWriter.WriteAll(frameConsentRows(domain, result))
+			}
+
+			// Write the web storage entries of the page's frames
+			for _, item := range result.Storage {
+				storageWriter.Write(storageRow(domain, result, item))
+			}
+			if CaptureStorage {
+				storageWriter.Flush()
+			}
+
+			// Write the calls to the geolocation and fingerprinting APIs and whether the special features were opted in to
+			if DetectSpecialFeatures {
+				featuresWriter.WriteAll(specialFeatureRows(domain, result))
+			}
+
+			// Write the consent frameworks the site's CMP implements
+			if DetectFrameworks {
+				frameworksWriter.WriteAll(frameworkRows(domain, result))
+			}
+
+			// Write the checklist of the CMP's __tcfapi
+			if CheckCMPConformance {
+				conformanceWriter.WriteAll(conformanceRows(domain, result))
+			}
+
+			// Write the consent the CMP granted before the injection, and whether it was pre-ticked
+			if CaptureInitialConsent {
+				if row := initialConsentRow(domain, result); row != nil {
+					initialConsentWriter.Write(row)
+				}
+			}
+
+			// Write the checks of the values reported by the CMP against the CMP list
+			if VerifyCMPMetadata {
+				cmpVerificationWriter.WriteAll(cmpVerificationRows(domain, result))
+			}
+
+			// Write the signs of more than one CMP on the page
+			if DetectMultipleCMPs {
+				if row := multipleCMPsRow(domain, result); row != nil {
+					multipleCMPsWriter.Write(row)
+				}
+			}
+
+			// Write how the banner blocked the page before consent
+			if DetectConsentWalls {
+				if row := consentWallRow(domain, result); row != nil {
+					consentWallsWriter.Write(row)
+				}
+			}
+
+			// Write the cookie syncs between the third parties, the edges of the domain's sync graph
+			if DetectCookieSyncs {
+				syncsWriter.WriteAll(cookieSyncRows(domain, result, result.CookieSyncs))
+			}
+
+			// Write whether each third party received the US privacy opt-out and still set cookies
+			if USPrivacyMode {
+				uspWriter.WriteAll(usPrivacyRows(domain, cookies, result, result.USPSignals))
+			}
+
+			// Write the third party iframes and whether the TC string was forwarded to them
+			if InspectIframes {
+				iframesWriter.WriteAll(iframeRows(domain, result))
+			}
+
+			// Write the requests of the page's workers and the storage writes of their origins
+			if CaptureWorkers {
+				workersWriter.WriteAll(workerRows(domain, result.Workers))
+			}
+
+			// Write how fast the CMP loaded and the requests to the CMP hosts
+			if MeasureCMPLatency {
+				cmpLatencyWriter.Write(cmpLatencyRow(domain, result))
+			}
+
+			// Write whether the vendors tested are gated on their own consent
+			if vendorGatingEnabled() {
+				gatingWriter.WriteAll(vendorGatingRows(domain, result))
+			}
+
+			// Write the requests blocked by the proxy and whether the page broke without them
+			if blockingEnabled() {
+				blockingWriter.Write(blockingRow(domain, result))
+			}
+
+			// Write the TLS endpoints the proxy connected to
+			if CaptureTLS {
+				tlsWriter.WriteAll(tlsRows(domain, result.TLSEndpoints))
+			}
+
+			// Write the values captured on the sampled subdomains
+			for _, s := range result.Subdomains {
+				subdomainsWriter.Write(subdomainRow(domain, result.TCString, s))
+				subdomainsWriter.Flush()
+			}
+
+			// Write the stacks presented by the CMP and the issues found with them
+			if ValidateStacks {
+				presented := detectStacks(result.PageText, stacks)
+				stacksWriter.Write(stackRow(domain, presented, validateStacks(presented, result.APITCString)))
+				stacksWriter.Flush()
+			}
+
+			// Write the mode in which the TCF API was present
+			modesWriter.Write([]string{domain, result.TCFAPIMode, result.ErrorClass, strconv.Itoa(result.Attempts), result.CMPRoute, *deviceFlag, string(scanVerdict(result))})
+			modesWriter.Flush()
+			writeVerdict(verdictRecord(domain, result))
+			if rescanning() {
+				scanned = append(scanned, newScanOutcome(domain, cookies, result))
+			}
+			progress.end(worker, domain, failureClass(result), scanFindings(domain, cookies, result, matcher))
+
+			metrics.domainsProcessed.Add(1)
+			if result.TCFAPIMode != tcf.ModeNone {
+				metrics.tcfAPIFound.Add(1)
+			}
+
+			flushOutputFiles()
+			logger.Info("Done with domain")
+			source.finish(domain, result)
+			stopDomainLogging()
+		}()
 	}
+	scans.Wait()
 
-	// Reset progress
-	saveProgress(0)
+	// Re-scan a sample of the domains to estimate the measurement noise, see reproducibility.go
+	if rescanning() {
+		rescanSample(allocCtx, budget, scanned)
+	}
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+
+	"github.com/SirDataFR/iabtcfv2"
+)
+
+const (
+	// Special feature opt-ins of the injected consent string. Without them, sites and vendors may neither use precise
+	// geolocation data (special feature 1) nor actively scan device characteristics for identification (special
+	// feature 2), whatever purposes are consented to
+	OptInPreciseGeolocation = false
+	OptInDeviceScanning     = false
+
+	// Special feature detection records the calls of every frame to the geolocation API and the canvas, audio, WebGL
+	// and plugin APIs used for fingerprinting, along with the script making them, and flags those made without the
+	// opt-in to the matching special feature
+	DetectSpecialFeatures = false
+	SpecialFeaturesFile   = "special_features.csv"
+	featureCallBinding    = "__vendorComplianceFeatureCall"
+
+	// Special features of the TCF
+	specialFeatureGeolocation    = 1
+	specialFeatureDeviceScanning = 2
+
+	// JavaScript run in every frame of every new document, which wraps the APIs revealing the user's location or a
+	// fingerprint of the device and reports each call through the binding, with the URL of the calling script taken
+	// from the stack. Canvas and audio fingerprinting read back what was rendered, so only the read-back calls are
+	// reported, not the drawing, and of the WebGL parameters only the unmasked vendor and renderer. Each API is
+	// reported at most 100 times per script and document, so pages rendering with canvas or WebGL do not flood the
+	// binding.
+	featureMonitorJS = `
+			(function () {
+				const report = window.` + featureCallBinding + `;
+				if (typeof report !== 'function') {
+					return;
+				}
+
+				const counts = {};
+				const callerScript = () => {
+					const lines = (new Error().stack || '').split('\n');
+					for (const line of lines) {
+						const match = line.match(/(https?:\/\/[^\s()]+?)(?::\d+){1,2}\)?\s*$/);
+						if (match) {
+							return match[1];
+						}
+					}
+					return '';
+				};
+				const record = (behavior, api) => {
+					try {
+						const script = callerScript();
+						const key = api + ' ' + script;
+						counts[key] = (counts[key] || 0) + 1;
+						if (counts[key] <= 100) {
+							report(JSON.stringify({behavior: behavior, api: api, frame: location.href, script: script}));
+						}
+					} catch (e) {
+					}
+				};
+				const wrap = (target, name, behavior, api, filter) => {
+					if (!target || typeof target[name] !== 'function') {
+						return;
+					}
+					const original = target[name];
+					target[name] = function () {
+						if (!filter || filter.apply(this, arguments)) {
+							record(behavior, api);
+						}
+						return original.apply(this, arguments);
+					};
+				};
+				const wrapGetter = (target, name, behavior, api) => {
+					const descriptor = target && Object.getOwnPropertyDescriptor(target, name);
+					if (!descriptor || typeof descriptor.get !== 'function' || !descriptor.configurable) {
+						return;
+					}
+					Object.defineProperty(target, name, Object.assign({}, descriptor, {
+						get: function () {
+							record(behavior, api);
+							return descriptor.get.call(this);
+						},
+					}));
+				};
+				const unmasked = (parameter) => parameter === 0x9245 || parameter === 0x9246;
+
+				if (navigator.geolocation) {
+					const geolocation = Object.getPrototypeOf(navigator.geolocation);
+					wrap(geolocation, 'getCurrentPosition', 'geolocation', 'Geolocation.getCurrentPosition');
+					wrap(geolocation, 'watchPosition', 'geolocation', 'Geolocation.watchPosition');
+				}
+				wrap(window.HTMLCanvasElement && HTMLCanvasElement.prototype, 'toDataURL', 'canvas', 'HTMLCanvasElement.toDataURL');
+				wrap(window.HTMLCanvasElement && HTMLCanvasElement.prototype, 'toBlob', 'canvas', 'HTMLCanvasElement.toBlob');
+				wrap(window.CanvasRenderingContext2D && CanvasRenderingContext2D.prototype, 'getImageData', 'canvas', 'CanvasRenderingContext2D.getImageData');
+				wrap(window.OfflineAudioContext && OfflineAudioContext.prototype, 'startRendering', 'audio', 'OfflineAudioContext.startRendering');
+				wrap(window.AnalyserNode && AnalyserNode.prototype, 'getFloatFrequencyData', 'audio', 'AnalyserNode.getFloatFrequencyData');
+				wrap(window.BaseAudioContext && BaseAudioContext.prototype, 'createDynamicsCompressor', 'audio', 'BaseAudioContext.createDynamicsCompressor');
+				wrap(window.WebGLRenderingContext && WebGLRenderingContext.prototype, 'getParameter', 'webgl', 'WebGLRenderingContext.getParameter', unmasked);
+				wrap(window.WebGL2RenderingContext && WebGL2RenderingContext.prototype, 'getParameter', 'webgl', 'WebGL2RenderingContext.getParameter', unmasked);
+				wrap(window.WebGLRenderingContext && WebGLRenderingContext.prototype, 'readPixels', 'webgl', 'WebGLRenderingContext.readPixels');
+				wrapGetter(window.Navigator && Navigator.prototype, 'plugins', 'plugins', 'Navigator.plugins');
+				wrapGetter(window.Navigator && Navigator.prototype, 'mimeTypes', 'plugins', 'Navigator.mimeTypes');
+			})()
+		`
+)
+
+// Behaviors reported by the feature monitor, and the special feature each requires
+var behaviorFeatures = map[string]int{
+	"geolocation": specialFeatureGeolocation,
+	"canvas":      specialFeatureDeviceScanning,
+	"audio":       specialFeatureDeviceScanning,
+	"webgl":       specialFeatureDeviceScanning,
+	"plugins":     specialFeatureDeviceScanning,
+}
+
+// featureCall is a call to an API revealing the user's location or a fingerprint of the device.
+type featureCall struct {
+	Behavior string    `json:"behavior"` // Behavior is geolocation, canvas, audio, webgl or plugins.
+	API      string    `json:"api"`
+	Frame    string    `json:"frame"`  // Frame is the URL of the calling frame.
+	Script   string    `json:"script"` // Script is the URL of the calling script, empty for inline scripts.
+	Party    string    `json:"-"`      // Party is the class of the script's host, see party.go, or empty for inline scripts.
+	Time     time.Time `json:"-"`
+}
+
+// featureCallLog collects the feature calls made by the frames of the tab.
+type featureCallLog struct {
+	mu    sync.Mutex
+	calls []featureCall
+}
+
+// add records a call reported through the binding.
+func (l *featureCallLog) add(payload string) {
+	var call featureCall
+	if err := json.Unmarshal([]byte(payload), &call); err != nil {
+		slog.Debug("Error decoding feature call", "error", err)
+		return
+	}
+	call.Time = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+// get returns the calls recorded so far.
+func (l *featureCallLog) get() []featureCall {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]featureCall(nil), l.calls...)
+}
+
+// registerFeatureMonitor returns a chromedp Action which makes every frame of the following documents in the tab
+// report its calls to the geolocation and fingerprinting APIs. It does nothing unless DetectSpecialFeatures is set.
+func registerFeatureMonitor() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !DetectSpecialFeatures {
+			return nil
+		}
+		if err := runtime.AddBinding(featureCallBinding).Do(ctx); err != nil {
+			return err
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(featureMonitorJS).Do(ctx)
+		return err
+	})
+}
+
+// specialFeatureOptIns returns the special features opted in to in the injected consent string.
+func specialFeatureOptIns() []int {
+	var features []int
+	if OptInPreciseGeolocation {
+		features = append(features, specialFeatureGeolocation)
+	}
+	if OptInDeviceScanning {
+		features = append(features, specialFeatureDeviceScanning)
+	}
+	return features
+}
+
+// optedIn reports whether the special feature is opted in to in the TC string.
+func optedIn(tcString string, feature int) bool {
+	tcData, err := iabtcfv2.Decode(tcString)
+	if err != nil || tcData == nil || tcData.CoreString == nil {
+		return false
+	}
+	return tcData.CoreString.SpecialFeatureOptIns[feature]
+}
+
+// classifyFeatureCalls sets the party of the calls' scripts.
+func classifyFeatureCalls(calls []featureCall, parties *partyClassifier) {
+	for i, call := range calls {
+		if u, err := url.Parse(call.Script); err == nil && u.Hostname() != "" {
+			calls[i].Party, _ = parties.classify(u.Hostname())
+		}
+	}
+}
+
+// specialFeatureRows builds the special features CSV rows, one per frame, calling script and API. Calls made before
+// the consent was injected, or without the opt-in to the special feature in the injected TC string, are violations.
+func specialFeatureRows(domain string, result scanResult) [][]string {
+	type key struct{ frame, script, api string }
+	var order []key
+	counts := map[key]int{}
+	beforeInjection := map[key]bool{}
+	behaviors := map[key]string{}
+	parties := map[key]string{}
+	for _, call := range result.FeatureCalls {
+		k := key{call.Frame, call.Script, call.API}
+		if counts[k] == 0 {
+			order = append(order, k)
+		}
+		counts[k]++
+		behaviors[k] = call.Behavior
+		parties[k] = call.Party
+		if result.InjectedAt.IsZero() || call.Time.Before(result.InjectedAt) {
+			beforeInjection[k] = true
+		}
+	}
+
+	var rows [][]string
+	for _, k := range order {
+		feature := behaviorFeatures[behaviors[k]]
+		opted := optedIn(result.TCString, feature)
+		violation := !opted || beforeInjection[k]
+		if violation {
+			slog.Warn("Special feature used without opt-in", "feature", feature, "api", k.api, "script", k.script, "frame", k.frame)
+		}
+		rows = append(rows, []string{domain, k.frame, k.script, parties[k], behaviors[k], k.api, strconv.Itoa(counts[k]), strconv.Itoa(feature), fmt.Sprint(opted), fmt.Sprint(beforeInjection[k]), fmt.Sprint(violation)})
+	}
+	return rows
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// Frame consent tracking sniffs the __tcfapiCall and __tcfapiReturn messages frames exchange via postMessage, and
+	// compares the consent returned to each frame, such as the iframes of ad vendors, with the top frame's
+	TrackFrameConsent   = false // TrackFrameConsent records the consent returned to every frame and flags frames receiving a TC string different from the top frame's.
+	FrameConsentFile    = "frame_consent.csv"
+	frameMessageBinding = "__vendorComplianceFrameMessage"
+
+	// JavaScript run in every frame of every new document, which reports each TCF message the frame receives through
+	// the binding. chromedp disables site isolation, so cross-origin iframes are part of the same target and run it too.
+	frameSnifferJS = `
+			(function () {
+				const report = window.` + frameMessageBinding + `;
+				if (typeof report !== 'function') {
+					return;
+				}
+
+				window.addEventListener('message', (event) => {
+					let data = event.data;
+					if (typeof data === 'string') {
+						try {
+							data = JSON.parse(data);
+						} catch (e) {
+							return;
+						}
+					}
+					if (!data || (!data.__tcfapiCall && !data.__tcfapiReturn)) {
+						return;
+					}
+
+					const message = {frame: location.href, top: window === window.top, origin: event.origin};
+					if (data.__tcfapiCall) {
+						message.kind = 'call';
+						message.command = String(data.__tcfapiCall.command);
+						message.callId = String(data.__tcfapiCall.callId);
+					} else {
+						const returnValue = data.__tcfapiReturn.returnValue;
+						message.kind = 'return';
+						message.callId = String(data.__tcfapiReturn.callId);
+						if (returnValue && typeof returnValue === 'object') {
+							message.tcString = returnValue.tcString || '';
+							message.eventStatus = returnValue.eventStatus || '';
+						}
+					}
+					report(JSON.stringify(message));
+				}, true);
+			})()
+		`
+)
+
+// frameMessage is a __tcfapiCall or __tcfapiReturn message received by a frame.
+type frameMessage struct {
+	Frame       string `json:"frame"`  // Frame is the URL of the receiving frame.
+	Top         bool   `json:"top"`    // Top reports whether the receiving frame is the top frame.
+	Origin      string `json:"origin"` // Origin is the origin of the sending frame.
+	Kind        string `json:"kind"`   // Kind is either "call" or "return".
+	Command     string `json:"command"`
+	CallID      string `json:"callId"`
+	TCString    string `json:"tcString"`
+	EventStatus string `json:"eventStatus"`
+	Stage       string `json:"-"` // Stage is either "before reload" or "after reload".
+}
+
+// frameMessageLog collects the TCF messages received by the frames of the tab.
+type frameMessageLog struct {
+	mu       sync.Mutex
+	stage    string
+	messages []frameMessage
+}
+
+// newFrameMessageLog returns an empty log in the "before reload" stage.
+func newFrameMessageLog() *frameMessageLog {
+	return &frameMessageLog{stage: "before reload"}
+}
+
+// add records a message reported through the binding.
+func (l *frameMessageLog) add(payload string) {
+	var message frameMessage
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		slog.Debug("Error decoding frame message", "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	message.Stage = l.stage
+	l.messages = append(l.messages, message)
+}
+
+// get returns the messages recorded so far.
+func (l *frameMessageLog) get() []frameMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]frameMessage(nil), l.messages...)
+}
+
+// registerFrameSniffer returns a chromedp Action which makes every frame of the following documents in the tab report
+// the TCF messages it receives. It does nothing unless TrackFrameConsent or InspectIframes is set.
+func registerFrameSniffer() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !TrackFrameConsent && !InspectIframes {
+			return nil
+		}
+		if err := runtime.AddBinding(frameMessageBinding).Do(ctx); err != nil {
+			return err
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(frameSnifferJS).Do(ctx)
+		return err
+	})
+}
+
+// setFrameStage returns a chromedp Action which records the following messages under the given stage.
+func setFrameStage(log *frameMessageLog, stage string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		log.stage = stage
+		return nil
+	})
+}
+
+// frameConsentRows builds the frame consent CSV rows for the returns carrying a TC string. Returns received after
+// reload are compared to the TC string the top frame's CMP returned after reload, and each frame receiving a
+// different one is logged. The command of a return is taken from the matching call, if it was seen.
+func frameConsentRows(domain string, result scanResult) [][]string {
+	commands := map[string]string{}
+	for _, m := range result.FrameMessages {
+		if m.Kind == "call" {
+			commands[m.CallID] = m.Command
+		}
+	}
+
+	var rows [][]string
+	for _, m := range result.FrameMessages {
+		if m.Kind != "return" || m.TCString == "" {
+			continue
+		}
+
+		matches, diff := "", ""
+		if m.Stage == "after reload" && result.APITCString != "" {
+			matches = fmt.Sprint(m.TCString == result.APITCString)
+			diff = consentDiffJSON(result.APITCString, m.TCString)
+			if m.TCString != result.APITCString {
+				slog.Warn("Frame received consent different from the top frame's", "frame", m.Frame, "origin", m.Origin, "diff", diff)
+			}
+		}
+
+		rows = append(rows, []string{domain, m.Stage, m.Frame, fmt.Sprint(m.Top), m.Origin, commands[m.CallID], m.CallID, m.EventStatus, m.TCString, matches, diff})
+	}
+	return rows
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/gvl"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Vendor gating tells the vendors that read their own consent bit from those that only read the purposes: after the
+	// scan, the homepage is visited twice for every vendor of -gate-vendors, each time in a new browser context, storing
+	// a TC string consenting to all purposes and either to the vendor only or to all vendors but the vendor, see
+	// tcfaudit.OnlyVendor and tcfaudit.AllVendorsExcept. The cookies attributed to the vendor after the page is reloaded
+	// with that consent, and the requests to its domains carrying identifiers, are counted: a gated vendor only shows up
+	// under its own consent. Requests carry identifiers if they send a cookie, or pass the value of a cookie of the
+	// visit in their query, of at least MinSyncIDLength characters, so plain loads of the vendor's scripts do not count.
+	// The vendors' domains and cookies are taken from the GVL of MatchGVL, which has to be set
+	GatedVendors     = "" // GatedVendors specifies the default of -gate-vendors, the comma separated IDs of the vendors tested.
+	VendorGatingFile = "vendor_gating.csv"
+	VendorGatingWait = 5 * time.Second // VendorGatingWait specifies how long to wait after reload for the vendors' requests.
+
+	// Verdicts of the vendor gating test
+	gatingGated       = "gated"        // The vendor showed up with its consent only.
+	gatingNotGated    = "not-gated"    // The vendor showed up without its consent.
+	gatingNotObserved = "not-observed" // The vendor did not show up at all, e.g. as the site does not use it.
+	gatingFailed      = "failed"       // A visit failed, so the vendor's gating is unknown.
+)
+
+var gateVendorsFlag = flag.String("gate-vendors", GatedVendors, "comma separated IDs of the vendors whose gating on their own consent is tested, e.g. 755,793")
+
+// gatingGVL holds the vendors tested and the GVL attributing requests and cookies to them, loaded by
+// checkVendorGating.
+var gatingGVL struct {
+	vendors []int
+	names   map[string]string // names maps the ID of every vendor of the GVL to its name.
+	index   *gvl.Index
+}
+
+// vendorGatingEnabled reports whether the gating of any vendors is tested.
+func vendorGatingEnabled() bool {
+	return *gateVendorsFlag != ""
+}
+
+// checkVendorGating parses -gate-vendors and loads the GVL of MatchGVL, stopping the run if either fails.
+func checkVendorGating() {
+	if !vendorGatingEnabled() {
+		return
+	}
+	for _, field := range strings.Split(*gateVendorsFlag, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id < 1 || id > tcfaudit.MaxVendorID {
+			fatal("Invalid vendor ID in -gate-vendors", "id", field, "max", tcfaudit.MaxVendorID)
+		}
+		gatingGVL.vendors = append(gatingGVL.vendors, id)
+	}
+	if MatchGVL == "" {
+		fatal("Testing vendor gating needs MatchGVL to attribute the requests and cookies to the vendors")
+	}
+
+	g, err := gvl.Load(MatchGVL)
+	if err != nil {
+		fatal("Error reading GVL", "file", MatchGVL, "error", err)
+	}
+	gatingGVL.index = g.Index(gvl.CookieColumns)
+	gatingGVL.names = map[string]string{}
+	for _, vendor := range g.Vendors {
+		gatingGVL.names[vendor[gvl.IDColumn]] = vendor[gvl.NameColumn]
+	}
+	slog.Info("Testing vendor gating", "vendors", gatingGVL.vendors)
+}
+
+// gatingCookie is a cookie set during a vendor gating visit.
+type gatingCookie struct {
+	Name   string
+	Domain string // Domain is the cookie's Domain attribute, or the host that set it for host-only cookies.
+}
+
+// gatingVisit is the traffic of a vendor gating visit after the consent was stored.
+type gatingVisit struct {
+	requests map[string]int // requests maps each host to the number of its requests carrying identifiers.
+	cookies  []gatingCookie
+	values   map[string]bool // values holds the values of the cookies sent or set during the visit that may be identifiers.
+}
+
+// gatingLog routes the traffic of the vendor gating visits passing through the proxy, which is kept out of the scan's
+// results, to the current visit.
+type gatingLog struct {
+	mu        sync.Mutex
+	visit     *gatingVisit // visit is the current visit, nil outside of the vendor gating visits.
+	recording bool         // recording is set once the consent of the current visit is stored.
+}
+
+// start starts a visit, whose traffic is not recorded until record is called.
+func (l *gatingLog) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.visit = &gatingVisit{requests: map[string]int{}, values: map[string]bool{}}
+	l.recording = false
+}
+
+// record starts recording the traffic of the current visit.
+func (l *gatingLog) record() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recording = true
+}
+
+// stop ends the current visit, returning its traffic.
+func (l *gatingLog) stop() *gatingVisit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	visit := l.visit
+	l.visit = nil
+	return visit
+}
+
+// active reports whether a visit is in progress.
+func (l *gatingLog) active() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.visit != nil
+}
+
+// addRequest records the request if it carries identifiers, and reports whether a visit is in progress, in which case
+// the request is not the scan's.
+func (l *gatingLog) addRequest(req *http.Request) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.visit == nil {
+		return false
+	}
+	identifiers := false
+	for _, c := range req.Cookies() {
+		if len(c.Value) >= MinSyncIDLength {
+			l.visit.values[c.Value] = true
+			identifiers = true
+		}
+	}
+	for _, values := range req.URL.Query() {
+		for _, value := range values {
+			identifiers = identifiers || l.visit.values[value]
+		}
+	}
+	if l.recording && identifiers {
+		l.visit.requests[strings.ToLower(req.URL.Hostname())]++
+	}
+	return true
+}
+
+// addCookie records a cookie set by the host, and reports whether a visit is in progress, in which case the cookie is
+// not the scan's.
+func (l *gatingLog) addCookie(host string, c *http.Cookie) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.visit == nil {
+		return false
+	}
+	if len(c.Value) >= MinSyncIDLength {
+		l.visit.values[c.Value] = true
+	}
+	if l.recording {
+		domain := c.Domain
+		if domain == "" {
+			domain = host
+		}
+		l.visit.cookies = append(l.visit.cookies, gatingCookie{Name: c.Name, Domain: strings.TrimPrefix(strings.ToLower(domain), ".")})
+	}
+	return true
+}
+
+// vendorActivity is what a vendor did during a visit.
+type vendorActivity struct {
+	Requests int
+	Hosts    []string // Hosts are the vendor's hosts requested.
+	Cookies  []string // Cookies are the names of the cookies attributed to the vendor.
+	Err      error
+}
+
+// seen reports whether the vendor showed up during the visit.
+func (a vendorActivity) seen() bool {
+	return a.Requests > 0 || len(a.Cookies) > 0
+}
+
+// vendorGating is the result of testing a vendor's gating on a domain.
+type vendorGating struct {
+	VendorID       int
+	VendorName     string
+	WithConsent    vendorActivity // WithConsent is the vendor's activity when only it was consented to.
+	WithoutConsent vendorActivity // WithoutConsent is the vendor's activity when all vendors but it were consented to.
+	Verdict        string
+}
+
+// testVendorGating visits the target URL with the consent of tcfaudit.OnlyVendor and tcfaudit.AllVendorsExcept for
+// every vendor tested, for at most the domain's timeout each, and returns how each vendor behaved.
+func testVendorGating(ctx context.Context, targetURL string, timeout time.Duration, log *gatingLog) []vendorGating {
+	var results []vendorGating
+	for _, id := range gatingGVL.vendors {
+		result := vendorGating{VendorID: id, VendorName: gatingGVL.names[strconv.Itoa(id)]}
+		result.WithConsent = visitWithProfile(ctx, targetURL, tcfaudit.OnlyVendor(id), timeout, log).activityOf(id)
+		result.WithoutConsent = visitWithProfile(ctx, targetURL, tcfaudit.AllVendorsExcept(id), timeout, log).activityOf(id)
+		result.Verdict = gatingVerdict(result)
+		logging.FromContext(ctx).Info("Tested vendor gating", "vendor", id, "verdict", result.Verdict)
+		results = append(results, result)
+	}
+	return results
+}
+
+// gatingVisitResult is the traffic of a vendor gating visit and the error that ended it, if any.
+type gatingVisitResult struct {
+	visit *gatingVisit
+	err   error
+}
+
+// visitWithProfile loads the target URL in a new tab in its own browser context, stores the TC string of the profile
+// for the site's CMP, reloads the page and records its traffic.
+func visitWithProfile(ctx context.Context, targetURL string, profile tcfaudit.ConsentProfile, timeout time.Duration, log *gatingLog) gatingVisitResult {
+	tabCtx, cancelTab := chromedp.NewContext(ctx, newBrowserContext(ctx))
+	defer cancelTab()
+	timeoutCtx, cancel := context.WithTimeout(tabCtx, timeout)
+	defer cancel()
+
+	log.start()
+	err := chromedp.Run(timeoutCtx,
+		emulateDevice(),
+		network.Enable(),
+		chromedp.Navigate(targetURL),
+		waitForTcfApi(*tcfTimeout),
+		storeProfileConsent(profile, log),
+		chromedp.Reload(),
+		waitForTcfApi(*tcfTimeout),
+		chromedp.Sleep(VendorGatingWait),
+	)
+	if err != nil {
+		logging.FromContext(ctx).Error("Encountered an error testing vendor gating", "profile", profile.Name, "error", err)
+		metrics.recordFailure(classifyError(err))
+	}
+	return gatingVisitResult{visit: log.stop(), err: err}
+}
+
+// storeProfileConsent returns a chromedp Action which stores the TC string of the profile for the page's CMP, and
+// starts recording the visit's traffic.
+func storeProfileConsent(profile tcfaudit.ConsentProfile, log *gatingLog) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		session := chromedpSession{ctx}
+		ping, err := tcf.GetPing(session)
+		if err != nil {
+			return err
+		}
+		profile.SpecialFeatures = specialFeatureOptIns()
+		if _, err := tcf.StoreConsent(session, ping.CmpID, consentString(profile, tcfaudit.CMPFromPing(ping))); err != nil {
+			return err
+		}
+		log.record()
+		return nil
+	})
+}
+
+// activityOf attributes the requests carrying identifiers and the cookies of the visit to the vendor: requests by the
+// domains the vendor discloses, cookies by the identifier matched in the GVL, or by their domain if no vendor discloses them.
+func (r gatingVisitResult) activityOf(vendorID int) vendorActivity {
+	activity := vendorActivity{Err: r.err}
+	if r.visit == nil {
+		return activity
+	}
+	id := strconv.Itoa(vendorID)
+
+	for host, requests := range r.visit.requests {
+		if onVendorDomain(id, host) {
+			activity.Requests += requests
+			activity.Hosts = append(activity.Hosts, host)
+		}
+	}
+	seen := map[string]bool{}
+	for _, c := range r.visit.cookies {
+		match := gatingGVL.index.Match(c.Name, c.Domain)
+		attributed := match.Vendor != nil && match.Vendor[gvl.IDColumn] == id || match.Vendor == nil && onVendorDomain(id, c.Domain)
+		if attributed && !seen[c.Name] {
+			seen[c.Name] = true
+			activity.Cookies = append(activity.Cookies, c.Name)
+		}
+	}
+	sort.Strings(activity.Hosts)
+	sort.Strings(activity.Cookies)
+	return activity
+}
+
+// onVendorDomain reports whether the vendor with the given ID discloses a domain matching the host.
+func onVendorDomain(id string, host string) bool {
+	for _, vendor := range gatingGVL.index.VendorsOnDomain(host) {
+		if vendor[gvl.IDColumn] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// gatingVerdict returns the verdict of a vendor's gating test.
+func gatingVerdict(result vendorGating) string {
+	switch {
+	case result.WithoutConsent.seen():
+		return gatingNotGated
+	case result.WithConsent.Err != nil || result.WithoutConsent.Err != nil:
+		return gatingFailed
+	case result.WithConsent.seen():
+		return gatingGated
+	}
+	return gatingNotObserved
+}
+
+// vendorGatingRows builds the vendor gating CSV rows, one per vendor tested on the domain.
+func vendorGatingRows(domain string, result scanResult) [][]string {
+	var rows [][]string
+	for _, gating := range result.VendorGating {
+		var errs []string
+		for _, activity := range []vendorActivity{gating.WithConsent, gating.WithoutConsent} {
+			if activity.Err != nil {
+				errs = append(errs, activity.Err.Error())
+			}
+		}
+		rows = append(rows, []string{
+			domain,
+			strconv.Itoa(gating.VendorID),
+			gating.VendorName,
+			gating.Verdict,
+			strconv.Itoa(gating.WithConsent.Requests),
+			strings.Join(gating.WithConsent.Cookies, " "),
+			strconv.Itoa(gating.WithoutConsent.Requests),
+			strings.Join(gating.WithoutConsent.Cookies, " "),
+			strings.Join(gating.WithoutConsent.Hosts, " "),
+			strings.Join(errs, "; "),
+			result.TCFAPIMode,
+			result.ErrorClass,
+		})
+	}
+	return rows
+}
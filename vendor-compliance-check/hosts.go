@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Host comparison visits the www/apex counterpart of the host the scan ended up on and checks whether the consent carries over
+	CompareHostVariants = false
+	HostVariantsFile    = "host_variants.csv"
+)
+
+// hostComparison holds the result of comparing the CMP's behavior on the www and apex variants of a site.
+type hostComparison struct {
+	PrimaryHost          string
+	AlternateHost        string
+	Separate             bool     // Separate reports whether the alternate host serves the site itself instead of redirecting to the primary host.
+	ConsentCookieDomains []string // ConsentCookieDomains lists the Domain attribute of every euconsent-v2 cookie the site stored for either host.
+	AlternateTCString    string
+	AlternateEventStatus string
+	Issues               []string
+}
+
+// alternateHost returns the www variant of an apex host and the apex variant of a www host.
+func alternateHost(host string) string {
+	if strings.HasPrefix(host, "www.") {
+		return strings.TrimPrefix(host, "www.")
+	}
+	return "www." + host
+}
+
+// injectedConsentCookie reports whether the euconsent-v2 cookie with the given Domain attribute and value is the one
+// the crawler stored when injecting the TC string, rather than one set by the site: a host-only cookie, as set by
+// document.cookie and the pre-seed, holding the injected TC string.
+func injectedConsentCookie(domain string, value string, tcString string) bool {
+	return !strings.HasPrefix(domain, ".") && value == tcString
+}
+
+// compareHostVariants returns a chromedp Action which visits the alternate host of the current page in the same tab,
+// so the consent stored on the primary host is available to it, and compares the CMP's behavior on both hosts.
+func compareHostVariants(tcString string, tracker *pageTracker, comparison *hostComparison) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if err := chromedp.Evaluate(`location.hostname`, &comparison.PrimaryHost).Do(ctx); err != nil {
+			return err
+		}
+		comparison.AlternateHost = alternateHost(comparison.PrimaryHost)
+
+		if _, err := net.LookupHost(comparison.AlternateHost); err != nil {
+			logging.FromContext(ctx).Info("Alternate host does not resolve", "host", comparison.AlternateHost, "error", err)
+			return nil
+		}
+
+		tracker.Set("https://" + comparison.AlternateHost)
+		var finalHost string
+		if err := (chromedp.Tasks{
+			chromedp.Navigate("https://" + comparison.AlternateHost),
+			chromedp.Evaluate(`location.hostname`, &finalHost),
+		}).Do(ctx); err != nil {
+			return err
+		}
+
+		comparison.Separate = finalHost == comparison.AlternateHost
+		if !comparison.Separate {
+			return nil
+		}
+
+		if err := (chromedp.Tasks{
+			waitForTcfApi(*tcfTimeout),
+			getTCstring(&comparison.AlternateTCString),
+			getTcEventStatus(&comparison.AlternateEventStatus),
+		}).Do(ctx); err != nil {
+			return err
+		}
+
+		cookies, err := network.GetCookies().WithURLs([]string{"https://" + comparison.PrimaryHost, "https://" + comparison.AlternateHost}).Do(ctx)
+		if err != nil {
+			return err
+		}
+
+		hostOnly := false
+		for _, c := range cookies {
+			if c.Name != "euconsent-v2" || injectedConsentCookie(c.Domain, c.Value, tcString) {
+				continue
+			}
+			comparison.ConsentCookieDomains = append(comparison.ConsentCookieDomains, c.Domain)
+			// Domain cookies are reported with a leading dot, host-only cookies are not
+			if !strings.HasPrefix(c.Domain, ".") {
+				hostOnly = true
+			}
+		}
+		sort.Strings(comparison.ConsentCookieDomains)
+
+		if hostOnly {
+			comparison.Issues = append(comparison.Issues, "euconsent-v2 cookie is host-only")
+		}
+		if strings.Split(comparison.AlternateTCString, ".")[0] != strings.Split(tcString, ".")[0] {
+			comparison.Issues = append(comparison.Issues, fmt.Sprintf("consent does not propagate to %s", comparison.AlternateHost))
+		}
+
+		return nil
+	})
+}
+
+// hostComparisonRow builds the host variants CSV row for a single domain.
+func hostComparisonRow(domain string, apiTcString string, comparison hostComparison) []string {
+	return []string{
+		domain,
+		comparison.PrimaryHost,
+		comparison.AlternateHost,
+		fmt.Sprint(comparison.Separate),
+		strings.Join(comparison.ConsentCookieDomains, "; "),
+		apiTcString,
+		comparison.AlternateTCString,
+		comparison.AlternateEventStatus,
+		strings.Join(comparison.Issues, "; "),
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Iframe inspection enumerates the third party iframes of the page after reload, reads their document.cookie and
+	// localStorage in an isolated world of each frame, and checks with the frame sniffer of frames.go whether the TC
+	// string was forwarded to them, catching vendors in iframes that store identifiers without receiving the consent
+	InspectIframes = false
+	IframesFile    = "iframes.csv"
+
+	iframeWorld = "vendorComplianceIframe" // The name of the isolated worlds created in the iframes.
+
+	// JavaScript returning the names of the frame's cookies and its localStorage keys, which it may be denied, e.g. in
+	// sandboxed frames
+	iframeStorageJS = `
+			(() => {
+				const result = {cookies: [], localStorage: [], error: ''};
+				try {
+					result.cookies = document.cookie.split(';').map((c) => c.split('=')[0].trim()).filter((name) => name);
+					result.localStorage = Object.keys(localStorage);
+				} catch (e) {
+					result.error = String(e);
+				}
+				return result;
+			})()
+		`
+)
+
+// iframeInfo is a third party iframe of the page, with the cookies and localStorage keys it can read.
+type iframeInfo struct {
+	URL          string
+	Origin       string
+	Cookies      []string `json:"cookies"`
+	LocalStorage []string `json:"localStorage"`
+	Error        string   `json:"error"` // Error is the error reading the frame's storage, if any.
+}
+
+// inspectIframes returns a chromedp Action which appends the third party iframes of the current page and their
+// storage to frames. Errors inspecting a single frame are recorded in the frame's Error. It does nothing unless
+// InspectIframes is set.
+func inspectIframes(targetURL string, frames *[]iframeInfo) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !InspectIframes {
+			return nil
+		}
+
+		tree, err := page.GetFrameTree().Do(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error getting the frame tree", "error", err)
+			return nil
+		}
+		for _, frame := range childFrames(tree) {
+			if !strings.Contains(frame.SecurityOrigin, "://") || !isThirdPartyOrigin(frame.SecurityOrigin, targetURL) {
+				continue
+			}
+			*frames = append(*frames, readIframeStorage(ctx, frame))
+		}
+		return nil
+	})
+}
+
+// childFrames returns all frames of the tree below its root.
+func childFrames(tree *page.FrameTree) []*cdp.Frame {
+	var frames []*cdp.Frame
+	for _, child := range tree.ChildFrames {
+		if child.Frame != nil {
+			frames = append(frames, child.Frame)
+		}
+		frames = append(frames, childFrames(child)...)
+	}
+	return frames
+}
+
+// readIframeStorage reads the cookies and localStorage keys of the frame in an isolated world, which shares the
+// frame's storage but not its scripts.
+func readIframeStorage(ctx context.Context, frame *cdp.Frame) iframeInfo {
+	info := iframeInfo{URL: frame.URL, Origin: frame.SecurityOrigin}
+	world, err := page.CreateIsolatedWorld(frame.ID).WithWorldName(iframeWorld).Do(ctx)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	value, exception, err := runtime.Evaluate(iframeStorageJS).WithContextID(world).WithReturnByValue(true).Do(ctx)
+	switch {
+	case err != nil:
+		info.Error = err.Error()
+		return info
+	case exception != nil:
+		info.Error = exception.Error()
+		return info
+	}
+	if err := json.Unmarshal(value.Value, &info); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+// withoutFragment returns the URL without its fragment.
+func withoutFragment(u string) string {
+	before, _, _ := strings.Cut(u, "#")
+	return before
+}
+
+// iframeRows builds the iframes CSV rows of the domain, matching each iframe with the TCF messages sniffed after
+// reload: the __tcfapiCall messages sent from its origin and the TC strings returned to it. Iframes holding cookies
+// or localStorage entries without having received a TC string are logged.
+func iframeRows(domain string, result scanResult) [][]string {
+	var rows [][]string
+	for _, frame := range result.Iframes {
+		calls := 0
+		tcString, eventStatus := "", ""
+		for _, m := range result.FrameMessages {
+			if m.Stage != "after reload" {
+				continue
+			}
+			if m.Kind == "call" && m.Origin == frame.Origin {
+				calls++
+			}
+			if m.Kind == "return" && m.TCString != "" && withoutFragment(m.Frame) == withoutFragment(frame.URL) {
+				tcString, eventStatus = m.TCString, m.EventStatus
+			}
+		}
+
+		matches := ""
+		if tcString != "" && result.APITCString != "" {
+			matches = fmt.Sprint(tcString == result.APITCString)
+		}
+		stores := len(frame.Cookies) > 0 || len(frame.LocalStorage) > 0
+		withoutSignal := stores && tcString == ""
+		if withoutSignal {
+			slog.Warn("Iframe stores data without receiving the TC string", "frame", frame.URL, "cookies", len(frame.Cookies), "localStorage", len(frame.LocalStorage), "calls", calls)
+		}
+
+		rows = append(rows, []string{domain, frame.URL, frame.Origin, strings.Join(frame.Cookies, " "), strings.Join(frame.LocalStorage, " "), frame.Error, strconv.Itoa(calls), eventStatus, tcString, matches, fmt.Sprint(withoutSignal)})
+	}
+	return rows
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Initial consent capture queries the TC string the CMP holds on initial load, before the consent is injected, and
+	// decodes what it grants. Consent granted before the user acted, i.e. pre-ticked by the CMP, is itself a violation
+	CaptureInitialConsent = false
+	InitialConsentFile    = "initial_consent.csv"
+
+	eventStatusUserAction = "useractioncomplete" // The event status of a TC string reflecting the user's choices.
+)
+
+// captureInitialConsent returns a chromedp Action which stores the TC string the CMP returns before the consent is
+// injected. It does nothing unless CaptureInitialConsent or VerifyCMPMetadata is set.
+func captureInitialConsent(tcString *string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CaptureInitialConsent && !VerifyCMPMetadata {
+			return nil
+		}
+		tcData, err := tcf.GetTCData(chromedpSession{ctx})
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error querying the initial TC string", "error", err)
+		}
+		*tcString = tcData.TCString
+		return nil
+	})
+}
+
+// initialConsentRow builds the initial consent CSV row of the domain, or nil if the page has no TCF API. The TC string
+// is pre-ticked if it grants consent while the event status shows the user has not acted. A TC string that is the one
+// pre-seeded by the crawler is decoded but never pre-ticked.
+func initialConsentRow(domain string, result scanResult) []string {
+	if result.TCFAPIMode == tcf.ModeNone {
+		return nil
+	}
+
+	var grants tcfaudit.Grants
+	decodeError := ""
+	if result.InitialTCString != "" {
+		var err error
+		if grants, err = tcfaudit.DecodeGrants(result.InitialTCString); err != nil {
+			decodeError = err.Error()
+		}
+	}
+	preTicked := grants.Consented() && result.EventStatusBeforeRL != eventStatusUserAction && result.InitialTCString != result.TCString
+	if preTicked {
+		slog.Warn("CMP granted consent before the user acted", "purposes", tcfaudit.CompactRanges(grants.Purposes), "vendors", len(grants.Vendors))
+	}
+
+	cmpID, cmpVersion := "", ""
+	if result.InitialTCString != "" && decodeError == "" {
+		cmpID, cmpVersion = strconv.Itoa(grants.CmpID), strconv.Itoa(grants.CmpVersion)
+	}
+	return []string{domain, result.EventStatusBeforeRL, result.InitialTCString, cmpID, cmpVersion, tcfaudit.CompactRanges(grants.Purposes), tcfaudit.CompactRanges(grants.PurposesLI), tcfaudit.CompactRanges(grants.SpecialFeatures), tcfaudit.CompactRanges(grants.Vendors), tcfaudit.CompactRanges(grants.VendorsLI), strconv.Itoa(len(grants.Vendors)), fmt.Sprint(preTicked), decodeError}
+}
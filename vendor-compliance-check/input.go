@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+)
+
+const (
+	// The entries to scan are read from DomainsFile by default, or with -input from another file, from stdin ("-") or
+	// from the URL of a list. Each entry is a domain, scanned at https://<domain>, or a URL with a scheme and possibly a
+	// path, scanned as is. Files may be CSV files with the entry in the first column, see options.go for the other
+	// columns, or plain text files with an entry per line. Lines starting with # are skipped.
+	// With -tranco-top N the top N domains of the Tranco list are scanned instead, or with -country also set, the top N
+	// origins of the Chrome UX Report list of that country, as Tranco has no per-country lists
+	TrancoListURL    = "https://tranco-list.eu/top-1m.csv.zip"                                                       // TrancoListURL specifies the zipped CSV of the current Tranco list, with rows of rank and domain.
+	CruxCountryURL   = "https://raw.githubusercontent.com/zakird/crux-top-lists/main/data/country/%s/current.csv.gz" // CruxCountryURL specifies the gzipped CSV of the Chrome UX Report top list of a country, with rows of origin and rank, %s being the lowercase country code.
+	FetchListTimeout = 5 * time.Minute                                                                               // FetchListTimeout specifies the maximum duration of downloading a list.
+
+	stdinInput = "-"
+)
+
+// unsafeFileChars matches the characters replaced in the file names of URL entries.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var (
+	inputFlag   = flag.String("input", "", "file, URL or - for stdin to read the domains or URLs to scan from, instead of DomainsFile")
+	trancoTop   = flag.Int("tranco-top", 0, "scan the top N domains of the Tranco list, or of the Chrome UX Report list of -country, instead of reading the domains")
+	countryFlag = flag.String("country", "", "two-letter country code of the Chrome UX Report list to take the -tranco-top origins from, e.g. NL")
+)
+
+// readDomains returns the entries to scan from the input selected by the flags, preprocessed, see preprocess.go. The
+// overrides of the rows of CSV inputs are recorded in domainOverrides.
+func readDomains() ([]string, error) {
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	return preprocessDomains(entries), nil
+}
+
+// readEntries returns the entries of the input selected by the flags.
+func readEntries() ([]string, error) {
+	switch {
+	case *trancoTop > 0 && *countryFlag != "":
+		return readTopList(fmt.Sprintf(CruxCountryURL, strings.ToLower(*countryFlag)), *trancoTop, cruxColumn)
+	case *trancoTop > 0:
+		return readTopList(TrancoListURL, *trancoTop, trancoColumn)
+	case *inputFlag == stdinInput:
+		return readDomainList(os.Stdin, "stdin")
+	case isURL(*inputFlag):
+		body, err := fetchList(*inputFlag)
+		if err != nil {
+			return nil, err
+		}
+		return readDomainList(bytes.NewReader(body), *inputFlag)
+	case *inputFlag != "":
+		return readDomainsFromFile(*inputFlag)
+	}
+	return readDomainsFromFile(DomainsFile)
+}
+
+// Columns of the entries in the top lists
+const (
+	trancoColumn = 1 // Tranco rows are rank,domain.
+	cruxColumn   = 0 // Chrome UX Report rows are origin,rank.
+)
+
+// readTopList downloads the top list, a zipped or gzipped CSV file sorted by rank, and returns the entries of its first
+// top rows.
+func readTopList(listURL string, top int, column int) ([]string, error) {
+	body, err := fetchList(listURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var list io.Reader = bytes.NewReader(body)
+	switch {
+	case strings.HasSuffix(listURL, ".zip"):
+		archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", listURL, err)
+		}
+		if len(archive.File) == 0 {
+			return nil, fmt.Errorf("reading %s: empty archive", listURL)
+		}
+		file, err := archive.File[0].Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", listURL, err)
+		}
+		defer file.Close()
+		list = file
+	case strings.HasSuffix(listURL, ".gz"):
+		gz, err := gzip.NewReader(list)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", listURL, err)
+		}
+		defer gz.Close()
+		list = gz
+	}
+
+	// The lists are read with a comma, whatever csvfile.Delimiter is set to
+	reader := csvfile.NewReader(list)
+	reader.Comma = ','
+	reader.FieldsPerRecord = -1
+
+	var domains []string
+	for len(domains) < top {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", listURL, err)
+		}
+		if len(row) <= column || row[column] == "origin" || row[column] == "domain" {
+			continue
+		}
+		domains = append(domains, row[column])
+	}
+	slog.Info("Read top list", "url", listURL, "entries", len(domains))
+	return domains, nil
+}
+
+// fetchList downloads the list at the URL.
+func fetchList(listURL string) ([]byte, error) {
+	client := &http.Client{Timeout: FetchListTimeout}
+	resp, err := client.Get(listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", listURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// isURL reports whether the entry is a URL with an HTTP(S) scheme rather than a domain.
+func isURL(entry string) bool {
+	return strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://")
+}
+
+// targetURL returns the URL at which the entry is scanned: the entry itself if it is a URL, its homepage otherwise.
+func targetURL(entry string) string {
+	if isURL(entry) {
+		return entry
+	}
+	return "https://" + entry
+}
+
+// entryHost returns the host scanned for the entry, under which its screenshots are saved.
+func entryHost(entry string) string {
+	if u, err := url.Parse(targetURL(entry)); err == nil {
+		return u.Host
+	}
+	return entry
+}
+
+// entryFileName returns the entry as a file name, e.g. of its log file, replacing the characters of URLs that are not
+// valid in file names.
+func entryFileName(entry string) string {
+	if !isURL(entry) {
+		return entry
+	}
+	return unsafeFileChars.ReplaceAllString(strings.SplitN(entry, "://", 2)[1], "_")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Framework is the consent framework whose consent string is generated and injected, see tcfaudit.Framework:
+	// tcfaudit.FrameworkTCFEU or tcfaudit.FrameworkTCFCanada. The Framework column of the output tags every row with it
+	Framework = tcfaudit.FrameworkTCFEU
+
+	// Framework detection records which of the registered frameworks the site's CMP implements on initial load, e.g.
+	// TCF Canada through GPP or the LGPD CMPs of Brazilian sites, so the same vendors can be audited across
+	// jurisdictions
+	DetectFrameworks = false
+	FrameworksFile   = "frameworks.csv"
+)
+
+// detectedFramework is a framework the site's CMP implements.
+type detectedFramework struct {
+	Name     string
+	Evidence string
+}
+
+// consentFramework returns the framework configured by Framework, stopping the run if it is unknown or has no consent
+// string to inject.
+func consentFramework() tcfaudit.Framework {
+	framework, err := tcfaudit.LookupFramework(Framework)
+	if err != nil {
+		fatal("Error looking up the consent framework", "error", err)
+	}
+	if _, err := framework.ConsentString(tcfaudit.RejectAll, tcfaudit.CMP{}); err != nil {
+		fatal("The consent framework cannot be injected", "framework", Framework, "error", err)
+	}
+	return framework
+}
+
+// consentString returns the consent string of the profile for the CMP in the configured framework.
+func consentString(profile tcfaudit.ConsentProfile, cmp tcfaudit.CMP) string {
+	consentString, _ := consentFramework().ConsentString(profile, cmp)
+	return consentString
+}
+
+// consentInjector returns the configured framework as a tcfaudit.Injector, if its CMPs are found, injected and read
+// back through it rather than through the TCF v2 API and the euconsent-v2 storage.
+func consentInjector() (tcfaudit.Injector, bool) {
+	injector, ok := consentFramework().(tcfaudit.Injector)
+	return injector, ok
+}
+
+// detectFrameworks returns a chromedp Action which stores the registered frameworks the site's CMP implements. It does
+// nothing unless DetectFrameworks is set.
+func detectFrameworks(detected *[]detectedFramework) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !DetectFrameworks {
+			return nil
+		}
+		for _, name := range tcfaudit.FrameworkNames() {
+			framework, _ := tcfaudit.LookupFramework(name)
+			found, evidence, err := framework.Detect(chromedpSession{ctx})
+			if err != nil {
+				logging.FromContext(ctx).Warn("Error detecting consent framework", "framework", name, "error", err)
+				continue
+			}
+			if found {
+				*detected = append(*detected, detectedFramework{Name: name, Evidence: evidence})
+			}
+		}
+		logging.FromContext(ctx).Info("Detected consent frameworks", "frameworks", *detected)
+		return nil
+	})
+}
+
+// frameworkRows builds the frameworks CSV rows, one per framework detected on the domain.
+func frameworkRows(domain string, result scanResult) [][]string {
+	var rows [][]string
+	for _, framework := range result.Frameworks {
+		rows = append(rows, []string{domain, framework.Name, framework.Evidence, Framework})
+	}
+	return rows
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Logging configuration
+	LogLevel      = slog.LevelInfo // LogLevel specifies the minimum level of the records logged, slog.LevelDebug includes the proxy and chromedp output.
+	LogJSON       = false          // LogJSON switches the log output from text to JSON lines.
+	PerDomainLogs = false          // PerDomainLogs additionally writes the records logged while processing a domain to <LogDir>/<domain>.log, compressed according to outfile.Compression.
+	LogDir        = "logs"
+)
+
+// logConfig holds the logging constants.
+var logConfig = logging.Config{Level: LogLevel, JSON: LogJSON, PerDomain: PerDomainLogs, Dir: LogDir}
+
+// newLogHandler returns a log handler writing records to w in the configured format.
+func newLogHandler(w io.Writer) slog.Handler {
+	return logConfig.NewHandler(w)
+}
+
+// setupLogging installs the default logger, which writes to stderr.
+func setupLogging() {
+	logConfig.Setup()
+}
+
+// startDomainLogging returns a logger tagging every record with the given domain and, if PerDomainLogs is set, also
+// writing it to the domain's log file, for the scan of the domain to log through, see logging.NewContext. The returned
+// function closes the log file.
+func startDomainLogging(domain string) (*slog.Logger, func()) {
+	return logConfig.ForDomain(domain, entryFileName(domain))
+}
+
+// chromedpLogf returns a function forwarding chromedp's log output to the context's logger at debug level.
+func chromedpLogf(ctx context.Context) func(string, ...interface{}) {
+	logger := logging.FromContext(ctx)
+	return func(format string, args ...interface{}) {
+		logger.Debug(fmt.Sprintf(format, args...), "source", "chromedp")
+	}
+}
+
+// fatal logs an error and exits the program.
+func fatal(msg string, args ...interface{}) {
+	stopProgress()
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
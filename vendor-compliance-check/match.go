@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/gvl"
+)
+
+const (
+	// The cookies of each domain can be matched against the GVL as they are captured, writing the matched, partial
+	// match and unmatched results of reference-gvl.go without handing OutputFile over to it. Set MatchGVL to the
+	// gvl_data.csv written by gvl-to-csv.go to do so, or to its gvl_data.db store for the matched results to cite the
+	// disclosure entry that matched; the other checks of reference-gvl.go, such as the purpose violations and web
+	// storage identifiers, still need a run of it
+	MatchGVL             = ""
+	MatchedResultsFile   = "matched_results.csv"
+	PartialMatchFile     = "partial_match_results.csv"
+	UnmatchedResultsFile = "unmatched_results.csv"
+)
+
+// gvlMatcher matches the cookies of each domain against the GVL loaded from MatchGVL.
+type gvlMatcher struct {
+	index     *gvl.Index
+	matched   *csvOutput
+	partial   *csvOutput
+	unmatched *csvOutput
+}
+
+// newGVLMatcher loads the GVL CSV or store from MatchGVL and opens the results files, which have no header, like those of
+// reference-gvl.go.
+func newGVLMatcher() *gvlMatcher {
+	g, err := gvl.Load(MatchGVL)
+	if err != nil {
+		fatal("Error reading GVL", "file", MatchGVL, "error", err)
+	}
+
+	currentRun.GVLVersion = g.Version()
+
+	m := &gvlMatcher{index: g.Index(gvl.CookieColumns)}
+	for _, output := range []struct {
+		name   string
+		output **csvOutput
+	}{{MatchedResultsFile, &m.matched}, {PartialMatchFile, &m.partial}, {UnmatchedResultsFile, &m.unmatched}} {
+		if *output.output, err = openCSVOutput(output.name, nil); err != nil {
+			fatal("Error opening GVL results file", "file", output.name, "error", err)
+		}
+	}
+	return m
+}
+
+// write matches the non-expired cookies of the domain and writes each to the matched, partial match or unmatched
+// results.
+func (m *gvlMatcher) write(domain string, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		if isCookieExpired(c) {
+			continue
+		}
+		name, cookieDomain := strings.ReplaceAll(c.Name, " ", ""), strings.ReplaceAll(c.Domain, " ", "")
+
+		match := m.index.Match(name, cookieDomain)
+		switch {
+		case match.Vendor != nil:
+			m.matched.Write([]string{domain, match.Vendor[gvl.NameColumn], match.Vendor[gvl.IDColumn], match.Vendor[gvl.PurposesColumn], name, cookieDomain, match.Vendor[gvl.CookieColumns.Purposes], "cookie", match.Kind, match.Confidence, match.Citation()})
+		case match.Partial != nil:
+			m.partial.Write([]string{domain, match.Partial[gvl.NameColumn], match.Partial[gvl.IDColumn], match.Partial[gvl.PurposesColumn], name, cookieDomain, "cookie"})
+		default:
+			m.unmatched.Write([]string{domain, name, cookieDomain, "cookie"})
+		}
+	}
+}
+
+// vendorOf returns the vendor disclosing the cookie, as name (ID), or an empty string if none does.
+func (m *gvlMatcher) vendorOf(c *http.Cookie) string {
+	match := m.index.Match(strings.ReplaceAll(c.Name, " ", ""), strings.ReplaceAll(c.Domain, " ", ""))
+	if match.Vendor == nil {
+		return ""
+	}
+	return match.Vendor[gvl.NameColumn] + " (" + match.Vendor[gvl.IDColumn] + ")"
+}
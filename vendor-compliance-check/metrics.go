@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// MetricsAddr specifies the address on which the Prometheus /metrics endpoint is served, e.g. ":9090". It is disabled when empty.
+	MetricsAddr = ""
+
+	metricsPrefix = "vendor_compliance_"
+)
+
+// scanMetrics holds the counters reported on the /metrics endpoint.
+type scanMetrics struct {
+	domainsProcessed atomic.Int64
+	tcfAPIFound      atomic.Int64
+	cookiesCaptured  atomic.Int64
+	proxyRequests    atomic.Int64
+	politenessWaits  atomic.Int64
+	pageLoads        atomic.Int64
+	pageLoadNanos    atomic.Int64
+	tcfReady         atomic.Int64
+	tcfReadyNanos    atomic.Int64
+
+	mu       sync.Mutex
+	failures map[string]int64
+}
+
+// metrics is the process wide set of counters, which is updated whether or not the endpoint is served.
+var metrics = &scanMetrics{failures: map[string]int64{}}
+
+// recordFailure counts a failure under the given category.
+func (m *scanMetrics) recordFailure(category string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[category]++
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format.
+func (m *scanMetrics) writeTo(w io.Writer) {
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s counter\n%s%s %d\n", metricsPrefix, name, help, metricsPrefix, name, metricsPrefix, name, value)
+	}
+
+	processed := m.domainsProcessed.Load()
+	found := m.tcfAPIFound.Load()
+	counter("domains_processed_total", "Number of domains processed.", processed)
+	counter("tcf_api_found_total", "Number of domains on which the TCF API was found.", found)
+	counter("cookies_captured_total", "Number of non-expired third party cookies written to the output.", m.cookiesCaptured.Load())
+	counter("proxy_requests_total", "Number of requests handled by the proxy.", m.proxyRequests.Load())
+	counter("politeness_waits_total", "Number of requests the proxy held back to keep to -request-delay.", m.politenessWaits.Load())
+
+	ratio := 0.0
+	if processed > 0 {
+		ratio = float64(found) / float64(processed)
+	}
+	fmt.Fprintf(w, "# HELP %stcf_api_found_ratio Share of processed domains on which the TCF API was found.\n# TYPE %stcf_api_found_ratio gauge\n%stcf_api_found_ratio %g\n", metricsPrefix, metricsPrefix, metricsPrefix, ratio)
+
+	fmt.Fprintf(w, "# HELP %spage_load_seconds Time taken to navigate to a domain's homepage.\n# TYPE %spage_load_seconds summary\n", metricsPrefix, metricsPrefix)
+	fmt.Fprintf(w, "%spage_load_seconds_sum %g\n%spage_load_seconds_count %d\n", metricsPrefix, time.Duration(m.pageLoadNanos.Load()).Seconds(), metricsPrefix, m.pageLoads.Load())
+
+	fmt.Fprintf(w, "# HELP %stcf_api_ready_seconds Time taken by the TCF API to report a CMP ID after a page load.\n# TYPE %stcf_api_ready_seconds summary\n", metricsPrefix, metricsPrefix)
+	fmt.Fprintf(w, "%stcf_api_ready_seconds_sum %g\n%stcf_api_ready_seconds_count %d\n", metricsPrefix, time.Duration(m.tcfReadyNanos.Load()).Seconds(), metricsPrefix, m.tcfReady.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	categories := make([]string, 0, len(m.failures))
+	for category := range m.failures {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	fmt.Fprintf(w, "# HELP %sfailures_total Number of failures by category.\n# TYPE %sfailures_total counter\n", metricsPrefix, metricsPrefix)
+	for _, category := range categories {
+		fmt.Fprintf(w, "%sfailures_total{category=%q} %d\n", metricsPrefix, category, m.failures[category])
+	}
+}
+
+// serveMetrics serves the /metrics endpoint on MetricsAddr in a separate goroutine.
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(MetricsAddr, mux); err != nil {
+			slog.Error("Error serving metrics", "addr", MetricsAddr, "error", err)
+		}
+	}()
+}
+
+// timedNavigate returns a chromedp Action which navigates to the given URL and records how long the page took to load.
+func timedNavigate(targetURL string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		start := time.Now()
+		if err := chromedp.Navigate(targetURL).Do(ctx); err != nil {
+			return &navigationError{err}
+		}
+		metrics.pageLoads.Add(1)
+		metrics.pageLoadNanos.Add(int64(time.Since(start)))
+		return nil
+	})
+}
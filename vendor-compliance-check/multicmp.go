@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+const (
+	// Multiple CMP detection flags the domains loading more than one CMP, whose TC strings depend on which CMP answers
+	// first and differ from run to run: on initial load and after reload, the page is checked for the TCF v1 __cmp
+	// API or its __cmpLocator frame, for more than one __tcfapiLocator frame, each CMP stub adding its own, and the
+	// CMP is pinged CMPIDSamples times to catch a cmpId that changes between calls or between the two stages
+	DetectMultipleCMPs  = false
+	MultipleCMPsFile    = "multiple_cmps.csv"
+	CMPIDSamples        = 3                      // CMPIDSamples specifies the number of pings per stage.
+	CMPIDSampleInterval = 500 * time.Millisecond // CMPIDSampleInterval specifies the time between the pings of a stage.
+
+	// JavaScript returning whether the page has the TCF v1 __cmp API, and the number of __cmpLocator and
+	// __tcfapiLocator frames in the page and the frames of its origin.
+	cmpPresenceJS = `
+			(() => {
+				const count = (doc, name) => {
+					let n = doc.querySelectorAll('iframe[name="' + name + '"]').length;
+					for (const frame of doc.querySelectorAll('iframe')) {
+						try {
+							if (frame.contentDocument) {
+								n += count(frame.contentDocument, name);
+							}
+						} catch (e) {}
+					}
+					return n;
+				};
+				return {
+					cmpV1: typeof window.__cmp === 'function',
+					v1Locators: count(document, '__cmpLocator'),
+					locators: count(document, '__tcfapiLocator'),
+				};
+			})()
+		`
+)
+
+// cmpPresence is the CMPs found on the page at a stage of the scan.
+type cmpPresence struct {
+	Stage      string `json:"-"`
+	CMPv1      bool   `json:"cmpV1"`      // CMPv1 reports whether the page has the TCF v1 __cmp API.
+	V1Locators int    `json:"v1Locators"` // V1Locators is the number of __cmpLocator frames.
+	Locators   int    `json:"locators"`   // Locators is the number of __tcfapiLocator frames.
+	CMPIDs     []int  `json:"-"`          // CMPIDs are the distinct cmpIds the pings answered, in the order they were first answered.
+}
+
+// detectCMPs returns a chromedp Action which stores the CMPs found on the current page at the stage. It does nothing
+// unless DetectMultipleCMPs is set.
+func detectCMPs(stage string, presence *[]cmpPresence) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !DetectMultipleCMPs {
+			return nil
+		}
+		p := cmpPresence{Stage: stage}
+		if err := chromedp.Evaluate(cmpPresenceJS, &p).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error detecting the CMPs of the page", "stage", stage, "error", err)
+		}
+		for i := 0; i < CMPIDSamples; i++ {
+			if i > 0 {
+				if err := chromedp.Sleep(CMPIDSampleInterval).Do(ctx); err != nil {
+					return err
+				}
+			}
+			ping, err := tcf.GetPing(chromedpSession{ctx})
+			if err != nil {
+				logging.FromContext(ctx).Warn("Error pinging the CMP", "stage", stage, "error", err)
+				continue
+			}
+			if ping.CmpID != 0 && !containsInt(p.CMPIDs, ping.CmpID) {
+				p.CMPIDs = append(p.CMPIDs, ping.CmpID)
+			}
+		}
+		if p.CMPv1 || p.V1Locators > 0 || p.Locators > 1 || len(p.CMPIDs) > 1 {
+			logging.FromContext(ctx).Warn("Page loads more than one CMP", "stage", stage, "cmpV1", p.CMPv1 || p.V1Locators > 0, "locators", p.Locators, "cmpIds", formatInts(p.CMPIDs))
+		}
+		*presence = append(*presence, p)
+		return nil
+	})
+}
+
+// cmpConflicts returns the signs of more than one CMP found across the stages of the scan.
+func cmpConflicts(presence []cmpPresence) []string {
+	var conflicts, ids []string
+	seen := map[int]bool{}
+	for _, p := range presence {
+		if p.CMPv1 || p.V1Locators > 0 {
+			conflicts = append(conflicts, "TCF v1 __cmp API on "+p.Stage)
+		}
+		if p.Locators > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%d __tcfapiLocator frames on %s", p.Locators, p.Stage))
+		}
+		for _, id := range p.CMPIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, strconv.Itoa(id))
+			}
+		}
+	}
+	if len(ids) > 1 {
+		conflicts = append(conflicts, "cmpId changed: "+strings.Join(ids, " -> "))
+	}
+	return conflicts
+}
+
+// multipleCMPsRow builds the multiple CMPs CSV row of the domain, or nil if the CMPs were not detected.
+func multipleCMPsRow(domain string, result scanResult) []string {
+	if len(result.CMPPresence) == 0 {
+		return nil
+	}
+	cmpV1, v1Locators, locators := false, 0, 0
+	ids := map[string]string{}
+	for _, p := range result.CMPPresence {
+		cmpV1 = cmpV1 || p.CMPv1
+		v1Locators, locators = max(v1Locators, p.V1Locators), max(locators, p.Locators)
+		ids[p.Stage] = formatInts(p.CMPIDs)
+	}
+	conflicts := cmpConflicts(result.CMPPresence)
+	return []string{
+		domain,
+		result.TCFAPIMode,
+		strconv.FormatBool(cmpV1),
+		strconv.Itoa(v1Locators),
+		strconv.Itoa(locators),
+		ids[stageInitialLoad],
+		ids[stageAfterReload],
+		strconv.FormatBool(len(conflicts) > 0),
+		strings.Join(conflicts, "; "),
+	}
+}
+
+// containsInt reports whether the IDs contain id.
+func containsInt(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// formatInts formats the IDs as a comma separated list.
+func formatInts(ids []int) string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = strconv.Itoa(id)
+	}
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/elazarl/goproxy"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// The JavaScript-disabled visit loads the homepage once more, in a new browser context without scripts, after the
+	// scan. The third party cookies set during it are set by servers regardless of any CMP, a baseline separating
+	// server-side tracking from tracking by scripts the CMP could have held back
+	VisitWithoutJS = false // VisitWithoutJS records the third party cookies set with JavaScript disabled in nojs_cookies.csv.
+	NoJSFile       = "nojs_cookies.csv"
+	NoJSWait       = 3 * time.Second // NoJSWait specifies how long to wait after load for the requests of images and iframes to complete.
+
+	// noJSHeader tags the requests of the visit, so the proxy attributes their cookies to it rather than to the scan,
+	// whose tab may still be loading. The proxy removes it before forwarding the request.
+	noJSHeader = "X-Vendor-Compliance-No-JS"
+)
+
+// noJSRequest is the user data of the proxy context of a request of the JavaScript-disabled visit.
+type noJSRequest struct{}
+
+// tagNoJSRequest removes the header tagging requests of the JavaScript-disabled visit from the request, and marks the
+// proxy context of the request if it was set.
+func tagNoJSRequest(req *http.Request, ctx *goproxy.ProxyCtx) {
+	if req.Header.Get(noJSHeader) == "" {
+		return
+	}
+	req.Header.Del(noJSHeader)
+	ctx.UserData = noJSRequest{}
+}
+
+// isNoJSResponse reports whether the response answers a request of the JavaScript-disabled visit.
+func isNoJSResponse(ctx *goproxy.ProxyCtx) bool {
+	_, ok := ctx.UserData.(noJSRequest)
+	return ok
+}
+
+// visitWithoutJS loads the target URL in a new tab in its own browser context, so no cookies of the scan are sent,
+// with script execution disabled, for at most the domain's timeout. The cookies are captured by the proxy like those of
+// the scan.
+func visitWithoutJS(ctx context.Context, targetURL string, timeout time.Duration) {
+	tabCtx, cancelTab := chromedp.NewContext(ctx, newBrowserContext(ctx))
+	defer cancelTab()
+	timeoutCtx, cancel := context.WithTimeout(tabCtx, timeout)
+	defer cancel()
+
+	err := chromedp.Run(timeoutCtx,
+		emulation.SetScriptExecutionDisabled(true),
+		emulateDevice(),
+		network.Enable(),
+		network.SetExtraHTTPHeaders(network.Headers{noJSHeader: "1"}),
+		chromedp.Navigate(targetURL),
+		chromedp.Sleep(NoJSWait),
+	)
+	if err != nil {
+		logging.FromContext(ctx).Error("Encountered an error visiting with JavaScript disabled", "error", err)
+		metrics.recordFailure(classifyError(err))
+	}
+}
+
+// containsCookie reports whether a cookie with the same domain and name as the given one is in cookies.
+func containsCookie(cookies []*http.Cookie, cookie *http.Cookie) bool {
+	for _, c := range cookies {
+		if cookieKey(c) == cookieKey(cookie) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverSetColumn returns the value of the Set Without JavaScript column of the output for the cookie, which is empty
+// unless VisitWithoutJS is set.
+func serverSetColumn(cookie *http.Cookie, result scanResult) string {
+	if !VisitWithoutJS {
+		return ""
+	}
+	return fmt.Sprint(containsCookie(result.ServerCookies, cookie))
+}
+
+// noJSRows builds the JavaScript-disabled CSV rows for the non-expired cookies set during the visit, noting whether
+// each was also set during the scan.
+func noJSRows(domain string, cookies []*http.Cookie, serverCookies []*http.Cookie) [][]string {
+	var rows [][]string
+	for _, c := range serverCookies {
+		if !isCookieExpired(c) {
+			rows = append(rows, []string{domain, c.Domain, c.Name, c.Value, c.Path, c.Expires.Format(time.RFC1123), fmt.Sprint(containsCookie(cookies, c))})
+		}
+	}
+	return rows
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/notify"
+)
+
+// domainFindings returns the findings of the scan of the domain to notify: the third party cookies set under the
+// reject-all profile of ReturningUserMode, and the TC string the CMP returned after reload if it changed the consent
+// or legitimate interest the injected one granted to purposes or vendors. Cookies are attributed to vendors if MatchGVL is set.
+func domainFindings(domain string, cookies []*http.Cookie, result scanResult, matcher *gvlMatcher) []notify.Finding {
+	var findings []notify.Finding
+	if result.ReturningUser {
+		for _, c := range cookies {
+			if isCookieExpired(c) || result.CookieParties[cookieKey(c)] != partyThird {
+				continue
+			}
+			finding := notify.Finding{Kind: notify.FindingRejectAllCookies, Tool: StateTool, Domain: domain, Time: result.CookieTimes[cookieKey(c)]}
+			finding.Evidence = fmt.Sprintf("%s=%s on %s, set by %s on %s", c.Name, c.Value, c.Domain, result.CookieURLs[cookieKey(c)], result.CookiePages[cookieKey(c)])
+			if matcher != nil {
+				finding.Vendor = matcher.vendorOf(c)
+			}
+			findings = append(findings, finding)
+		}
+	}
+
+	// Only changed purpose and vendor grants count, as CMPs rewrite their metadata as a matter of course, and strings
+	// that could not be compared are a CMP error rather than a mismatch
+	if result.APITCString != "" {
+		if diff := consentDiff(result.TCString, result.APITCString); diff.GrantsChanged() {
+			findings = append(findings, notify.Finding{Kind: notify.FindingTCStringMismatch, Tool: StateTool, Domain: domain, Evidence: diff.Summary(), Time: result.InjectedAt})
+		}
+	}
+	return findings
+}
+
+// notifyFindings posts the findings of the scan of the domain to the webhooks configured in notify.Webhooks. Errors
+// are logged.
+func notifyFindings(domain string, cookies []*http.Cookie, result scanResult, matcher *gvlMatcher) {
+	findings := domainFindings(domain, cookies, result, matcher)
+	if len(findings) == 0 {
+		return
+	}
+	slog.Info("Notifying findings", "findings", len(findings))
+	if err := notify.Send(findings); err != nil {
+		slog.Error("Error notifying findings", "error", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Columns of the domains file after the domain, which override the run's settings for the domain when not empty,
+// e.g. "shop.example,120s,returning-user" gives a heavy site twice the default RunTimeout
+const (
+	timeoutColumn = 1 // timeoutColumn holds the domain's run timeout, as a duration such as 90s or a number of seconds.
+	profileColumn = 2 // profileColumn holds the profile the domain is scanned with, profileDefault or profileReturningUser.
+)
+
+var (
+	runTimeout = flag.Duration("run-timeout", RunTimeout, "maximum duration of the scan of a single domain, unless overridden by the domain's row of the domains file")
+	tcfTimeout = flag.Duration("tcf-timeout", TCFTimeOut, "maximum duration to wait for the TCF API to become available")
+)
+
+// scanOptions are the settings a domain is scanned with.
+type scanOptions struct {
+	Timeout       time.Duration `json:"timeout"`       // Timeout is the maximum duration of running chromedp for the domain, see RunTimeout.
+	ReturningUser bool          `json:"returningUser"` // ReturningUser pre-seeds a reject-all decision before the first load, see ReturningUserMode.
+	Rescan        bool          `json:"-"`             // Rescan skips the evidence and screenshots, keeping those of the first scan, see RescanPercent.
+}
+
+// domainOverrides holds the options of the domains whose row of the domains file, or lease, overrides the run's.
+var domainOverrides = map[string]scanOptions{}
+
+// defaultScanOptions returns the run's options, set by the constants and the -run-timeout flag.
+func defaultScanOptions() scanOptions {
+	return scanOptions{Timeout: *runTimeout, ReturningUser: ReturningUserMode}
+}
+
+// optionsFor returns the options the domain is scanned with.
+func optionsFor(domain string) scanOptions {
+	if options, found := domainOverrides[domain]; found {
+		return options
+	}
+	return defaultScanOptions()
+}
+
+// parseOverrides returns the options of the domain's row of the domains file, and whether the row overrides any of the
+// run's options.
+func parseOverrides(row []string) (scanOptions, bool, error) {
+	options := defaultScanOptions()
+	overridden := false
+
+	if len(row) > timeoutColumn && strings.TrimSpace(row[timeoutColumn]) != "" {
+		timeout, err := parseTimeout(strings.TrimSpace(row[timeoutColumn]))
+		if err != nil {
+			return options, false, err
+		}
+		options.Timeout = timeout
+		overridden = true
+	}
+
+	if len(row) > profileColumn && strings.TrimSpace(row[profileColumn]) != "" {
+		switch profile := strings.TrimSpace(row[profileColumn]); profile {
+		case profileDefault:
+			options.ReturningUser = false
+		case profileReturningUser:
+			options.ReturningUser = true
+		default:
+			return options, false, fmt.Errorf("unknown profile %q, use %q or %q", profile, profileDefault, profileReturningUser)
+		}
+		overridden = true
+	}
+	return options, overridden, nil
+}
+
+// parseTimeout parses a timeout given as a duration, e.g. 90s or 2m, or as a number of seconds.
+func parseTimeout(value string) (time.Duration, error) {
+	duration := value
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		duration = fmt.Sprintf("%gs", seconds)
+	}
+	timeout, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", value, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: not positive", value)
+	}
+	return timeout, nil
+}
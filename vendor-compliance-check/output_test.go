@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSVOutput(t *testing.T) {
+	header := []string{"Website", "Cookies"}
+	tests := []struct {
+		name       string
+		existing   string // existing is the content of the file before it is opened, none if empty.
+		provenance bool
+		rows       [][]string
+		want       string
+		movedAside string // movedAside is the content of the file moved aside, none if empty.
+	}{
+		{name: "new file", rows: [][]string{{"a.com", "2"}}, want: "Website,Cookies\na.com,2\n"},
+		{name: "appended", existing: "Website,Cookies\na.com,2\n", rows: [][]string{{"b.com", "0"}}, want: "Website,Cookies\na.com,2\nb.com,0\n"},
+		{name: "columns added", existing: "Website\na.com\n", rows: [][]string{{"b.com", "0"}}, want: "Website,Cookies\na.com,\nb.com,0\n"},
+		{name: "header changed", existing: "Domain,Count\na.com,2\n", rows: [][]string{{"b.com", "0"}},
+			want: "Website,Cookies\nb.com,0\n", movedAside: "Domain,Count\na.com,2\n"},
+		{name: "provenance", provenance: true, rows: [][]string{{"a.com", "2"}, {"b.com", "0", "v1", "", "accept-all", "hash"}},
+			want: "Website,Cookies,Tool Version,GVL Version,Consent Profile,Config Hash\na.com,2,v1,,accept-all,hash\nb.com,0,v1,,accept-all,hash\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Cleanup(func() { outputs = nil })
+			*provenanceFlag = tt.provenance
+			t.Cleanup(func() { *provenanceFlag = EmbedProvenance })
+			currentRun = runRecord{Provenance: Provenance{ToolVersion: "v1", ConsentProfile: "accept-all", ConfigHash: "hash"}}
+			if tt.existing != "" {
+				if err := os.WriteFile("out.csv", []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			output, err := openCSVOutput("out.csv", header)
+			if err != nil {
+				t.Fatalf("openCSVOutput() error = %v", err)
+			}
+			for _, row := range tt.rows {
+				if err := output.Write(row); err != nil {
+					t.Fatalf("Write(%q) error = %v", row, err)
+				}
+			}
+			if err := output.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if got, _ := os.ReadFile("out.csv"); string(got) != tt.want {
+				t.Errorf("out.csv = %q, want %q", got, tt.want)
+			}
+			aside, _ := filepath.Glob("out.*.csv")
+			switch {
+			case tt.movedAside == "" && len(aside) > 0:
+				t.Errorf("moved aside %v, want none", aside)
+			case tt.movedAside != "" && len(aside) != 1:
+				t.Errorf("moved aside %v, want one file", aside)
+			case tt.movedAside != "":
+				if got, _ := os.ReadFile(aside[0]); string(got) != tt.movedAside {
+					t.Errorf("%s = %q, want %q", aside[0], got, tt.movedAside)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// Cookies and requests are classified relative to the registrable domain (eTLD+1) of the scanned site, so that
+	// subdomains of the site are first party and unrelated hosts merely containing its name are not
+	ResolveCNAMEs = true            // ResolveCNAMEs resolves the site's subdomains, classifying those that are CNAMEs to another site as first-party-set.
+	CNAMETimeout  = 2 * time.Second // CNAMETimeout specifies the maximum duration of a single CNAME lookup.
+	LogRequests   = false           // LogRequests records every request sent while scanning, with its classification, in requests.csv.
+	RequestsFile  = "requests.csv"
+)
+
+// Classes of a request or cookie relative to the scanned site
+const (
+	partyFirst    = "first-party"     // The host is part of the site.
+	partyFirstSet = "first-party-set" // The host is a subdomain of the site, but a CNAME to another site, i.e. CNAME-cloaked.
+	partyThird    = "third-party"     // The host is part of another site.
+)
+
+// registrableDomain returns the eTLD+1 of the host, or the host itself if it is an IP address or has none.
+func registrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// partyClassifier classifies hosts relative to the site of a target URL, caching the CNAMEs it resolves.
+type partyClassifier struct {
+	site string
+
+	mu     sync.Mutex
+	cnames map[string]string
+}
+
+// newPartyClassifier returns a classifier for the site of targetURL.
+func newPartyClassifier(targetURL string) *partyClassifier {
+	site := targetURL
+	if u, err := url.Parse(targetURL); err == nil {
+		site = u.Hostname()
+	}
+	return &partyClassifier{site: registrableDomain(site), cnames: map[string]string{}}
+}
+
+// classify returns the class of the host, and the canonical name it resolves to if it is a CNAME to another site.
+func (p *partyClassifier) classify(host string) (string, string) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if registrableDomain(host) != p.site {
+		return partyThird, ""
+	}
+	if !ResolveCNAMEs || host == p.site || host == "www."+p.site {
+		return partyFirst, ""
+	}
+
+	if cname := p.cname(host); cname != "" && registrableDomain(cname) != p.site {
+		return partyFirstSet, cname
+	}
+	return partyFirst, ""
+}
+
+// cname returns the canonical name of the host, or an empty string if it has none or the lookup fails.
+func (p *partyClassifier) cname(host string) string {
+	p.mu.Lock()
+	cname, found := p.cnames[host]
+	p.mu.Unlock()
+	if found {
+		return cname
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CNAMETimeout)
+	defer cancel()
+	if resolved, err := net.DefaultResolver.LookupCNAME(ctx, host); err == nil && strings.TrimSuffix(resolved, ".") != host {
+		cname = strings.TrimSuffix(resolved, ".")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cnames[host] = cname
+	return cname
+}
+
+// requestRecord is a request sent while scanning a domain, classified relative to the domain's site.
+type requestRecord struct {
+	URL   string // URL is the request URL without its query.
+	Page  string
+	Party string
+	CNAME string
+}
+
+// requestLog collects the requests seen by the proxy.
+type requestLog struct {
+	mu       sync.Mutex
+	requests []requestRecord
+}
+
+// add records a request.
+func (l *requestLog) add(request requestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests = append(l.requests, request)
+}
+
+// get returns the requests recorded so far.
+func (l *requestLog) get() []requestRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]requestRecord(nil), l.requests...)
+}
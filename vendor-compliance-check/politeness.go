@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	// Politeness controls keep large crawls from overloading the sites and getting the crawler's IP blocklisted: the
+	// proxy waits RequestDelay between the requests it forwards to the same host and forwards at most HostConnections
+	// of them at a time, with -robots the domains whose robots.txt disallows the scanned page for the crawler are
+	// skipped and their disallowed sub-pages left out, and -identify appends a product token, e.g.
+	// "IAB-vendor-compliance/1.0 (+https://example.org/study)", to the user agent of the browser or device preset, so
+	// the sites can tell who is crawling them while serving the page as they would to the browser
+	RequestDelay    = 0 * time.Millisecond // RequestDelay specifies the default of -request-delay, the minimum time between two requests to the same host.
+	HostConnections = 0                    // HostConnections specifies the default of -host-connections, the maximum number of concurrent requests per host, 0 for no limit.
+	RespectRobots   = false                // RespectRobots specifies the default of -robots.
+	CrawlerToken    = ""                   // CrawlerToken specifies the default of -identify, the product token appended to the user agent.
+	RobotsTimeout   = 10 * time.Second     // RobotsTimeout specifies the maximum duration of fetching a robots.txt.
+
+	robotsMaxBytes = 500 << 10               // robotsMaxBytes caps the size of a robots.txt read, as Google does.
+	robotsAgent    = "IAB-vendor-compliance" // robotsAgent is the agent matched against the robots.txt groups if -identify is not set.
+)
+
+var (
+	requestDelayFlag    = flag.Duration("request-delay", RequestDelay, "minimum time between two requests the proxy forwards to the same host, e.g. 250ms")
+	hostConnectionsFlag = flag.Int("host-connections", HostConnections, "maximum number of concurrent requests the proxy forwards to the same host, 0 for no limit")
+	robotsFlag          = flag.Bool("robots", RespectRobots, "skip the domains whose robots.txt disallows the scanned page, and leave out their disallowed sub-pages")
+	identifyFlag        = flag.String("identify", CrawlerToken, "product token appended to the user agent, e.g. \"IAB-vendor-compliance/1.0 (+https://example.org/study)\"")
+)
+
+// hostLimits spaces and caps the requests the proxy forwards to each host, across the proxies of all scans.
+var hostLimits = struct {
+	sync.Mutex
+	next  map[string]time.Time     // next holds the time from which the next request to each host may be sent.
+	slots map[string]chan struct{} // slots holds a semaphore of -host-connections per host.
+}{next: map[string]time.Time{}, slots: map[string]chan struct{}{}}
+
+// politenessEnabled reports whether the proxy limits the requests per host.
+func politenessEnabled() bool {
+	return *requestDelayFlag > 0 || *hostConnectionsFlag > 0
+}
+
+// politeRoundTripper returns the RoundTripper forwarding the proxy's requests within the limits of -request-delay and
+// -host-connections.
+func politeRoundTripper() goproxy.RoundTripper {
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		release, err := waitForHost(req.Context(), req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return ctx.Proxy.Tr.RoundTrip(req)
+	})
+}
+
+// waitForHost blocks until a request may be sent to the host, returning the function to call once it is answered.
+func waitForHost(ctx context.Context, host string) (func(), error) {
+	release := func() {}
+	if *hostConnectionsFlag > 0 {
+		hostLimits.Lock()
+		slots, ok := hostLimits.slots[host]
+		if !ok {
+			slots = make(chan struct{}, *hostConnectionsFlag)
+			hostLimits.slots[host] = slots
+		}
+		hostLimits.Unlock()
+		select {
+		case slots <- struct{}{}:
+			release = func() { <-slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if *requestDelayFlag > 0 {
+		// Reserve the next free time of the host, so concurrent requests are spaced as well
+		hostLimits.Lock()
+		now := time.Now()
+		at := hostLimits.next[host]
+		if at.Before(now) {
+			at = now
+		}
+		hostLimits.next[host] = at.Add(*requestDelayFlag)
+		hostLimits.Unlock()
+
+		if wait := at.Sub(now); wait > 0 {
+			metrics.politenessWaits.Add(1)
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// identifyCrawler returns a chromedp Action which appends the -identify token to the user agent of the browser. It
+// does nothing unless -identify is set. Device presets append it to their own user agent instead, see emulateDevice.
+func identifyCrawler() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if *identifyFlag == "" {
+			return nil
+		}
+		_, _, _, userAgent, _, err := browser.GetVersion().Do(ctx)
+		if err != nil {
+			return fmt.Errorf("getting the user agent: %w", err)
+		}
+		return emulation.SetUserAgentOverride(identifiedUserAgent(userAgent)).Do(ctx)
+	})
+}
+
+// identifiedUserAgent returns the user agent with the -identify token appended, or unchanged if it is not set.
+func identifiedUserAgent(userAgent string) string {
+	if *identifyFlag == "" {
+		return userAgent
+	}
+	return userAgent + " " + *identifyFlag
+}
+
+// robotsRules are the rules of the robots.txt group applying to the crawler.
+type robotsRules struct {
+	allow    []string
+	disallow []string
+}
+
+// robotsCache holds the rules of the robots.txt of each origin fetched, nil for origins without one.
+var robotsCache = struct {
+	sync.Mutex
+	rules map[string]*robotsRules
+}{rules: map[string]*robotsRules{}}
+
+// robotsAllowed reports whether the robots.txt of the page's origin lets the crawler visit it. Pages are allowed
+// unless -robots is set, and if the robots.txt cannot be read, as crawlers treat a missing robots.txt.
+func robotsAllowed(page string) bool {
+	if !*robotsFlag {
+		return true
+	}
+	u, err := url.Parse(page)
+	if err != nil {
+		return true
+	}
+	origin := u.Scheme + "://" + u.Host
+
+	robotsCache.Lock()
+	rules, ok := robotsCache.rules[origin]
+	robotsCache.Unlock()
+	if !ok {
+		rules, err = fetchRobots(origin)
+		if err != nil {
+			slog.Info("Error reading robots.txt", "origin", origin, "error", err)
+		}
+		robotsCache.Lock()
+		robotsCache.rules[origin] = rules
+		robotsCache.Unlock()
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return rules.allows(path)
+}
+
+// fetchRobots fetches the robots.txt of the origin and returns the rules applying to the crawler, nil if it has none.
+func fetchRobots(origin string) (*robotsRules, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RobotsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := *identifyFlag
+	if userAgent == "" {
+		userAgent = robotsAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.New(resp.Status)
+	}
+	return parseRobots(io.LimitReader(resp.Body, robotsMaxBytes), crawlerAgent()), nil
+}
+
+// crawlerAgent returns the agent matched against the robots.txt groups: the product name of the -identify token,
+// robotsAgent if it is not set.
+func crawlerAgent() string {
+	agent := robotsAgent
+	if fields := strings.Fields(*identifyFlag); len(fields) > 0 {
+		agent = strings.SplitN(fields[0], "/", 2)[0]
+	}
+	return strings.ToLower(agent)
+}
+
+// parseRobots returns the rules of the groups of the robots.txt naming the agent, or of the * groups if none does, as
+// specified by RFC 9309.
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	named, wildcard := &robotsRules{}, &robotsRules{}
+	var current []*robotsRules // current holds the rules of the group read, by the agents matched.
+	var matchedNamed bool
+	inAgents := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = nil
+				inAgents = true
+			}
+			name := strings.ToLower(value)
+			switch {
+			case name == "*":
+				current = append(current, wildcard)
+			case name != "" && strings.HasPrefix(agent, name):
+				current = append(current, named)
+				matchedNamed = true
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			for _, rules := range current {
+				if key == "allow" {
+					rules.allow = append(rules.allow, value)
+				} else {
+					rules.disallow = append(rules.disallow, value)
+				}
+			}
+		default:
+			inAgents = false
+		}
+	}
+	if matchedNamed {
+		return named
+	}
+	return wildcard
+}
+
+// allows reports whether the rules let the crawler visit the path: the longest matching rule wins, allow rules
+// winning ties. Rules that are nil allow every path.
+func (r *robotsRules) allows(path string) bool {
+	if r == nil {
+		return true
+	}
+	longest, allowed := -1, true
+	for _, pattern := range r.disallow {
+		if robotsMatch(pattern, path) && len(pattern) > longest {
+			longest, allowed = len(pattern), false
+		}
+	}
+	for _, pattern := range r.allow {
+		if robotsMatch(pattern, path) && len(pattern) >= longest {
+			longest, allowed = len(pattern), true
+		}
+	}
+	return allowed
+}
+
+// robotsMatch reports whether the path matches the pattern of a robots.txt rule, in which * matches any characters
+// and a trailing $ anchors the pattern at the end of the path.
+func robotsMatch(pattern string, path string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.TrimSuffix(pattern, "$")), `\*`, ".*")
+	if strings.HasSuffix(pattern, "$") {
+		expr += "$"
+	}
+	matched, err := regexp.MatchString(expr, path)
+	return err == nil && matched
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+const (
+	// Preprocessing normalizes the entries read from the input before they are scanned: the scheme, a leading www.,
+	// trailing dots and the path are stripped and internationalized domains are converted to punycode, so the same site
+	// given in several forms is scanned once. Entries that are not valid domains are dropped. The outcome for every
+	// entry is written to InputCheckFile
+	NormalizeEntries = false
+	KeepURLPaths     = true // KeepURLPaths keeps the URLs with a path other than the homepage as URLs, see input.go, rather than reducing them to their domain.
+	InputCheckFile   = "input_check.csv"
+
+	// The pre-flight check resolves every entry and sends it an HTTP request before the run starts, dropping the entries
+	// that do not resolve or answer, so no scan is spent on dead domains. Any HTTP response counts as an answer
+	PreflightCheck   = false
+	PreflightTimeout = 10 * time.Second // PreflightTimeout specifies the maximum duration of resolving an entry and of its HTTP request.
+	PreflightWorkers = 16               // PreflightWorkers specifies the number of entries checked at the same time.
+)
+
+// Outcomes of the preprocessing of an entry
+const (
+	inputOK          = "ok"
+	inputDuplicate   = "duplicate"   // The entry normalizes to an entry seen before.
+	inputInvalid     = "invalid"     // The entry is not a valid domain or URL.
+	inputDNSFailed   = "dns-failed"  // The entry's host does not resolve.
+	inputUnreachable = "unreachable" // The entry's host resolves, but does not answer HTTP requests.
+)
+
+// inputCheck is the outcome of the preprocessing of an entry.
+type inputCheck struct {
+	entry      string
+	normalized string
+	outcome    string
+	detail     string
+}
+
+// preprocessDomains normalizes and deduplicates the entries if NormalizeEntries is set, and drops those failing the
+// pre-flight check if PreflightCheck is set, recording the outcome for every entry in InputCheckFile. The overrides of
+// the entries in domainOverrides are moved to their normalized form.
+func preprocessDomains(entries []string) []string {
+	if !NormalizeEntries && !PreflightCheck {
+		return entries
+	}
+
+	var checks []inputCheck
+	var domains []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		check := inputCheck{entry: entry, normalized: entry, outcome: inputOK}
+		if NormalizeEntries {
+			normalized, err := normalizeEntry(entry)
+			switch {
+			case err != nil:
+				check.normalized, check.outcome, check.detail = "", inputInvalid, err.Error()
+			case seen[normalized]:
+				check.normalized, check.outcome = normalized, inputDuplicate
+			default:
+				check.normalized = normalized
+			}
+		}
+		if check.outcome == inputOK {
+			seen[check.normalized] = true
+			domains = append(domains, check.normalized)
+			if options, found := domainOverrides[entry]; found && check.normalized != entry {
+				delete(domainOverrides, entry)
+				domainOverrides[check.normalized] = options
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	if PreflightCheck {
+		failed := preflight(domains)
+		domains = domains[:0]
+		for i, check := range checks {
+			if check.outcome != inputOK {
+				continue
+			}
+			if failure, found := failed[check.normalized]; found {
+				checks[i].outcome, checks[i].detail = failure.outcome, failure.detail
+				continue
+			}
+			domains = append(domains, check.normalized)
+		}
+	}
+
+	writeInputChecks(checks)
+	slog.Info("Preprocessed input", "entries", len(entries), "kept", len(domains))
+	return domains
+}
+
+// normalizeEntry returns the normalized form of a domain or URL entry: its lowercase ASCII host without a leading
+// www. or trailing dots, or if KeepURLPaths is set and the entry is a URL of a page other than the homepage, the URL
+// with that host.
+func normalizeEntry(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	raw := entry
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	host := strings.TrimRight(strings.ToLower(u.Hostname()), ".")
+	host = strings.TrimPrefix(host, "www.")
+	if host == "" {
+		return "", fmt.Errorf("no host")
+	}
+	if net.ParseIP(host) == nil {
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", fmt.Errorf("invalid domain: %w", err)
+		}
+		if _, err := publicsuffix.EffectiveTLDPlusOne(host); err != nil {
+			return "", fmt.Errorf("invalid domain: %w", err)
+		}
+	}
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	if KeepURLPaths && isURL(entry) && (strings.TrimSuffix(u.EscapedPath(), "/") != "" || u.RawQuery != "") {
+		u.Host, u.Fragment = host, ""
+		return u.String(), nil
+	}
+	return host, nil
+}
+
+// preflight resolves the entries and sends each an HTTP request, returning the checks of those that failed by entry.
+func preflight(entries []string) map[string]inputCheck {
+	client := &http.Client{Timeout: PreflightTimeout}
+	failed := map[string]inputCheck{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+
+	for i := 0; i < PreflightWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				if outcome, detail := preflightEntry(client, entry); outcome != inputOK {
+					mu.Lock()
+					failed[entry] = inputCheck{entry: entry, normalized: entry, outcome: outcome, detail: detail}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, entry := range entries {
+		queue <- entry
+	}
+	close(queue)
+	wg.Wait()
+
+	slog.Info("Pre-flight check done", "entries", len(entries), "failed", len(failed))
+	return failed
+}
+
+// preflightEntry resolves the entry's host and sends it a HEAD request, returning the outcome and the error.
+func preflightEntry(client *http.Client, entry string) (string, string) {
+	target := targetURL(entry)
+	u, err := url.Parse(target)
+	if err != nil {
+		return inputInvalid, err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PreflightTimeout)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return inputDNSFailed, err.Error()
+	}
+
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err != nil {
+		return inputInvalid, err.Error()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return inputUnreachable, err.Error()
+	}
+	resp.Body.Close()
+	return inputOK, ""
+}
+
+// writeInputChecks writes the outcome of the preprocessing of every entry to InputCheckFile.
+func writeInputChecks(checks []inputCheck) {
+	file, err := outfile.Create(InputCheckFile)
+	if err != nil {
+		slog.Error("Error creating input check file", "file", InputCheckFile, "error", err)
+		return
+	}
+	defer file.Close()
+
+	writer := csvfile.NewWriter(file, file.New)
+	writer.Write([]string{"Entry", "Normalized", "Outcome", "Detail"})
+	for _, check := range checks {
+		writer.Write([]string{check.entry, check.normalized, check.outcome, check.detail})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		slog.Error("Error writing input check file", "file", InputCheckFile, "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// Instead of starting a local Chrome, the crawler can attach to a running one, e.g. in a container or on another
+	// host, with `go run . -remote-chrome ws://chrome:9222`. Every domain is then scanned in a new browser context of
+	// that Chrome, whose requests are sent through the proxy of the scan. The remote Chrome has to be started with
+	// --remote-debugging-address and --ignore-certificate-errors, as the proxy intercepts TLS, or with ManagedCA set,
+	// --ignore-certificate-errors-spki-list set to the hash of the managed CA's key, see tls.go. The proxy then listens
+	// on all interfaces, so the remote Chrome can reach it
+	RemoteChrome    = ""                     // RemoteChrome specifies the default of -remote-chrome, the DevTools URL of the Chrome to attach to.
+	RemoteProxyAddr = "host.docker.internal" // RemoteProxyAddr specifies the default of -remote-proxy, the host at which the remote Chrome reaches the proxy.
+)
+
+var (
+	remoteChrome    = flag.String("remote-chrome", RemoteChrome, "DevTools URL of a running Chrome to attach to, e.g. ws://chrome:9222, instead of starting a local one")
+	remoteProxyAddr = flag.String("remote-proxy", RemoteProxyAddr, "host at which the remote Chrome reaches the proxy, on the port of each scan's proxy")
+)
+
+// createRemoteChromeContext attaches to the remote Chrome, returning a context holding the connection to it.
+func createRemoteChromeContext() (context.Context, context.CancelFunc) {
+	allocCtx, cancelAlloc := chromedp.NewRemoteAllocator(context.Background(), *remoteChrome)
+	browserCtx, cancelBrowser := chromedp.NewContext(allocCtx, chromedp.WithLogf(chromedpLogf(allocCtx)))
+
+	// Connect right away, so domain contexts can create their browser contexts in it
+	if err := chromedp.Run(browserCtx); err != nil {
+		cancelBrowser()
+		cancelAlloc()
+		fatal("Error connecting to remote Chrome", "url", *remoteChrome, "error", err)
+	}
+	return browserCtx, func() {
+		cancelBrowser()
+		cancelAlloc()
+	}
+}
+
+// scanProxyKey is the key of the context value holding the address of the scan's proxy, see withScanProxy.
+type scanProxyKey struct{}
+
+// withScanProxy returns a context holding the address the proxy of the scan listens on, so the browser contexts created
+// from it send their requests through that proxy.
+func withScanProxy(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, scanProxyKey{}, addr.String())
+}
+
+// newBrowserContext returns the option creating a context in a new browser context, whose requests are sent through
+// the proxy of the scan held by ctx. A remote Chrome reaches it at the host of -remote-proxy.
+func newBrowserContext(ctx context.Context) chromedp.ContextOption {
+	addr, _ := ctx.Value(scanProxyKey{}).(string)
+	if addr == "" {
+		return chromedp.WithNewBrowserContext()
+	}
+	if *remoteChrome != "" {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort(remoteProxyHost(), port)
+		}
+	}
+	return chromedp.WithNewBrowserContext(func(p *target.CreateBrowserContextParams) *target.CreateBrowserContextParams {
+		return p.WithProxyServer(addr)
+	})
+}
+
+// remoteProxyHost returns the host of -remote-proxy, which may be given with a port from when the proxy listened on a
+// fixed one.
+func remoteProxyHost() string {
+	if host, _, err := net.SplitHostPort(*remoteProxyAddr); err == nil {
+		return host
+	}
+	return *remoteProxyAddr
+}
+
+// proxyListenAddr returns the address the proxy of a scan listens on, on a port picked by the system so concurrent
+// scans each have their own proxy. It is only reachable locally unless a remote Chrome is used.
+func proxyListenAddr() string {
+	if *remoteChrome == "" {
+		return proxyAddr
+	}
+	return ":0"
+}
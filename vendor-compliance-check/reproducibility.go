@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/clock"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+const (
+	// Runs can be reproduced from their outputs: every run appends to RunsFile the seed it used, the order and hash of
+	// its domain list, the tool and GVL versions, the consent profile and the flags, with the hash of the flags as the
+	// config hash. The seed drives every random choice of the run, so a run given the seed of another, with -seed,
+	// scans the same domains in the same order. -order shuffle scans the domains in a random order, and -order
+	// stratify splits the list into -strata strata by position, i.e. by rank for the top lists, and scans them in
+	// turns, so a run stopped early still covers every rank range. With -rescan the given percentage of the domains
+	// scanned by the run is re-scanned once it is done, writing to RescanFile whether the verdict and the cookies set
+	// are the same, so the measurement noise can be estimated. With -provenance the tool version, GVL version, consent
+	// profile and config hash are also appended to every row of the outputs with a header and every record of
+	// VerdictsFile. As resumed runs append to the outputs of earlier runs, start it with a new output directory
+	DomainOrder     = orderInput
+	Seed            = 0  // Seed specifies the default of -seed, 0 to pick a seed from the clock.
+	Strata          = 10 // Strata specifies the default of -strata.
+	RescanPercent   = 0.0
+	EmbedProvenance = false
+	RunsFile        = "runs.jsonl"
+	RescanFile      = "rescan.csv"
+
+	// Orders of -order
+	orderInput    = "input"    // The order of the input.
+	orderShuffle  = "shuffle"  // A random order.
+	orderStratify = "stratify" // A random domain of each stratum in turn.
+
+	configHashLength = 16 // configHashLength is the number of hex digits of the config hash and input hash written.
+)
+
+var (
+	seedFlag       = flag.Int64("seed", Seed, "seed of the random choices of the run, such as the domain order and the re-scan sample, 0 to pick one from the clock")
+	orderFlag      = flag.String("order", DomainOrder, "order in which the domains are scanned: input, shuffle, or stratify to take a random domain of each -strata stratum in turn")
+	strataFlag     = flag.Int("strata", Strata, "number of strata, by position in the input, of -order stratify")
+	rescanFlag     = flag.Float64("rescan", RescanPercent, "percentage of the domains scanned that is re-scanned once the run is done, to estimate the measurement noise")
+	provenanceFlag = flag.Bool("provenance", EmbedProvenance, "append the tool version, GVL version, consent profile and config hash to every output row and verdict record")
+)
+
+// unhashedFlags are the flags left out of the config hash, as they do not change what is scanned. The seed only
+// changes the order and the re-scan sample, and is recorded on its own.
+var unhashedFlags = map[string]bool{"coordinator": true, "export": true, "progress": true, "seed": true}
+
+// provenanceColumns are appended to the header of the outputs with -provenance, see Provenance.values.
+var provenanceColumns = []string{"Tool Version", "GVL Version", "Consent Profile", "Config Hash"}
+
+// Provenance identifies the build and configuration that produced an output record.
+type Provenance struct {
+	ToolVersion    string `json:"toolVersion"`
+	GVLVersion     int    `json:"gvlVersion,omitempty"` // GVLVersion is the version of the MatchGVL store, 0 without one.
+	ConsentProfile string `json:"consentProfile"`
+	ConfigHash     string `json:"configHash"`
+}
+
+// values returns the values of the provenanceColumns.
+func (p Provenance) values() []string {
+	gvlVersion := ""
+	if p.GVLVersion > 0 {
+		gvlVersion = fmt.Sprint(p.GVLVersion)
+	}
+	return []string{p.ToolVersion, gvlVersion, p.ConsentProfile, p.ConfigHash}
+}
+
+// runRecord is a run as written to RunsFile.
+type runRecord struct {
+	Provenance
+	Tool      string            `json:"tool"`
+	GoVersion string            `json:"goVersion"`
+	Seed      int64             `json:"seed"`
+	Order     string            `json:"order"`
+	Domains   int               `json:"domains"`   // Domains is the number of domains of the input, including those done by earlier runs.
+	InputHash string            `json:"inputHash"` // InputHash is the hash of the domains of the input, in the order they are scanned.
+	Flags     map[string]string `json:"flags"`
+	Started   time.Time         `json:"started"`
+}
+
+// currentRun is the current run. Its GVLVersion is set once MatchGVL is loaded, see newGVLMatcher.
+var currentRun runRecord
+
+// startRun checks the flags of this file and fills currentRun. Runs scanning from the domains file without a -seed get
+// one from the clock, which is set on the flag so the config hash covers it. Workers keep theirs, as the coordinator
+// orders the domains.
+func startRun() {
+	switch *orderFlag {
+	case orderInput, orderShuffle, orderStratify:
+	default:
+		fatal("Unknown -order, use input, shuffle or stratify", "order", *orderFlag)
+	}
+	if *strataFlag < 1 {
+		fatal("-strata must be at least 1", "strata", *strataFlag)
+	}
+	if *rescanFlag < 0 || *rescanFlag > 100 {
+		fatal("-rescan must be a percentage between 0 and 100", "rescan", *rescanFlag)
+	}
+	if *seedFlag == 0 && *coordinatorURL == "" {
+		flag.Set("seed", fmt.Sprint(clock.System.Now().UnixNano()))
+	}
+
+	currentRun = runRecord{
+		Tool:      StateTool,
+		GoVersion: runtime.Version(),
+		Seed:      *seedFlag,
+		Order:     *orderFlag,
+		Flags:     map[string]string{},
+		Started:   clock.System.Now(),
+	}
+	currentRun.ToolVersion = toolVersion()
+	currentRun.ConsentProfile = consentProfile().Name
+	var config []string
+	flag.VisitAll(func(f *flag.Flag) {
+		currentRun.Flags[f.Name] = f.Value.String()
+		if !unhashedFlags[f.Name] {
+			config = append(config, f.Name+"="+f.Value.String())
+		}
+	})
+	currentRun.ConfigHash = hashLines(config)
+	slog.Info("Starting run", "seed", currentRun.Seed, "order", currentRun.Order, "version", currentRun.ToolVersion, "config", currentRun.ConfigHash)
+}
+
+// recordRun appends currentRun to RunsFile. Errors are logged.
+func recordRun() {
+	file, err := outfile.Open(RunsFile)
+	if err != nil {
+		slog.Error("Error opening runs file", "error", err)
+		return
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(currentRun); err != nil {
+		slog.Error("Error writing run", "error", err)
+	}
+}
+
+// toolVersion returns the module version of the build, or else its version control revision, with -dirty appended if
+// it had uncommitted changes. Builds without either, e.g. go run outside a checkout, are identified by the hash of
+// their executable, which changes with the constants of the tool.
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+		revision, modified := "", false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if revision != "" {
+			if len(revision) > 12 {
+				revision = revision[:12]
+			}
+			if modified {
+				revision += "-dirty"
+			}
+			return revision
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return "unknown"
+	}
+	file, err := os.Open(executable)
+	if err != nil {
+		return "unknown"
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "unknown"
+	}
+	return "build-" + hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// hashLines returns the first configHashLength hex digits of the SHA-256 hash of the lines.
+func hashLines(lines []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])[:configHashLength]
+}
+
+// orderDomains returns the domains in the order of -order, drawn with the seed of the run, and records their number
+// and hash in currentRun.
+func orderDomains(domains []string) []string {
+	rng := rand.New(rand.NewSource(currentRun.Seed))
+	switch *orderFlag {
+	case orderShuffle:
+		domains = append([]string(nil), domains...)
+		rng.Shuffle(len(domains), func(i, j int) { domains[i], domains[j] = domains[j], domains[i] })
+	case orderStratify:
+		domains = stratify(domains, *strataFlag, rng)
+	}
+	currentRun.Domains, currentRun.InputHash = len(domains), hashLines(domains)
+	return domains
+}
+
+// stratify splits the domains into n strata of consecutive domains, shuffles each, and returns a domain of each
+// stratum in turn.
+func stratify(domains []string, n int, rng *rand.Rand) []string {
+	if n > len(domains) {
+		n = len(domains)
+	}
+	strata := make([][]string, n)
+	for i := range strata {
+		stratum := append([]string(nil), domains[i*len(domains)/n:(i+1)*len(domains)/n]...)
+		rng.Shuffle(len(stratum), func(a, b int) { stratum[a], stratum[b] = stratum[b], stratum[a] })
+		strata[i] = stratum
+	}
+
+	ordered := make([]string, 0, len(domains))
+	for i := 0; len(ordered) < len(domains); i++ {
+		for _, stratum := range strata {
+			if i < len(stratum) {
+				ordered = append(ordered, stratum[i])
+			}
+		}
+	}
+	return ordered
+}
+
+// stampHeader returns the header with the provenanceColumns appended with -provenance, and whether they were. Headers
+// that already end with them, such as those sent by workers, are returned as is.
+func stampHeader(header []string) ([]string, bool) {
+	if !*provenanceFlag || len(header) == 0 {
+		return header, false
+	}
+	if len(header) >= len(provenanceColumns) && strings.Join(header[len(header)-len(provenanceColumns):], ",") == strings.Join(provenanceColumns, ",") {
+		return header, true
+	}
+	return append(header[:len(header):len(header)], provenanceColumns...), true
+}
+
+// recordProvenance returns the provenance added to the verdict records, nil without -provenance.
+func recordProvenance() *Provenance {
+	if !*provenanceFlag {
+		return nil
+	}
+	return &currentRun.Provenance
+}
+
+// rescanning reports whether the run re-scans a sample of its domains. Workers leave it to the coordinator's runs.
+func rescanning() bool {
+	return *rescanFlag > 0 && *coordinatorURL == ""
+}
+
+// scanOutcome is what a scan is compared on when it is re-scanned.
+type scanOutcome struct {
+	domain  string
+	verdict verdict.Verdict
+	cookies map[string]bool // cookies holds the keys of the non-expired cookies set, see cookieKey.
+}
+
+// newScanOutcome returns the outcome of the domain's scan.
+func newScanOutcome(domain string, cookies []*http.Cookie, result scanResult) scanOutcome {
+	outcome := scanOutcome{domain: domain, verdict: scanVerdict(result), cookies: map[string]bool{}}
+	for _, c := range cookies {
+		if !isCookieExpired(c) {
+			outcome.cookies[cookieKey(c)] = true
+		}
+	}
+	return outcome
+}
+
+// rescanSample re-scans -rescan percent of the scanned domains, drawn with the seed of the run, and writes how their
+// outcome compares to the first scan to RescanFile. The domains are re-scanned within what is left of the run budget.
+func rescanSample(allocCtx context.Context, budget runBudget, scanned []scanOutcome) {
+	size := int(math.Ceil(float64(len(scanned)) * *rescanFlag / 100))
+	if size == 0 {
+		return
+	}
+	sample := rand.New(rand.NewSource(currentRun.Seed)).Perm(len(scanned))[:size]
+	sort.Ints(sample)
+
+	writer, err := openCSVOutput(RescanFile, []string{"Website", "Verdict", "Rescan Verdict", "Verdict Agrees", "Cookies", "Rescan Cookies", "Cookie Jaccard"})
+	if err != nil {
+		fatal("Error opening rescan file", "error", err)
+	}
+	defer writer.Close()
+
+	slog.Info("Re-scanning sample", "domains", size)
+	agreed, jaccardSum := 0, 0.0
+	for i, index := range sample {
+		first := scanned[index]
+		logger, stopDomainLogging := startDomainLogging(first.domain)
+		domainBudget, ok := budget.domainBudget(size - i)
+		if !ok {
+			logger.Warn("Run budget exhausted, stopping the re-scan")
+			stopDomainLogging()
+			size = i
+			break
+		}
+
+		options := optionsFor(first.domain)
+		options.Rescan = true
+		cookies, result, _ := runWithRecrawls(logging.NewContext(allocCtx, logger), first.domain, domainBudget, options)
+		again := newScanOutcome(first.domain, cookies, result)
+		jaccard := cookieJaccard(first.cookies, again.cookies)
+		if first.verdict == again.verdict {
+			agreed++
+		}
+		jaccardSum += jaccard
+
+		writer.Write([]string{first.domain, string(first.verdict), string(again.verdict), fmt.Sprint(first.verdict == again.verdict), fmt.Sprint(len(first.cookies)), fmt.Sprint(len(again.cookies)), fmt.Sprintf("%.3f", jaccard)})
+		writer.Flush()
+		flushOutputFiles()
+		stopDomainLogging()
+	}
+	if size > 0 {
+		slog.Info("Re-scan done", "domains", size, "verdict_agreement", fmt.Sprintf("%.3f", float64(agreed)/float64(size)), "cookie_jaccard", fmt.Sprintf("%.3f", jaccardSum/float64(size)))
+	}
+}
+
+// cookieJaccard returns the Jaccard index of the cookies of two scans, 1 if neither set any.
+func cookieJaccard(a map[string]bool, b map[string]bool) float64 {
+	union := len(b)
+	shared := 0
+	for key := range a {
+		if b[key] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
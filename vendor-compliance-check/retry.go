@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Domains whose scan fails with a transient error are scanned again in a new browser, or a new browser context
+	// of the shared browser, waiting RetryBackoff before the first retry and twice as long before each further one
+	MaxAttempts     = 3                // MaxAttempts specifies the number of times a domain is scanned at most, 1 disables retries.
+	RetryBackoff    = 5 * time.Second  // RetryBackoff specifies the time waited before the first retry.
+	MaxRetryBackoff = 60 * time.Second // MaxRetryBackoff specifies the longest time waited between two attempts.
+)
+
+// Error classes, telling a site without a CMP apart from a failed scan in the output
+const (
+	errorDNS           = "dns"            // The domain could not be resolved.
+	errorTLS           = "tls"            // The TLS handshake with the site failed.
+	errorNavTimeout    = "nav-timeout"    // The homepage did not load in time.
+	errorTimeout       = "timeout"        // The scan did not complete in time after the homepage loaded.
+	errorProxy         = "proxy"          // The MITM proxy could not be started or reached.
+	errorConnection    = "connection"     // The connection to the site was refused, reset or closed.
+	errorChromedpCrash = "chromedp-crash" // The browser or tab crashed or the connection to it was lost.
+	errorCanceled      = "canceled"       // The scan was canceled, e.g. as the run budget was spent.
+	errorChromedp      = "chromedp"       // Any other error running chromedp.
+	errorTCFMissing    = "tcf-missing"    // The scan succeeded, but the TCF API was not found on the site.
+)
+
+// retryableErrors lists the error classes that are likely to be transient, and so worth another attempt.
+var retryableErrors = map[string]bool{
+	errorDNS:           true,
+	errorNavTimeout:    true,
+	errorTimeout:       true,
+	errorProxy:         true,
+	errorConnection:    true,
+	errorChromedpCrash: true,
+}
+
+// navigationError is an error loading the homepage, as opposed to an error in the actions that follow.
+type navigationError struct {
+	err error
+}
+
+func (e *navigationError) Error() string { return "navigating: " + e.err.Error() }
+func (e *navigationError) Unwrap() error { return e.err }
+
+// classifyError returns the class of an error returned while scanning a domain. Navigation errors are reported by
+// Chrome as net:: error codes.
+func classifyError(err error) string {
+	message := err.Error()
+	var navErr *navigationError
+	navigating := errors.As(err, &navErr)
+
+	switch {
+	case strings.Contains(message, "ERR_NAME_NOT_RESOLVED") || strings.Contains(message, "ERR_NAME_RESOLUTION_FAILED"):
+		return errorDNS
+	case strings.Contains(message, "ERR_CERT_") || strings.Contains(message, "ERR_SSL_"):
+		return errorTLS
+	case strings.Contains(message, "ERR_PROXY_") || strings.Contains(message, "ERR_TUNNEL_CONNECTION_FAILED"):
+		return errorProxy
+	case strings.Contains(message, "ERR_CONNECTION_") || strings.Contains(message, "ERR_EMPTY_RESPONSE"):
+		return errorConnection
+	case strings.Contains(message, "ERR_TIMED_OUT") || navigating && errors.Is(err, context.DeadlineExceeded):
+		return errorNavTimeout
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTimeout
+	case errors.Is(err, context.Canceled):
+		return errorCanceled
+	case errors.Is(err, chromedp.ErrChannelClosed) || errors.Is(err, chromedp.ErrInvalidContext) || errors.Is(err, chromedp.ErrInvalidTarget) ||
+		strings.Contains(message, "crashed") || strings.Contains(message, "websocket"):
+		return errorChromedpCrash
+	}
+	return errorChromedp
+}
+
+// runWithRetries scans the domain, in a new browser or browser context for every attempt, until the scan succeeds, fails
+// with an error that is not transient, or MaxAttempts is reached. All attempts share the domain's budget, if it is not 0.
+func runWithRetries(allocCtx context.Context, targetURL string, budget time.Duration, options scanOptions) ([]*http.Cookie, scanResult) {
+	deadline := time.Now().Add(budget)
+	backoff := RetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancelCtx := createDomainContext(allocCtx)
+		if budget > 0 {
+			ctx, cancelCtx = withBudget(ctx, cancelCtx, time.Until(deadline))
+		}
+
+		cookies, result := run(targetURL, ctx, options)
+		// Scans cut short by the budget, e.g. while crawling sub-pages, are completed by the next run, see scanError
+		result.Truncated = budget > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancelCtx()
+		result.Attempts = attempt
+
+		if attempt >= MaxAttempts || !retryableErrors[result.ErrorClass] {
+			return cookies, result
+		}
+		if budget > 0 && time.Until(deadline) < backoff+MinDomainBudget {
+			logging.FromContext(allocCtx).Warn("Not retrying, as the domain's budget is spent", "error_class", result.ErrorClass)
+			return cookies, result
+		}
+
+		logging.FromContext(allocCtx).Warn("Retrying domain", "attempt", attempt, "error_class", result.ErrorClass, "error", result.Err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, MaxRetryBackoff)
+	}
+}
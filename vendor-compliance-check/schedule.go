@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+)
+
+const (
+	// In scheduler mode, started with `go run . schedule`, the scans configured in ScheduleFile are run as a monitoring
+	// service whenever their cron schedules are due, one at a time as they share the proxy. Each run is a crawl of
+	// this tool in its own directory, ScheduleDir/<name>/<start time>, laid out as the repository, so the report's diff
+	// subcommand can compare two runs. The third party cookies of a run that violate the consent and were not found
+	// by the schedule's previous run are posted to the schedule's webhook
+	ScheduleFile   = "schedules.yaml"
+	ScheduleDir    = "runs"
+	WebhookTimeout = 10 * time.Second // WebhookTimeout specifies the maximum duration of posting the new violations of a run to a webhook.
+	RunLogFile     = "run.log"        // RunLogFile is the file of the run's directory the crawl's output is written to.
+
+	runDirFormat   = "20060102-150405" // The format of the names of the runs' directories, which sort by start time.
+	runDomainsFile = "domains.csv"     // The domains file of a run, with the schedule's profile applied.
+	runDoneFile    = "done"            // The file created in the run's directory once its crawl finished successfully.
+
+	// Reasons a third party cookie violates the consent
+	violationBeforeInjection = "set-before-injection" // The cookie was set before the consent was injected.
+	violationAfterReject     = "set-after-reject"     // The cookie was set although the user rejected all, under the returning-user profile.
+)
+
+// scheduledScan is a scan of a domain list run on a cron schedule.
+type scheduledScan struct {
+	Name    string   `yaml:"name"`
+	Cron    string   `yaml:"cron"`    // Cron is the schedule, as the minute, hour, day of month, month and day of week fields of crontab(5).
+	Domains string   `yaml:"domains"` // Domains is the domains file, relative to this directory if not absolute.
+	Profile string   `yaml:"profile"` // Profile is the profile the domains are scanned with unless their row sets one, see options.go.
+	Webhook string   `yaml:"webhook"` // Webhook is the URL the new violations of each run are posted to, if any.
+	Args    []string `yaml:"args"`    // Args are the flags the crawl is started with, e.g. ["-run-timeout", "2m"].
+	cron    cronSchedule
+}
+
+// violation is a third party cookie set in violation of the consent.
+type violation struct {
+	Website string `json:"website"`
+	Cookie  string `json:"cookie"`
+	Domain  string `json:"domain"`
+	Reason  string `json:"reason"`
+}
+
+// webhookPayload is the body posted to the webhook of a schedule.
+type webhookPayload struct {
+	Schedule   string      `json:"schedule"`
+	Run        string      `json:"run"` // Run is the directory of the run.
+	Started    time.Time   `json:"started"`
+	Finished   time.Time   `json:"finished"`
+	Violations []violation `json:"violations"` // Violations holds the violations not found by the schedule's previous run.
+}
+
+// schedule runs the scans configured in ScheduleFile, or in the file given after the subcommand, whenever they are
+// due until the process is stopped.
+func schedule(configFile string) {
+	if configFile == "" {
+		configFile = ScheduleFile
+	}
+	scans, err := loadSchedules(configFile)
+	if err != nil {
+		fatal("Error loading schedules", "file", configFile, "error", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatal("Error finding the crawler's executable", "error", err)
+	}
+
+	next := make([]time.Time, len(scans))
+	for i, scan := range scans {
+		next[i] = scan.cron.next(time.Now())
+		slog.Info("Scheduled scan", "name", scan.Name, "cron", scan.Cron, "next", next[i])
+	}
+	for {
+		// Run the scan due first, as soon as the previous run finished if it is already due
+		due := 0
+		for i := range scans {
+			if next[i].Before(next[due]) {
+				due = i
+			}
+		}
+		time.Sleep(time.Until(next[due]))
+		runScheduledScan(executable, scans[due])
+		next[due] = scans[due].cron.next(time.Now())
+		slog.Info("Next run of scheduled scan", "name", scans[due].Name, "next", next[due])
+	}
+}
+
+// loadSchedules reads the scheduled scans from the config file.
+func loadSchedules(path string) ([]*scheduledScan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Schedules []*scheduledScan `yaml:"schedules"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Schedules) == 0 {
+		return nil, fmt.Errorf("no schedules in %s", path)
+	}
+
+	names := map[string]bool{}
+	for _, scan := range config.Schedules {
+		switch {
+		case scan.Name == "" || strings.ContainsAny(scan.Name, `/\`) || names[scan.Name]:
+			return nil, fmt.Errorf("schedule names must be unique and non-empty, and cannot hold slashes: %q", scan.Name)
+		case scan.Domains == "":
+			return nil, fmt.Errorf("schedule %s has no domains file", scan.Name)
+		case scan.Profile != "" && scan.Profile != profileDefault && scan.Profile != profileReturningUser:
+			return nil, fmt.Errorf("schedule %s has unknown profile %q, use %q or %q", scan.Name, scan.Profile, profileDefault, profileReturningUser)
+		}
+		names[scan.Name] = true
+		if scan.cron, err = parseCron(scan.Cron); err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", scan.Name, err)
+		}
+		if scan.Domains, err = filepath.Abs(scan.Domains); err != nil {
+			return nil, err
+		}
+	}
+	return config.Schedules, nil
+}
+
+// runScheduledScan crawls the domains of the scheduled scan in a new directory and posts its new violations to the
+// schedule's webhook. Errors are logged, leaving the next runs scheduled.
+func runScheduledScan(executable string, scan *scheduledScan) {
+	started := time.Now()
+	runDir, err := filepath.Abs(filepath.Join(ScheduleDir, scan.Name, started.Format(runDirFormat)))
+	if err != nil {
+		slog.Error("Error creating run directory", "schedule", scan.Name, "error", err)
+		return
+	}
+	// The crawl runs in a directory named after this one, keeping the state database of the run, at ../scan-state.db, apart
+	crawlDir := filepath.Join(runDir, filepath.Base(mustGetwd()))
+	if err := os.MkdirAll(crawlDir, 0755); err != nil {
+		slog.Error("Error creating run directory", "schedule", scan.Name, "error", err)
+		return
+	}
+	if err := writeRunDomains(scan, filepath.Join(crawlDir, runDomainsFile)); err != nil {
+		slog.Error("Error writing the run's domains", "schedule", scan.Name, "error", err)
+		return
+	}
+	runLog, err := os.Create(filepath.Join(runDir, RunLogFile))
+	if err != nil {
+		slog.Error("Error creating run log", "schedule", scan.Name, "error", err)
+		return
+	}
+	defer runLog.Close()
+
+	slog.Info("Starting scheduled scan", "schedule", scan.Name, "dir", runDir)
+	cmd := exec.Command(executable, append(append([]string(nil), scan.Args...), "-input", runDomainsFile)...)
+	cmd.Dir, cmd.Stdout, cmd.Stderr = crawlDir, runLog, runLog
+	if err := cmd.Run(); err != nil {
+		slog.Error("Scheduled scan failed", "schedule", scan.Name, "dir", runDir, "error", err)
+		return
+	}
+	slog.Info("Finished scheduled scan", "schedule", scan.Name, "dir", runDir, "duration", time.Since(started).Round(time.Second))
+	if err := os.WriteFile(filepath.Join(runDir, runDoneFile), nil, 0644); err != nil {
+		slog.Error("Error marking the run as done", "schedule", scan.Name, "dir", runDir, "error", err)
+	}
+
+	violations := newViolations(readViolations(crawlDir, scan.Profile), readViolations(previousRun(scan.Name, runDir), scan.Profile))
+	slog.Info("Found new violations", "schedule", scan.Name, "violations", len(violations))
+	if scan.Webhook != "" && len(violations) > 0 {
+		payload := webhookPayload{Schedule: scan.Name, Run: runDir, Started: started, Finished: time.Now(), Violations: violations}
+		if err := postWebhook(scan.Webhook, payload); err != nil {
+			slog.Error("Error posting new violations to webhook", "schedule", scan.Name, "error", err)
+		}
+	}
+}
+
+// mustGetwd returns the working directory, in which the scheduler was started, or "." if it cannot be determined.
+func mustGetwd() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return dir
+}
+
+// writeRunDomains copies the domains file of the scan to path, setting the schedule's profile on the rows setting none.
+func writeRunDomains(scan *scheduledScan, path string) error {
+	file, err := os.Open(scan.Domains)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := csvfile.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	for i, row := range rows {
+		if scan.Profile == "" || len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		for len(row) <= profileColumn {
+			row = append(row, "")
+		}
+		if strings.TrimSpace(row[profileColumn]) == "" {
+			row[profileColumn] = scan.Profile
+		}
+		rows[i] = row
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Written with the configured delimiter, which the crawl reads its domains file with
+	writer := csvfile.NewWriter(out, false)
+	if err := writer.WriteAll(rows); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// previousRun returns the crawl directory of the last successful run of the schedule preceding runDir, or an empty
+// string if there is none. Failed runs, whose outputs may only cover part of the domains, are skipped, so their
+// missing violations are not reported as new by the next run.
+func previousRun(name string, runDir string) string {
+	runs, err := filepath.Glob(filepath.Join(filepath.Dir(runDir), "*"))
+	if err != nil {
+		return ""
+	}
+	sort.Strings(runs)
+	previous := ""
+	for _, run := range runs {
+		if filepath.Base(run) >= filepath.Base(runDir) {
+			break
+		}
+		if _, err := os.Stat(filepath.Join(run, runDoneFile)); err == nil {
+			previous = run
+		}
+	}
+	if previous == "" {
+		return ""
+	}
+	return filepath.Join(previous, filepath.Base(mustGetwd()))
+}
+
+// readViolations returns the third party cookies of the output files in the crawl directory violating the consent:
+// those set before the consent was injected, and all of them under the returning-user profile.
+func readViolations(crawlDir string, profile string) []violation {
+	if crawlDir == "" {
+		return nil
+	}
+	parts, _ := filepath.Glob(filepath.Join(crawlDir, strings.TrimSuffix(OutputFile, filepath.Ext(OutputFile))+"*"))
+
+	var violations []violation
+	for _, part := range parts {
+		rows, err := readOutputRows(part)
+		if err != nil {
+			slog.Warn("Error reading the run's output", "file", part, "error", err)
+			continue
+		}
+		for _, row := range rows {
+			if row["Party"] != "" && row["Party"] != partyThird {
+				continue
+			}
+			v := violation{Website: row["Website"], Cookie: row["Name"], Domain: row["Domain"]}
+			switch {
+			case profile == profileReturningUser:
+				v.Reason = violationAfterReject
+			case row["Set Before Injection"] == "true":
+				v.Reason = violationBeforeInjection
+			default:
+				continue
+			}
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// readOutputRows reads the rows of an output CSV file, written compressed or not, by the names of its columns.
+func readOutputRows(path string) ([]map[string]string, error) {
+	file, err := outfile.OpenReader(strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zst"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csvfile.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		row := map[string]string{}
+		for i, value := range record {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// newViolations returns the violations of current not in previous, once each.
+func newViolations(current []violation, previous []violation) []violation {
+	seen := map[violation]bool{}
+	for _, v := range previous {
+		seen[v] = true
+	}
+	var result []violation
+	for _, v := range current {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// postWebhook posts the payload to the webhook as JSON.
+func postWebhook(url string, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: WebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// cronSchedule holds the values each field of a cron schedule matches.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool // anyDay and anyWeekday report whether the day of month and day of week fields are *.
+}
+
+// cronFields are the ranges of the fields of a cron schedule, in order.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+// parseCron parses a schedule of five fields, each * or a comma separated list of values and ranges such as 1-5,
+// optionally with a step such as */15. Day of week 7 is Sunday, like 0.
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("cron schedule %q must have %d fields", spec, len(cronFields))
+	}
+
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		sets[i] = map[int]bool{}
+		for _, item := range strings.Split(field, ",") {
+			values, step, _ := strings.Cut(item, "/")
+			low, high := cronFields[i].min, cronFields[i].max
+			if values != "*" {
+				first, last, isRange := strings.Cut(values, "-")
+				var err error
+				if low, err = strconv.Atoi(first); err != nil {
+					return cronSchedule{}, fmt.Errorf("invalid %s %q", cronFields[i].name, item)
+				}
+				high = low
+				if isRange {
+					if high, err = strconv.Atoi(last); err != nil {
+						return cronSchedule{}, fmt.Errorf("invalid %s %q", cronFields[i].name, item)
+					}
+				} else if step != "" {
+					high = cronFields[i].max
+				}
+			}
+			every := 1
+			if step != "" {
+				var err error
+				if every, err = strconv.Atoi(step); err != nil || every < 1 {
+					return cronSchedule{}, fmt.Errorf("invalid step of %s %q", cronFields[i].name, item)
+				}
+			}
+			if low < cronFields[i].min || high > cronFields[i].max || low > high {
+				return cronSchedule{}, fmt.Errorf("%s %q out of range %d-%d", cronFields[i].name, item, cronFields[i].min, cronFields[i].max)
+			}
+			for value := low; value <= high; value += every {
+				sets[i][value] = true
+			}
+		}
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return cronSchedule{minutes: sets[0], hours: sets[1], days: sets[2], months: sets[3], weekdays: sets[4], anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}, nil
+}
+
+// matches reports whether the schedule is due in the minute of t. As in cron, a day matches either the day of month
+// or the day of week field if both are restricted.
+func (c cronSchedule) matches(t time.Time) bool {
+	day := c.days[t.Day()]
+	weekday := c.weekdays[int(t.Weekday())]
+	dayMatches := day && weekday
+	if !c.anyDay && !c.anyWeekday {
+		dayMatches = day || weekday
+	}
+	return c.minutes[t.Minute()] && c.hours[t.Hour()] && c.months[int(t.Month())] && dayMatches
+}
+
+// next returns the first minute after t in which the schedule is due, looking up to five years ahead, after which it
+// is considered never due.
+func (c cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if c.matches(t) {
+			return t
+		}
+	}
+	return t
+}
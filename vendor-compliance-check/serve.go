@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+const (
+	// In server mode, started with `go run . serve`, domains are scanned on request rather than read from DomainsFile.
+	// POST /scan runs the full pipeline for a single domain and returns its result as JSON, or the ID of the job to poll
+	// with GET /scan/{id} if it is asynchronous. Up to TabPoolSize scans run at a time in the shared browser, see
+	// concurrentScans, each through its own proxy and browser context. Scans are neither recorded in the state database
+	// nor written to the output files.
+	ServeAddr     = "localhost:8090" // ServeAddr specifies the address on which the scan API is served.
+	MaxQueuedJobs = 100              // MaxQueuedJobs specifies the number of scans that may wait for the scanner before requests are rejected.
+	KeepJobsFor   = time.Hour        // KeepJobsFor specifies how long the result of a finished scan can be fetched.
+
+	// Profiles a scan can be run with
+	profileDefault       = "default"        // The generated consent is injected into the CMP, see ReturningUserMode.
+	profileReturningUser = "returning-user" // The browser is seeded with a stored reject-all decision before the first load.
+)
+
+// Job statuses
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// scanRequest is the body of POST /scan.
+type scanRequest struct {
+	Domain  string `json:"domain"`
+	Profile string `json:"profile"` // Profile is "default" or "returning-user", the default profile when empty.
+	Async   bool   `json:"async"`   // Async returns the job ID right away instead of waiting for the result.
+}
+
+// scanJob is a scan requested through the API.
+type scanJob struct {
+	ID       string     `json:"id"`
+	Domain   string     `json:"domain"`
+	Profile  string     `json:"profile"`
+	Status   string     `json:"status"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   *jobResult `json:"result,omitempty"`
+	done     chan struct{}
+}
+
+// jobResult is the JSON form of a domain's scanResult and cookies.
+type jobResult struct {
+	TCFAPIMode          string            `json:"tcfApiMode"`
+	CMPRoute            string            `json:"cmpRoute,omitempty"`
+	Device              string            `json:"device"`
+	GeneratedTCString   string            `json:"generatedTcString"`
+	APITCString         string            `json:"apiTcString"`
+	ConsentDiff         json.RawMessage   `json:"consentDiff,omitempty"`
+	EventStatusBeforeRL string            `json:"eventStatusBeforeReload"`
+	EventStatusAfterRL  string            `json:"eventStatusAfterReload"`
+	Error               string            `json:"error,omitempty"`
+	ErrorClass          string            `json:"errorClass,omitempty"`
+	Attempts            int               `json:"attempts"`
+	Verdict             verdict.Verdict   `json:"verdict"`
+	Cookies             []jobCookie       `json:"cookies"`
+	ServerCookies       []jobCookie       `json:"serverCookies,omitempty"` // ServerCookies are the cookies set with JavaScript disabled, if VisitWithoutJS is set.
+	Transmissions       []jobTransmission `json:"transmissions,omitempty"`
+}
+
+// jobCookie is a non-expired cookie captured while scanning the domain.
+type jobCookie struct {
+	Domain  string    `json:"domain"`
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+	Page    string    `json:"page,omitempty"`
+	Party   string    `json:"party,omitempty"` // Party is first-party, first-party-set or third-party, see party.go.
+	CNAME   string    `json:"cname,omitempty"` // CNAME is the canonical name of the CNAME-cloaked subdomain that set the cookie.
+}
+
+// jobTransmission is a consent value sent to a third party, if DetectConsentTransmission is set.
+type jobTransmission struct {
+	URL    string `json:"url"`
+	Page   string `json:"page"`
+	Source string `json:"source"`
+	Param  string `json:"param"`
+	Value  string `json:"value"`
+}
+
+// scanServer runs the scans requested through the API, concurrentScans at a time.
+type scanServer struct {
+	allocCtx context.Context
+	queue    chan *scanJob
+
+	mu   sync.Mutex
+	jobs map[string]*scanJob
+}
+
+// serve serves the scan API on ServeAddr until the process is stopped.
+func serve() {
+	allocCtx, cancel := createChromeContext()
+	defer cancel()
+
+	if Calibrate && !calibrate(allocCtx) {
+		cancel()
+		fatal("Calibration failed, not serving")
+	}
+
+	server := &scanServer{allocCtx: allocCtx, queue: make(chan *scanJob, MaxQueuedJobs), jobs: map[string]*scanJob{}}
+	for range concurrentScans(allocCtx) {
+		go server.work()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", server.handleScan)
+	mux.HandleFunc("/scan/", server.handleJob)
+
+	slog.Info("Serving scan API", "addr", ServeAddr)
+	if err := http.ListenAndServe(ServeAddr, mux); err != nil {
+		cancel()
+		fatal("Error serving scan API", "addr", ServeAddr, "error", err)
+	}
+}
+
+// work runs the queued jobs one at a time, and forgets finished jobs after KeepJobsFor. Every scan that may run at the
+// same time has a goroutine running work.
+func (s *scanServer) work() {
+	for job := range s.queue {
+		s.mu.Lock()
+		now := time.Now()
+		job.Status, job.Started = jobRunning, &now
+		s.mu.Unlock()
+
+		logger, stopDomainLogging := startDomainLogging(job.Domain)
+		options := defaultScanOptions()
+		options.ReturningUser = job.Profile == profileReturningUser
+		cookies, result := runWithRetries(logging.NewContext(s.allocCtx, logger), targetURL(job.Domain), 0, options)
+		stopDomainLogging()
+		metrics.domainsProcessed.Add(1)
+
+		s.mu.Lock()
+		finished := time.Now()
+		job.Status, job.Finished, job.Result = jobDone, &finished, newJobResult(cookies, result)
+		s.mu.Unlock()
+		close(job.done)
+
+		time.AfterFunc(KeepJobsFor, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.jobs, job.ID)
+		})
+	}
+}
+
+// handleScan queues the scan of the domain in the request body, and returns its result once it is done, or the job
+// right away if the request is asynchronous, either through the body or ?async=1.
+func (s *scanServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST to request a scan")
+		return
+	}
+
+	var request scanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	domain, err := normalizeDomain(request.Domain)
+	if err == nil {
+		err = checkPublicHost(r.Context(), domain)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.Profile == "" {
+		request.Profile = profileDefault
+	}
+	if request.Profile != profileDefault && request.Profile != profileReturningUser {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown profile %q, use %q or %q", request.Profile, profileDefault, profileReturningUser))
+		return
+	}
+
+	job := &scanJob{ID: newJobID(), Domain: domain, Profile: request.Profile, Status: jobQueued, Queued: time.Now(), done: make(chan struct{})}
+	s.mu.Lock()
+	select {
+	case s.queue <- job:
+		s.jobs[job.ID] = job
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		writeError(w, http.StatusServiceUnavailable, "too many scans queued, try again later")
+		return
+	}
+	slog.Info("Queued scan", "id", job.ID, "domain", domain, "profile", job.Profile)
+
+	if request.Async || r.URL.Query().Get("async") == "1" {
+		s.writeJob(w, http.StatusAccepted, job)
+		return
+	}
+
+	select {
+	case <-job.done:
+		s.writeJob(w, http.StatusOK, job)
+	case <-r.Context().Done():
+		// The client went away, the result can still be fetched with GET /scan/{id}
+	}
+}
+
+// handleJob returns the job with the ID in the path, including its result once it is done.
+func (s *scanServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET to fetch a scan")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/scan/")
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no scan with ID %q", id))
+		return
+	}
+	s.writeJob(w, http.StatusOK, job)
+}
+
+// writeJob writes the job as JSON, holding the lock so the worker does not update it meanwhile.
+func (s *scanServer) writeJob(w http.ResponseWriter, status int, job *scanJob) {
+	s.mu.Lock()
+	data, err := json.Marshal(job)
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("Error encoding scan job", "id", job.ID, "error", err)
+		writeError(w, http.StatusInternalServerError, "error encoding the scan")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeError writes an error response as a JSON object with a single error field.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// newJobResult converts the result of a scan to its JSON form, keeping the non-expired cookies as in the output file.
+func newJobResult(cookies []*http.Cookie, result scanResult) *jobResult {
+	r := &jobResult{
+		TCFAPIMode:          result.TCFAPIMode,
+		CMPRoute:            result.CMPRoute,
+		Device:              *deviceFlag,
+		GeneratedTCString:   result.TCString,
+		APITCString:         result.APITCString,
+		EventStatusBeforeRL: result.EventStatusBeforeRL,
+		EventStatusAfterRL:  result.EventStatusAfterRL,
+		ErrorClass:          result.ErrorClass,
+		Attempts:            result.Attempts,
+		Verdict:             scanVerdict(result),
+		Cookies:             []jobCookie{},
+	}
+	if diff := consentDiffJSON(result.TCString, result.APITCString); diff != "" {
+		r.ConsentDiff = json.RawMessage(diff)
+	}
+	if result.Err != nil {
+		r.Error = result.Err.Error()
+	}
+	for _, c := range cookies {
+		if !isCookieExpired(c) {
+			r.Cookies = append(r.Cookies, jobCookie{Domain: c.Domain, Name: c.Name, Value: c.Value, Path: c.Path, Expires: c.Expires, Page: result.CookiePages[cookieKey(c)], Party: result.CookieParties[cookieKey(c)], CNAME: result.CookieCNAMEs[cookieKey(c)]})
+		}
+	}
+	for _, c := range result.ServerCookies {
+		if !isCookieExpired(c) {
+			r.ServerCookies = append(r.ServerCookies, jobCookie{Domain: c.Domain, Name: c.Name, Value: c.Value, Path: c.Path, Expires: c.Expires})
+		}
+	}
+	for _, t := range result.Transmissions {
+		r.Transmissions = append(r.Transmissions, jobTransmission{URL: t.URL, Page: t.Page, Source: t.Source, Param: t.Param, Value: t.Value})
+	}
+	return r
+}
+
+// normalizeDomain returns the host name of a domain given with or without a scheme, or an error if it is not one. IP
+// addresses, ports and local names are rejected, so the API cannot be used to make the scanner load internal pages.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSpace(domain)
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "https://"), "http://")
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(domain, "/"), "."))
+	if domain == "" || strings.ContainsAny(domain, "/?#@:[] \t") || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	if _, err := netip.ParseAddr(domain); err == nil {
+		return "", fmt.Errorf("invalid domain %q: IP addresses cannot be scanned", domain)
+	}
+	for _, suffix := range localSuffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return "", fmt.Errorf("invalid domain %q: local names cannot be scanned", domain)
+		}
+	}
+	return domain, nil
+}
+
+// localSuffixes are the suffixes of names that are not resolved publicly.
+var localSuffixes = []string{".localhost", ".local", ".internal", ".home.arpa", ".lan", ".intranet", ".corp"}
+
+// reservedPrefixes are the ranges not covered by the netip predicates that are not reachable on the public internet.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// checkPublicHost returns an error unless every address the host resolves to is a public one.
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("invalid domain %q: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return fmt.Errorf("invalid domain %q: it resolves to the non-public address %s", host, addr)
+		}
+	}
+	return nil
+}
+
+// isPublicAddr reports whether the address is a global unicast address outside the private and reserved ranges.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newJobID returns a random ID for a job.
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Worker capture attaches to the service workers and dedicated and shared workers started by the page, whose
+	// requests bypass the page's context, and records the requests they send with the cookies set in the responses,
+	// and the IndexedDB and Cache Storage writes of their origins. Requests a worker sends right after it starts, before
+	// it is attached, are only seen by the proxy
+	CaptureWorkers = false
+	WorkersFile    = "workers.csv"
+
+	// Kinds of worker activity
+	workerRequest      = "request"
+	workerIndexedDB    = "indexeddb"
+	workerCacheStorage = "cache-storage"
+)
+
+// workerTypes are the types of the targets attached to as workers.
+var workerTypes = map[string]bool{"service_worker": true, "worker": true, "shared_worker": true}
+
+// workerInfo is a worker attached to.
+type workerInfo struct {
+	Type string // Type is the worker's target type, e.g. service_worker.
+	URL  string // URL is the URL of the worker's script.
+}
+
+// workerActivity is a request sent by a worker, or a storage write of its origin.
+type workerActivity struct {
+	Worker  workerInfo
+	Kind    string
+	URL     string   // URL is the URL requested without its query, or the origin written to.
+	Name    string   // Name is the IndexedDB database and object store, or the cache, written to.
+	Party   string   // Party is the party of the host requested or written to, see party.go.
+	Cookies []string // Cookies holds the names of the cookies set by the response to a request.
+	Page    string   // Page is the URL of the page open at the time.
+	Time    time.Time
+}
+
+// workerLog collects the activity of the workers attached to while scanning a domain.
+type workerLog struct {
+	mu         sync.Mutex
+	parties    *partyClassifier
+	tracker    *pageTracker
+	attached   map[target.ID]bool
+	origins    map[string]workerInfo // origins maps the origins whose storage is tracked to their first worker.
+	requests   map[string]int        // requests maps the worker's target ID and request ID to the index of the request in activities.
+	pending    map[string][]string   // pending maps the requests whose cookies were reported before the request to the cookies' names.
+	writes     map[string]bool       // writes holds the storage written to, by origin, kind and name.
+	activities []workerActivity
+}
+
+// newWorkerLog returns an empty log classifying hosts with the parties of the scanned site.
+func newWorkerLog(parties *partyClassifier, tracker *pageTracker) *workerLog {
+	return &workerLog{
+		parties:  parties,
+		tracker:  tracker,
+		attached: map[target.ID]bool{},
+		origins:  map[string]workerInfo{},
+		requests: map[string]int{},
+		pending:  map[string][]string{},
+		writes:   map[string]bool{},
+	}
+}
+
+// autoAttachWorkers returns a chromedp Action which makes the page's target attach to the workers it starts, in
+// flattened sessions on the page's connection, so they are reported as target.EventAttachedToTarget and attached to
+// by attach. It does nothing unless CaptureWorkers is set.
+func autoAttachWorkers() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CaptureWorkers {
+			return nil
+		}
+		return (&target.SetAutoAttachParams{AutoAttach: true, Flatten: true}).Do(ctx)
+	})
+}
+
+// attach attaches to the target if it is a worker not attached to yet, enabling the network domain in the worker's
+// session to listen for its network activity, and tracking the storage of its origin in the page's context ctx. It returns without waiting for the attachment.
+func (l *workerLog) attach(ctx context.Context, info *target.Info) {
+	if info == nil || !workerTypes[info.Type] {
+		return
+	}
+	l.mu.Lock()
+	if l.attached[info.TargetID] {
+		l.mu.Unlock()
+		return
+	}
+	l.attached[info.TargetID] = true
+	l.mu.Unlock()
+
+	worker := workerInfo{Type: info.Type, URL: info.URL}
+	go func() {
+		// The worker's context is cancelled along with the page's, as cancelling it earlier would close the worker
+		workerCtx, _ := chromedp.NewContext(ctx, chromedp.WithTargetID(info.TargetID))
+		chromedp.ListenTarget(workerCtx, func(ev interface{}) {
+			switch ev := ev.(type) {
+			case *network.EventRequestWillBeSent:
+				l.addRequest(info.TargetID, worker, ev)
+			case *network.EventResponseReceivedExtraInfo:
+				l.addCookies(info.TargetID, ev)
+			}
+		})
+		if err := chromedp.Run(workerCtx, network.Enable()); err != nil {
+			logging.FromContext(ctx).Warn("Error attaching to worker", "type", worker.Type, "url", worker.URL, "error", err)
+			return
+		}
+		logging.FromContext(ctx).Debug("Attached to worker", "type", worker.Type, "url", worker.URL)
+
+		origin := workerOrigin(worker.URL)
+		if origin == "" {
+			return
+		}
+		l.mu.Lock()
+		_, tracked := l.origins[origin]
+		if !tracked {
+			l.origins[origin] = worker
+		}
+		l.mu.Unlock()
+		if !tracked {
+			if err := chromedp.Run(ctx, storage.TrackIndexedDBForOrigin(origin), storage.TrackCacheStorageForOrigin(origin)); err != nil {
+				logging.FromContext(ctx).Warn("Error tracking the storage of the worker's origin", "origin", origin, "error", err)
+			}
+		}
+	}()
+}
+
+// addRequest records a request sent by the worker.
+func (l *workerLog) addRequest(id target.ID, worker workerInfo, ev *network.EventRequestWillBeSent) {
+	u, err := url.Parse(ev.Request.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+	party, _ := l.parties.classify(u.Hostname())
+	key := string(id) + "/" + string(ev.RequestID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests[key] = len(l.activities)
+	l.activities = append(l.activities, workerActivity{Worker: worker, Kind: workerRequest, URL: (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String(), Party: party, Cookies: l.pending[key], Page: l.tracker.Get(), Time: time.Now()})
+	delete(l.pending, key)
+}
+
+// addCookies records the names of the cookies set by the response to a request of the worker.
+func (l *workerLog) addCookies(id target.ID, ev *network.EventResponseReceivedExtraInfo) {
+	var names []string
+	for name, value := range ev.Headers {
+		if v, ok := value.(string); ok && strings.EqualFold(name, "set-cookie") {
+			for _, c := range (&http.Response{Header: http.Header{"Set-Cookie": strings.Split(v, "\n")}}).Cookies() {
+				names = append(names, c.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	key := string(id) + "/" + string(ev.RequestID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i, ok := l.requests[key]; ok {
+		l.activities[i].Cookies = append(l.activities[i].Cookies, names...)
+	} else {
+		l.pending[key] = append(l.pending[key], names...)
+	}
+}
+
+// addStorageWrite records a write to the storage of a worker's origin, once per database and object store or cache.
+func (l *workerLog) addStorageWrite(origin string, kind string, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	worker, tracked := l.origins[origin]
+	key := origin + " " + kind + " " + name
+	if !tracked || l.writes[key] {
+		return
+	}
+	l.writes[key] = true
+	party := ""
+	if u, err := url.Parse(origin); err == nil {
+		party, _ = l.parties.classify(u.Hostname())
+	}
+	l.activities = append(l.activities, workerActivity{Worker: worker, Kind: kind, URL: origin, Name: name, Party: party, Page: l.tracker.Get(), Time: time.Now()})
+}
+
+// handleStorageEvent records the storage writes reported to the page for the origins of the workers.
+func (l *workerLog) handleStorageEvent(ev interface{}) {
+	switch ev := ev.(type) {
+	case *storage.EventIndexedDBContentUpdated:
+		l.addStorageWrite(ev.Origin, workerIndexedDB, ev.DatabaseName+"/"+ev.ObjectStoreName)
+	case *storage.EventCacheStorageContentUpdated:
+		l.addStorageWrite(ev.Origin, workerCacheStorage, ev.CacheName)
+	}
+}
+
+// get returns the activity recorded so far, in the order it happened.
+func (l *workerLog) get() []workerActivity {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	activities := append([]workerActivity(nil), l.activities...)
+	sort.SliceStable(activities, func(i, j int) bool { return activities[i].Time.Before(activities[j].Time) })
+	return activities
+}
+
+// workerOrigin returns the origin of the worker's script URL, or an empty string if it has none, e.g. for blob URLs.
+func workerOrigin(scriptURL string) string {
+	u, err := url.Parse(scriptURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// workerRows builds the workers CSV rows of the domain.
+func workerRows(domain string, activities []workerActivity) [][]string {
+	var rows [][]string
+	for _, a := range activities {
+		rows = append(rows, []string{domain, a.Worker.Type, a.Worker.URL, a.Kind, a.URL, a.Name, a.Party, strings.Join(a.Cookies, " "), a.Page, a.Time.Format(time.RFC3339)})
+	}
+	return rows
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/browser"
+)
+
+// chromedpSession implements browser.Session on the chromedp tab of ctx, so the TCF probes in package tcf can be used
+// from chromedp Actions.
+type chromedpSession struct {
+	ctx context.Context
+}
+
+var _ browser.Session = chromedpSession{}
+
+// Navigate loads the URL and waits for the page to load.
+func (s chromedpSession) Navigate(url string) error {
+	return chromedp.Navigate(url).Do(s.ctx)
+}
+
+// Reload reloads the current page and waits for it to load.
+func (s chromedpSession) Reload() error {
+	return chromedp.Reload().Do(s.ctx)
+}
+
+// Evaluate evaluates the JavaScript expression on the current page, awaiting the promise it may evaluate to.
+func (s chromedpSession) Evaluate(js string, res interface{}) error {
+	return chromedp.Evaluate(js, res, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		return p.WithAwaitPromise(true)
+	}).Do(s.ctx)
+}
+
+// Cookies returns the cookies the browser sends to the current page.
+func (s chromedpSession) Cookies() ([]*http.Cookie, error) {
+	cookies, err := network.GetCookies().Do(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Secure:   c.Secure,
+			HttpOnly: c.HTTPOnly,
+		}
+		if !c.Session {
+			cookie.Expires = time.Unix(int64(c.Expires), 0)
+		}
+		result = append(result, cookie)
+	}
+	return result, nil
+}
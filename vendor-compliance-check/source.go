@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+)
+
+// domainSource hands out the domains a run scans, and records what became of them.
+type domainSource interface {
+	// next returns the next domain to scan and the number of domains left including it, or false once there are none.
+	next() (string, int, bool)
+	// claim reports whether the domain should be scanned by this run.
+	claim(domain string) bool
+	// skip records that the domain was not scanned for the given reason.
+	skip(domain string, reason string)
+	// finish records the result of the domain's scan, once its rows have been written to the outputs.
+	finish(domain string, result scanResult)
+}
+
+// newDomainSource returns the source of the domains to scan: the input selected by the flags, see input.go, or the
+// coordinator with -coordinator.
+func newDomainSource() domainSource {
+	if *coordinatorURL != "" {
+		return newWorkerSource(*coordinatorURL)
+	}
+
+	// Read domains from the domains file, or the input selected by the flags
+	domains, err := readDomains()
+	if err != nil {
+		fatal("Error reading domains", "error", err)
+	}
+
+	// Open the state database in which the progress is kept
+	store, err := state.Open(StateFile)
+	if err != nil {
+		fatal("Error opening state database", "error", err)
+	}
+
+	// Order the domains with the seed of the run, see reproducibility.go, then skip those already processed
+	domains = pendingDomains(store, orderDomains(domains))
+	slog.Info("Domains left to process", "count", len(domains))
+	return &fileSource{store: store, domains: domains}
+}
+
+// fileSource hands out the domains of the domains file that are not done yet, keeping their progress in the state
+// database.
+type fileSource struct {
+	store   state.Storage
+	domains []string
+}
+
+func (s *fileSource) next() (string, int, bool) {
+	if len(s.domains) == 0 {
+		return "", 0, false
+	}
+	domain, left := s.domains[0], len(s.domains)
+	s.domains = s.domains[1:]
+	return domain, left, true
+}
+
+func (s *fileSource) claim(domain string) bool {
+	return claimDomain(s.store, domain)
+}
+
+func (s *fileSource) skip(domain string, reason string) {
+	skipDomain(s.store, domain, reason)
+}
+
+func (s *fileSource) finish(domain string, result scanResult) {
+	finishDomain(s.store, domain, result)
+}
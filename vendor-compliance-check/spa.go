@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+const (
+	// Single-page apps may only mount their CMP once the app has rendered, or after client-side routing. If the TCF
+	// API is not found on initial load, the crawler watches the DOM for the CMP to mount and, if it does not, follows
+	// internal links within the app without reloading it, so such sites are not mistaken for sites without a CMP
+	WaitForSPAMount = false            // WaitForSPAMount makes the crawler wait for a late-mounted CMP before concluding the TCF API is missing.
+	SPAMountTimeout = 10 * time.Second // SPAMountTimeout specifies how long to wait for the CMP to mount on each route.
+	SPARouteLimit   = 0                // SPARouteLimit specifies the number of client-side routes visited at most while waiting, 0 only waits on the landing page.
+
+	// Selectors of the containers mounted by common CMPs, whose banner may appear before the TCF API is defined
+	cmpContainerSelectors = `#onetrust-banner-sdk, #qc-cmp2-container, .qc-cmp2-container, #didomi-host, #usercentrics-root, ` +
+		`[id^="sp_message_container"], #CybotCookiebotDialog, .fc-consent-root, #cmpbox, #truste-consent-track`
+
+	// JavaScript which resolves to true once the TCF API, its locator frame or a CMP container is present, watching
+	// DOM mutations and polling, as the API may be defined without changing the DOM, or to false after the timeout
+	cmpMountJS = `
+		new Promise((resolve) => {
+			const mounted = () => typeof window.__tcfapi === 'function' || !!window.frames['__tcfapiLocator'] ||
+				document.querySelector('` + cmpContainerSelectors + `') !== null;
+			if (mounted()) {
+				resolve(true);
+				return;
+			}
+
+			const done = (value) => {
+				observer.disconnect();
+				clearInterval(poll);
+				clearTimeout(timer);
+				resolve(value);
+			};
+			const observer = new MutationObserver(() => mounted() && done(true));
+			observer.observe(document.documentElement, {childList: true, subtree: true, attributes: true});
+			const poll = setInterval(() => mounted() && done(true), 250);
+			const timer = setTimeout(() => done(false), %TIMEOUT%);
+		})
+	`
+
+	// JavaScript which navigates the app to the route %HREF% the way a user would, by clicking a link to it, falling
+	// back to pushing it to the history for routers listening to popstate
+	spaRouteJS = `
+		(() => {
+			const href = %HREF%;
+			const link = Array.from(document.querySelectorAll('a[href]')).find((a) => a.href === href);
+			if (link) {
+				link.click();
+				return true;
+			}
+			history.pushState(null, '', href);
+			window.dispatchEvent(new PopStateEvent('popstate', {state: null}));
+			return false;
+		})()
+	`
+)
+
+// waitForSPAMount returns a chromedp Action which, if the TCF API is not present on the current page, waits for a CMP
+// to mount and follows up to SPARouteLimit client-side routes until one does. The route on which the CMP mounted is
+// stored in route, and the page stays on it so consent is injected there. It does nothing unless WaitForSPAMount is
+// set.
+func waitForSPAMount(targetURL string, tracker *pageTracker, route *string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !WaitForSPAMount {
+			return nil
+		}
+		if mode, err := tcf.DetectMode(chromedpSession{ctx}); err == nil && mode != tcf.ModeNone {
+			return nil
+		}
+
+		if waitForCMPMount(ctx) {
+			logging.FromContext(ctx).Info("CMP mounted late on the landing page")
+			return waitForTcfApi(*tcfTimeout).Do(ctx)
+		}
+		if SPARouteLimit == 0 {
+			return nil
+		}
+
+		u, err := url.Parse(targetURL)
+		if err != nil {
+			return nil
+		}
+		var links []string
+		if err := getInternalLinks(u.Hostname(), &links).Do(ctx); err != nil {
+			return nil
+		}
+
+		seen := map[string]bool{targetURL: true, targetURL + "/": true}
+		visited := 0
+		for _, link := range links {
+			if seen[link] || visited >= SPARouteLimit {
+				continue
+			}
+			seen[link] = true
+			visited++
+
+			clicked, err := navigateRoute(ctx, link)
+			if err != nil {
+				logging.FromContext(ctx).Debug("Error navigating to route", "route", link, "error", err)
+				continue
+			}
+			tracker.Set(link)
+			if waitForCMPMount(ctx) {
+				logging.FromContext(ctx).Info("CMP mounted after client-side routing", "route", link, "clicked", clicked)
+				*route = link
+				return waitForTcfApi(*tcfTimeout).Do(ctx)
+			}
+		}
+
+		logging.FromContext(ctx).Info("No CMP mounted on the visited routes", "routes", visited)
+		return nil
+	})
+}
+
+// waitForCMPMount reports whether a CMP mounts on the current page within SPAMountTimeout. Errors, e.g. as a link
+// caused a full navigation, count as not mounted.
+func waitForCMPMount(ctx context.Context) bool {
+	mountCtx, cancel := context.WithTimeout(ctx, SPAMountTimeout+time.Second)
+	defer cancel()
+
+	var mounted bool
+	js := strings.Replace(cmpMountJS, "%TIMEOUT%", strconv.FormatInt(SPAMountTimeout.Milliseconds(), 10), 1)
+	if err := (chromedpSession{mountCtx}).Evaluate(js, &mounted); err != nil {
+		logging.FromContext(ctx).Debug("Error waiting for the CMP to mount", "error", err)
+		return false
+	}
+	return mounted
+}
+
+// navigateRoute navigates the app to the given route without reloading it, and reports whether a link to it was
+// clicked rather than the route pushed to the history.
+func navigateRoute(ctx context.Context, route string) (bool, error) {
+	href, err := json.Marshal(route)
+	if err != nil {
+		return false, err
+	}
+
+	var clicked bool
+	err = chromedp.Evaluate(strings.Replace(spaRouteJS, "%HREF%", string(href), 1), &clicked).Do(ctx)
+	return clicked, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/SirDataFR/iabtcfv2"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Stack validation detects the IAB stacks a CMP presents in its UI and validates them against the GVL stack definitions
+	ValidateStacks = false
+	StacksFile     = "stacks.csv"
+	VendorListURL  = "https://vendor-list.consensu.org/v2/vendor-list.json"
+
+	// JavaScript to collect the visible text of the page, including open shadow roots and same-origin iframes in which CMPs render their UI,
+	// leaving out the source of scripts and styles
+	pageTextJS = `
+			(() => {
+				const texts = [];
+				const collect = (doc) => {
+					if (!doc || !doc.body) {
+						return;
+					}
+					texts.push(doc.body.innerText || '');
+					doc.querySelectorAll('*').forEach((el) => {
+						if (el.shadowRoot) {
+							Array.from(el.shadowRoot.children).forEach((child) => {
+								if (child.tagName !== 'SCRIPT' && child.tagName !== 'STYLE') {
+									texts.push(child.innerText || '');
+								}
+							});
+						}
+					});
+					doc.querySelectorAll('iframe').forEach((frame) => {
+						try {
+							collect(frame.contentDocument);
+						} catch (e) {}
+					});
+				};
+				collect(document);
+				return texts.join('\n');
+			})()
+		`
+)
+
+// Stack represents a stack of purposes and special features as defined in the Global Vendor List.
+type Stack struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	Purposes        []int  `json:"purposes"`
+	SpecialFeatures []int  `json:"specialFeatures"`
+}
+
+// fetchStacks retrieves the stack definitions from the Global Vendor List found at the given URL.
+func fetchStacks(url string) (map[string]Stack, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var vendorList struct {
+		Stacks map[string]Stack `json:"stacks"`
+	}
+	if err := json.Unmarshal(body, &vendorList); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vendor list JSON from %s: %v", url, err)
+	}
+
+	return vendorList.Stacks, nil
+}
+
+// capturePageText returns a chromedp Action which stores the visible text of the current page.
+// It does nothing unless ValidateStacks is set.
+func capturePageText(pageText *string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !ValidateStacks {
+			return nil
+		}
+
+		if err := chromedp.Evaluate(pageTextJS, pageText).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error capturing the page text", "error", err)
+		}
+		return nil
+	})
+}
+
+// normalizeText lowercases the given text and collapses all whitespace into single spaces.
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// detectStacks returns the stacks whose name appears as whole words in the given page text, ordered by stack ID.
+// CMPs that translate the stack names cannot be detected this way.
+func detectStacks(pageText string, stacks map[string]Stack) []Stack {
+	text := normalizeText(pageText)
+
+	var detected []Stack
+	for _, stack := range stacks {
+		if stack.Name != "" && containsWords(text, normalizeText(stack.Name)) {
+			detected = append(detected, stack)
+		}
+	}
+
+	sort.Slice(detected, func(i, j int) bool {
+		return detected[i].ID < detected[j].ID
+	})
+	return detected
+}
+
+// containsWords reports whether the phrase appears in the text between word boundaries, so a name is not found within
+// a longer word or number, e.g. "stack 1" in "stack 10".
+func containsWords(text string, phrase string) bool {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], phrase)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(phrase)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// isWordRune reports whether r is part of a word, as opposed to the spaces and punctuation between words.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// validateStacks checks the presented stacks against the TCF policy and returns the issues found.
+// Presented stacks may not share purposes or special features, and CMPs may not signal the use of non-standard stacks.
+func validateStacks(presented []Stack, apiTcString string) []string {
+	var issues []string
+
+	for i := 0; i < len(presented); i++ {
+		for j := i + 1; j < len(presented); j++ {
+			for _, purpose := range intersect(presented[i].Purposes, presented[j].Purposes) {
+				issues = append(issues, fmt.Sprintf("stacks %d and %d both include purpose %d", presented[i].ID, presented[j].ID, purpose))
+			}
+			for _, feature := range intersect(presented[i].SpecialFeatures, presented[j].SpecialFeatures) {
+				issues = append(issues, fmt.Sprintf("stacks %d and %d both include special feature %d", presented[i].ID, presented[j].ID, feature))
+			}
+		}
+	}
+
+	if apiTcString != "" {
+		tcData, err := iabtcfv2.Decode(apiTcString)
+		if err != nil {
+			slog.Warn("Error decoding the TC string returned by the CMP", "error", err)
+		} else if tcData.CoreString.UseNonStandardStacks {
+			issues = append(issues, "CMP TC string signals non-standard stacks")
+		}
+	}
+
+	return issues
+}
+
+// intersect returns the values present in both a and b.
+func intersect(a, b []int) []int {
+	var common []int
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				common = append(common, x)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// stackRow builds the stacks CSV row for a single domain.
+func stackRow(domain string, presented []Stack, issues []string) []string {
+	var ids, names []string
+	for _, stack := range presented {
+		ids = append(ids, strconv.Itoa(stack.ID))
+		names = append(names, stack.Name)
+	}
+	return []string{domain, strings.Join(ids, "; "), strings.Join(names, "; "), strings.Join(issues, "; ")}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Progress is kept in the state database shared with the other tools, see the scan-state tool to inspect or reset it
+	StateFile  = "../scan-state.db"
+	StateTool  = "vendor-compliance-check" // StateTool is the name under which the progress of this tool is stored, see stateTool.
+	StaleAfter = 3 * RunTimeout            // StaleAfter specifies after how long a domain left running, e.g. by a stopped run, is processed again.
+)
+
+// stateTool returns the name under which the progress of the domain is stored: StateTool for domains scanned with the
+// default profile and the accept-all consent, or else StateTool followed by their profiles, e.g.
+// "vendor-compliance-check@returning-user", so runs scanning the same domains with other profiles keep their own
+// progress.
+func stateTool(domain string) string {
+	var profiles []string
+	if optionsFor(domain).ReturningUser {
+		profiles = append(profiles, profileReturningUser)
+	}
+	if name := consentProfile().Name; name != tcfaudit.AcceptAll.Name {
+		profiles = append(profiles, name)
+	}
+	if len(profiles) == 0 {
+		return StateTool
+	}
+	return StateTool + "@" + strings.Join(profiles, "+")
+}
+
+// claimDomain reports whether the domain should be processed by this run, marking it as running if so.
+func claimDomain(store state.Storage, domain string) bool {
+	err := store.Claim(stateTool(domain), domain, StaleAfter)
+	if errors.Is(err, state.ErrSkip) {
+		slog.Debug("Skipping domain that is done or being processed elsewhere", "domain", domain)
+		return false
+	}
+	if err != nil {
+		slog.Error("Error claiming domain", "domain", domain, "error", err)
+		return false
+	}
+	return true
+}
+
+// pendingDomains returns the domains that are not done yet, in their original order.
+func pendingDomains(store state.Storage, domains []string) []string {
+	done := map[string]bool{} // done holds the domains that are done, keyed by their tool and domain.
+	listed := map[string]bool{}
+	for _, domain := range domains {
+		tool := stateTool(domain)
+		if listed[tool] {
+			continue
+		}
+		listed[tool] = true
+		records, err := store.List(tool)
+		if err != nil {
+			slog.Error("Error listing domain states", "tool", tool, "error", err)
+			continue
+		}
+		for _, r := range records {
+			done[tool+"|"+r.Domain] = r.Status == state.StatusDone
+		}
+	}
+
+	var pending []string
+	for _, domain := range domains {
+		if !done[stateTool(domain)+"|"+domain] {
+			pending = append(pending, domain)
+		}
+	}
+	return pending
+}
+
+// skipDomain marks the domain as skipped for the given reason, so it is clear it was not processed.
+func skipDomain(store state.Storage, domain string, reason string) {
+	if err := store.Skip(stateTool(domain), domain, reason); err != nil {
+		slog.Error("Error saving domain state", "domain", domain, "error", err)
+	}
+}
+
+// finishDomain marks the domain as done, as partial if the run budget cut its scan short, or as failed if its scan
+// failed, and records the files its results were written to. Partial and failed domains are scanned again by the next
+// run. Sites without the TCF API are done.
+func finishDomain(store state.Storage, domain string, result scanResult) {
+	if err := store.Finish(stateTool(domain), domain, scanError(result), domainArtifacts(domain)); err != nil {
+		slog.Error("Error saving domain state", "domain", domain, "error", err)
+	}
+}
+
+// scanError returns the error with which the scan failed, wrapping state.ErrPartial if the run budget cut it short, or
+// nil if it succeeded or found no TCF API.
+func scanError(result scanResult) error {
+	if result.ErrorClass != "" && result.ErrorClass != errorTCFMissing {
+		return fmt.Errorf("%s: %w", result.ErrorClass, result.Err)
+	}
+	if result.Truncated {
+		return fmt.Errorf("%w: the domain's share of the run budget ran out", state.ErrPartial)
+	}
+	return nil
+}
+
+// domainArtifacts returns the paths of the outputs written for the domain, keyed by kind.
+func domainArtifacts(domain string) map[string]string {
+	artifacts := map[string]string{
+		"cookies":   outfile.Path(rotation.Name(OutputFile)),
+		"tcf_modes": outfile.Path(rotation.Name(TCFModesFile)),
+		"verdicts":  outfile.Path(rotation.Name(VerdictsFile)),
+		"anomalies": outfile.Path(rotation.Name(AnomaliesFile)),
+	}
+	if MatchGVL != "" {
+		artifacts["gvl_matched"] = outfile.Path(rotation.Name(MatchedResultsFile))
+		artifacts["gvl_partial"] = outfile.Path(rotation.Name(PartialMatchFile))
+		artifacts["gvl_unmatched"] = outfile.Path(rotation.Name(UnmatchedResultsFile))
+	}
+	if ValidateStacks {
+		artifacts["stacks"] = outfile.Path(rotation.Name(StacksFile))
+	}
+	if SubPageLimit > 0 {
+		artifacts["pages"] = outfile.Path(rotation.Name(PagesFile))
+	}
+	if CompareHostVariants {
+		artifacts["host_variants"] = outfile.Path(rotation.Name(HostVariantsFile))
+	}
+	if TrackEventStatus {
+		artifacts["event_status"] = outfile.Path(rotation.Name(EventStatusFile))
+	}
+	if DetectConsentTransmission {
+		artifacts["consent_transmissions"] = outfile.Path(rotation.Name(ConsentTransmissionsFile))
+	}
+	if CaptureStorage {
+		artifacts["storage"] = outfile.Path(rotation.Name(StorageFile))
+	}
+	if LogRequests {
+		artifacts["requests"] = outfile.Path(rotation.Name(RequestsFile))
+	}
+	if VisitWithoutJS {
+		artifacts["nojs_cookies"] = outfile.Path(rotation.Name(NoJSFile))
+	}
+	if TrackFrameConsent {
+		artifacts["frame_consent"] = outfile.Path(rotation.Name(FrameConsentFile))
+	}
+	if DetectSpecialFeatures {
+		artifacts["special_features"] = outfile.Path(rotation.Name(SpecialFeaturesFile))
+	}
+	if DetectFrameworks {
+		artifacts["frameworks"] = outfile.Path(rotation.Name(FrameworksFile))
+	}
+	if CheckCMPConformance {
+		artifacts["cmp_conformance"] = outfile.Path(rotation.Name(CMPConformanceFile))
+	}
+	if CaptureInitialConsent {
+		artifacts["initial_consent"] = outfile.Path(rotation.Name(InitialConsentFile))
+	}
+	if VerifyCMPMetadata {
+		artifacts["cmp_verification"] = outfile.Path(rotation.Name(CMPVerificationFile))
+	}
+	if DetectMultipleCMPs {
+		artifacts["multiple_cmps"] = outfile.Path(rotation.Name(MultipleCMPsFile))
+	}
+	if DetectConsentWalls {
+		artifacts["consent_walls"] = outfile.Path(rotation.Name(ConsentWallsFile))
+	}
+	if DetectCookieSyncs {
+		artifacts["cookie_syncs"] = outfile.Path(rotation.Name(CookieSyncsFile))
+	}
+	if USPrivacyMode {
+		artifacts["us_privacy"] = outfile.Path(rotation.Name(USPrivacyFile))
+	}
+	if CaptureTLS {
+		artifacts["tls_endpoints"] = outfile.Path(rotation.Name(TLSFile))
+	}
+	if InspectIframes {
+		artifacts["iframes"] = outfile.Path(rotation.Name(IframesFile))
+	}
+	if CaptureWorkers {
+		artifacts["workers"] = outfile.Path(rotation.Name(WorkersFile))
+	}
+	if MeasureCMPLatency {
+		artifacts["cmp_latency"] = outfile.Path(rotation.Name(CMPLatencyFile))
+	}
+	if vendorGatingEnabled() {
+		artifacts["vendor_gating"] = outfile.Path(rotation.Name(VendorGatingFile))
+	}
+	if blockingEnabled() {
+		artifacts["blocking"] = outfile.Path(rotation.Name(BlockingFile))
+	}
+	if SubdomainSampleSize > 0 {
+		artifacts["subdomains"] = outfile.Path(rotation.Name(SubdomainsFile))
+	}
+	if CaptureScreenshots {
+		artifacts["screenshots"] = filepath.Join(ScreenshotDir, entryHost(domain))
+	}
+	if CaptureEvidence {
+		artifacts["evidence"] = filepath.Join(EvidenceDir, entryHost(domain))
+	}
+	if PerDomainLogs {
+		artifacts["log"] = logConfig.FilePath(entryFileName(domain))
+	}
+	return artifacts
+}
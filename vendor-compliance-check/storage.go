@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/domstorage"
+	"github.com/chromedp/cdproto/indexeddb"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Storage capture dumps the localStorage, sessionStorage and IndexedDB entries of the origins of all frames,
+	// including third party iframes, on initial load, after consent injection and after reload, as vendors increasingly
+	// keep identifiers outside cookies. reference-gvl.go matches them against the storage disclosures of the GVL.
+	CaptureStorage        = false // CaptureStorage records the web storage entries of every frame's origin in storage.csv.
+	StorageFile           = "storage.csv"
+	MaxStorageEntries     = 100 // MaxStorageEntries specifies the number of entries read at most from each IndexedDB object store.
+	MaxStorageValueLength = 512 // MaxStorageValueLength specifies the length above which stored values are truncated in the output.
+	storageTypeLocal      = "localStorage"
+	storageTypeSession    = "sessionStorage"
+	storageTypeIndexedDB  = "indexedDB"
+)
+
+// storageItem is a single entry in the web storage of an origin.
+type storageItem struct {
+	Phase  string
+	Origin string
+	Type   string // Type is localStorage, sessionStorage or indexedDB.
+	Name   string // Name is the identifier disclosed in the GVL: the key for localStorage and sessionStorage, the database name for IndexedDB.
+	Key    string // Key is the object store and key of an IndexedDB entry.
+	Value  string
+}
+
+// captureStorage returns a chromedp Action which appends the web storage entries of the origins of all frames of the
+// current page to items. Errors reading a single origin's storage are logged and skipped. It does nothing unless
+// CaptureStorage is set.
+func captureStorage(phase string, items *[]storageItem) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !CaptureStorage {
+			return nil
+		}
+
+		tree, err := page.GetFrameTree().Do(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error getting the frame tree", "phase", phase, "error", err)
+			return nil
+		}
+
+		for _, frame := range storageFrames(tree, map[string]bool{}) {
+			origin := frame.SecurityOrigin
+			key, err := storage.GetStorageKeyForFrame(frame.ID).Do(ctx)
+			if err != nil {
+				logging.FromContext(ctx).Debug("Error getting the storage key", "origin", origin, "error", err)
+				continue
+			}
+
+			for _, local := range []bool{true, false} {
+				entries, err := domstorage.GetDOMStorageItems(&domstorage.StorageID{StorageKey: domstorage.SerializedStorageKey(key), IsLocalStorage: local}).Do(ctx)
+				if err != nil {
+					logging.FromContext(ctx).Debug("Error reading DOM storage", "origin", origin, "error", err)
+					continue
+				}
+				storageType := storageTypeLocal
+				if !local {
+					storageType = storageTypeSession
+				}
+				for _, entry := range entries {
+					if len(entry) == 2 {
+						*items = append(*items, storageItem{Phase: phase, Origin: origin, Type: storageType, Name: entry[0], Value: entry[1]})
+					}
+				}
+			}
+
+			*items = append(*items, indexedDBItems(ctx, phase, origin, string(key))...)
+		}
+		return nil
+	})
+}
+
+// storageFrames returns the first frame of each distinct security origin in the tree, skipping opaque origins. The
+// storage key of an origin's storage is looked up through its frame.
+func storageFrames(tree *page.FrameTree, seen map[string]bool) []*cdp.Frame {
+	var frames []*cdp.Frame
+	if frame := tree.Frame; frame != nil && strings.Contains(frame.SecurityOrigin, "://") && !seen[frame.SecurityOrigin] {
+		seen[frame.SecurityOrigin] = true
+		frames = append(frames, frame)
+	}
+	for _, child := range tree.ChildFrames {
+		frames = append(frames, storageFrames(child, seen)...)
+	}
+	return frames
+}
+
+// indexedDBItems returns up to MaxStorageEntries entries of every object store of every IndexedDB database stored under
+// the storage key of the origin.
+func indexedDBItems(ctx context.Context, phase string, origin string, key string) []storageItem {
+	names, err := indexeddb.RequestDatabaseNames().WithStorageKey(key).Do(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Debug("Error listing IndexedDB databases", "origin", origin, "error", err)
+		return nil
+	}
+
+	var items []storageItem
+	for _, name := range names {
+		database, err := indexeddb.RequestDatabase(name).WithStorageKey(key).Do(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Debug("Error reading IndexedDB database", "origin", origin, "database", name, "error", err)
+			continue
+		}
+		for _, store := range database.ObjectStores {
+			entries, _, err := indexeddb.RequestData(name, store.Name, "", 0, MaxStorageEntries).WithStorageKey(key).Do(ctx)
+			if err != nil {
+				logging.FromContext(ctx).Debug("Error reading IndexedDB object store", "origin", origin, "database", name, "store", store.Name, "error", err)
+				continue
+			}
+			for _, entry := range entries {
+				items = append(items, storageItem{Phase: phase, Origin: origin, Type: storageTypeIndexedDB, Name: name, Key: store.Name + "/" + remoteObjectString(entry.Key), Value: remoteObjectString(entry.Value)})
+			}
+		}
+	}
+	return items
+}
+
+// remoteObjectString returns the value of a primitive or JSON remote object, or its description otherwise.
+func remoteObjectString(object *runtime.RemoteObject) string {
+	if object == nil {
+		return ""
+	}
+	if len(object.Value) > 0 {
+		var s string
+		if json.Unmarshal(object.Value, &s) == nil {
+			return s
+		}
+		return string(object.Value)
+	}
+	return object.Description
+}
+
+// isThirdPartyOrigin reports whether the origin is outside the site of targetURL.
+func isThirdPartyOrigin(origin string, targetURL string) bool {
+	o, err := url.Parse(origin)
+	if err != nil {
+		return true
+	}
+	t, err := url.Parse(targetURL)
+	if err != nil {
+		return true
+	}
+	return registrableDomain(o.Hostname()) != registrableDomain(t.Hostname())
+}
+
+// storageRow builds the storage CSV row for a single entry, truncating long values.
+func storageRow(domain string, result scanResult, item storageItem) []string {
+	value := item.Value
+	if len(value) > MaxStorageValueLength {
+		value = value[:MaxStorageValueLength] + "..."
+	}
+	return []string{domain, item.Phase, item.Origin, fmt.Sprint(isThirdPartyOrigin(item.Origin, targetURL(domain))), item.Type, item.Name, item.Key, value, result.TCString}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Subdomain sampling checks whether the consent set on the scanned host is honored on a few of the site's subdomains
+	SubdomainSampleSize = 0 // SubdomainSampleSize specifies the maximum number of subdomains visited per domain, 0 disables subdomain sampling.
+	SubdomainsFile      = "subdomains.csv"
+	TLSDialTimeout      = 10 * time.Second // TLSDialTimeout specifies the maximum duration of time allowed to fetch a site's certificate.
+)
+
+// subdomainCandidate is a subdomain of the scanned site along with where it was found.
+type subdomainCandidate struct {
+	Host   string
+	Source string // Source is either "links", for subdomains linked from the homepage, or "certificate", for subdomains taken from the certificate's SANs.
+	Links  int    // Links counts the links on the homepage pointing to the subdomain, which serves as an indication of its traffic.
+}
+
+// subdomainResult holds the consent related values captured on a single subdomain.
+type subdomainResult struct {
+	subdomainCandidate
+	APITCString   string
+	EventStatus   string
+	ConsentCookie bool // ConsentCookie reports whether the browser sends an euconsent-v2 cookie set by the site to the subdomain.
+}
+
+// siteDomain returns the domain of which subdomains are sampled, i.e. the given host without its www prefix.
+func siteDomain(host string) string {
+	return strings.TrimPrefix(host, "www.")
+}
+
+// isSampledSubdomain reports whether host is a subdomain of site other than its www variant.
+func isSampledSubdomain(host string, site string) bool {
+	return strings.HasSuffix(host, "."+site) && host != "www."+site && !strings.HasPrefix(host, "*.")
+}
+
+// certificateSubdomains returns the subdomains of site listed in the subject alternative names of the certificate served by host.
+func certificateSubdomains(host string, site string) []string {
+	dialer := &net.Dialer{Timeout: TLSDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, "443"), &tls.Config{ServerName: host})
+	if err != nil {
+		slog.Info("Error fetching certificate", "host", host, "error", err)
+		return nil
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	var subdomains []string
+	for _, name := range certs[0].DNSNames {
+		name = strings.ToLower(name)
+		if isSampledSubdomain(name, site) {
+			subdomains = append(subdomains, name)
+		}
+	}
+	return subdomains
+}
+
+// discoverSubdomains returns up to SubdomainSampleSize subdomains of the site the browser is on. Subdomains linked from
+// the current page come first, ordered by the number of links pointing to them, followed by those found in the certificate.
+func discoverSubdomains(ctx context.Context, targetURL string) []subdomainCandidate {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error parsing URL", "url", targetURL, "error", err)
+		return nil
+	}
+	site := siteDomain(u.Hostname())
+
+	var hrefs []string
+	if err := chromedp.Run(ctx, chromedp.Evaluate(linksJS, &hrefs)); err != nil {
+		logging.FromContext(ctx).Warn("Error collecting links", "error", err)
+	}
+
+	linkCounts := map[string]int{}
+	for _, href := range hrefs {
+		if link, err := url.Parse(href); err == nil && isSampledSubdomain(strings.ToLower(link.Hostname()), site) {
+			linkCounts[strings.ToLower(link.Hostname())]++
+		}
+	}
+
+	var candidates []subdomainCandidate
+	for host, count := range linkCounts {
+		candidates = append(candidates, subdomainCandidate{Host: host, Source: "links", Links: count})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Links != candidates[j].Links {
+			return candidates[i].Links > candidates[j].Links
+		}
+		return candidates[i].Host < candidates[j].Host
+	})
+
+	for _, host := range certificateSubdomains(u.Hostname(), site) {
+		if _, found := linkCounts[host]; !found {
+			candidates = append(candidates, subdomainCandidate{Host: host, Source: "certificate"})
+			linkCounts[host] = 0
+		}
+	}
+
+	if len(candidates) > SubdomainSampleSize {
+		candidates = candidates[:SubdomainSampleSize]
+	}
+	return candidates
+}
+
+// checkSubdomains visits the given subdomains in the current tab, so the consent stored for the scanned host is
+// available to them, and captures the TC string, event status and presence of the consent cookie on each of them. Only
+// consent cookies set by the site count, not the one the crawler stored when injecting tcString.
+func checkSubdomains(ctx context.Context, candidates []subdomainCandidate, tcString string, tracker *pageTracker) []subdomainResult {
+	var results []subdomainResult
+	for _, candidate := range candidates {
+		subdomainURL := "https://" + candidate.Host
+		result := subdomainResult{subdomainCandidate: candidate}
+
+		tracker.Set(subdomainURL)
+		subCtx, cancel := context.WithTimeout(ctx, SubPageTimeout)
+		if err := chromedp.Run(subCtx,
+			chromedp.Navigate(subdomainURL),
+			waitForTcfApi(*tcfTimeout),
+			getTCstring(&result.APITCString),
+			getTcEventStatus(&result.EventStatus),
+			chromedp.ActionFunc(func(ctx context.Context) error {
+				cookies, err := chromedpSession{ctx}.Cookies()
+				if err != nil {
+					return err
+				}
+				for _, c := range cookies {
+					if c.Name == "euconsent-v2" && !injectedConsentCookie(c.Domain, c.Value, tcString) {
+						result.ConsentCookie = true
+					}
+				}
+				return nil
+			}),
+		); err != nil {
+			logging.FromContext(ctx).Error("Encountered an error checking subdomain", "host", candidate.Host, "error", err)
+			metrics.recordFailure(classifyError(err))
+		}
+		cancel()
+
+		results = append(results, result)
+	}
+	return results
+}
+
+// subdomainRow builds the subdomains CSV row for a single subdomain.
+func subdomainRow(domain string, tcString string, result subdomainResult) []string {
+	return []string{
+		domain,
+		result.Host,
+		result.Source,
+		fmt.Sprint(result.Links),
+		result.APITCString,
+		consentDiffJSON(tcString, result.APITCString),
+		result.EventStatus,
+		fmt.Sprint(result.ConsentCookie),
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/links"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+)
+
+const (
+	// Sub-page crawling repeats the cookie/TC string capture on internal pages after the homepage has been processed
+	SubPageLimit   = 0                // SubPageLimit specifies the maximum number of internal pages visited per domain, 0 disables sub-page crawling.
+	SubPageDepth   = 1                // SubPageDepth specifies how many links away from the homepage the crawler may go.
+	SubPageTimeout = 30 * time.Second // SubPageTimeout specifies the maximum duration of time allowed to process a single sub-page.
+	UseSitemap     = false            // UseSitemap makes the crawler take sub-pages from /sitemap.xml before falling back to links found on the homepage.
+	PagesFile      = "pages.csv"
+
+	sitemapMaxBytes = 10 << 20 // sitemapMaxBytes caps the size of a sitemap read into memory.
+
+	// JavaScript to collect the targets of all links on the page
+	linksJS = `Array.from(document.querySelectorAll('a[href]')).map((a) => a.href)`
+)
+
+// pageResult holds the consent related values captured on a single sub-page.
+type pageResult struct {
+	URL         string
+	Depth       int
+	APITCString string
+	EventStatus string
+}
+
+// pageTracker keeps track of the page the browser is visiting, so captured cookies can be attributed to it.
+type pageTracker struct {
+	mu  sync.Mutex
+	url string
+}
+
+// Set records the page the browser is about to visit.
+func (t *pageTracker) Set(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.url = url
+}
+
+// Get returns the page the browser is visiting.
+func (t *pageTracker) Get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.url
+}
+
+// getInternalLinks returns a chromedp Action which stores the internal links found on the current page.
+func getInternalLinks(host string, found *[]string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var hrefs []string
+		if err := chromedp.Evaluate(linksJS, &hrefs).Do(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Error collecting links", "error", err)
+			return nil
+		}
+
+		for _, href := range hrefs {
+			if link, ok := links.Internal(href, host); ok {
+				*found = append(*found, link)
+			}
+		}
+		return nil
+	})
+}
+
+// sitemap represents both a sitemap and a sitemap index as defined by sitemaps.org.
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// fetchSitemap retrieves and parses the sitemap found at the given URL.
+func fetchSitemap(sitemapURL string) (*sitemap, error) {
+	resp, err := http.Get(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sm sitemap
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, sitemapMaxBytes)).Decode(&sm); err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
+
+// getSitemapLinks returns the internal pages listed in the domain's sitemap.
+// If the sitemap is a sitemap index, the first sitemap it references is used.
+func getSitemapLinks(targetURL string, host string) []string {
+	sm, err := fetchSitemap(targetURL + "/sitemap.xml")
+	if err != nil {
+		slog.Info("Error reading sitemap", "url", targetURL, "error", err)
+		return nil
+	}
+
+	if len(sm.URLs) == 0 && len(sm.Sitemaps) > 0 {
+		sm, err = fetchSitemap(strings.TrimSpace(sm.Sitemaps[0].Loc))
+		if err != nil {
+			slog.Info("Error reading sitemap", "url", targetURL, "error", err)
+			return nil
+		}
+	}
+
+	var found []string
+	for _, u := range sm.URLs {
+		if link, ok := links.Internal(strings.TrimSpace(u.Loc), host); ok {
+			found = append(found, link)
+		}
+	}
+	return found
+}
+
+// crawlSubPages visits up to SubPageLimit internal pages of the domain in the current tab, so the consent set on the
+// homepage carries over, and captures the TC string and event status on each of them.
+// It expects the browser to be on the homepage and updates the tracker before every navigation.
+func crawlSubPages(ctx context.Context, targetURL string, tracker *pageTracker) []pageResult {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error parsing URL", "url", targetURL, "error", err)
+		return nil
+	}
+	host := u.Hostname()
+
+	type queuedPage struct {
+		url   string
+		depth int
+	}
+	var queue []queuedPage
+
+	if UseSitemap {
+		for _, link := range getSitemapLinks(targetURL, host) {
+			queue = append(queue, queuedPage{link, 1})
+		}
+	}
+	if len(queue) == 0 {
+		var links []string
+		if err := chromedp.Run(ctx, getInternalLinks(host, &links)); err != nil {
+			logging.FromContext(ctx).Warn("Error collecting links", "url", targetURL, "error", err)
+		}
+		for _, link := range links {
+			queue = append(queue, queuedPage{link, 1})
+		}
+	}
+
+	visited := map[string]bool{targetURL: true, targetURL + "/": true}
+	var results []pageResult
+	for len(queue) > 0 && len(results) < SubPageLimit {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next.url] {
+			continue
+		}
+		visited[next.url] = true
+		if !robotsAllowed(next.url) {
+			logging.FromContext(ctx).Debug("Sub-page disallowed by robots.txt", "url", next.url)
+			continue
+		}
+
+		tracker.Set(next.url)
+		result := pageResult{URL: next.url, Depth: next.depth}
+		var links []string
+
+		tasks := chromedp.Tasks{
+			chromedp.Navigate(next.url),
+			waitForTcfApi(*tcfTimeout),
+			getTCstring(&result.APITCString),
+			getTcEventStatus(&result.EventStatus),
+		}
+		if next.depth < SubPageDepth {
+			tasks = append(tasks, getInternalLinks(host, &links))
+		}
+
+		pageCtx, cancel := context.WithTimeout(ctx, SubPageTimeout)
+		if err := chromedp.Run(pageCtx, tasks); err != nil {
+			logging.FromContext(ctx).Error("Encountered an error crawling sub-page", "url", next.url, "error", err)
+			metrics.recordFailure(classifyError(err))
+		}
+		cancel()
+
+		results = append(results, result)
+		for _, link := range links {
+			queue = append(queue, queuedPage{link, next.depth + 1})
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+)
+
+const (
+	// Cookie sync detection follows the redirects between third party hosts passing through the proxy, and looks for
+	// the values of third party cookies in the query of the requests to other third parties, i.e. identifiers passed
+	// from one ad tech domain to another so they can match their users
+	DetectCookieSyncs = false
+	CookieSyncsFile   = "cookie_syncs.csv"
+	MinSyncIDLength   = 8 // MinSyncIDLength is the length below which cookie values are not looked for, as they are flags rather than identifiers.
+
+	// Profiles in force when a sync happened, besides those of consentProfile
+	syncProfileNone = "none" // The consent was not injected yet.
+)
+
+// cookieSync is an identifier of a third party's cookie passed to another third party.
+type cookieSync struct {
+	From         string // From is the registrable domain of the third party whose cookie holds the identifier.
+	Cookie       string // Cookie is the name of that cookie.
+	To           string // To is the registrable domain of the third party receiving the identifier.
+	URL          string // URL is the URL receiving the identifier, without its query.
+	Param        string
+	RedirectFrom string // RedirectFrom is the host that redirected to URL, if the identifier was passed in a redirect.
+	Hop          int    // Hop is the position of the redirect in its chain of third party redirects, 0 if not passed in a redirect.
+	Page         string
+	Time         time.Time
+}
+
+// cookieSyncLog collects the third party cookie values and redirects seen by the proxy, and the syncs among them.
+type cookieSyncLog struct {
+	mu        sync.Mutex
+	values    map[string]map[string]string // values maps each third party cookie value to the domains holding it and the cookie's name.
+	redirects map[string]redirectHop       // redirects maps the targets of third party redirects, without their fragment, to the redirect.
+	syncs     []cookieSync
+}
+
+// redirectHop is a third party redirect.
+type redirectHop struct {
+	from string // from is the redirecting host.
+	hop  int
+}
+
+// newCookieSyncLog returns an empty log.
+func newCookieSyncLog() *cookieSyncLog {
+	return &cookieSyncLog{values: map[string]map[string]string{}, redirects: map[string]redirectHop{}}
+}
+
+// addCookies records the values of the third party's cookies, sent by the browser or set by the response.
+func (l *cookieSyncLog) addCookies(host string, cookies []*http.Cookie) {
+	domain := registrableDomain(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range cookies {
+		if len(c.Value) < MinSyncIDLength {
+			continue
+		}
+		if l.values[c.Value] == nil {
+			l.values[c.Value] = map[string]string{}
+		}
+		l.values[c.Value][domain] = c.Name
+	}
+}
+
+// addRedirect records a redirect of a third party to the Location of its response, extending the chain of the
+// redirect that led to it.
+func (l *cookieSyncLog) addRedirect(resp *http.Response) {
+	location, err := resp.Location()
+	if err != nil {
+		return
+	}
+	location.Fragment = ""
+
+	request := *resp.Request.URL
+	request.Fragment = ""
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.redirects[location.String()] = redirectHop{from: resp.Request.URL.Hostname(), hop: l.redirects[request.String()].hop + 1}
+}
+
+// checkRequest records a sync for every query value of the third party request holding the cookie value of another
+// third party.
+func (l *cookieSyncLog) checkRequest(req *http.Request, page string) {
+	to := registrableDomain(req.URL.Hostname())
+	endpoint := *req.URL
+	endpoint.RawQuery, endpoint.Fragment = "", ""
+	target := *req.URL
+	target.Fragment = ""
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	redirect := l.redirects[target.String()]
+	for param, values := range req.URL.Query() {
+		for _, value := range values {
+			for from, cookie := range l.values[value] {
+				if from == to {
+					continue
+				}
+				l.syncs = append(l.syncs, cookieSync{From: from, Cookie: cookie, To: to, URL: endpoint.String(), Param: param, RedirectFrom: redirect.from, Hop: redirect.hop, Page: page, Time: now})
+			}
+		}
+	}
+}
+
+// get returns the syncs recorded so far.
+func (l *cookieSyncLog) get() []cookieSync {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]cookieSync(nil), l.syncs...)
+}
+
+// isRedirect reports whether the response redirects to its Location.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// syncProfile returns the consent profile in force at the time: none before the consent was injected, the pre-seeded
+// reject-all profile of a returning user, or the injected profile.
+func syncProfile(at time.Time, result scanResult) string {
+	switch {
+	case result.InjectedAt.IsZero() || at.Before(result.InjectedAt):
+		return syncProfileNone
+	case result.ReturningUser:
+		return tcfaudit.RejectAll.Name
+	default:
+		return consentProfile().Name
+	}
+}
+
+// cookieSyncRows builds the cookie syncs CSV rows, the edges of the domain's sync graph. Syncs made without consent,
+// i.e. before the injection or under the reject-all profile, are logged.
+func cookieSyncRows(domain string, result scanResult, syncs []cookieSync) [][]string {
+	var rows [][]string
+	for _, s := range syncs {
+		profile := syncProfile(s.Time, result)
+		rejectAll := profile == tcfaudit.RejectAll.Name
+		if profile == syncProfileNone || rejectAll {
+			slog.Warn("Cookie synced without consent", "from", s.From, "to", s.To, "param", s.Param, "profile", profile)
+		}
+		hop := ""
+		if s.RedirectFrom != "" {
+			hop = strconv.Itoa(s.Hop)
+		}
+		rows = append(rows, []string{domain, s.From, s.Cookie, s.To, s.URL, s.Param, s.RedirectFrom, hop, s.Page, profile, fmt.Sprint(rejectAll)})
+	}
+	return rows
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// Instead of starting a new browser for every domain, or a new browser context on a remote Chrome, domains are
+	// scanned in a single browser shared by TabPoolSize scans at a time, see concurrentScans. Rather than reusing tabs
+	// and clearing them with Network.clearBrowserCookies and Storage.clearDataForOrigin, which only clears the storage
+	// of the origins named, every scan runs in a browser context of its own, see run, which Chrome disposes of with its
+	// tabs, cookies, cache and storage once the scan ends, so nothing is cleared or reset between domains. The browser
+	// is checked before every scan, and restarted if it does not answer within BrowserCheckTimeout, e.g. as it crashed.
+	// Run with -isolate to scan every domain in a new browser instead, one at a time, as the HSTS and connection state
+	// of the browser are kept between domains in the pool
+	IsolateDomains      = false           // IsolateDomains specifies the default of -isolate.
+	TabPoolSize         = 2               // TabPoolSize specifies the number of domains scanned in the browser at a time.
+	BrowserCheckTimeout = 5 * time.Second // BrowserCheckTimeout specifies the maximum duration of checking the browser.
+)
+
+var isolateDomains = flag.Bool("isolate", IsolateDomains, "scan every domain in a new browser instead of in a shared one")
+
+// tabPoolKey is the key of the tab pool in the browser's context.
+type tabPoolKey struct{}
+
+// tabPool hands out the shared browser to the domains' scans, TabPoolSize at a time.
+type tabPool struct {
+	allocCtx context.Context
+	slots    chan struct{}
+
+	mu            sync.Mutex
+	browserCtx    context.Context // browserCtx holds the browser, or the browser context on a remote Chrome, of the scans.
+	cancelBrowser context.CancelFunc
+}
+
+// withTabPool starts the shared browser of the allocator, returning a context holding the pool and a function closing
+// the browser and the allocator.
+func withTabPool(allocCtx context.Context, cancelAlloc context.CancelFunc) (context.Context, context.CancelFunc) {
+	p := &tabPool{allocCtx: allocCtx, slots: make(chan struct{}, TabPoolSize)}
+	if err := p.startBrowser(); err != nil {
+		cancelAlloc()
+		fatal("Error starting the browser of the tab pool", "error", err)
+	}
+	slog.Info("Scanning domains in a shared browser", "tabs", TabPoolSize)
+
+	return context.WithValue(allocCtx, tabPoolKey{}, p), func() {
+		p.mu.Lock()
+		p.cancelBrowser()
+		p.mu.Unlock()
+		cancelAlloc()
+	}
+}
+
+// concurrentScans returns the number of domains scanned at a time: TabPoolSize in the shared browser of the pool, and
+// one in isolated browsers or on a worker, which leases a single domain at a time.
+func concurrentScans(allocCtx context.Context) int {
+	if tabPoolFrom(allocCtx) == nil || *coordinatorURL != "" {
+		return 1
+	}
+	return TabPoolSize
+}
+
+// tabPoolFrom returns the tab pool of the browser's context, or nil if domains are isolated.
+func tabPoolFrom(allocCtx context.Context) *tabPool {
+	p, _ := allocCtx.Value(tabPoolKey{}).(*tabPool)
+	return p
+}
+
+// startBrowser starts a new browser, or creates a new browser context on a remote Chrome, for the scans. Its initial
+// tab stays blank, as closing it would close the browser.
+func (p *tabPool) startBrowser() error {
+	var options []chromedp.ContextOption
+	if *remoteChrome != "" {
+		options = append(options, newBrowserContext(p.allocCtx))
+	}
+	browserCtx, cancelBrowser := chromedp.NewContext(p.allocCtx, append(options, chromedp.WithLogf(chromedpLogf(p.allocCtx)))...)
+	if err := chromedp.Run(browserCtx); err != nil {
+		cancelBrowser()
+		return err
+	}
+	p.browserCtx, p.cancelBrowser = browserCtx, cancelBrowser
+	return nil
+}
+
+// acquire waits until fewer than TabPoolSize domains are scanned, and returns a context scanning a domain in the
+// browser, restarted if it does not answer, and a function ending the scan.
+func (p *tabPool) acquire() (context.Context, context.CancelFunc) {
+	p.slots <- struct{}{}
+
+	p.mu.Lock()
+	if err := p.checkBrowser(); err != nil {
+		// The browser itself is gone, e.g. as it crashed, failing the scans still running in it
+		slog.Warn("Restarting the browser of the tab pool", "error", err)
+		p.cancelBrowser()
+		if err := p.startBrowser(); err != nil {
+			fatal("Error restarting the browser of the tab pool", "error", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(p.browserCtx)
+	p.mu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		<-p.slots
+	}
+}
+
+// checkBrowser returns an error if the browser does not answer within BrowserCheckTimeout.
+func (p *tabPool) checkBrowser() error {
+	ctx, cancel := context.WithTimeout(p.browserCtx, BrowserCheckTimeout)
+	defer cancel()
+	return chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, _, _, _, _, err := browser.GetVersion().Do(ctx)
+		return err
+	}))
+}
@@ -0,0 +1,18 @@
+package main
+
+import "github.com/CLendering/IAB-vendor-compliance/pkg/tcfaudit"
+
+// consentDiff returns the differences between the generated and returned TC strings, see tcfaudit.DiffTCStrings. The
+// strings of frameworks injected through a tcfaudit.Injector are compared by it.
+func consentDiff(generated string, returned string) tcfaudit.Diff {
+	if injector, ok := consentInjector(); ok {
+		return injector.Diff(generated, returned)
+	}
+	return tcfaudit.DiffTCStrings(generated, returned)
+}
+
+// consentDiffJSON returns the differences between the generated and returned TC strings as a compact JSON object,
+// which is "{}" when the CMP kept the generated string, see consentDiff.
+func consentDiffJSON(generated string, returned string) string {
+	return consentDiff(generated, returned).Summary()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/logging"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+)
+
+// TCFModesFile holds the mode in which the TCF API was present on each domain, see tcf.DetectMode for the modes
+const TCFModesFile = "tcf_modes.csv"
+
+// detectTcfMode returns a chromedp Action which stores the mode in which the TCF API is present on the current page.
+func detectTcfMode(mode *string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		if *mode, err = tcf.DetectMode(chromedpSession{ctx}); err != nil {
+			logging.FromContext(ctx).Warn("Error detecting the TCF API mode", "error", err)
+			*mode = tcf.ModeNone
+		}
+		logging.FromContext(ctx).Info("Detected TCF API mode", "mode", *mode)
+		return nil
+	})
+}
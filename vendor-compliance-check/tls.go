@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	// With a managed CA, the proxy intercepts TLS with a CA of its own, generated in CADir on the first run, instead of
+	// goproxy's built-in one, and Chrome trusts that CA only rather than ignoring all certificate errors. The CA is
+	// installed in the NSS database of Chrome's home if certutil (libnss3-tools) is available, otherwise Chrome ignores
+	// the errors of certificates issued by the CA's key only. The proxy then also verifies the certificates of the sites
+	// it connects to, so a site with an invalid certificate fails as it would in a normal browser. A remote Chrome has
+	// to be started with --ignore-certificate-errors-spki-list set to the hash logged at the start of the run
+	ManagedCA  = false
+	CADir      = "ca"
+	CACertFile = "ca.pem"                  // CACertFile is the name of the CA certificate in CADir, which can be imported in other browsers.
+	CAKeyFile  = "ca-key.pem"              // CAKeyFile is the name of the CA's private key in CADir.
+	CAValidity = 10 * 365 * 24 * time.Hour // CAValidity specifies how long a generated CA is valid.
+	CAName     = "IAB vendor compliance check CA"
+
+	// TLS capture records the TLS endpoints the proxy connects to while scanning: the SNI host, the TLS version and
+	// cipher suite, and the subject, issuer and expiry of the certificate, along with the verification error, if any
+	CaptureTLS = false
+	TLSFile    = "tls_endpoints.csv"
+)
+
+// managedCA holds the CA the proxy signs certificates with, if ManagedCA is set.
+var managedCA struct {
+	spkiHash  string // spkiHash is the base64 SHA-256 hash of the CA's public key, as taken by --ignore-certificate-errors-spki-list.
+	nssHome   string // nssHome is the home directory whose NSS database holds the CA, or empty if it could not be installed.
+	installed bool
+}
+
+// setupManagedCA loads the CA from CADir, generating it on the first run, makes the proxy sign its certificates with
+// it and installs it for Chrome. It ends the run if the CA cannot be loaded or generated.
+func setupManagedCA() {
+	ca, err := loadOrCreateCA(CADir)
+	if err != nil {
+		fatal("Error setting up the managed CA", "dir", CADir, "error", err)
+	}
+
+	goproxy.GoproxyCa = ca
+	tlsConfig := goproxy.TLSConfigFromCA(&ca)
+	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: tlsConfig}
+	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: tlsConfig}
+	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: tlsConfig}
+	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: tlsConfig}
+
+	spki := sha256.Sum256(ca.Leaf.RawSubjectPublicKeyInfo)
+	managedCA.spkiHash = base64.StdEncoding.EncodeToString(spki[:])
+
+	home, err := installCA(filepath.Join(CADir, CACertFile))
+	if err != nil {
+		slog.Warn("Error installing the CA in Chrome's NSS database, trusting its key instead", "error", err)
+	} else {
+		managedCA.nssHome, managedCA.installed = home, true
+	}
+	slog.Info("Using the managed CA", "cert", filepath.Join(CADir, CACertFile), "spki", managedCA.spkiHash, "installed", managedCA.installed)
+}
+
+// loadOrCreateCA loads the CA certificate and key from the directory, generating and saving them if they do not exist.
+func loadOrCreateCA(dir string) (tls.Certificate, error) {
+	certPath, keyPath := filepath.Join(dir, CACertFile), filepath.Join(dir, CAKeyFile)
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		if err := createCA(certPath, keyPath); err != nil {
+			return tls.Certificate{}, err
+		}
+		slog.Info("Generated the managed CA", "cert", certPath)
+	}
+
+	ca, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	return ca, nil
+}
+
+// createCA generates a self-signed CA and writes its certificate and key as PEM files, the key only readable by the
+// user.
+func createCA(certPath string, keyPath string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: CAName, Organization: []string{CAName}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// installCA imports the CA certificate in the NSS database of a home directory next to it, which Chrome on Linux reads
+// its trusted CAs from, and returns that home directory. The database is created on the first run.
+func installCA(certPath string) (string, error) {
+	certutil, err := exec.LookPath("certutil")
+	if err != nil {
+		return "", err
+	}
+	home, err := filepath.Abs(filepath.Join(filepath.Dir(certPath), "home"))
+	if err != nil {
+		return "", err
+	}
+	db := filepath.Join(home, ".pki", "nssdb")
+	if _, err := os.Stat(filepath.Join(db, "cert9.db")); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(db, 0700); err != nil {
+			return "", err
+		}
+		if out, err := exec.Command(certutil, "-N", "-d", "sql:"+db, "--empty-password").CombinedOutput(); err != nil {
+			return "", fmt.Errorf("creating %s: %v: %s", db, err, out)
+		}
+	}
+	if out, err := exec.Command(certutil, "-A", "-d", "sql:"+db, "-n", CAName, "-t", "C,,", "-i", certPath).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("importing %s: %v: %s", certPath, err, out)
+	}
+	return home, nil
+}
+
+// chromeCertOptions returns the options making a local Chrome accept the proxy's certificates: the home directory
+// holding the managed CA, the hash of its key if it could not be installed, or ignoring all certificate errors without a
+// managed CA.
+func chromeCertOptions() []chromedp.ExecAllocatorOption {
+	switch {
+	case !ManagedCA:
+		return []chromedp.ExecAllocatorOption{chromedp.Flag("ignore-certificate-errors", true)}
+	case managedCA.installed:
+		return []chromedp.ExecAllocatorOption{chromedp.Env("HOME=" + managedCA.nssHome)}
+	default:
+		return []chromedp.ExecAllocatorOption{chromedp.Flag("ignore-certificate-errors-spki-list", managedCA.spkiHash)}
+	}
+}
+
+// tlsEndpoint is a TLS endpoint the proxy connected to.
+type tlsEndpoint struct {
+	Host       string // Host is the server name sent in the SNI extension, which is empty for IP addresses.
+	Party      string
+	Version    string
+	Cipher     string
+	Subject    string // Subject is the common name of the certificate's subject.
+	Issuer     string // Issuer is the common name, or organization, of the certificate's issuer.
+	NotAfter   time.Time
+	Handshakes int
+	Error      string // Error is the error verifying the certificate, if any.
+}
+
+// tlsEndpointLog collects the TLS endpoints the proxy connected to, by host.
+type tlsEndpointLog struct {
+	mu        sync.Mutex
+	endpoints map[string]*tlsEndpoint
+}
+
+// newTLSEndpointLog returns an empty log.
+func newTLSEndpointLog() *tlsEndpointLog {
+	return &tlsEndpointLog{endpoints: map[string]*tlsEndpoint{}}
+}
+
+// transport returns the transport the proxy sends its requests with, which verifies the sites' certificates if
+// ManagedCA is set and records the endpoints in the log if CaptureTLS is set. The certificates are verified in
+// VerifyConnection rather than by the TLS client, so the endpoints failing verification are recorded too.
+func (l *tlsEndpointLog) transport(parties *partyClassifier) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				err := verifyConnection(cs)
+				if CaptureTLS {
+					l.add(cs, parties, err)
+				}
+				if ManagedCA {
+					return err
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// verifyConnection verifies the server's certificate chain against the system roots and its server name.
+func verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: cs.ServerName, Intermediates: intermediates})
+	return err
+}
+
+// add records a handshake with the endpoint.
+func (l *tlsEndpointLog) add(cs tls.ConnectionState, parties *partyClassifier, verifyErr error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.endpoints[cs.ServerName]
+	if e == nil {
+		party, _ := parties.classify(cs.ServerName)
+		e = &tlsEndpoint{Host: cs.ServerName, Party: party}
+		l.endpoints[cs.ServerName] = e
+	}
+	e.Handshakes++
+	e.Version, e.Cipher = tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite)
+	if len(cs.PeerCertificates) > 0 {
+		leaf := cs.PeerCertificates[0]
+		e.Subject, e.Issuer, e.NotAfter = leaf.Subject.CommonName, leaf.Issuer.CommonName, leaf.NotAfter
+		if e.Issuer == "" && len(leaf.Issuer.Organization) > 0 {
+			e.Issuer = leaf.Issuer.Organization[0]
+		}
+	}
+	e.Error = ""
+	if verifyErr != nil {
+		e.Error = verifyErr.Error()
+	}
+}
+
+// get returns the endpoints recorded so far, sorted by host.
+func (l *tlsEndpointLog) get() []tlsEndpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	endpoints := make([]tlsEndpoint, 0, len(l.endpoints))
+	for _, e := range l.endpoints {
+		endpoints = append(endpoints, *e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Host < endpoints[j].Host })
+	return endpoints
+}
+
+// tlsRows builds the TLS endpoints CSV rows, one per endpoint.
+func tlsRows(domain string, endpoints []tlsEndpoint) [][]string {
+	var rows [][]string
+	for _, e := range endpoints {
+		notAfter := ""
+		if !e.NotAfter.IsZero() {
+			notAfter = e.NotAfter.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{domain, e.Host, e.Party, e.Version, e.Cipher, e.Subject, e.Issuer, notAfter, strconv.Itoa(e.Handshakes), e.Error})
+	}
+	return rows
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SirDataFR/iabtcfv2"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// Consent transmission detection scans the third party requests passing through the proxy for the consent
+	// parameters of ad and bid requests, showing whether vendors receive the consent that was injected
+	DetectConsentTransmission = false // DetectConsentTransmission records the gdpr, gdpr_consent and us_privacy values sent to third parties.
+	ConsentTransmissionsFile  = "consent_transmissions.csv"
+	maxScannedBodyBytes       = 1 << 20 // maxScannedBodyBytes is the size above which request bodies are not scanned.
+)
+
+// consentParams are the query, form and JSON keys holding consent values.
+var consentParams = map[string]bool{
+	"gdpr":         true,
+	"gdpr_consent": true,
+	"euconsent":    true,
+	"euconsent-v2": true,
+	"us_privacy":   true,
+}
+
+// openRTBConsentParam is the key of the TC string in OpenRTB bid requests (user.ext.consent). As the key is used for
+// unrelated values too, it is only recorded when its value decodes as a TC string.
+const openRTBConsentParam = "consent"
+
+// consentHeaderPattern matches the names of request headers carrying consent, such as x-gdpr-consent or x-us-privacy.
+var consentHeaderPattern = regexp.MustCompile(`(?i)gdpr|euconsent|us-?privacy`)
+
+// tcStringPattern matches values shaped like a TCF v2 TC string: dot separated base64url segments, the core string
+// starting with the encoded version 2.
+var tcStringPattern = regexp.MustCompile(`^C[A-Za-z0-9_-]{15,}(\.[A-Za-z0-9_-]+)*$`)
+
+// consentTransmission is a consent value sent to a third party.
+type consentTransmission struct {
+	URL    string // URL is the request URL without its query.
+	Page   string // Page is the page the browser was on when the request was sent.
+	Source string // Source is either "query", "body" or "header".
+	Param  string
+	Value  string
+	Time   time.Time
+}
+
+// transmissionLog collects the consent transmissions seen by the proxy.
+type transmissionLog struct {
+	mu            sync.Mutex
+	transmissions []consentTransmission
+}
+
+// add records the transmissions.
+func (l *transmissionLog) add(transmissions []consentTransmission) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.transmissions = append(l.transmissions, transmissions...)
+}
+
+// get returns the transmissions recorded so far.
+func (l *transmissionLog) get() []consentTransmission {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]consentTransmission(nil), l.transmissions...)
+}
+
+// findConsentTransmissions returns the consent values found in the query, headers and body of the request. Headers are
+// recorded if their name refers to consent, or their value decodes as a TC string. The body is read and replaced, so
+// the request can still be forwarded.
+func findConsentTransmissions(req *http.Request, page string) []consentTransmission {
+	endpoint := *req.URL
+	endpoint.RawQuery = ""
+	now := time.Now()
+
+	var transmissions []consentTransmission
+	record := func(source, param, value string) {
+		transmissions = append(transmissions, consentTransmission{URL: endpoint.String(), Page: page, Source: source, Param: param, Value: value, Time: now})
+	}
+
+	for param, values := range req.URL.Query() {
+		for _, value := range values {
+			if isConsentParam(param, value) {
+				record("query", param, value)
+			}
+		}
+	}
+
+	for name, values := range req.Header {
+		if name == "Cookie" {
+			continue
+		}
+		for _, value := range values {
+			if consentHeaderPattern.MatchString(name) || looksLikeTCString(value) {
+				record("header", name, value)
+			}
+		}
+	}
+
+	if req.Body == nil || req.ContentLength > maxScannedBodyBytes {
+		return transmissions
+	}
+	// The body is forwarded whole, the part read followed by the rest of bodies larger than maxScannedBodyBytes
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxScannedBodyBytes+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil || len(body) == 0 || len(body) > maxScannedBodyBytes {
+		return transmissions
+	}
+
+	var doc interface{}
+	if json.Unmarshal(body, &doc) == nil {
+		walkConsentJSON(doc, func(param, value string) { record("body", param, value) })
+	} else if form, err := url.ParseQuery(string(body)); err == nil {
+		for param, values := range form {
+			for _, value := range values {
+				if isConsentParam(param, value) {
+					record("body", param, value)
+				}
+			}
+		}
+	}
+	return transmissions
+}
+
+// walkConsentJSON calls found for every consent key with a scalar value anywhere in the decoded JSON document.
+func walkConsentJSON(doc interface{}, found func(param, value string)) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch value.(type) {
+			case string, float64, bool:
+				if isConsentParam(key, fmt.Sprint(value)) {
+					found(key, fmt.Sprint(value))
+				}
+			default:
+				walkConsentJSON(value, found)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			walkConsentJSON(value, found)
+		}
+	}
+}
+
+// isConsentParam reports whether the query, form or JSON key holds a consent value: one of consentParams, or the
+// OpenRTB consent key with a TC string.
+func isConsentParam(param string, value string) bool {
+	param = strings.ToLower(param)
+	return consentParams[param] || param == openRTBConsentParam && looksLikeTCString(value)
+}
+
+// isTCStringParam reports whether the parameter carries a TC string rather than a flag or US privacy string.
+func isTCStringParam(param string) bool {
+	param = strings.ToLower(param)
+	return param == "gdpr_consent" || param == "euconsent" || param == "euconsent-v2" || param == openRTBConsentParam
+}
+
+// looksLikeTCString reports whether the value is shaped like a TC string and decodes as one.
+func looksLikeTCString(value string) bool {
+	if !tcStringPattern.MatchString(value) {
+		return false
+	}
+	_, err := iabtcfv2.Decode(value)
+	return err == nil
+}
+
+// markInjected returns a chromedp Action which stores the time at which the consent was injected.
+func markInjected(injectedAt *time.Time) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		*injectedAt = time.Now()
+		return nil
+	})
+}
+
+// transmissionRow builds the consent transmissions CSV row for a single transmission. TC strings are compared to the
+// injected one, which only the requests sent after the injection are expected to carry.
+func transmissionRow(domain string, result scanResult, t consentTransmission) []string {
+	afterInjection := !result.InjectedAt.IsZero() && t.Time.After(result.InjectedAt)
+
+	matches, diff := "", ""
+	if isTCStringParam(t.Param) || t.Source == "header" && looksLikeTCString(t.Value) {
+		matches = fmt.Sprint(t.Value == result.TCString)
+		diff = consentDiffJSON(result.TCString, t.Value)
+	}
+
+	return []string{domain, t.URL, t.Page, t.Source, t.Param, t.Value, fmt.Sprint(afterInjection), matches, diff}
+}
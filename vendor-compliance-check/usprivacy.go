@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	// US privacy mode audits sites under the CCPA the way the TCF flow audits them under the GDPR: before the first
+	// navigation the usprivacy cookie is set to an opt-out of the sale of personal information, and __uspapi answers
+	// getUSPData with it, whatever CMP the page loads. The third party requests passing through the proxy are then
+	// checked for the us_privacy parameter, and the third party cookies set despite the opt-out are counted per host
+	USPrivacyMode   = false
+	USPrivacyString = "1YYN" // USPrivacyString specifies the US privacy string signalled: version 1, notice given, opted out of the sale, not covered by the LSPA.
+	USPrivacyFile   = "us_privacy.csv"
+
+	uspCookieName = "usprivacy" // The first-party cookie in which the IAB CCPA framework stores the US privacy string.
+	uspParam      = "us_privacy"
+)
+
+// uspHeaderPattern matches the names of request headers carrying the US privacy string, such as x-us-privacy.
+var uspHeaderPattern = regexp.MustCompile(`(?i)us[-_]?privacy`)
+
+// uspAPIJS returns the JavaScript making the page's __uspapi, and that of the frames calling it through
+// __uspapiLocator, answer getUSPData with the US privacy string. The page's own __uspapi is kept for other commands.
+func uspAPIJS(uspString string) string {
+	return `
+		(() => {
+			const uspData = {version: 1, uspString: '` + uspString + `'};
+			let pageAPI;
+			const api = function(command, version, callback) {
+				if (command === 'getUSPData') {
+					if (typeof callback === 'function') {
+						callback(uspData, true);
+					}
+					return;
+				}
+				if (typeof pageAPI === 'function') {
+					return pageAPI.apply(this, arguments);
+				}
+				if (typeof callback === 'function') {
+					callback(null, false);
+				}
+			};
+			Object.defineProperty(window, '__uspapi', {
+				configurable: true,
+				get: () => api,
+				set: (value) => {
+					if (value !== api) {
+						pageAPI = value;
+					}
+				},
+			});
+
+			if (window === window.top && !window.frames['__uspapiLocator']) {
+				const addLocator = () => {
+					if (!document.body) {
+						setTimeout(addLocator, 5);
+						return;
+					}
+					const locator = document.createElement('iframe');
+					locator.style.display = 'none';
+					locator.name = '__uspapiLocator';
+					document.body.appendChild(locator);
+				};
+				addLocator();
+			}
+			window.addEventListener('message', (event) => {
+				let message = event.data;
+				try {
+					message = typeof message === 'string' ? JSON.parse(message) : message;
+				} catch (e) {
+					return;
+				}
+				const call = message && message.__uspapiCall;
+				if (!call || !event.source) {
+					return;
+				}
+				api(call.command, call.version, (returnValue, success) => {
+					const answer = {__uspapiReturn: {returnValue: returnValue, success: success, callId: call.callId}};
+					event.source.postMessage(typeof event.data === 'string' ? JSON.stringify(answer) : answer, '*');
+				});
+			});
+		})();
+	`
+}
+
+// seedUSPrivacy returns a chromedp Action which stores the US privacy string in the usprivacy cookie of the target URL
+// and overrides __uspapi before the first navigation. It does nothing unless USPrivacyMode is set.
+func seedUSPrivacy(targetURL string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if !USPrivacyMode {
+			return nil
+		}
+		expires := cdp.TimeSinceEpoch(time.Now().AddDate(1, 0, 0))
+		if err := network.SetCookie(uspCookieName, USPrivacyString).WithURL(targetURL).WithPath("/").WithExpires(&expires).Do(ctx); err != nil {
+			return err
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(uspAPIJS(USPrivacyString)).Do(ctx)
+		return err
+	})
+}
+
+// uspHost holds the requests sent to a third party host and the US privacy strings they carried.
+type uspHost struct {
+	party      string
+	requests   int
+	withSignal int
+	values     map[string]bool
+}
+
+// uspSignalLog collects the US privacy strings sent to third parties, by host.
+type uspSignalLog struct {
+	mu    sync.Mutex
+	hosts map[string]*uspHost
+}
+
+// newUSPSignalLog returns an empty log.
+func newUSPSignalLog() *uspSignalLog {
+	return &uspSignalLog{hosts: map[string]*uspHost{}}
+}
+
+// add records a request to the third party host, with the US privacy strings among the consent values found in it.
+func (l *uspSignalLog) add(host string, party string, found []consentTransmission) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.hosts[host]
+	if h == nil {
+		h = &uspHost{party: party, values: map[string]bool{}}
+		l.hosts[host] = h
+	}
+	h.requests++
+
+	signalled := false
+	for _, t := range found {
+		if isUSPrivacyParam(t.Source, t.Param) {
+			h.values[t.Value] = true
+			signalled = true
+		}
+	}
+	if signalled {
+		h.withSignal++
+	}
+}
+
+// get returns a copy of the hosts recorded so far.
+func (l *uspSignalLog) get() map[string]uspHost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make(map[string]uspHost, len(l.hosts))
+	for host, h := range l.hosts {
+		values := make(map[string]bool, len(h.values))
+		for value := range h.values {
+			values[value] = true
+		}
+		hosts[host] = uspHost{party: h.party, requests: h.requests, withSignal: h.withSignal, values: values}
+	}
+	return hosts
+}
+
+// isUSPrivacyParam reports whether the consent value found in the request carries the US privacy string.
+func isUSPrivacyParam(source string, param string) bool {
+	if source == "header" {
+		return uspHeaderPattern.MatchString(param)
+	}
+	return strings.ToLower(param) == uspParam
+}
+
+// isUSPOptOut reports whether the US privacy string signals an opt-out of the sale, i.e. its third character is Y.
+func isUSPOptOut(value string) bool {
+	return len(value) == 4 && value[0] == '1' && (value[2] == 'Y' || value[2] == 'y')
+}
+
+// usPrivacyRows builds the US privacy CSV rows, one per third party host the site sent requests to or whose cookies
+// were set. Every third party cookie is set after the opt-out was signalled, so hosts still setting cookies are logged.
+func usPrivacyRows(domain string, cookies []*http.Cookie, result scanResult, signals map[string]uspHost) [][]string {
+	hosts := map[string]uspHost{}
+	for host, h := range signals {
+		hosts[host] = h
+	}
+	cookieNames := map[string][]string{}
+	for _, c := range cookies {
+		party := result.CookieParties[cookieKey(c)]
+		if party == "" || party == partyFirst {
+			continue
+		}
+		u, err := url.Parse(result.CookieURLs[cookieKey(c)])
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := u.Hostname()
+		cookieNames[host] = append(cookieNames[host], c.Name)
+		if _, found := hosts[host]; !found {
+			hosts[host] = uspHost{party: party}
+		}
+	}
+
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	var rows [][]string
+	for _, host := range names {
+		h := hosts[host]
+		values := make([]string, 0, len(h.values))
+		optOut := len(h.values) > 0
+		for value := range h.values {
+			values = append(values, value)
+			optOut = optOut && isUSPOptOut(value)
+		}
+		sort.Strings(values)
+
+		set := cookieNames[host]
+		sort.Strings(set)
+		if len(set) > 0 {
+			slog.Warn("Third party set cookies despite the US privacy opt-out", "host", host, "cookies", len(set))
+		}
+		rows = append(rows, []string{domain, host, h.party, strconv.Itoa(h.requests), strconv.Itoa(h.withSignal), strings.Join(values, " "), fmt.Sprint(optOut), strconv.Itoa(len(set)), strings.Join(set, " ")})
+	}
+	return rows
+}
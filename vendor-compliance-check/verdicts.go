@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/outfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/tcf"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/verdict"
+)
+
+const (
+	// VerdictsFile holds the verdict of every domain scanned as JSON lines, see verdict.Record, in the same form as the
+	// CMP check's. TCFModesFile holds them in its Verdict column. In distributed crawls, the coordinator writes it from
+	// the rows of TCFModesFile its workers send
+	VerdictsFile = "verdicts.jsonl"
+
+	// eventStatusBannerShown is the eventStatus of the TCF events and getTCData while the CMP shows its banner.
+	eventStatusBannerShown = "cmpuishown"
+)
+
+// verdictsFile is the current part of VerdictsFile, or nil in workers.
+var verdictsFile *outfile.File
+
+// openVerdictsFile opens the current part of VerdictsFile, listing it in the manifest if it is new.
+func openVerdictsFile() error {
+	file, err := outfile.Open(rotation.Name(VerdictsFile))
+	if err != nil {
+		return err
+	}
+	if file.New && outfile.Rotating() {
+		if err := outfile.AddToManifest(VerdictsFile, file.Name); err != nil {
+			slog.Error("Error adding part to manifest", "file", file.Name, "error", err)
+		}
+	}
+	verdictsFile = file
+	return nil
+}
+
+// writeVerdict writes the record to VerdictsFile, with the provenance of the run with -provenance, unless it is not
+// open. Errors are logged.
+func writeVerdict(record verdict.Record) {
+	if verdictsFile == nil {
+		return
+	}
+	stamped := struct {
+		verdict.Record
+		*Provenance
+	}{record, recordProvenance()}
+	if err := json.NewEncoder(verdictsFile).Encode(stamped); err != nil {
+		slog.Error("Error writing verdict", "error", err)
+	}
+}
+
+// scanVerdict returns the verdict of the scan: NoCMP for domains without the TCF API, Error for failed scans,
+// APITimeout if the CMP only loaded its stub or did not return a TC string after the reload, and otherwise the
+// classification of whether the CMP showed its banner after the reload and returned the injected TC string.
+func scanVerdict(result scanResult) verdict.Verdict {
+	switch {
+	case result.ErrorClass == errorTCFMissing:
+		return verdict.NoCMP
+	case result.Err != nil:
+		return verdict.Error
+	case result.TCFAPIMode == tcf.ModeStub || result.APITCString == "":
+		return verdict.APITimeout
+	}
+	return verdict.Classify(result.EventStatusAfterRL == eventStatusBannerShown, verdict.TCStringKept(result.TCString, result.APITCString))
+}
+
+// verdictRecord returns the record of the scan's verdict.
+func verdictRecord(domain string, result scanResult) verdict.Record {
+	record := verdict.NewRecord(StateTool, domain, targetURL(domain), scanVerdict(result))
+	record.CmpID = result.Ping.CmpID
+	if result.Err != nil {
+		record.Detail = result.Err.Error()
+	}
+	return record
+}
+
+// writeVerdictRows writes the records of the verdicts in the rows of TCFModesFile with the header, as sent by workers,
+// and returns the verdicts.
+func writeVerdictRows(header []string, rows [][]string) []verdict.Verdict {
+	column := -1
+	for i, name := range header {
+		if name == "Verdict" {
+			column = i
+		}
+	}
+	if column < 0 {
+		return nil
+	}
+	var verdicts []verdict.Verdict
+	for _, row := range rows {
+		if len(row) <= column {
+			continue
+		}
+		v, err := verdict.Parse(row[column])
+		if err != nil {
+			slog.Warn("Invalid verdict sent by worker", "domain", row[0], "error", err)
+			continue
+		}
+		writeVerdict(verdict.NewRecord(StateTool, row[0], targetURL(row[0]), v))
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
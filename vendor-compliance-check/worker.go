@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CLendering/IAB-vendor-compliance/pkg/csvfile"
+	"github.com/CLendering/IAB-vendor-compliance/pkg/state"
+)
+
+const (
+	// Coordinator specifies the default of -coordinator, the URL of the coordinator to lease domains from instead of
+	// reading DomainsFile, see coordinator.go. Workers write no output files, their rows are sent to the coordinator
+	Coordinator       = ""
+	LeasePollInterval = 10 * time.Second // LeasePollInterval specifies how long a worker waits before asking again when all domains are leased or the coordinator is unreachable.
+)
+
+var coordinatorURL = flag.String("coordinator", Coordinator, "URL of the coordinator to lease domains from, e.g. http://coordinator:8091, instead of reading the domains file")
+
+// workerSource leases the domains from the coordinator, renewing the lease of the domain being scanned until it is
+// acknowledged.
+type workerSource struct {
+	url    string
+	name   string // name identifies the worker to the coordinator.
+	client *http.Client
+
+	lease         *lease
+	stopHeartbeat chan struct{}
+}
+
+// newWorkerSource returns a source leasing domains from the coordinator at url.
+func newWorkerSource(url string) *workerSource {
+	host, _ := os.Hostname()
+	return &workerSource{url: strings.TrimSuffix(url, "/"), name: fmt.Sprintf("%s-%d", host, os.Getpid()), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// next leases the next domain, waiting while all domains are leased to other workers or the coordinator is
+// unreachable. It returns false once the coordinator reports all domains are done.
+func (s *workerSource) next() (string, int, bool) {
+	for {
+		var l lease
+		status, err := s.post("/lease", leaseRequest{Worker: s.name}, &l)
+		switch {
+		case err != nil:
+			slog.Warn("Error leasing domain, retrying", "coordinator", s.url, "error", err, "delay", LeasePollInterval)
+		case status == http.StatusGone:
+			slog.Info("Coordinator has no domains left")
+			return "", 0, false
+		case status == http.StatusOK:
+			s.lease = &l
+			if l.Options != nil {
+				domainOverrides[l.Domain] = *l.Options
+			}
+			s.stopHeartbeat = make(chan struct{})
+			go s.heartbeat(l.ID, s.stopHeartbeat)
+			return l.Domain, l.Left, true
+		}
+		time.Sleep(LeasePollInterval)
+	}
+}
+
+// claim always returns true, the lease already hands the domain to this worker only.
+func (s *workerSource) claim(string) bool {
+	return true
+}
+
+func (s *workerSource) skip(domain string, reason string) {
+	s.ack(ackRequest{Skipped: reason})
+}
+
+// finish sends the rows written for the domain to the coordinator along with the acknowledgement.
+func (s *workerSource) finish(domain string, result scanResult) {
+	request := ackRequest{}
+	if err := scanError(result); errors.Is(err, state.ErrPartial) {
+		request.Partial = true
+	} else if err != nil {
+		request.Error = err.Error()
+	}
+	outputs, err := takeOutputRows()
+	if err != nil {
+		slog.Error("Error reading buffered rows", "error", err)
+		request.Error = fmt.Sprintf("reading buffered rows: %v", err)
+	}
+	request.Outputs = outputs
+	s.ack(request)
+}
+
+// ack stops renewing the domain's lease and acknowledges it. Rows of a lease that expired meanwhile are dropped by the
+// coordinator, as the domain was handed out again.
+func (s *workerSource) ack(request ackRequest) {
+	close(s.stopHeartbeat)
+	request.Lease = s.lease.ID
+
+	status, err := s.post("/ack", request, nil)
+	switch {
+	case err != nil:
+		slog.Error("Error acknowledging domain, it is handed out again once its lease expires", "coordinator", s.url, "error", err)
+	case status == http.StatusGone:
+		slog.Warn("Lease expired before the domain was acknowledged, its results are dropped")
+	case status != http.StatusNoContent:
+		slog.Error("Coordinator rejected acknowledgement", "status", status)
+	}
+}
+
+// heartbeat renews the lease every HeartbeatInterval until stop is closed.
+func (s *workerSource) heartbeat(id string, stop chan struct{}) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			status, err := s.post("/heartbeat", heartbeatRequest{Lease: id}, nil)
+			if err != nil {
+				slog.Warn("Error renewing lease", "coordinator", s.url, "error", err)
+			} else if status == http.StatusGone {
+				slog.Warn("Lease expired, the domain is handed out to another worker")
+				return
+			}
+		}
+	}
+}
+
+// post sends the request as JSON to the coordinator's path, decoding a successful response into response if it is
+// not nil. Error responses other than 410 are returned as errors.
+func (s *workerSource) post(path string, request any, response any) (int, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Post(s.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusGone {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, fmt.Errorf("coordinator responded with %s: %s", resp.Status, e.Error)
+	}
+	if response != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// takeOutputRows returns the rows buffered in the outputs since the last call, emptying the buffers.
+func takeOutputRows() ([]outputRows, error) {
+	var results []outputRows
+	var errs []error
+	for _, output := range outputs {
+		output.Flush()
+		reader := csvfile.NewReader(output.buffer)
+		reader.FieldsPerRecord = -1
+		rows, err := reader.ReadAll()
+		output.buffer.Reset()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", output.name, err))
+			continue
+		}
+		if len(rows) > 0 {
+			results = append(results, outputRows{Name: output.name, Header: output.header, Rows: rows})
+		}
+	}
+	return results, errors.Join(errs...)
+}